@@ -555,6 +555,11 @@ const (
 	// ObjectHasNoDependentsReason represents when a resource object has no dependents that are
 	// blocking deletion.
 	ObjectHasNoDependentsReason ConditionReason = "ObjectHasNoDependents"
+
+	// CSIPluginReadyReason represents when all the pods of a csi driver are ready
+	CSIPluginReadyReason ConditionReason = "CSIPluginReady"
+	// CSIPluginNotReadyReason represents when some pods of a csi driver are missing or not ready
+	CSIPluginNotReadyReason ConditionReason = "CSIPluginNotReady"
 )
 
 // ConditionType represent a resource's status
@@ -576,6 +581,13 @@ const (
 
 	// ConditionDeletionIsBlocked represents when deletion of the object is blocked.
 	ConditionDeletionIsBlocked ConditionType = "DeletionIsBlocked"
+
+	// ConditionCSIRBDPluginReady represents the health of the rbd csi driver serving the cluster
+	ConditionCSIRBDPluginReady ConditionType = "CSIRBDPluginReady"
+	// ConditionCSICephFSPluginReady represents the health of the cephfs csi driver serving the cluster
+	ConditionCSICephFSPluginReady ConditionType = "CSICephFSPluginReady"
+	// ConditionCSINFSPluginReady represents the health of the nfs csi driver serving the cluster
+	ConditionCSINFSPluginReady ConditionType = "CSINFSPluginReady"
 )
 
 // ClusterState represents the state of a Ceph Cluster
@@ -59,7 +59,8 @@ func UpdateClusterCondition(c *clusterd.Context, cluster *cephv1.CephCluster, na
 			condition.Reason == cephv1.ClusterCreatedReason ||
 			condition.Reason == cephv1.ClusterConnectedReason ||
 			condition.Type == cephv1.ConditionDeleting ||
-			condition.Type == cephv1.ConditionDeletionIsBlocked {
+			condition.Type == cephv1.ConditionDeletionIsBlocked ||
+			isCSIDriverCondition(condition.Type) {
 			if conditionType != condition.Type {
 				conditions = append(conditions, condition)
 				continue
@@ -109,6 +110,14 @@ func UpdateClusterCondition(c *clusterd.Context, cluster *cephv1.CephCluster, na
 	}
 }
 
+// isCSIDriverCondition returns whether the condition reports the health of a csi driver. These
+// conditions are maintained by the csi controller and must not be reset by the cluster reconcile.
+func isCSIDriverCondition(conditionType cephv1.ConditionType) bool {
+	return conditionType == cephv1.ConditionCSIRBDPluginReady ||
+		conditionType == cephv1.ConditionCSICephFSPluginReady ||
+		conditionType == cephv1.ConditionCSINFSPluginReady
+}
+
 // translatePhasetoState convert the Phases to corresponding State
 // 1. We still need to set the State in case someone is still using it
 // instead of Phase. If we stopped setting the State it would be a
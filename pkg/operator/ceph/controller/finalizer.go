@@ -54,19 +54,23 @@ func remove(list []string, s string) []string {
 // of the object without finalizing it.
 func AddFinalizerIfNotPresent(ctx context.Context, client client.Client, obj client.Object) error {
 	objectFinalizer := buildFinalizerName(obj.GetObjectKind().GroupVersionKind().Kind)
+	return AddFinalizerWithNameIfNotPresent(ctx, client, obj, objectFinalizer)
+}
 
+// AddFinalizerWithNameIfNotPresent adds the finalizer passed as an argument to an object
+func AddFinalizerWithNameIfNotPresent(ctx context.Context, client client.Client, obj client.Object, finalizerName string) error {
 	accessor, err := meta.Accessor(obj)
 	if err != nil {
 		return errors.Wrap(err, "failed to get meta information of object")
 	}
 
-	if !contains(accessor.GetFinalizers(), objectFinalizer) {
-		logger.Infof("adding finalizer %q on %q", objectFinalizer, accessor.GetName())
-		accessor.SetFinalizers(append(accessor.GetFinalizers(), objectFinalizer))
+	if !contains(accessor.GetFinalizers(), finalizerName) {
+		logger.Infof("adding finalizer %q on %q", finalizerName, accessor.GetName())
+		accessor.SetFinalizers(append(accessor.GetFinalizers(), finalizerName))
 
 		// Update CR with finalizer
 		if err := client.Update(ctx, obj); err != nil {
-			return errors.Wrapf(err, "failed to add finalizer %q on %q", objectFinalizer, accessor.GetName())
+			return errors.Wrapf(err, "failed to add finalizer %q on %q", finalizerName, accessor.GetName())
 		}
 	}
 
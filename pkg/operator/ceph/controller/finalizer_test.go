@@ -104,3 +104,29 @@ func TestRemoveFinalizerWithName(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Empty(t, fakeObject.Finalizers)
 }
+
+func TestAddFinalizerWithNameIfNotPresent(t *testing.T) {
+	fakeObject := &cephv1.CephBlockPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Namespace:  "rook-ceph",
+			Finalizers: []string{"cephblockpool.ceph.rook.io"},
+		},
+	}
+
+	object := []runtime.Object{
+		fakeObject,
+	}
+	s := scheme.Scheme
+	s.AddKnownTypes(cephv1.SchemeGroupVersion, fakeObject)
+	cl := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(object...).Build()
+
+	err := AddFinalizerWithNameIfNotPresent(context.TODO(), cl, fakeObject, "test.rook.io/cleanup")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cephblockpool.ceph.rook.io", "test.rook.io/cleanup"}, fakeObject.Finalizers)
+
+	// the finalizer is not added twice
+	err = AddFinalizerWithNameIfNotPresent(context.TODO(), cl, fakeObject, "test.rook.io/cleanup")
+	assert.NoError(t, err)
+	assert.Len(t, fakeObject.Finalizers, 2)
+}
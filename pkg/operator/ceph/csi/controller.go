@@ -19,13 +19,16 @@ package csi
 import (
 	"context"
 	"os"
+	"slices"
 	"strconv"
+	"time"
 
 	csiopv1a1 "github.com/ceph/ceph-csi-operator/api/v1alpha1"
 	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
 	cephclient "github.com/rook/rook/pkg/daemon/ceph/client"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -39,14 +42,35 @@ import (
 	"github.com/rook/rook/pkg/operator/ceph/csi/peermap"
 	"github.com/rook/rook/pkg/operator/k8sutil"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
 const (
 	controllerName = "rook-ceph-operator-csi-controller"
+
+	// event reasons of the csi driver lifecycle
+	csiDriverStartedReason           = "CSIDriverStarted"
+	csiDriverStoppedReason           = "CSIDriverStopped"
+	csiValidationFailedReason        = "CSIValidationFailed"
+	csiSidecarIncompatibleReason     = "CSISidecarIncompatible"
+	csiPriorityClassNotFoundReason   = "CSIPriorityClassNotFound"
+	csiRuntimeClassNotFoundReason    = "CSIRuntimeClassNotFound"
+	csiUnknownContainerReason        = "CSIUnknownResourceContainer"
+	csiReconcilePausedReason         = "CSIReconcilePaused"
+	csiDriverRecreatedReason         = "CSIDriverRecreated"
+	csiDriverNotOwnedReason          = "CSIDriverNotOwned"
+	csiImagePullSecretNotFoundReason = "CSIImagePullSecretNotFound"
+
+	// csiReconcilePausedAnnotation on the operator configmap pauses the reconcile of the csi drivers
+	csiReconcilePausedAnnotation = "rook.io/csi-reconcile-paused"
 )
 
 // ReconcileCSI reconciles a ceph-csi driver
@@ -56,8 +80,11 @@ type ReconcileCSI struct {
 	context          *clusterd.Context
 	opManagerContext context.Context
 	opConfig         opcontroller.OperatorConfig
+	recorder         record.EventRecorder
 	// the first cluster CR which will determine some settings for the csi driver
 	firstCephCluster *cephv1.ClusterSpec
+	// the dynamic client of the csi ServiceMonitors, created on first use
+	dynamicClient dynamic.Interface
 }
 
 // Add creates a new Ceph CSI Controller and adds it to the Manager. The Manager will set fields on the Controller
@@ -74,6 +101,7 @@ func newReconciler(mgr manager.Manager, context *clusterd.Context, opManagerCont
 		context:          context,
 		opConfig:         opConfig,
 		opManagerContext: opManagerContext,
+		recorder:         mgr.GetEventRecorderFor("rook-ceph-operator"),
 	}
 }
 
@@ -113,6 +141,28 @@ func add(ctx context.Context, mgr manager.Manager, r reconcile.Reconciler, opCon
 		return err
 	}
 
+	// Watch for nodes being added or removed since the provisioner replicas depend on the node count
+	nodeKind := source.Kind[client.Object](
+		mgr.GetCache(),
+		&v1.Node{TypeMeta: metav1.TypeMeta{Kind: "Node", APIVersion: v1.SchemeGroupVersion.String()}},
+		nodeEventHandler(opConfig.OperatorNamespace),
+	)
+	err = c.Watch(nodeKind)
+	if err != nil {
+		return err
+	}
+
+	// Watch for the CSIDriver objects of this operator being edited or deleted by a user
+	csiDriverKind := source.Kind[client.Object](
+		mgr.GetCache(),
+		&storagev1.CSIDriver{TypeMeta: metav1.TypeMeta{Kind: "CSIDriver", APIVersion: storagev1.SchemeGroupVersion.String()}},
+		csiDriverEventHandler(opConfig.OperatorNamespace),
+	)
+	err = c.Watch(csiDriverKind)
+	if err != nil {
+		return err
+	}
+
 	err = csiopv1a1.AddToScheme(mgr.GetScheme())
 	if err != nil {
 		return err
@@ -121,6 +171,63 @@ func add(ctx context.Context, mgr manager.Manager, r reconcile.Reconciler, opCon
 	return nil
 }
 
+// nodeEventDebounce is how long node additions and removals are batched before reconciling, so
+// that replacing nodes one after the other does not update the provisioners on every event
+var nodeEventDebounce = 30 * time.Second
+
+// nodeEventHandler enqueues a reconcile of the operator config when a node is added or removed.
+// Node updates are ignored since they don't change the node count.
+func nodeEventHandler(opNamespace string) handler.Funcs {
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Name: opcontroller.OperatorSettingConfigMapName, Namespace: opNamespace}}
+	return handler.Funcs{
+		CreateFunc: func(ctx context.Context, e event.CreateEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			q.AddAfter(request, nodeEventDebounce)
+		},
+		DeleteFunc: func(ctx context.Context, e event.DeleteEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			q.AddAfter(request, nodeEventDebounce)
+		},
+	}
+}
+
+// csiDriverEventHandler enqueues a reconcile of the operator config when a CSIDriver object created
+// by this operator is deleted or its labels, annotations or spec are changed, so the drift is repaired
+func csiDriverEventHandler(opNamespace string) handler.Funcs {
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Name: opcontroller.OperatorSettingConfigMapName, Namespace: opNamespace}}
+	ownedByOperator := func(obj client.Object) bool {
+		return csiDriverOwnerNamespace(obj) == opNamespace
+	}
+	return handler.Funcs{
+		UpdateFunc: func(ctx context.Context, e event.UpdateEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			oldDriver, ok := e.ObjectOld.(*storagev1.CSIDriver)
+			if !ok {
+				return
+			}
+			newDriver, ok := e.ObjectNew.(*storagev1.CSIDriver)
+			if !ok {
+				return
+			}
+			// the ownership label and annotation may have been removed by the update
+			if !ownedByOperator(oldDriver) && !ownedByOperator(newDriver) {
+				return
+			}
+			if equality.Semantic.DeepEqual(oldDriver.Spec, newDriver.Spec) &&
+				equality.Semantic.DeepEqual(oldDriver.Labels, newDriver.Labels) &&
+				equality.Semantic.DeepEqual(oldDriver.Annotations, newDriver.Annotations) {
+				return
+			}
+			logger.Debugf("CSIDriver object %q changed, reconciling the csi drivers", newDriver.Name)
+			q.Add(request)
+		},
+		DeleteFunc: func(ctx context.Context, e event.DeleteEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			if !ownedByOperator(e.Object) {
+				return
+			}
+			logger.Debugf("CSIDriver object %q deleted, reconciling the csi drivers", e.Object.GetName())
+			q.Add(request)
+		},
+	}
+}
+
 // Reconcile reads that state of the operator config map and makes changes based on the state read
 // The Controller will requeue the Request to be processed again if the returned error is non-nil or
 // Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
@@ -141,29 +248,12 @@ func (r *ReconcileCSI) reconcile(request reconcile.Request) (reconcile.Result, e
 	// reconcileResult is used to communicate the result of the reconciliation back to the caller
 	var reconcileResult reconcile.Result
 
-	ownerRef, err := k8sutil.GetDeploymentOwnerReference(r.opManagerContext, r.context.Clientset, os.Getenv(k8sutil.PodNameEnvVar), r.opConfig.OperatorNamespace)
-	if err != nil {
-		logger.Warningf("could not find deployment owner reference to assign to csi drivers. %v", err)
-	}
-	if ownerRef != nil {
-		blockOwnerDeletion := false
-		ownerRef.BlockOwnerDeletion = &blockOwnerDeletion
-	}
-
-	ownerInfo := k8sutil.NewOwnerInfoWithOwnerRef(ownerRef, r.opConfig.OperatorNamespace)
-	// create an empty config map. config map will be filled with data
-	// later when clusters have mons
-	err = CreateCsiConfigMap(r.opManagerContext, r.opConfig.OperatorNamespace, r.context.Clientset, ownerInfo)
-	if err != nil {
-		return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed creating csi config map")
-	}
-
 	// Fetch the operator's configmap. We force the NamespaceName to the operator since the request
 	// could be a CephCluster. If so the NamespaceName will be the one from the cluster and thus the
 	// CM won't be found
 	opNamespaceName := types.NamespacedName{Name: opcontroller.OperatorSettingConfigMapName, Namespace: r.opConfig.OperatorNamespace}
 	opConfig := &v1.ConfigMap{}
-	err = r.client.Get(r.opManagerContext, opNamespaceName, opConfig)
+	err := r.client.Get(r.opManagerContext, opNamespaceName, opConfig)
 	if err != nil {
 		if kerrors.IsNotFound(err) {
 			logger.Debug("operator's configmap resource not found. will use default value or env var.")
@@ -177,6 +267,55 @@ func (r *ReconcileCSI) reconcile(request reconcile.Request) (reconcile.Result, e
 		r.opConfig.Parameters = opConfig.Data
 	}
 
+	// See if there is a CephCluster
+	cephClusters := &cephv1.CephClusterList{}
+	err = r.client.List(r.opManagerContext, cephClusters, &client.ListOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		// Error reading the object - requeue the request.
+		return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed to list ceph clusters")
+	}
+
+	// the deleted clusters are handled even while the reconcile is paused, so that the csi cleanup
+	// finalizer never blocks their deletion
+	for i, cluster := range cephClusters.Items {
+		if cluster.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if slices.Contains(cluster.Finalizers, csiCleanupFinalizer) {
+			err = r.cleanupCSIOnClusterDeletion(&cephClusters.Items[i], cephClusters.Items)
+			if err != nil {
+				return opcontroller.ImmediateRetryResult, errors.Wrapf(err, "failed to clean up csi drivers for deleted cluster %q", cluster.Name)
+			}
+		}
+		logger.Debugf("ceph cluster %q is being deleting, no need to reconcile the csi driver", request.NamespacedName)
+		return reconcile.Result{}, nil
+	}
+
+	// do not make any change while the reconcile is paused, it resumes as soon as the annotation
+	// is removed or set to false
+	if isCSIReconcilePaused(opConfig) {
+		logger.Infof("csi reconcile is paused by the %q annotation on the %q configmap", csiReconcilePausedAnnotation, opcontroller.OperatorSettingConfigMapName)
+		r.recordCSIEvent(v1.EventTypeWarning, csiReconcilePausedReason, "csi reconcile is paused by the "+csiReconcilePausedAnnotation+" annotation on the operator configmap")
+		return reconcileResult, nil
+	}
+
+	ownerRef, err := k8sutil.GetDeploymentOwnerReference(r.opManagerContext, r.context.Clientset, os.Getenv(k8sutil.PodNameEnvVar), r.opConfig.OperatorNamespace)
+	if err != nil {
+		logger.Warningf("could not find deployment owner reference to assign to csi drivers. %v", err)
+	}
+	if ownerRef != nil {
+		blockOwnerDeletion := false
+		ownerRef.BlockOwnerDeletion = &blockOwnerDeletion
+	}
+
+	ownerInfo := k8sutil.NewOwnerInfoWithOwnerRef(ownerRef, r.opConfig.OperatorNamespace)
+	// create an empty config map. config map will be filled with data
+	// later when clusters have mons
+	err = CreateCsiConfigMap(r.opManagerContext, r.opConfig.OperatorNamespace, r.context.Clientset, ownerInfo)
+	if err != nil {
+		return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed creating csi config map")
+	}
+
 	enableCSIOperator, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "ROOK_USE_CSI_OPERATOR", "false"))
 	if err != nil {
 		return reconcileResult, errors.Wrap(err, "unable to parse value for 'ROOK_USE_CSI_OPERATOR'")
@@ -190,29 +329,11 @@ func (r *ReconcileCSI) reconcile(request reconcile.Request) (reconcile.Result, e
 		logger.Info("ceph csi driver is disabled")
 	}
 
-	// See if there is a CephCluster
-	cephClusters := &cephv1.CephClusterList{}
-	err = r.client.List(r.opManagerContext, cephClusters, &client.ListOptions{})
-	if err != nil {
-		if kerrors.IsNotFound(err) {
-			logger.Debug("no ceph cluster found not deploying ceph csi driver")
-			EnableRBD, EnableCephFS, EnableNFS = false, false, false
-			err = r.stopDrivers()
-			if err != nil {
-				return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed to stop Drivers")
-			}
-
-			return reconcile.Result{}, nil
-		}
-		// Error reading the object - requeue the request.
-		return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed to list ceph clusters")
-	}
-
 	// Do nothing if no ceph cluster is present
 	if len(cephClusters.Items) == 0 {
 		logger.Debug("no ceph cluster found not deploying ceph csi driver")
 		EnableRBD, EnableCephFS, EnableNFS = false, false, false
-		err = r.stopDrivers()
+		err = r.stopDrivers(false)
 		if err != nil {
 			return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed to stop Drivers")
 		}
@@ -235,17 +356,18 @@ func (r *ReconcileCSI) reconcile(request reconcile.Request) (reconcile.Result, e
 	}
 	CustomCSICephConfigExists = exists
 
+	managed := !disableCSI && !EnableCSIOperator()
 	for i, cluster := range cephClusters.Items {
-		if !cluster.DeletionTimestamp.IsZero() {
-			logger.Debugf("ceph cluster %q is being deleting, no need to reconcile the csi driver", request.NamespacedName)
-			return reconcile.Result{}, nil
-		}
-
 		if !cluster.Spec.External.Enable && cluster.Spec.CleanupPolicy.HasDataDirCleanPolicy() {
 			logger.Debugf("ceph cluster %q has cleanup policy, the cluster will soon go away, no need to reconcile the csi driver", cluster.Name)
 			return reconcile.Result{}, nil
 		}
 
+		err = r.reconcileCSICleanupFinalizer(&cephClusters.Items[i], managed)
+		if err != nil {
+			return opcontroller.ImmediateRetryResult, errors.Wrapf(err, "failed to reconcile csi cleanup finalizer for cluster %q", cluster.Name)
+		}
+
 		if r.firstCephCluster == nil {
 			r.firstCephCluster = &cephClusters.Items[i].Spec
 		}
@@ -274,7 +396,7 @@ func (r *ReconcileCSI) reconcile(request reconcile.Request) (reconcile.Result, e
 		// disable Rook-managed CSI drivers if CSI operator is enabled
 		if EnableCSIOperator() {
 			logger.Info("disabling csi-driver since EnableCSIOperator is true")
-			err := r.stopDrivers()
+			err := r.stopDrivers(false)
 			if err != nil {
 				return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed to stop csi Drivers")
 			}
@@ -282,20 +404,54 @@ func (r *ReconcileCSI) reconcile(request reconcile.Request) (reconcile.Result, e
 			if err != nil {
 				return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed to reconcile csi-op config CR")
 			}
+			r.updateCSIDriverConditions(false)
 			return reconcileResult, nil
 		}
 	}
 
-	if !disableCSI && !EnableCSIOperator() {
+	if managed {
 		err = r.validateAndConfigureDrivers(ownerInfo)
 		if err != nil {
 			return opcontroller.ImmediateRetryResult, errors.Wrap(err, "failed to configure ceph csi")
 		}
 	}
 
+	// refresh the health of the drivers until they are all ready
+	if !r.updateCSIDriverConditions(managed) && reconcileResult.IsZero() {
+		reconcileResult = csiDriverHealthRequeue
+	}
+
 	return reconcileResult, nil
 }
 
+// isCSIReconcilePaused returns whether the csi reconcile is paused by an annotation on the
+// operator configmap
+func isCSIReconcilePaused(opConfig *v1.ConfigMap) bool {
+	value, ok := opConfig.GetAnnotations()[csiReconcilePausedAnnotation]
+	if !ok {
+		return false
+	}
+	paused, err := strconv.ParseBool(value)
+	if err != nil {
+		logger.Warningf("failed to parse value %q of annotation %q, the csi reconcile is not paused. %v", value, csiReconcilePausedAnnotation, err)
+		return false
+	}
+	return paused
+}
+
+// recordCSIEvent records the event on all the CephClusters, since the csi drivers serve all of them
+func (r *ReconcileCSI) recordCSIEvent(eventType, reason, message string) {
+	cephClusters := &cephv1.CephClusterList{}
+	err := r.client.List(r.opManagerContext, cephClusters, &client.ListOptions{})
+	if err != nil {
+		logger.Debugf("failed to list ceph clusters to record csi event %q. %v", reason, err)
+		return
+	}
+	for i := range cephClusters.Items {
+		r.recorder.Event(&cephClusters.Items[i], eventType, reason, message)
+	}
+}
+
 func (r *ReconcileCSI) reconcileOperatorConfig(cluster cephv1.CephCluster, clusterInfo *cephclient.ClusterInfo) error {
 	if err := r.setParams(); err != nil {
 		return errors.Wrapf(err, "failed to configure CSI parameters")
@@ -20,6 +20,7 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/coreos/pkg/capnslog"
 	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
@@ -32,12 +33,18 @@ import (
 	"github.com/rook/rook/pkg/operator/test"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	apifake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
@@ -60,6 +67,8 @@ func TestCephCSIController(t *testing.T) {
 	os.Setenv("ROOK_LOG_LEVEL", "DEBUG")
 	t.Setenv(k8sutil.PodNameEnvVar, "rook-ceph-operator")
 	t.Setenv(k8sutil.PodNamespaceEnvVar, namespace)
+	// the fake clientset never rolls out the provisioner deployments
+	t.Setenv("CSI_DRIVER_ROLLOUT_TIMEOUT", "0s")
 
 	CSIParam = Param{
 		CSIPluginImage:   "image",
@@ -97,12 +106,14 @@ func TestCephCSIController(t *testing.T) {
 
 		// Create a ReconcileCSI object with the scheme and fake client.
 		r := &ReconcileCSI{
-			client:  cl,
-			context: c,
+			client:   cl,
+			context:  c,
+			recorder: record.NewFakeRecorder(5),
 			opConfig: controller.OperatorConfig{
 				OperatorNamespace: namespace,
 				Image:             "rook",
 				ServiceAccount:    "foo",
+				Parameters:        map[string]string{"ROOK_CSI_KUBELET_DIR_PATH": DefaultKubeletDirPath},
 			},
 		}
 
@@ -123,6 +134,7 @@ func TestCephCSIController(t *testing.T) {
 		assert.NoError(t, err)
 		_, err = c.Clientset.AppsV1().ReplicaSets(namespace).Create(context.TODO(), test.FakeReplicaSet(namespace), metav1.CreateOptions{})
 		assert.NoError(t, err)
+		createCSIClusterRoles(t, c.Clientset)
 		cephCluster := &cephv1.CephCluster{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      namespace,
@@ -166,12 +178,14 @@ func TestCephCSIController(t *testing.T) {
 		c.Client = cl
 		// // Create a ReconcileCSI object with the scheme and fake client.
 		r := &ReconcileCSI{
-			client:  cl,
-			context: c,
+			client:   cl,
+			context:  c,
+			recorder: record.NewFakeRecorder(5),
 			opConfig: controller.OperatorConfig{
 				OperatorNamespace: namespace,
 				Image:             "rook",
 				ServiceAccount:    "foo",
+				Parameters:        map[string]string{"ROOK_CSI_KUBELET_DIR_PATH": DefaultKubeletDirPath},
 			},
 		}
 
@@ -198,6 +212,7 @@ func TestCephCSIController(t *testing.T) {
 		assert.NoError(t, err)
 		_, err = c.Clientset.AppsV1().ReplicaSets(namespace).Create(context.TODO(), test.FakeReplicaSet(namespace), metav1.CreateOptions{})
 		assert.NoError(t, err)
+		createCSIClusterRoles(t, c.Clientset)
 		cephCluster := &cephv1.CephCluster{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      namespace,
@@ -245,15 +260,20 @@ func TestCephCSIController(t *testing.T) {
 		// Create a fake client to mock API calls.
 		cl := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(object...).Build()
 		c.Client = cl
+		// the sidecar warning of the previous test is reported again
+		warnedSidecarIncompatibilities = nil
 		// Create a ReconcileCSI object with the scheme and fake client.
+		recorder := record.NewFakeRecorder(5)
 		r := &ReconcileCSI{
-			scheme:  s,
-			client:  cl,
-			context: c,
+			scheme:   s,
+			client:   cl,
+			context:  c,
+			recorder: recorder,
 			opConfig: controller.OperatorConfig{
 				OperatorNamespace: namespace,
 				Image:             "rook",
 				ServiceAccount:    "foo",
+				Parameters:        map[string]string{"ROOK_CSI_KUBELET_DIR_PATH": DefaultKubeletDirPath},
 			},
 		}
 
@@ -268,6 +288,266 @@ func TestCephCSIController(t *testing.T) {
 		assert.Equal(t, "csi-rbdplugin", ds.Items[1].Name)
 		assert.Equal(t, ``, ds.Items[1].Spec.Template.Annotations["k8s.v1.cni.cncf.io/networks"], ds.Items[1].Spec.Template.Annotations)
 
+		// the default snapshotter requires a newer kubernetes than the faked v1.21.0, and
+		// an event is recorded on the cluster for each started driver
+		assert.Len(t, recorder.Events, 3)
+		assert.Contains(t, <-recorder.Events, "Warning "+csiSidecarIncompatibleReason)
+		for i := 0; i < 2; i++ {
+			assert.Contains(t, <-recorder.Events, "Normal "+csiDriverStartedReason)
+		}
+
 		assert.Equal(t, []string{namespace}, saveCSIDriverOptionsCalledForClusterNS)
 	})
+
+	t.Run("reconcile paused by the operator config annotation", func(t *testing.T) {
+		fakeClientSet := test.New(t, 1)
+		test.SetFakeKubernetesVersion(fakeClientSet, "v1.21.0")
+		c := &clusterd.Context{
+			Clientset:           fakeClientSet,
+			RookClientset:       rookclient.NewSimpleClientset(),
+			ApiExtensionsClient: apifake.NewSimpleClientset(),
+		}
+		_, err := c.Clientset.CoreV1().Pods(namespace).Create(ctx, test.FakeOperatorPod(namespace), metav1.CreateOptions{})
+		assert.NoError(t, err)
+		_, err = c.Clientset.AppsV1().ReplicaSets(namespace).Create(ctx, test.FakeReplicaSet(namespace), metav1.CreateOptions{})
+		assert.NoError(t, err)
+		createCSIClusterRoles(t, c.Clientset)
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "rook-ceph-mon", Namespace: namespace},
+			Data: map[string][]byte{
+				"fsid":         []byte(name),
+				"mon-secret":   []byte("monsecret"),
+				"admin-secret": []byte("adminsecret"),
+			},
+			Type: k8sutil.RookType,
+		}
+		_, err = c.Clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		cephCluster := &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: namespace, Namespace: namespace}}
+		opConfigMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        controller.OperatorSettingConfigMapName,
+				Namespace:   namespace,
+				Annotations: map[string]string{csiReconcilePausedAnnotation: "true"},
+			},
+			Data: map[string]string{"ROOK_CSI_KUBELET_DIR_PATH": DefaultKubeletDirPath},
+		}
+		s := scheme.Scheme
+		s.AddKnownTypes(cephv1.SchemeGroupVersion, &cephv1.CephCluster{}, &cephv1.CephClusterList{}, &v1.ConfigMap{})
+		cl := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(cephCluster, opConfigMap).Build()
+		c.Client = cl
+		recorder := record.NewFakeRecorder(5)
+		r := &ReconcileCSI{
+			scheme:   s,
+			client:   cl,
+			context:  c,
+			recorder: recorder,
+			opConfig: controller.OperatorConfig{
+				OperatorNamespace: namespace,
+				Image:             "rook",
+				ServiceAccount:    "foo",
+			},
+		}
+
+		res, err := r.Reconcile(ctx, req)
+		assert.NoError(t, err)
+		assert.False(t, res.Requeue)
+		ds, err := c.Clientset.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, ds.Items)
+		_, err = c.Clientset.CoreV1().ConfigMaps(namespace).Get(ctx, ConfigName, metav1.GetOptions{})
+		assert.True(t, kerrors.IsNotFound(err))
+		assert.Len(t, recorder.Events, 1)
+		assert.Contains(t, <-recorder.Events, "Warning "+csiReconcilePausedReason)
+
+		// the reconcile resumes once the annotation is set to false
+		opConfigMap.Annotations[csiReconcilePausedAnnotation] = "false"
+		err = cl.Update(ctx, opConfigMap)
+		assert.NoError(t, err)
+		res, err = r.Reconcile(ctx, req)
+		assert.NoError(t, err)
+		assert.False(t, res.Requeue)
+		ds, err = c.Clientset.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(ds.Items), ds)
+		for len(recorder.Events) > 0 {
+			assert.NotContains(t, <-recorder.Events, csiReconcilePausedReason)
+		}
+	})
+}
+
+func TestProvisionerReplicasFollowNodeCount(t *testing.T) {
+	origParam, origRBD, origCephFS, origNFS := CSIParam, EnableRBD, EnableCephFS, EnableNFS
+	defer func() { CSIParam, EnableRBD, EnableCephFS, EnableNFS = origParam, origRBD, origCephFS, origNFS }()
+
+	ctx := context.TODO()
+	clientset := test.New(t, 1)
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: clientset, ApiExtensionsClient: apifake.NewSimpleClientset()},
+		opManagerContext: ctx,
+		opConfig:         controller.OperatorConfig{OperatorNamespace: "rook-ceph", Parameters: map[string]string{}},
+	}
+	renderReplicas := func() int32 {
+		dep, err := templateToDeployment("rbd-provisioner", RBDProvisionerDepTemplatePath, templateParam{Param: CSIParam, Namespace: "rook-ceph"})
+		assert.NoError(t, err)
+		return *dep.Spec.Replicas
+	}
+
+	// single node
+	assert.NoError(t, r.setParams())
+	assert.Equal(t, int32(1), CSIParam.ProvisionerReplicas)
+	assert.Equal(t, int32(1), renderReplicas())
+	singleNodeHash := CSIParam.Hash()
+
+	// 1 -> N
+	_, err := clientset.CoreV1().Nodes().Create(ctx, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, r.setParams())
+	assert.Equal(t, defaultProvisionerReplicas, CSIParam.ProvisionerReplicas)
+	assert.Equal(t, defaultProvisionerReplicas, renderReplicas())
+	assert.NotEqual(t, singleNodeHash, CSIParam.Hash())
+
+	// N -> 1
+	assert.NoError(t, clientset.CoreV1().Nodes().Delete(ctx, "node-2", metav1.DeleteOptions{}))
+	assert.NoError(t, r.setParams())
+	assert.Equal(t, int32(1), CSIParam.ProvisionerReplicas)
+	assert.Equal(t, singleNodeHash, CSIParam.Hash())
+}
+
+func TestPluginDaemonSetMaxUnavailable(t *testing.T) {
+	origParam := CSIParam
+	defer func() { CSIParam = origParam }()
+
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: test.New(t, 1), ApiExtensionsClient: apifake.NewSimpleClientset()},
+		opManagerContext: context.TODO(),
+	}
+	renderMaxUnavailable := func() *intstr.IntOrString {
+		ds, err := templateToDaemonSet("rbdplugin", RBDPluginTemplatePath, templateParam{Param: CSIParam, Namespace: "rook-ceph"})
+		assert.NoError(t, err)
+		if ds.Spec.UpdateStrategy.RollingUpdate == nil {
+			return nil
+		}
+		return ds.Spec.UpdateStrategy.RollingUpdate.MaxUnavailable
+	}
+
+	t.Run("default", func(t *testing.T) {
+		r.opConfig = controller.OperatorConfig{OperatorNamespace: "rook-ceph", Parameters: map[string]string{}}
+		assert.NoError(t, r.setParams())
+		assert.Equal(t, "1", CSIParam.RBDPluginUpdateStrategyMaxUnavailable)
+		assert.Equal(t, intstr.FromInt32(1), *renderMaxUnavailable())
+	})
+
+	t.Run("number", func(t *testing.T) {
+		r.opConfig = controller.OperatorConfig{OperatorNamespace: "rook-ceph", Parameters: map[string]string{
+			"CSI_PLUGIN_DAEMONSET_MAX_UNAVAILABLE": "3",
+		}}
+		assert.NoError(t, r.setParams())
+		assert.Equal(t, "3", CSIParam.RBDPluginUpdateStrategyMaxUnavailable)
+		assert.Equal(t, "3", CSIParam.CephFSPluginUpdateStrategyMaxUnavailable)
+		assert.Equal(t, "3", CSIParam.NFSPluginUpdateStrategyMaxUnavailable)
+		assert.Equal(t, intstr.FromInt32(3), *renderMaxUnavailable())
+	})
+
+	t.Run("percentage", func(t *testing.T) {
+		r.opConfig = controller.OperatorConfig{OperatorNamespace: "rook-ceph", Parameters: map[string]string{
+			"CSI_PLUGIN_DAEMONSET_MAX_UNAVAILABLE": "25%",
+		}}
+		assert.NoError(t, r.setParams())
+		assert.Equal(t, "25%", CSIParam.RBDPluginUpdateStrategyMaxUnavailable)
+		assert.Equal(t, intstr.FromString("25%"), *renderMaxUnavailable())
+	})
+
+	t.Run("per-driver setting wins", func(t *testing.T) {
+		r.opConfig = controller.OperatorConfig{OperatorNamespace: "rook-ceph", Parameters: map[string]string{
+			"CSI_PLUGIN_DAEMONSET_MAX_UNAVAILABLE":           "25%",
+			"CSI_RBD_PLUGIN_UPDATE_STRATEGY_MAX_UNAVAILABLE": "2",
+		}}
+		assert.NoError(t, r.setParams())
+		assert.Equal(t, "2", CSIParam.RBDPluginUpdateStrategyMaxUnavailable)
+		assert.Equal(t, "25%", CSIParam.CephFSPluginUpdateStrategyMaxUnavailable)
+		assert.Equal(t, intstr.FromInt32(2), *renderMaxUnavailable())
+	})
+
+	t.Run("on delete", func(t *testing.T) {
+		CSIParam.RBDPluginUpdateStrategyMaxUnavailable = ""
+		r.opConfig = controller.OperatorConfig{OperatorNamespace: "rook-ceph", Parameters: map[string]string{
+			"CSI_PLUGIN_DAEMONSET_MAX_UNAVAILABLE": "25%",
+			"CSI_RBD_PLUGIN_UPDATE_STRATEGY":       "OnDelete",
+		}}
+		assert.NoError(t, r.setParams())
+		assert.Equal(t, "OnDelete", CSIParam.RBDPluginUpdateStrategy)
+		assert.Empty(t, CSIParam.RBDPluginUpdateStrategyMaxUnavailable)
+		assert.Nil(t, renderMaxUnavailable())
+	})
+}
+
+func TestNodeEventHandler(t *testing.T) {
+	oldDebounce := nodeEventDebounce
+	defer func() { nodeEventDebounce = oldDebounce }()
+	nodeEventDebounce = 50 * time.Millisecond
+
+	q := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+	defer q.ShutDown()
+	h := nodeEventHandler("rook-ceph")
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+
+	// a rolling node replacement only enqueues a single reconcile once the events settle
+	h.DeleteFunc(context.TODO(), event.DeleteEvent{Object: node}, q)
+	h.CreateFunc(context.TODO(), event.CreateEvent{Object: node}, q)
+	h.DeleteFunc(context.TODO(), event.DeleteEvent{Object: node}, q)
+	assert.Equal(t, 0, q.Len())
+
+	assert.Eventually(t, func() bool { return q.Len() == 1 }, 5*time.Second, 10*time.Millisecond)
+	item, _ := q.Get()
+	assert.Equal(t, types.NamespacedName{Name: controller.OperatorSettingConfigMapName, Namespace: "rook-ceph"}, item.NamespacedName)
+	q.Done(item)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestCSIDriverEventHandler(t *testing.T) {
+	q := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+	defer q.ShutDown()
+	h := csiDriverEventHandler("rook-ceph")
+	driver := func(namespace string, attachRequired bool) *storagev1.CSIDriver {
+		d := &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: "rook-ceph.rbd.csi.ceph.com", ResourceVersion: "1"}}
+		if namespace != "" {
+			d.Annotations = map[string]string{operatorNamespaceAnnotation: namespace}
+		}
+		d.Spec.AttachRequired = &attachRequired
+		return d
+	}
+
+	// drivers of other operators and updates not changing the spec are ignored
+	h.DeleteFunc(context.TODO(), event.DeleteEvent{Object: driver("other", true)}, q)
+	h.DeleteFunc(context.TODO(), event.DeleteEvent{Object: driver("", true)}, q)
+	h.UpdateFunc(context.TODO(), event.UpdateEvent{ObjectOld: driver("other", true), ObjectNew: driver("other", false)}, q)
+	resynced := driver("rook-ceph", true)
+	resynced.ResourceVersion = "2"
+	h.UpdateFunc(context.TODO(), event.UpdateEvent{ObjectOld: driver("rook-ceph", true), ObjectNew: resynced}, q)
+	assert.Equal(t, 0, q.Len())
+
+	expected := types.NamespacedName{Name: controller.OperatorSettingConfigMapName, Namespace: "rook-ceph"}
+	for _, enqueue := range []func(){
+		func() { h.DeleteFunc(context.TODO(), event.DeleteEvent{Object: driver("rook-ceph", true)}, q) },
+		func() {
+			h.UpdateFunc(context.TODO(), event.UpdateEvent{ObjectOld: driver("rook-ceph", true), ObjectNew: driver("rook-ceph", false)}, q)
+		},
+		// the operator annotation was removed
+		func() {
+			h.UpdateFunc(context.TODO(), event.UpdateEvent{ObjectOld: driver("rook-ceph", true), ObjectNew: driver("", true)}, q)
+		},
+		// the ownership label was changed
+		func() {
+			relabeled := driver("rook-ceph", true)
+			relabeled.Labels = map[string]string{operatorNamespaceLabel: "other"}
+			h.UpdateFunc(context.TODO(), event.UpdateEvent{ObjectOld: driver("rook-ceph", true), ObjectNew: relabeled}, q)
+		},
+	} {
+		enqueue()
+		assert.Equal(t, 1, q.Len())
+		item, _ := q.Get()
+		assert.Equal(t, expected, item.NamespacedName)
+		q.Done(item)
+	}
 }
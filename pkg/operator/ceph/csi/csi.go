@@ -18,6 +18,7 @@ package csi
 
 import (
 	"context"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +27,7 @@ import (
 	"github.com/rook/rook/pkg/operator/k8sutil"
 
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -40,17 +42,19 @@ func (r *ReconcileCSI) validateAndConfigureDrivers(ownerInfo *k8sutil.OwnerInfo)
 	}
 
 	if err = validateCSIParam(); err != nil {
+		r.recordCSIEvent(corev1.EventTypeWarning, csiValidationFailedReason, fmt.Sprintf("failed to validate csi parameters. %v", err))
 		return errors.Wrapf(err, "failed to validate CSI parameters")
 	}
 
 	if CSIEnabled() {
 		if err = r.startDrivers(ownerInfo); err != nil {
+			r.saveCSIStatus(err)
 			return errors.Wrap(err, "failed to start ceph csi drivers")
 		}
 	}
 
 	// Check whether RBD or CephFS needs to be disabled
-	return r.stopDrivers()
+	return r.stopDrivers(false)
 }
 
 func (r *ReconcileCSI) setParams() error {
@@ -71,6 +75,17 @@ func (r *ReconcileCSI) setParams() error {
 	if CSIParam.EnableCSIHostNetwork, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_ENABLE_HOST_NETWORK", "true")); err != nil {
 		return errors.Wrap(err, "failed to parse value for 'CSI_ENABLE_HOST_NETWORK'")
 	}
+	// the per-driver host network settings fall back to the global CSI_ENABLE_HOST_NETWORK
+	hostNetwork := strconv.FormatBool(CSIParam.EnableCSIHostNetwork)
+	if CSIParam.EnableRBDHostNetwork, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_ENABLE_HOST_NETWORK", hostNetwork)); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_RBD_ENABLE_HOST_NETWORK'")
+	}
+	if CSIParam.EnableCephFSHostNetwork, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_ENABLE_HOST_NETWORK", hostNetwork)); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_CEPHFS_ENABLE_HOST_NETWORK'")
+	}
+	if CSIParam.EnableNFSHostNetwork, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_ENABLE_HOST_NETWORK", hostNetwork)); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_NFS_ENABLE_HOST_NETWORK'")
+	}
 
 	// If not set or set to anything but "false", the kernel client will be enabled
 	if strings.EqualFold(k8sutil.GetValue(r.opConfig.Parameters, "CSI_FORCE_CEPHFS_KERNEL_CLIENT", "true"), "false") {
@@ -80,17 +95,10 @@ func (r *ReconcileCSI) setParams() error {
 	}
 
 	// parse RPC timeout
-	timeout := k8sutil.GetValue(r.opConfig.Parameters, grpcTimeout, "150")
-	timeoutSeconds, err := strconv.Atoi(timeout)
+	CSIParam.GRPCTimeout, err = getGRPCTimeout(r.opConfig.Parameters)
 	if err != nil {
-		logger.Errorf("failed to parse %q. Defaulting to %d. %v", grpcTimeout, defaultGRPCTimeout, err)
-		timeoutSeconds = defaultGRPCTimeout
-	}
-	if timeoutSeconds < 120 {
-		logger.Warningf("%s is %q but it should be >= 120, setting the default value %d", grpcTimeout, timeout, defaultGRPCTimeout)
-		timeoutSeconds = defaultGRPCTimeout
+		return err
 	}
-	CSIParam.GRPCTimeout = time.Duration(timeoutSeconds) * time.Second
 
 	// parse Liveness port
 	CSIParam.CephFSLivenessMetricsPort, err = getPortFromConfig(r.opConfig.Parameters, "CSI_CEPHFS_LIVENESS_METRICS_PORT", DefaultCephFSLivenessMerticsPort)
@@ -105,27 +113,76 @@ func (r *ReconcileCSI) setParams() error {
 	if err != nil {
 		return errors.Wrap(err, "error getting CSI RBD liveness metrics port.")
 	}
+	CSIParam.NFSLivenessMetricsPort, err = getPortFromConfig(r.opConfig.Parameters, "CSI_NFS_LIVENESS_METRICS_PORT", DefaultNFSLivenessMerticsPort)
+	if err != nil {
+		return errors.Wrap(err, "error getting CSI NFS liveness metrics port.")
+	}
 
 	CSIParam.EnableLiveness, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_ENABLE_LIVENESS", "false"))
 	if err != nil {
 		return errors.Wrap(err, "failed to parse value for 'CSI_ENABLE_LIVENESS'")
 	}
 
+	// tolerate all taints so the plugins run on every node where volumes may be mounted
+	CSIParam.PluginTolerateAllTaints, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_PLUGIN_TOLERATE_ALL_TAINTS", "false"))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_PLUGIN_TOLERATE_ALL_TAINTS'")
+	}
+
+	CSIParam.EnablePluginHostPID, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_PLUGIN_ENABLE_HOST_PID", "false"))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_PLUGIN_ENABLE_HOST_PID'")
+	}
+
+	CSIParam.EnableCSIPrometheusMonitoring, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_ENABLE_PROMETHEUS_MONITORING", "false"))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_ENABLE_PROMETHEUS_MONITORING'")
+	}
+
+	CSIParam.EnableSnapshotValidationWebhook, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_ENABLE_SNAPSHOT_VALIDATION_WEBHOOK", "false"))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_ENABLE_SNAPSHOT_VALIDATION_WEBHOOK'")
+	}
+
 	CSIParam.Privileged = controller.HostPathRequiresPrivileged()
 
 	// default value `system-node-critical` is the highest available priority
 	CSIParam.PluginPriorityClassName = k8sutil.GetValue(r.opConfig.Parameters, "CSI_PLUGIN_PRIORITY_CLASSNAME", "")
+	// the per-driver plugin priority classes fall back to CSI_PLUGIN_PRIORITY_CLASSNAME
+	CSIParam.RBDPluginPriorityClassName = k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_PLUGIN_PRIORITY_CLASSNAME", CSIParam.PluginPriorityClassName)
+	CSIParam.CephFSPluginPriorityClassName = k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_PLUGIN_PRIORITY_CLASSNAME", CSIParam.PluginPriorityClassName)
+	CSIParam.NFSPluginPriorityClassName = k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_PLUGIN_PRIORITY_CLASSNAME", CSIParam.PluginPriorityClassName)
 
 	// default value `system-cluster-critical` is applied for some
 	// critical pods in cluster but less priority than plugin pods
 	CSIParam.ProvisionerPriorityClassName = k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_PRIORITY_CLASSNAME", "")
 
+	// the service accounts of the csi pods default to the ones of the rook rbac manifests when not set
+	CSIParam.RBDPluginServiceAccount = k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_PLUGIN_SERVICE_ACCOUNT", "")
+	CSIParam.RBDProvisionerServiceAccount = k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_PROVISIONER_SERVICE_ACCOUNT", "")
+	CSIParam.CephFSPluginServiceAccount = k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_PLUGIN_SERVICE_ACCOUNT", "")
+	CSIParam.CephFSProvisionerServiceAccount = k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_PROVISIONER_SERVICE_ACCOUNT", "")
+	CSIParam.NFSPluginServiceAccount = k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_PLUGIN_SERVICE_ACCOUNT", "")
+	CSIParam.NFSProvisionerServiceAccount = k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_PROVISIONER_SERVICE_ACCOUNT", "")
+
+	// e.g. to keep the csi pods on runc while the applications run with kata containers
+	CSIParam.PluginRuntimeClassName = k8sutil.GetValue(r.opConfig.Parameters, "CSI_PLUGIN_RUNTIME_CLASS_NAME", "")
+	CSIParam.ProvisionerRuntimeClassName = k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_RUNTIME_CLASS_NAME", "")
+
 	CSIParam.EnableOMAPGenerator = false
 	if strings.EqualFold(k8sutil.GetValue(r.opConfig.Parameters, "CSI_ENABLE_OMAP_GENERATOR", "false"), "true") {
 		CSIParam.EnableOMAPGenerator = true
 	}
 
-	CSIParam.EnableCSIDriverSeLinuxMount = true
+	if CSIParam.EnableCSIDriverSeLinuxMount, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_SELINUX_MOUNT", "true")); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_SELINUX_MOUNT'")
+	}
+
+	if CSIParam.EnableStorageCapacity, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_ENABLE_STORAGE_CAPACITY", "false")); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_ENABLE_STORAGE_CAPACITY'")
+	}
+
+	CSIParam.TokenProjectionAudience = k8sutil.GetValue(r.opConfig.Parameters, "CSI_TOKEN_PROJECTION_AUDIENCE", "")
 
 	CSIParam.EnableRBDSnapshotter = true
 	if strings.EqualFold(k8sutil.GetValue(r.opConfig.Parameters, "CSI_ENABLE_RBD_SNAPSHOTTER", "true"), "false") {
@@ -169,17 +226,21 @@ func (r *ReconcileCSI) setParams() error {
 		CSIParam.CSIEnableMetadata = true
 	}
 
+	// the per-driver max unavailable plugins fall back to CSI_PLUGIN_DAEMONSET_MAX_UNAVAILABLE
+	pluginMaxUnavailable := k8sutil.GetValue(r.opConfig.Parameters, pluginMaxUnavailableEnv, "1")
+
 	if strings.EqualFold(k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_PLUGIN_UPDATE_STRATEGY", rollingUpdate), onDelete) {
 		CSIParam.CephFSPluginUpdateStrategy = onDelete
 	} else {
 		CSIParam.CephFSPluginUpdateStrategy = rollingUpdate
-		CSIParam.CephFSPluginUpdateStrategyMaxUnavailable = k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_PLUGIN_UPDATE_STRATEGY_MAX_UNAVAILABLE", "1")
+		CSIParam.CephFSPluginUpdateStrategyMaxUnavailable = k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_PLUGIN_UPDATE_STRATEGY_MAX_UNAVAILABLE", pluginMaxUnavailable)
 	}
 
 	if strings.EqualFold(k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_PLUGIN_UPDATE_STRATEGY", rollingUpdate), onDelete) {
 		CSIParam.NFSPluginUpdateStrategy = onDelete
 	} else {
 		CSIParam.NFSPluginUpdateStrategy = rollingUpdate
+		CSIParam.NFSPluginUpdateStrategyMaxUnavailable = k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_PLUGIN_UPDATE_STRATEGY_MAX_UNAVAILABLE", pluginMaxUnavailable)
 	}
 
 	// Default values are based on Kubernetes official documentation.
@@ -188,7 +249,7 @@ func (r *ReconcileCSI) setParams() error {
 		CSIParam.RBDPluginUpdateStrategy = onDelete
 	} else {
 		CSIParam.RBDPluginUpdateStrategy = rollingUpdate
-		CSIParam.RBDPluginUpdateStrategyMaxUnavailable = k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_PLUGIN_UPDATE_STRATEGY_MAX_UNAVAILABLE", "1")
+		CSIParam.RBDPluginUpdateStrategyMaxUnavailable = k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_PLUGIN_UPDATE_STRATEGY_MAX_UNAVAILABLE", pluginMaxUnavailable)
 	}
 
 	CSIParam.EnablePluginSelinuxHostMount = false
@@ -207,17 +268,30 @@ func (r *ReconcileCSI) setParams() error {
 		}
 	}
 
-	sidecarLogLevel := k8sutil.GetValue(r.opConfig.Parameters, "CSI_SIDECAR_LOG_LEVEL", "")
-	CSIParam.SidecarLogLevel = defaultSidecarLogLevel
-	if sidecarLogLevel != "" {
-		l, err := strconv.ParseUint(sidecarLogLevel, 10, 8)
-		if err != nil {
-			logger.Errorf("failed to parse CSI_SIDECAR_LOG_LEVEL. Defaulting to %d. %v", defaultSidecarLogLevel, err)
-		} else {
-			CSIParam.SidecarLogLevel = uint8(l)
-		}
+	// the per-driver log levels fall back to the global CSI_LOG_LEVEL
+	CSIParam.RBDLogLevel = getLogLevelFromConfig(r.opConfig.Parameters, "CSI_RBD_LOG_LEVEL", CSIParam.LogLevel)
+	CSIParam.CephFSLogLevel = getLogLevelFromConfig(r.opConfig.Parameters, "CSI_CEPHFS_LOG_LEVEL", CSIParam.LogLevel)
+	CSIParam.NFSLogLevel = getLogLevelFromConfig(r.opConfig.Parameters, "CSI_NFS_LOG_LEVEL", CSIParam.LogLevel)
+
+	CSIParam.PluginReadinessProbeInitialDelaySeconds = getPositiveInt32FromConfig(r.opConfig.Parameters, "CSI_PLUGIN_READINESS_PROBE_INITIAL_DELAY_SECONDS", defaultPluginReadinessProbeInitialDelaySeconds)
+	CSIParam.PluginReadinessProbePeriodSeconds = getPositiveInt32FromConfig(r.opConfig.Parameters, "CSI_PLUGIN_READINESS_PROBE_PERIOD_SECONDS", defaultPluginReadinessProbePeriodSeconds)
+	CSIParam.PluginReadinessProbeFailureThreshold = getPositiveInt32FromConfig(r.opConfig.Parameters, "CSI_PLUGIN_READINESS_PROBE_FAILURE_THRESHOLD", defaultPluginReadinessProbeFailureThreshold)
+	// give the restarted plugins time to register with the kubelet before the rollout continues
+	CSIParam.PluginMinReadySeconds = getPositiveInt32FromConfig(r.opConfig.Parameters, "CSI_PLUGIN_MIN_READY_SECONDS", 0)
+
+	// the kubernetes default grace period is used if not set
+	CSIParam.PluginTerminationGracePeriodSeconds, err = getOptionalInt64FromConfig(r.opConfig.Parameters, "CSI_PLUGIN_TERMINATION_GRACE_PERIOD_SECONDS")
+	if err != nil {
+		return err
+	}
+	CSIParam.ProvisionerTerminationGracePeriodSeconds, err = getOptionalInt64FromConfig(r.opConfig.Parameters, "CSI_PROVISIONER_TERMINATION_GRACE_PERIOD_SECONDS")
+	if err != nil {
+		return err
 	}
 
+	// the kubernetes-csi sidecars also fall back to the global CSI_LOG_LEVEL
+	CSIParam.SidecarLogLevel = getLogLevelFromConfig(r.opConfig.Parameters, "CSI_SIDECAR_LOG_LEVEL", CSIParam.LogLevel)
+
 	leaderElectionLeaseDuration := k8sutil.GetValue(r.opConfig.Parameters, "CSI_LEADER_ELECTION_LEASE_DURATION", "")
 	CSIParam.LeaderElectionLeaseDuration = defaultLeaderElectionLeaseDuration
 	if leaderElectionLeaseDuration != "" {
@@ -251,6 +325,28 @@ func (r *ReconcileCSI) setParams() error {
 		}
 	}
 
+	driverRolloutTimeout := k8sutil.GetValue(r.opConfig.Parameters, "CSI_DRIVER_ROLLOUT_TIMEOUT", "")
+	CSIParam.DriverRolloutTimeout = defaultDriverRolloutTimeout
+	if driverRolloutTimeout != "" {
+		d, err := time.ParseDuration(driverRolloutTimeout)
+		if err != nil || d < 0 {
+			logger.Errorf("failed to parse CSI_DRIVER_ROLLOUT_TIMEOUT %q. Defaulting to %s. %v", driverRolloutTimeout, defaultDriverRolloutTimeout, err)
+		} else {
+			CSIParam.DriverRolloutTimeout = d
+		}
+	}
+
+	driverDeletionTimeout := k8sutil.GetValue(r.opConfig.Parameters, "CSI_DRIVER_DELETION_TIMEOUT", "")
+	CSIParam.DriverDeletionTimeout = defaultDriverDeletionTimeout
+	if driverDeletionTimeout != "" {
+		d, err := time.ParseDuration(driverDeletionTimeout)
+		if err != nil || d < 0 {
+			logger.Errorf("failed to parse CSI_DRIVER_DELETION_TIMEOUT %q. Defaulting to %s. %v", driverDeletionTimeout, defaultDriverDeletionTimeout, err)
+		} else {
+			CSIParam.DriverDeletionTimeout = d
+		}
+	}
+
 	CSIParam.ProvisionerReplicas = defaultProvisionerReplicas
 	nodes, err := r.context.Clientset.CoreV1().Nodes().List(r.opManagerContext, metav1.ListOptions{})
 	if err == nil {
@@ -269,21 +365,73 @@ func (r *ReconcileCSI) setParams() error {
 		logger.Errorf("failed to get nodes. Defaulting the number of replicas of provisioner pods to %d. %v", CSIParam.ProvisionerReplicas, err)
 	}
 
+	CSIParam.ProvisionerAntiAffinityTopologyKey = k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_ANTI_AFFINITY_TOPOLOGY_KEY", corev1.LabelHostname)
+	provisionerAntiAffinity := k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_ANTI_AFFINITY", requiredAntiAffinity)
+	switch {
+	case strings.EqualFold(provisionerAntiAffinity, requiredAntiAffinity):
+		CSIParam.ProvisionerAntiAffinity = requiredAntiAffinity
+	case strings.EqualFold(provisionerAntiAffinity, preferredAntiAffinity):
+		CSIParam.ProvisionerAntiAffinity = preferredAntiAffinity
+	default:
+		logger.Warningf("invalid CSI_PROVISIONER_ANTI_AFFINITY %q, must be %q or %q. Defaulting to %q", provisionerAntiAffinity, requiredAntiAffinity, preferredAntiAffinity, requiredAntiAffinity)
+		CSIParam.ProvisionerAntiAffinity = requiredAntiAffinity
+	}
+
+	CSIParam.EnableProvisionerPDB = true
+	if strings.EqualFold(k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_PDB_ENABLED", "true"), "false") {
+		CSIParam.EnableProvisionerPDB = false
+	}
+
+	CSIParam.ProvisionerMaxUnavailable = ""
+	CSIParam.ProvisionerMaxSurge = ""
+	provisionerStrategy := k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_DEPLOYMENT_STRATEGY", "")
+	switch {
+	case strings.EqualFold(provisionerStrategy, rollingUpdate):
+		CSIParam.ProvisionerDeploymentStrategy = rollingUpdate
+		CSIParam.ProvisionerMaxUnavailable = k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_MAX_UNAVAILABLE", "")
+		CSIParam.ProvisionerMaxSurge = k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_MAX_SURGE", "")
+	case provisionerStrategy == "" || strings.EqualFold(provisionerStrategy, recreate):
+		CSIParam.ProvisionerDeploymentStrategy = recreate
+		if provisionerStrategy != "" && CSIParam.ProvisionerReplicas > 1 {
+			logger.Warningf("CSI_PROVISIONER_DEPLOYMENT_STRATEGY is %q with %d provisioner replicas, provisioning will be unavailable while the provisioner pods are updated", recreate, CSIParam.ProvisionerReplicas)
+		}
+	default:
+		logger.Warningf("invalid CSI_PROVISIONER_DEPLOYMENT_STRATEGY %q, must be %q or %q. Defaulting to %q", provisionerStrategy, recreate, rollingUpdate, recreate)
+		CSIParam.ProvisionerDeploymentStrategy = recreate
+	}
+
 	CSIParam.CSIPluginImage = getImage(r.opConfig.Parameters, "ROOK_CSI_CEPH_IMAGE", DefaultCSIPluginImage)
+	// the per-driver plugin images fall back to the common cephcsi image
+	CSIParam.RBDPluginImage = getPluginImage(r.opConfig.Parameters, "ROOK_CSI_RBD_PLUGIN_IMAGE", CSIParam.CSIPluginImage)
+	CSIParam.CephFSPluginImage = getPluginImage(r.opConfig.Parameters, "ROOK_CSI_CEPHFS_PLUGIN_IMAGE", CSIParam.CSIPluginImage)
+	CSIParam.NFSPluginImage = getPluginImage(r.opConfig.Parameters, "ROOK_CSI_NFS_PLUGIN_IMAGE", CSIParam.CSIPluginImage)
 	CSIParam.RegistrarImage = getImage(r.opConfig.Parameters, "ROOK_CSI_REGISTRAR_IMAGE", DefaultRegistrarImage)
 	CSIParam.ProvisionerImage = getImage(r.opConfig.Parameters, "ROOK_CSI_PROVISIONER_IMAGE", DefaultProvisionerImage)
 	CSIParam.AttacherImage = getImage(r.opConfig.Parameters, "ROOK_CSI_ATTACHER_IMAGE", DefaultAttacherImage)
 	CSIParam.SnapshotterImage = getImage(r.opConfig.Parameters, "ROOK_CSI_SNAPSHOTTER_IMAGE", DefaultSnapshotterImage)
 	CSIParam.ResizerImage = getImage(r.opConfig.Parameters, "ROOK_CSI_RESIZER_IMAGE", DefaultResizerImage)
-	CSIParam.KubeletDirPath = k8sutil.GetValue(r.opConfig.Parameters, "ROOK_CSI_KUBELET_DIR_PATH", DefaultKubeletDirPath)
+	CSIParam.KubeletDirPath = k8sutil.GetValue(r.opConfig.Parameters, kubeletDirPathEnv, DefaultKubeletDirPath)
 	CSIParam.CSIAddonsImage = getImage(r.opConfig.Parameters, "ROOK_CSIADDONS_IMAGE", DefaultCSIAddonsImage)
+	CSIParam.SnapshotValidationWebhookImage = getImage(r.opConfig.Parameters, "ROOK_CSI_SNAPSHOT_VALIDATION_WEBHOOK_IMAGE", DefaultSnapshotValidationWebhookImage)
+	// an empty secret name lets the operator generate a self-signed certificate
+	CSIParam.SnapshotValidationWebhookTLSSecret = k8sutil.GetValue(r.opConfig.Parameters, "CSI_SNAPSHOT_WEBHOOK_TLS_SECRET", "")
+	CSIParam.ImagePullSecrets = parseImagePullSecrets(k8sutil.GetValue(r.opConfig.Parameters, "CSI_IMAGE_PULL_SECRETS", ""))
+	CSIParam.CSIPluginImagePullSecret = k8sutil.GetValue(r.opConfig.Parameters, "CSI_PLUGIN_IMAGE_PULL_SECRET", "")
+	CSIParam.NFSPluginImagePullSecret = k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_IMAGE_PULL_SECRET", "")
+	CSIParam.SidecarImagePullSecret = k8sutil.GetValue(r.opConfig.Parameters, "CSI_SIDECAR_IMAGE_PULL_SECRET", "")
 	CSIParam.CSIDomainLabels = k8sutil.GetValue(r.opConfig.Parameters, "CSI_TOPOLOGY_DOMAIN_LABELS", "")
-	csiCephFSPodLabels := k8sutil.GetValue(r.opConfig.Parameters, "ROOK_CSI_CEPHFS_POD_LABELS", "")
-	CSIParam.CSICephFSPodLabels = k8sutil.ParseStringToLabels(csiCephFSPodLabels)
-	csiNFSPodLabels := k8sutil.GetValue(r.opConfig.Parameters, "ROOK_CSI_NFS_POD_LABELS", "")
-	CSIParam.CSINFSPodLabels = k8sutil.ParseStringToLabels(csiNFSPodLabels)
-	csiRBDPodLabels := k8sutil.GetValue(r.opConfig.Parameters, "ROOK_CSI_RBD_POD_LABELS", "")
-	CSIParam.CSIRBDPodLabels = k8sutil.ParseStringToLabels(csiRBDPodLabels)
+	if CSIParam.CSICephFSPodLabels, err = getPodLabels(r.opConfig.Parameters, "ROOK_CSI_CEPHFS_POD_LABELS", "CSI_CEPHFS_POD_LABELS"); err != nil {
+		return err
+	}
+	if CSIParam.CSINFSPodLabels, err = getPodLabels(r.opConfig.Parameters, "ROOK_CSI_NFS_POD_LABELS", "CSI_NFS_POD_LABELS"); err != nil {
+		return err
+	}
+	if CSIParam.CSIRBDPodLabels, err = getPodLabels(r.opConfig.Parameters, "ROOK_CSI_RBD_POD_LABELS", "CSI_RBD_POD_LABELS"); err != nil {
+		return err
+	}
+	CSIParam.CSICephFSPodAnnotations = k8sutil.ParseStringToLabels(k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_POD_ANNOTATIONS", ""))
+	CSIParam.CSINFSPodAnnotations = k8sutil.ParseStringToLabels(k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_POD_ANNOTATIONS", ""))
+	CSIParam.CSIRBDPodAnnotations = k8sutil.ParseStringToLabels(k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_POD_ANNOTATIONS", ""))
 	CSIParam.CSIClusterName = k8sutil.GetValue(r.opConfig.Parameters, "CSI_CLUSTER_NAME", "")
 	CSIParam.ImagePullPolicy = k8sutil.GetValue(r.opConfig.Parameters, "ROOK_CSI_IMAGE_PULL_POLICY", DefaultCSIImagePullPolicy)
 	CSIParam.CephFSKernelMountOptions = k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_KERNEL_MOUNT_OPTIONS", "")
@@ -301,6 +449,13 @@ func (r *ReconcileCSI) setParams() error {
 		CSIParam.NFSAttachRequired = false
 	}
 
+	if CSIParam.RBDPodInfoOnMount, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_POD_INFO_ON_MOUNT", "false")); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_RBD_POD_INFO_ON_MOUNT'")
+	}
+	if CSIParam.CephFSPodInfoOnMount, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_POD_INFO_ON_MOUNT", "false")); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_CEPHFS_POD_INFO_ON_MOUNT'")
+	}
+
 	CSIParam.DriverNamePrefix = k8sutil.GetValue(r.opConfig.Parameters, "CSI_DRIVER_NAME_PREFIX", r.opConfig.OperatorNamespace)
 
 	_, err = r.context.ApiExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), "volumegroupsnapshotclasses.groupsnapshot.storage.k8s.io", metav1.GetOptions{})
@@ -314,6 +469,19 @@ func (r *ReconcileCSI) setParams() error {
 		CSIParam.EnableVolumeGroupSnapshot = false
 	}
 
+	if CSIParam.EnableRestrictedPSA, err = strconv.ParseBool(k8sutil.GetValue(r.opConfig.Parameters, restrictedPSASetting, "false")); err != nil {
+		return errors.Wrapf(err, "failed to parse value for '%s'", restrictedPSASetting)
+	}
+
+	if CSIParam.ProvisionerWorkerThreads, err = strconv.Atoi(k8sutil.GetValue(r.opConfig.Parameters, "CSI_PROVISIONER_WORKER_THREADS", strconv.Itoa(defaultProvisionerWorkerThreads))); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_PROVISIONER_WORKER_THREADS'")
+	}
+	if CSIParam.AttacherWorkerThreads, err = strconv.Atoi(k8sutil.GetValue(r.opConfig.Parameters, "CSI_ATTACHER_WORKER_THREADS", strconv.Itoa(defaultAttacherWorkerThreads))); err != nil {
+		return errors.Wrap(err, "failed to parse value for 'CSI_ATTACHER_WORKER_THREADS'")
+	}
+
+	CSIParam.DefaultEphemeralStorageRequest = k8sutil.GetValue(r.opConfig.Parameters, defaultEphemeralStorageRequestEnv, "")
+
 	kubeApiBurst := k8sutil.GetValue(r.opConfig.Parameters, "CSI_KUBE_API_BURST", "")
 	CSIParam.KubeApiBurst = 0
 	if kubeApiBurst != "" {
@@ -18,37 +18,109 @@ package csi
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/rook/rook/pkg/operator/k8sutil"
 	v1k8scsi "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/version"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/kubernetes/typed/storage/v1"
 )
 
+const (
+	// operatorNamespaceAnnotation is set on the CSIDriver objects to the namespace of the operator that
+	// created them, so the objects left over from a previous driver name prefix can be cleaned up
+	operatorNamespaceAnnotation = "rook.io/operator-namespace"
+	// operatorNamespaceLabel is the label version of the operator namespace annotation. The
+	// CSIDriver objects are cluster-scoped and cannot have owner references, the label lets an
+	// operator and the cleanup scripts select the objects of an operator.
+	operatorNamespaceLabel = "rook.io/operator-namespace"
+)
+
+// kubeMinVerForSELinuxMount is the first kubernetes version with the seLinuxMount field of the
+// CSIDriver objects
+var kubeMinVerForSELinuxMount = version.MustParseSemantic("1.25.0")
+
+// kubeMinVerForStorageCapacity is the first kubernetes version serving the v1 CSIStorageCapacity
+// API that the provisioners publish the capacity with
+var kubeMinVerForStorageCapacity = version.MustParseSemantic("1.24.0")
+
+// csiDriverSELinuxMount returns whether the seLinuxMount field is set on the CSIDriver objects. The
+// field is skipped on the kubernetes versions that do not have it.
+func csiDriverSELinuxMount(clientset kubernetes.Interface, enabled bool) bool {
+	return enabled && kubeSupportsCSIDriverField(clientset, "seLinuxMount", kubeMinVerForSELinuxMount)
+}
+
+// csiDriverStorageCapacity returns whether the storage capacity tracking is enabled on the
+// CSIDriver objects and the provisioners. It is skipped on the kubernetes versions without the v1
+// CSIStorageCapacity API.
+func csiDriverStorageCapacity(clientset kubernetes.Interface, enabled bool) bool {
+	return enabled && kubeSupportsCSIDriverField(clientset, "storageCapacity", kubeMinVerForStorageCapacity)
+}
+
+// kubeSupportsCSIDriverField returns whether the kubernetes version is at least the minimum version
+// of a CSIDriver field. The field is assumed to be supported if the version cannot be detected.
+func kubeSupportsCSIDriverField(clientset kubernetes.Interface, field string, minVersion *version.Version) bool {
+	k8sVersion, err := k8sutil.GetK8SVersion(clientset)
+	if err != nil {
+		logger.Warningf("failed to get the kubernetes version, setting %s on the CSIDriver objects. %v", field, err)
+		return true
+	}
+	if !k8sVersion.AtLeast(minVersion) {
+		logger.Infof("skipping %s on the CSIDriver objects, kubernetes %q is older than %q", field, k8sVersion.String(), minVersion.String())
+		return false
+	}
+	return true
+}
+
 type v1CsiDriver struct {
 	csiDriver *v1k8scsi.CSIDriver
 	csiClient v1.CSIDriverInterface
+	// recreated is called with the reason when an existing CSIDriver object is recreated
+	recreated func(message string)
+	// notOwned is called with the reason when a CSIDriver object of another operator is not updated
+	// or deleted
+	notOwned func(message string)
+}
+
+// csiDriverOwnerNamespace returns the namespace of the operator that created the CSIDriver object.
+// The objects created before the ownership label was added only have the annotation.
+func csiDriverOwnerNamespace(driver metav1.Object) string {
+	if namespace, ok := driver.GetLabels()[operatorNamespaceLabel]; ok {
+		return namespace
+	}
+	return driver.GetAnnotations()[operatorNamespaceAnnotation]
 }
 
-// createCSIDriverInfo Registers CSI driver by creating a CSIDriver object
+// createCSIDriverInfo Registers CSI driver by creating a CSIDriver object. An existing object that
+// drifted from the desired spec is patched, or recreated if an immutable field differs.
 func (d v1CsiDriver) createCSIDriverInfo(
 	ctx context.Context,
 	clientset kubernetes.Interface,
-	name, fsGroupPolicy string,
-	attachRequired, seLinuxMountRequired bool) error {
-	mountInfo := false
+	namespace, name, fsGroupPolicy string,
+	attachRequired, podInfoOnMount, seLinuxMountRequired, storageCapacity bool, tokenAudience string) error {
 	// Create CSIDriver object
 	csiDriver := &v1k8scsi.CSIDriver{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
+			Name:        name,
+			Labels:      map[string]string{operatorNamespaceLabel: namespace},
+			Annotations: map[string]string{operatorNamespaceAnnotation: namespace},
 		},
 		Spec: v1k8scsi.CSIDriverSpec{
-			AttachRequired: &attachRequired,
-			PodInfoOnMount: &mountInfo,
+			AttachRequired:  &attachRequired,
+			PodInfoOnMount:  &podInfoOnMount,
+			StorageCapacity: &storageCapacity,
 		},
 	}
+	k8sutil.AddRookVersionLabelToObjectMeta(&csiDriver.ObjectMeta)
 	if seLinuxMountRequired {
 		selinuxMount := true
 		csiDriver.Spec.SELinuxMount = &selinuxMount
@@ -57,6 +129,13 @@ func (d v1CsiDriver) createCSIDriverInfo(
 		policy := v1k8scsi.FSGroupPolicy(fsGroupPolicy)
 		csiDriver.Spec.FSGroupPolicy = &policy
 	}
+	// the kubelet passes a service account token of the pod for the audience to the driver, and
+	// republishes the volumes to refresh the token before it expires
+	requiresRepublish := tokenAudience != ""
+	csiDriver.Spec.RequiresRepublish = &requiresRepublish
+	if tokenAudience != "" {
+		csiDriver.Spec.TokenRequests = []v1k8scsi.TokenRequest{{Audience: tokenAudience}}
+	}
 	csidrivers := clientset.StorageV1().CSIDrivers()
 	driver, err := csidrivers.Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
@@ -69,27 +148,106 @@ func (d v1CsiDriver) createCSIDriverInfo(
 		}
 		return err
 	}
+	if owner := csiDriverOwnerNamespace(driver); owner != "" && owner != namespace {
+		// two operators with the same driver name prefix would keep overwriting the ownership of
+		// the object, so it is only taken over when the namespace of the other operator is gone
+		_, err = clientset.CoreV1().Namespaces().Get(ctx, owner, metav1.GetOptions{})
+		if err == nil || !apierrors.IsNotFound(err) {
+			message := fmt.Sprintf("not updating CSIDriver object for driver %q, it belongs to the operator in namespace %q. Make sure the operators do not use the same driver name prefix", name, owner)
+			if d.notOwned != nil {
+				d.notOwned(message)
+			}
+			return errors.New(message)
+		}
+		logger.Warningf("CSIDriver object for driver %q was created by the operator in the deleted namespace %q, taking it over", name, owner)
+	}
 
-	// As FSGroupPolicy and AttachRequired fields are immutable, should be set only during create time.
-	// if the request is to change the FSGroupPolicy or AttachRequired, we are deleting the CSIDriver object and creating it.
-	if (driver.Spec.FSGroupPolicy != nil && csiDriver.Spec.FSGroupPolicy != nil && *driver.Spec.FSGroupPolicy != *csiDriver.Spec.FSGroupPolicy) || *driver.Spec.AttachRequired != *csiDriver.Spec.AttachRequired {
+	// As FSGroupPolicy, AttachRequired, PodInfoOnMount and StorageCapacity fields are immutable, should be set only during create time.
+	// if the request is to change any of them, we are deleting the CSIDriver object and creating it.
+	changes := immutableCSIDriverChanges(driver, csiDriver)
+	if len(changes) > 0 {
+		message := fmt.Sprintf("recreating CSIDriver object for driver %q to change %s", name, strings.Join(changes, ", "))
+		logger.Info(message)
 		d.csiClient = csidrivers
 		d.csiDriver = csiDriver
-		return d.reCreateCSIDriverInfo(ctx)
+		err = d.reCreateCSIDriverInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if d.recreated != nil {
+			d.recreated(message)
+		}
+		return nil
 	}
 
-	// For csidriver we need to provide the resourceVersion when updating the object.
-	// From the docs (https://github.com/kubernetes/community/blob/master/contributors/devel/sig-architecture/api-conventions.md#metadata)
-	// > "This value MUST be treated as opaque by clients and passed unmodified back to the server"
-	csiDriver.ObjectMeta.ResourceVersion = driver.ObjectMeta.ResourceVersion
-	_, err = csidrivers.Update(ctx, csiDriver, metav1.UpdateOptions{})
+	if !csiDriverMutableFieldsDrifted(driver, csiDriver) {
+		logger.Debugf("CSIDriver object for driver %q is up to date", name)
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": csiDriver.Labels, "annotations": csiDriver.Annotations},
+		"spec": map[string]interface{}{
+			"seLinuxMount":      csiDriver.Spec.SELinuxMount,
+			"requiresRepublish": csiDriver.Spec.RequiresRepublish,
+			"tokenRequests":     csiDriver.Spec.TokenRequests,
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to serialize patch of CSIDriver object for driver %q", name)
+	}
+	_, err = csidrivers.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
 	if err != nil {
 		return err
 	}
-	logger.Infof("CSIDriver object updated for driver %q", name)
+	logger.Infof("CSIDriver object patched for driver %q", name)
 	return nil
 }
 
+// immutableCSIDriverChanges describes the immutable fields of the existing CSIDriver object that
+// differ from the desired one
+func immutableCSIDriverChanges(existing, desired *v1k8scsi.CSIDriver) []string {
+	changes := []string{}
+	if existing.Spec.FSGroupPolicy != nil && desired.Spec.FSGroupPolicy != nil && *existing.Spec.FSGroupPolicy != *desired.Spec.FSGroupPolicy {
+		changes = append(changes, fmt.Sprintf("fsGroupPolicy from %q to %q", *existing.Spec.FSGroupPolicy, *desired.Spec.FSGroupPolicy))
+	}
+	if existing.Spec.AttachRequired != nil && *existing.Spec.AttachRequired != *desired.Spec.AttachRequired {
+		changes = append(changes, fmt.Sprintf("attachRequired from %t to %t", *existing.Spec.AttachRequired, *desired.Spec.AttachRequired))
+	}
+	// podInfoOnMount is only mutable from kubernetes 1.29
+	if existing.Spec.PodInfoOnMount != nil && *existing.Spec.PodInfoOnMount != *desired.Spec.PodInfoOnMount {
+		changes = append(changes, fmt.Sprintf("podInfoOnMount from %t to %t", *existing.Spec.PodInfoOnMount, *desired.Spec.PodInfoOnMount))
+	}
+	// storageCapacity was immutable before kubernetes 1.23, an unset value is the same as false
+	existingStorageCapacity := existing.Spec.StorageCapacity != nil && *existing.Spec.StorageCapacity
+	if existingStorageCapacity != *desired.Spec.StorageCapacity {
+		changes = append(changes, fmt.Sprintf("storageCapacity from %t to %t", existingStorageCapacity, *desired.Spec.StorageCapacity))
+	}
+	return changes
+}
+
+// csiDriverMutableFieldsDrifted returns whether the fields of the existing CSIDriver object that
+// can be patched differ from the desired ones
+func csiDriverMutableFieldsDrifted(existing, desired *v1k8scsi.CSIDriver) bool {
+	for key, value := range desired.Labels {
+		if existing.Labels[key] != value {
+			return true
+		}
+	}
+	for key, value := range desired.Annotations {
+		if existing.Annotations[key] != value {
+			return true
+		}
+	}
+	// an unset seLinuxMount or requiresRepublish is the same as false
+	existingSELinuxMount := existing.Spec.SELinuxMount != nil && *existing.Spec.SELinuxMount
+	desiredSELinuxMount := desired.Spec.SELinuxMount != nil && *desired.Spec.SELinuxMount
+	existingRequiresRepublish := existing.Spec.RequiresRepublish != nil && *existing.Spec.RequiresRepublish
+	desiredRequiresRepublish := desired.Spec.RequiresRepublish != nil && *desired.Spec.RequiresRepublish
+	return existingSELinuxMount != desiredSELinuxMount ||
+		existingRequiresRepublish != desiredRequiresRepublish ||
+		!equality.Semantic.DeepEqual(existing.Spec.TokenRequests, desired.Spec.TokenRequests)
+}
+
 func (d v1CsiDriver) reCreateCSIDriverInfo(ctx context.Context) error {
 	err := d.csiClient.Delete(ctx, d.csiDriver.Name, metav1.DeleteOptions{})
 	if err != nil {
@@ -104,14 +262,62 @@ func (d v1CsiDriver) reCreateCSIDriverInfo(ctx context.Context) error {
 	return nil
 }
 
-// deleteCSIDriverInfo deletes CSIDriverInfo and returns the error if any
-func (d v1CsiDriver) deleteCSIDriverInfo(ctx context.Context, clientset kubernetes.Interface, name string) error {
-	err := clientset.StorageV1().CSIDrivers().Delete(ctx, name, metav1.DeleteOptions{})
+// deleteCSIDriverInfo deletes CSIDriverInfo and returns the error if any. An object created by the
+// operator of another namespace is not deleted.
+func (d v1CsiDriver) deleteCSIDriverInfo(ctx context.Context, clientset kubernetes.Interface, namespace, name string) error {
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			logger.Debugf("%s CSIDriver not found; skipping deletion.", name)
 			return nil
 		}
+		return err
+	}
+	if owner := csiDriverOwnerNamespace(driver); owner != "" && owner != namespace {
+		message := fmt.Sprintf("not deleting CSIDriver object for driver %q, it belongs to the operator in namespace %q", name, owner)
+		logger.Warning(message)
+		if d.notOwned != nil {
+			d.notOwned(message)
+		}
+		return nil
+	}
+
+	err = clientset.StorageV1().CSIDrivers().Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && apierrors.IsNotFound(err) {
+		logger.Debugf("%s CSIDriver not found; skipping deletion.", name)
+		return nil
 	}
 	return err
 }
+
+// cleanupOrphanCSIDriverObjects deletes the CSIDriver objects created by this operator, or by an
+// operator whose namespace no longer exists, that do not match the current driver names anymore
+func cleanupOrphanCSIDriverObjects(ctx context.Context, clientset kubernetes.Interface, namespace string, expectedNames []string) error {
+	drivers, err := clientset.StorageV1().CSIDrivers().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list CSIDriver objects")
+	}
+
+	for _, driver := range drivers.Items {
+		ownerNamespace := csiDriverOwnerNamespace(&driver)
+		if ownerNamespace == "" || slices.Contains(expectedNames, driver.Name) {
+			continue
+		}
+		if ownerNamespace != namespace {
+			// the driver may belong to another operator running in the cluster
+			_, err := clientset.CoreV1().Namespaces().Get(ctx, ownerNamespace, metav1.GetOptions{})
+			if err == nil {
+				continue
+			}
+			if !apierrors.IsNotFound(err) {
+				return errors.Wrapf(err, "failed to get namespace %q of CSIDriver object %q", ownerNamespace, driver.Name)
+			}
+		}
+		err = clientset.StorageV1().CSIDrivers().Delete(ctx, driver.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete orphan CSIDriver object %q", driver.Name)
+		}
+		logger.Infof("deleted orphan CSIDriver object %q", driver.Name)
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCleanupOrphanCSIDriverObjects(t *testing.T) {
+	ctx := context.TODO()
+	driver := func(name, namespace string) *storagev1.CSIDriver {
+		d := &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if namespace != "" {
+			d.Annotations = map[string]string{operatorNamespaceAnnotation: namespace}
+		}
+		return d
+	}
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "rook-ceph"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other-operator"}},
+		// current drivers
+		driver("new.rbd.csi.ceph.com", "rook-ceph"),
+		driver("new.cephfs.csi.ceph.com", "rook-ceph"),
+		// left over from a previous prefix of this operator
+		driver("old.rbd.csi.ceph.com", "rook-ceph"),
+		// left over from an operator whose namespace was removed
+		driver("moved.cephfs.csi.ceph.com", "removed-namespace"),
+		// owned by another operator in the cluster
+		driver("other-operator.rbd.csi.ceph.com", "other-operator"),
+		// labeled by the current version of this operator
+		&storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: "labeled.nfs.csi.ceph.com", Labels: map[string]string{operatorNamespaceLabel: "rook-ceph"}}},
+		// not created by rook
+		driver("ebs.csi.aws.com", ""),
+	)
+
+	err := cleanupOrphanCSIDriverObjects(ctx, clientset, "rook-ceph", []string{"new.rbd.csi.ceph.com", "new.cephfs.csi.ceph.com", "new.nfs.csi.ceph.com"})
+	assert.NoError(t, err)
+
+	drivers, err := clientset.StorageV1().CSIDrivers().List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	names := []string{}
+	for _, d := range drivers.Items {
+		names = append(names, d.Name)
+	}
+	assert.ElementsMatch(t, []string{"new.rbd.csi.ceph.com", "new.cephfs.csi.ceph.com", "other-operator.rbd.csi.ceph.com", "ebs.csi.aws.com"}, names)
+}
+
+func TestCreateCSIDriverInfoAttachRequired(t *testing.T) {
+	ctx := context.TODO()
+	clientset := fake.NewSimpleClientset()
+	name := "rook-ceph.rbd.csi.ceph.com"
+
+	err := v1CsiDriver{}.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, *driver.Spec.AttachRequired)
+
+	// the same value updates the object in place
+	clientset.ClearActions()
+	err = v1CsiDriver{}.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	for _, action := range clientset.Actions() {
+		assert.NotEqual(t, "delete", action.GetVerb())
+	}
+
+	// attachRequired is immutable, the object is recreated to change it
+	clientset.ClearActions()
+	err = v1CsiDriver{}.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", false, false, false, false, "")
+	assert.NoError(t, err)
+	verbs := []string{}
+	for _, action := range clientset.Actions() {
+		verbs = append(verbs, action.GetVerb())
+	}
+	assert.Equal(t, []string{"get", "delete", "create"}, verbs)
+	driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, *driver.Spec.AttachRequired)
+}
+
+func TestCSIDriverSELinuxMount(t *testing.T) {
+	newClientset := func(gitVersion string) *fake.Clientset {
+		clientset := fake.NewSimpleClientset()
+		clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: gitVersion}
+		return clientset
+	}
+
+	assert.True(t, csiDriverSELinuxMount(newClientset("v1.25.0"), true))
+	assert.True(t, csiDriverSELinuxMount(newClientset("v1.30.2"), true))
+	assert.False(t, csiDriverSELinuxMount(newClientset("v1.30.2"), false))
+	// the field does not exist on older kubernetes versions
+	assert.False(t, csiDriverSELinuxMount(newClientset("v1.24.9"), true))
+}
+
+func TestCreateCSIDriverInfoSELinuxMount(t *testing.T) {
+	ctx := context.TODO()
+	clientset := fake.NewSimpleClientset()
+	name := "rook-ceph.cephfs.csi.ceph.com"
+
+	err := v1CsiDriver{}.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, true, false, "")
+	assert.NoError(t, err)
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, *driver.Spec.SELinuxMount)
+
+	// seLinuxMount is mutable, the object is updated in place
+	clientset.ClearActions()
+	err = v1CsiDriver{}.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	for _, action := range clientset.Actions() {
+		assert.NotEqual(t, "delete", action.GetVerb())
+	}
+	driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, driver.Spec.SELinuxMount)
+}
+
+func TestCreateCSIDriverInfoPodInfoOnMount(t *testing.T) {
+	ctx := context.TODO()
+	clientset := fake.NewSimpleClientset()
+	name := "rook-ceph.rbd.csi.ceph.com"
+
+	err := v1CsiDriver{}.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, *driver.Spec.PodInfoOnMount)
+
+	// podInfoOnMount is immutable on older kubernetes versions, the object is recreated to change it
+	clientset.ClearActions()
+	err = v1CsiDriver{}.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, true, false, false, "")
+	assert.NoError(t, err)
+	verbs := []string{}
+	for _, action := range clientset.Actions() {
+		verbs = append(verbs, action.GetVerb())
+	}
+	assert.Equal(t, []string{"get", "delete", "create"}, verbs)
+	driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, *driver.Spec.PodInfoOnMount)
+	assert.True(t, *driver.Spec.AttachRequired)
+}
+
+func TestCreateCSIDriverInfoFSGroupPolicy(t *testing.T) {
+	ctx := context.TODO()
+	clientset := fake.NewSimpleClientset()
+	name := "rook-ceph.rbd.csi.ceph.com"
+	messages := []string{}
+	d := v1CsiDriver{recreated: func(message string) { messages = append(messages, message) }}
+
+	err := d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	// a user changed the fsGroupPolicy, which is immutable, so the object is recreated
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	policy := storagev1.NoneFSGroupPolicy
+	driver.Spec.FSGroupPolicy = &policy
+	_, err = clientset.StorageV1().CSIDrivers().Update(ctx, driver, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	clientset.ClearActions()
+	err = d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	verbs := []string{}
+	for _, action := range clientset.Actions() {
+		verbs = append(verbs, action.GetVerb())
+	}
+	assert.Equal(t, []string{"get", "delete", "create"}, verbs)
+	driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, storagev1.FileFSGroupPolicy, *driver.Spec.FSGroupPolicy)
+	assert.Equal(t, []string{`recreating CSIDriver object for driver "rook-ceph.rbd.csi.ceph.com" to change fsGroupPolicy from "None" to "File"`}, messages)
+
+	// the policy set by the operator changes the same way
+	clientset.ClearActions()
+	err = d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "ReadWriteOnceWithFSType", true, false, false, false, "")
+	assert.NoError(t, err)
+	driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, storagev1.ReadWriteOnceWithFSTypeFSGroupPolicy, *driver.Spec.FSGroupPolicy)
+	assert.Len(t, messages, 2)
+}
+
+func TestCreateCSIDriverInfoDrift(t *testing.T) {
+	ctx := context.TODO()
+	clientset := fake.NewSimpleClientset()
+	name := "rook-ceph.cephfs.csi.ceph.com"
+	d := v1CsiDriver{recreated: func(message string) { assert.Fail(t, "unexpected recreate", message) }}
+
+	err := d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, true, false, "")
+	assert.NoError(t, err)
+
+	t.Run("no drift", func(t *testing.T) {
+		clientset.ClearActions()
+		err := d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, true, false, "")
+		assert.NoError(t, err)
+		verbs := []string{}
+		for _, action := range clientset.Actions() {
+			verbs = append(verbs, action.GetVerb())
+		}
+		assert.Equal(t, []string{"get"}, verbs)
+	})
+
+	t.Run("mutable fields are patched", func(t *testing.T) {
+		driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		driver.Labels = nil
+		driver.Annotations = nil
+		driver.Spec.SELinuxMount = nil
+		_, err = clientset.StorageV1().CSIDrivers().Update(ctx, driver, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+
+		clientset.ClearActions()
+		err = d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, true, false, "")
+		assert.NoError(t, err)
+		verbs := []string{}
+		for _, action := range clientset.Actions() {
+			verbs = append(verbs, action.GetVerb())
+		}
+		assert.Equal(t, []string{"get", "patch"}, verbs)
+		driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "rook-ceph", driver.Labels[operatorNamespaceLabel])
+		assert.Contains(t, driver.Labels, k8sutil.RookVersionLabelKey)
+		assert.Equal(t, "rook-ceph", driver.Annotations[operatorNamespaceAnnotation])
+		assert.True(t, *driver.Spec.SELinuxMount)
+	})
+
+	t.Run("deleted object is created", func(t *testing.T) {
+		err := clientset.StorageV1().CSIDrivers().Delete(ctx, name, metav1.DeleteOptions{})
+		assert.NoError(t, err)
+		err = d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, true, false, "")
+		assert.NoError(t, err)
+		_, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+	})
+}
+
+func TestCSIDriverStorageCapacity(t *testing.T) {
+	newClientset := func(gitVersion string) *fake.Clientset {
+		clientset := fake.NewSimpleClientset()
+		clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: gitVersion}
+		return clientset
+	}
+
+	assert.True(t, csiDriverStorageCapacity(newClientset("v1.24.0"), true))
+	assert.False(t, csiDriverStorageCapacity(newClientset("v1.30.2"), false))
+	// the v1 CSIStorageCapacity API does not exist on older kubernetes versions
+	assert.False(t, csiDriverStorageCapacity(newClientset("v1.23.9"), true))
+}
+
+func TestCreateCSIDriverInfoStorageCapacity(t *testing.T) {
+	ctx := context.TODO()
+	name := "rook-ceph.rbd.csi.ceph.com"
+	// objects created before the setting existed have the value defaulted by the api server
+	storageCapacity := false
+	clientset := fake.NewSimpleClientset(&storagev1.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{operatorNamespaceAnnotation: "rook-ceph"}},
+		Spec:       storagev1.CSIDriverSpec{StorageCapacity: &storageCapacity},
+	})
+	messages := []string{}
+	d := v1CsiDriver{recreated: func(message string) { messages = append(messages, message) }}
+
+	err := d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	// the object is recreated to enable the capacity tracking
+	clientset.ClearActions()
+	err = d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, true, "")
+	assert.NoError(t, err)
+	verbs := []string{}
+	for _, action := range clientset.Actions() {
+		verbs = append(verbs, action.GetVerb())
+	}
+	assert.Equal(t, []string{"get", "delete", "create"}, verbs)
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, *driver.Spec.StorageCapacity)
+	assert.Len(t, messages, 1)
+	assert.Contains(t, messages[0], "storageCapacity from false to true")
+}
+
+func TestCreateCSIDriverInfoTokenRequests(t *testing.T) {
+	ctx := context.TODO()
+	clientset := fake.NewSimpleClientset()
+	name := "rook-ceph.rbd.csi.ceph.com"
+	d := v1CsiDriver{recreated: func(message string) { assert.Fail(t, "unexpected recreate", message) }}
+
+	err := d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, driver.Spec.TokenRequests)
+	assert.False(t, *driver.Spec.RequiresRepublish)
+
+	// the token requests are mutable, the object is patched to enable the token projection
+	clientset.ClearActions()
+	err = d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "sts.amazonaws.com")
+	assert.NoError(t, err)
+	verbs := []string{}
+	for _, action := range clientset.Actions() {
+		verbs = append(verbs, action.GetVerb())
+	}
+	assert.Equal(t, []string{"get", "patch"}, verbs)
+	driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []storagev1.TokenRequest{{Audience: "sts.amazonaws.com"}}, driver.Spec.TokenRequests)
+	assert.True(t, *driver.Spec.RequiresRepublish)
+
+	// and to disable it again
+	err = d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+	assert.NoError(t, err)
+	driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, driver.Spec.TokenRequests)
+	assert.False(t, *driver.Spec.RequiresRepublish)
+}
+
+func TestReconcileNFSCSIDriverObject(t *testing.T) {
+	origRBD, origCephFS, origNFS, origNFSName, origParam := EnableRBD, EnableCephFS, EnableNFS, NFSDriverName, CSIParam
+	defer func() {
+		EnableRBD, EnableCephFS, EnableNFS, NFSDriverName, CSIParam = origRBD, origCephFS, origNFS, origNFSName, origParam
+	}()
+	EnableRBD, EnableCephFS, EnableNFS = false, false, true
+	NFSDriverName = "rook-ceph.nfs.csi.ceph.com"
+
+	clientset := fake.NewSimpleClientset()
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: "rook-ceph", Parameters: map[string]string{}},
+		recorder:         record.NewFakeRecorder(10),
+	}
+
+	// every change of the immutable fields recreates the object with the new values
+	for _, policy := range []string{"File", "ReadWriteOnceWithFSType", "None"} {
+		for _, attachRequired := range []bool{true, false} {
+			r.opConfig.Parameters["CSI_NFS_FSGROUPPOLICY"] = policy
+			tp := templateParam{Param: CSIParam, Namespace: "rook-ceph"}
+			tp.NFSAttachRequired = attachRequired
+
+			err := r.reconcileCSIDriverObjects(tp)
+			assert.NoError(t, err)
+			driver, err := clientset.StorageV1().CSIDrivers().Get(context.TODO(), NFSDriverName, metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, policy, string(*driver.Spec.FSGroupPolicy))
+			assert.Equal(t, attachRequired, *driver.Spec.AttachRequired)
+
+			// the provisioner runs the attacher only when the attachment is required
+			result, err := renderCSIDrivers(tp, r.opConfig.Parameters)
+			assert.NoError(t, err)
+			assert.Equal(t, attachRequired, getContainer(&result.NFSProvisioner.Spec.Template.Spec, "csi-attacher") != nil)
+		}
+	}
+}
+
+func TestDeleteCSIDriverInfo(t *testing.T) {
+	ctx := context.TODO()
+	driver := func(name string, labels, annotations map[string]string) *storagev1.CSIDriver {
+		return &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels, Annotations: annotations}}
+	}
+	clientset := fake.NewSimpleClientset(
+		driver("owned.rbd.csi.ceph.com", map[string]string{operatorNamespaceLabel: "rook-ceph"}, nil),
+		driver("legacy.rbd.csi.ceph.com", nil, map[string]string{operatorNamespaceAnnotation: "rook-ceph"}),
+		driver("unlabeled.rbd.csi.ceph.com", nil, nil),
+		driver("other.rbd.csi.ceph.com", map[string]string{operatorNamespaceLabel: "other-operator"}, nil),
+		driver("other-legacy.rbd.csi.ceph.com", nil, map[string]string{operatorNamespaceAnnotation: "other-operator"}),
+	)
+	messages := []string{}
+	d := v1CsiDriver{notOwned: func(message string) { messages = append(messages, message) }}
+
+	for _, name := range []string{"owned.rbd.csi.ceph.com", "legacy.rbd.csi.ceph.com", "unlabeled.rbd.csi.ceph.com", "missing.rbd.csi.ceph.com"} {
+		assert.NoError(t, d.deleteCSIDriverInfo(ctx, clientset, "rook-ceph", name))
+		_, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+		assert.True(t, kerrors.IsNotFound(err), name)
+	}
+	assert.Empty(t, messages)
+
+	// the objects of another operator are kept
+	for _, name := range []string{"other.rbd.csi.ceph.com", "other-legacy.rbd.csi.ceph.com"} {
+		assert.NoError(t, d.deleteCSIDriverInfo(ctx, clientset, "rook-ceph", name))
+		_, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err, name)
+	}
+	assert.Equal(t, []string{
+		`not deleting CSIDriver object for driver "other.rbd.csi.ceph.com", it belongs to the operator in namespace "other-operator"`,
+		`not deleting CSIDriver object for driver "other-legacy.rbd.csi.ceph.com", it belongs to the operator in namespace "other-operator"`,
+	}, messages)
+}
+
+func TestCreateCSIDriverInfoOtherOperator(t *testing.T) {
+	ctx := context.TODO()
+	name := "rook-ceph.rbd.csi.ceph.com"
+	otherDriver := &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{operatorNamespaceLabel: "other-operator"},
+	}}
+	messages := []string{}
+	d := v1CsiDriver{notOwned: func(message string) { messages = append(messages, message) }}
+
+	t.Run("other operator is running", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(otherDriver.DeepCopy(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other-operator"}})
+		err := d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+		assert.Error(t, err)
+		assert.Len(t, messages, 1)
+		assert.Contains(t, messages[0], `belongs to the operator in namespace "other-operator"`)
+
+		// the object is left to the other operator
+		driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "other-operator", driver.Labels[operatorNamespaceLabel])
+
+		// the other operator does not take the object back
+		err = d.createCSIDriverInfo(ctx, clientset, "other-operator", name, "File", true, false, false, false, "")
+		assert.NoError(t, err)
+		driver, err = clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "other-operator", driver.Labels[operatorNamespaceLabel])
+	})
+
+	t.Run("other operator namespace is deleted", func(t *testing.T) {
+		messages = []string{}
+		clientset := fake.NewSimpleClientset(otherDriver.DeepCopy())
+		err := d.createCSIDriverInfo(ctx, clientset, "rook-ceph", name, "File", true, false, false, false, "")
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+		driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "rook-ceph", driver.Labels[operatorNamespaceLabel])
+	})
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// CsiActiveConfigMap is the name of the ConfigMap holding the parameters the csi drivers were
+	// last started with
+	CsiActiveConfigMap = "rook-ceph-csi-active-config"
+
+	csiActiveConfigKey = "config.json"
+	maskedValue        = "<masked>"
+)
+
+// csiDebugConfig returns the JSON representation of the template parameters, the images are
+// reduced to their tag and the fields about secrets are masked
+func csiDebugConfig(tp templateParam) (string, error) {
+	b, err := json.Marshal(tp)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to serialize csi parameters")
+	}
+	config := map[string]interface{}{}
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to deserialize csi parameters")
+	}
+
+	for field, value := range config {
+		if strings.Contains(field, "Secret") {
+			config[field] = maskedValue
+			continue
+		}
+		if image, ok := value.(string); ok && strings.HasSuffix(field, "Image") {
+			config[field] = imageTag(image)
+		}
+	}
+
+	b, err = json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to serialize csi debug config")
+	}
+	return string(b), nil
+}
+
+// imageTag returns the tag of the image, or its digest if it is pinned by digest
+func imageTag(image string) string {
+	if _, digest, found := strings.Cut(image, "@"); found {
+		return digest
+	}
+	i := strings.LastIndex(image, ":")
+	if i == -1 || strings.Contains(image[i:], "/") {
+		return ""
+	}
+	return image[i+1:]
+}
+
+// writeCSIDebugConfigMap saves the parameters the csi drivers were started with to the csi active
+// config ConfigMap, so that they can be inspected without reading the operator logs
+func writeCSIDebugConfigMap(ctx context.Context, clientset kubernetes.Interface, namespace string, tp templateParam) error {
+	config, err := csiDebugConfig(tp)
+	if err != nil {
+		return err
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CsiActiveConfigMap,
+			Namespace: namespace,
+		},
+		Data: map[string]string{csiActiveConfigKey: config},
+	}
+	_, err = k8sutil.CreateOrUpdateConfigMap(ctx, clientset, cm)
+	if err != nil {
+		return errors.Wrapf(err, "failed to save csi active config configmap %q", CsiActiveConfigMap)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/stretchr/testify/assert"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestImageTag(t *testing.T) {
+	assert.Equal(t, "v3.12.3", imageTag("quay.io/cephcsi/cephcsi:v3.12.3"))
+	assert.Equal(t, "v2.11.1", imageTag("localhost:5000/csi-node-driver-registrar:v2.11.1"))
+	assert.Equal(t, "sha256:abc", imageTag("quay.io/cephcsi/cephcsi:v3.12.3@sha256:abc"))
+	assert.Equal(t, "", imageTag("localhost:5000/cephcsi"))
+	assert.Equal(t, "", imageTag(""))
+}
+
+func TestWriteCSIDebugConfigMap(t *testing.T) {
+	ctx := context.TODO()
+	namespace := "rook-ceph"
+	clientset := kfake.NewSimpleClientset()
+	tp := templateParam{
+		Param: Param{
+			CSIPluginImage:                     "quay.io/cephcsi/cephcsi:v3.12.3",
+			RegistrarImage:                     "registry.k8s.io/sig-storage/csi-node-driver-registrar:v2.11.1",
+			ImagePullSecrets:                   []string{"my-secret"},
+			CSIPluginImagePullSecret:           "plugin-secret",
+			SnapshotValidationWebhookTLSSecret: "webhook-tls",
+			EnableLiveness:                     true,
+			RBDLivenessMetricsPort:             9080,
+		},
+		Namespace: namespace,
+	}
+
+	err := writeCSIDebugConfigMap(ctx, clientset, namespace, tp)
+	assert.NoError(t, err)
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, CsiActiveConfigMap, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	config := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(cm.Data[csiActiveConfigKey]), &config))
+	assert.Equal(t, namespace, config["Namespace"])
+	assert.Equal(t, true, config["EnableLiveness"])
+	assert.Equal(t, float64(9080), config["RBDLivenessMetricsPort"])
+	// the images are reduced to their tag
+	assert.Equal(t, "v3.12.3", config["CSIPluginImage"])
+	assert.Equal(t, "v2.11.1", config["RegistrarImage"])
+	assert.Equal(t, "", config["ProvisionerImage"])
+	// the secrets are masked
+	for _, field := range []string{"ImagePullSecrets", "CSIPluginImagePullSecret", "NFSPluginImagePullSecret", "SnapshotValidationWebhookTLSSecret"} {
+		assert.Equal(t, maskedValue, config[field], field)
+	}
+	assert.NotContains(t, cm.Data[csiActiveConfigKey], "my-secret")
+	assert.NotContains(t, cm.Data[csiActiveConfigKey], "plugin-secret")
+	assert.NotContains(t, cm.Data[csiActiveConfigKey], "webhook-tls")
+
+	// the configmap is updated with the new parameters
+	tp.EnableLiveness = false
+	assert.NoError(t, writeCSIDebugConfigMap(ctx, clientset, namespace, tp))
+	cm, err = clientset.CoreV1().ConfigMaps(namespace).Get(ctx, CsiActiveConfigMap, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal([]byte(cm.Data[csiActiveConfigKey]), &config))
+	assert.Equal(t, false, config["EnableLiveness"])
+}
+
+func TestStopDriversDeletesCSIDebugConfigMap(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+
+	namespace := "rook-ceph"
+	clientset := kfake.NewSimpleClientset()
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+	}
+	assert.NoError(t, writeCSIDebugConfigMap(context.TODO(), clientset, namespace, templateParam{Namespace: namespace}))
+
+	// the configmap is kept while a driver is still running
+	EnableRBD, EnableCephFS, EnableNFS = true, false, false
+	assert.NoError(t, r.stopDrivers(false))
+	_, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), CsiActiveConfigMap, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	EnableRBD = false
+	assert.NoError(t, r.stopDrivers(false))
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), CsiActiveConfigMap, metav1.GetOptions{})
+	assert.True(t, kerrors.IsNotFound(err))
+}
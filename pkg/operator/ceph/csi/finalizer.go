@@ -0,0 +1,74 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	opcontroller "github.com/rook/rook/pkg/operator/ceph/controller"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// csiCleanupFinalizer is set on the CephClusters while the csi drivers are managed by rook, so that
+// the drivers are removed before the last cluster is deleted
+const csiCleanupFinalizer = "csi.rook.io/cleanup"
+
+// reconcileCSICleanupFinalizer adds the csi cleanup finalizer to the cluster when the csi drivers
+// are managed by rook, and removes it otherwise so that it does not block the cluster deletion
+func (r *ReconcileCSI) reconcileCSICleanupFinalizer(cluster *cephv1.CephCluster, managed bool) error {
+	if managed {
+		return opcontroller.AddFinalizerWithNameIfNotPresent(r.opManagerContext, r.client, cluster, csiCleanupFinalizer)
+	}
+	if !slices.Contains(cluster.Finalizers, csiCleanupFinalizer) {
+		return nil
+	}
+	return opcontroller.RemoveFinalizerWithName(r.opManagerContext, r.client, cluster, csiCleanupFinalizer)
+}
+
+// cleanupCSIOnClusterDeletion removes the csi drivers when the last CephCluster is deleted, then
+// removes the csi cleanup finalizer from the cluster. The drivers are kept while another cluster
+// still uses them. The cleanup waits for the other finalizers of the cluster so that the drivers
+// keep running while the resources of the cluster are removed.
+func (r *ReconcileCSI) cleanupCSIOnClusterDeletion(cluster *cephv1.CephCluster, clusters []cephv1.CephCluster) error {
+	for _, finalizer := range cluster.Finalizers {
+		if finalizer != csiCleanupFinalizer {
+			logger.Debugf("waiting for finalizer %q to be removed from ceph cluster %q before the csi cleanup", finalizer, cluster.Name)
+			return nil
+		}
+	}
+
+	inUse := slices.ContainsFunc(clusters, func(c cephv1.CephCluster) bool {
+		return c.DeletionTimestamp.IsZero()
+	})
+	if inUse {
+		logger.Infof("ceph cluster %q is deleted, keeping the csi drivers used by the other ceph clusters", cluster.Name)
+	} else {
+		logger.Infof("last ceph cluster %q is deleted, removing the csi drivers", cluster.Name)
+		err := r.stopDrivers(true)
+		if err != nil {
+			return errors.Wrap(err, "failed to stop csi drivers")
+		}
+	}
+
+	err := opcontroller.RemoveFinalizerWithName(r.opManagerContext, r.client, cluster, csiCleanupFinalizer)
+	if err != nil && !kerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to remove csi cleanup finalizer from ceph cluster %q", cluster.Name)
+	}
+	return nil
+}
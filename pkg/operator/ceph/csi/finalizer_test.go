@@ -0,0 +1,153 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"testing"
+
+	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func newFinalizerTestReconciler(t *testing.T, objects ...client.Object) (*ReconcileCSI, client.Client, *kfake.Clientset) {
+	s := runtime.NewScheme()
+	assert.NoError(t, cephv1.AddToScheme(s))
+	assert.NoError(t, corev1.AddToScheme(s))
+	cl := fake.NewClientBuilder().WithScheme(s).WithObjects(objects...).Build()
+	clientset := kfake.NewSimpleClientset(&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: CsiRBDPlugin, Namespace: "rook-ceph"}})
+	r := &ReconcileCSI{
+		client:           cl,
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: "rook-ceph"},
+		recorder:         record.NewFakeRecorder(10),
+	}
+	return r, cl, clientset
+}
+
+func TestReconcileCSICleanupFinalizer(t *testing.T) {
+	cluster := &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "rook-ceph"}}
+	r, cl, _ := newFinalizerTestReconciler(t, cluster)
+	getFinalizers := func() []string {
+		c := &cephv1.CephCluster{}
+		assert.NoError(t, cl.Get(context.TODO(), types.NamespacedName{Name: "my-cluster", Namespace: "rook-ceph"}, c))
+		return c.Finalizers
+	}
+
+	t.Run("not added when csi is not enabled", func(t *testing.T) {
+		assert.NoError(t, r.reconcileCSICleanupFinalizer(cluster, false))
+		assert.Empty(t, getFinalizers())
+	})
+
+	t.Run("added when csi is enabled", func(t *testing.T) {
+		assert.NoError(t, r.reconcileCSICleanupFinalizer(cluster, true))
+		assert.Equal(t, []string{csiCleanupFinalizer}, getFinalizers())
+		// the finalizer is added only once
+		assert.NoError(t, r.reconcileCSICleanupFinalizer(cluster, true))
+		assert.Equal(t, []string{csiCleanupFinalizer}, getFinalizers())
+	})
+
+	t.Run("removed when csi is disabled", func(t *testing.T) {
+		assert.NoError(t, r.reconcileCSICleanupFinalizer(cluster, false))
+		assert.Empty(t, getFinalizers())
+	})
+}
+
+func TestCleanupCSIOnClusterDeletion(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+
+	now := metav1.Now()
+	deletedCluster := func(finalizers ...string) *cephv1.CephCluster {
+		return &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "rook-ceph", DeletionTimestamp: &now, Finalizers: finalizers}}
+	}
+	clusterExists := func(cl client.Client) bool {
+		err := cl.Get(context.TODO(), types.NamespacedName{Name: "deleted", Namespace: "rook-ceph"}, &cephv1.CephCluster{})
+		if err != nil {
+			assert.True(t, kerrors.IsNotFound(err))
+			return false
+		}
+		return true
+	}
+	pluginExists := func(clientset *kfake.Clientset) bool {
+		_, err := clientset.AppsV1().DaemonSets("rook-ceph").Get(context.TODO(), CsiRBDPlugin, metav1.GetOptions{})
+		return err == nil
+	}
+
+	t.Run("waits for the other finalizers", func(t *testing.T) {
+		EnableRBD, EnableCephFS, EnableNFS = true, true, false
+		cluster := deletedCluster("cephcluster.ceph.rook.io", csiCleanupFinalizer)
+		r, cl, clientset := newFinalizerTestReconciler(t, cluster)
+		assert.NoError(t, r.cleanupCSIOnClusterDeletion(cluster, []cephv1.CephCluster{*cluster}))
+		assert.True(t, clusterExists(cl))
+		assert.True(t, pluginExists(clientset))
+	})
+
+	t.Run("drivers are kept for the other clusters", func(t *testing.T) {
+		EnableRBD, EnableCephFS, EnableNFS = true, true, false
+		cluster := deletedCluster(csiCleanupFinalizer)
+		other := cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "other-ns"}}
+		r, cl, clientset := newFinalizerTestReconciler(t, cluster)
+		assert.NoError(t, r.cleanupCSIOnClusterDeletion(cluster, []cephv1.CephCluster{*cluster, other}))
+		assert.False(t, clusterExists(cl))
+		assert.True(t, pluginExists(clientset))
+	})
+
+	t.Run("drivers are removed with the last cluster", func(t *testing.T) {
+		EnableRBD, EnableCephFS, EnableNFS = true, true, false
+		cluster := deletedCluster(csiCleanupFinalizer)
+		r, cl, clientset := newFinalizerTestReconciler(t, cluster)
+		assert.NoError(t, r.cleanupCSIOnClusterDeletion(cluster, []cephv1.CephCluster{*cluster}))
+		assert.False(t, clusterExists(cl))
+		assert.False(t, pluginExists(clientset))
+		// the drivers enabled in the operator config are not changed
+		assert.True(t, EnableRBD && EnableCephFS)
+
+		// the csi resources are already absent
+		assert.NoError(t, r.stopDrivers(true))
+		assert.NoError(t, r.cleanupCSIOnClusterDeletion(cluster, []cephv1.CephCluster{*cluster}))
+	})
+
+	t.Run("cluster deleted while the reconcile is paused", func(t *testing.T) {
+		EnableRBD, EnableCephFS, EnableNFS = true, true, false
+		cluster := deletedCluster(csiCleanupFinalizer)
+		opConfig := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Name:        controller.OperatorSettingConfigMapName,
+			Namespace:   "rook-ceph",
+			Annotations: map[string]string{csiReconcilePausedAnnotation: "true"},
+		}}
+		r, cl, clientset := newFinalizerTestReconciler(t, cluster, opConfig)
+		_, err := r.reconcile(reconcile.Request{NamespacedName: types.NamespacedName{Name: "deleted", Namespace: "rook-ceph"}})
+		assert.NoError(t, err)
+		assert.False(t, clusterExists(cl))
+		assert.False(t, pluginExists(clientset))
+	})
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	"github.com/rook/rook/pkg/operator/ceph/reporting"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// csiDriverHealthRequeue is how often the health of the csi drivers is refreshed while a driver
+// is not ready, since the operator does not watch the pods of the drivers
+var csiDriverHealthRequeue = reconcile.Result{RequeueAfter: 30 * time.Second}
+
+// DriverHealth is the operational state of a csi driver deployed by the operator
+type DriverHealth struct {
+	// DesiredPods is the number of nodes that should run the plugin pod
+	DesiredPods int32
+	// ReadyPods is the number of nodes running a ready plugin pod
+	ReadyPods int32
+	// AvailableReplicas is the number of available provisioner pods
+	AvailableReplicas int32
+	// ObservedGeneration is the generation of the plugin daemonset observed by its controller
+	ObservedGeneration int64
+	// Conditions describes why the driver is not healthy, it is empty for a healthy driver
+	Conditions []string
+}
+
+// Ready returns whether all the pods of the driver are ready
+func (h DriverHealth) Ready() bool {
+	return len(h.Conditions) == 0
+}
+
+type csiDriverResources struct {
+	daemonset, deployment string
+	conditionType         cephv1.ConditionType
+}
+
+// enabledCSIDriverResources returns the plugin and provisioner of the enabled drivers, by driver name
+func enabledCSIDriverResources() map[string]csiDriverResources {
+	drivers := map[string]csiDriverResources{}
+	if EnableRBD {
+		drivers[RBDDriverName] = csiDriverResources{CsiRBDPlugin, csiRBDProvisioner, cephv1.ConditionCSIRBDPluginReady}
+	}
+	if EnableCephFS {
+		drivers[CephFSDriverName] = csiDriverResources{CsiCephFSPlugin, csiCephFSProvisioner, cephv1.ConditionCSICephFSPluginReady}
+	}
+	if EnableNFS {
+		drivers[NFSDriverName] = csiDriverResources{CsiNFSPlugin, csiNFSProvisioner, cephv1.ConditionCSINFSPluginReady}
+	}
+	return drivers
+}
+
+// GetCSIDriverHealth returns the operational state of each enabled csi driver, by driver name
+func GetCSIDriverHealth(ctx context.Context, clientset kubernetes.Interface, namespace string) map[string]DriverHealth {
+	health := map[string]DriverHealth{}
+	for name, resources := range enabledCSIDriverResources() {
+		h := DriverHealth{Conditions: []string{}}
+
+		ds, err := clientset.AppsV1().DaemonSets(namespace).Get(ctx, resources.daemonset, metav1.GetOptions{})
+		if err != nil {
+			h.Conditions = append(h.Conditions, resourceError("plugin daemonset", resources.daemonset, err))
+		} else {
+			h.DesiredPods = ds.Status.DesiredNumberScheduled
+			h.ReadyPods = ds.Status.NumberReady
+			h.ObservedGeneration = ds.Status.ObservedGeneration
+			h.Conditions = append(h.Conditions, daemonSetConditions(ds)...)
+		}
+
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, resources.deployment, metav1.GetOptions{})
+		if err != nil {
+			h.Conditions = append(h.Conditions, resourceError("provisioner deployment", resources.deployment, err))
+		} else {
+			h.AvailableReplicas = deployment.Status.AvailableReplicas
+			h.Conditions = append(h.Conditions, deploymentConditions(deployment)...)
+		}
+
+		health[name] = h
+	}
+	return health
+}
+
+func resourceError(kind, name string, err error) string {
+	if kerrors.IsNotFound(err) {
+		return fmt.Sprintf("%s %q not found", kind, name)
+	}
+	return fmt.Sprintf("failed to get %s %q. %v", kind, name, err)
+}
+
+func daemonSetConditions(ds *appsv1.DaemonSet) []string {
+	conditions := []string{}
+	if ds.Status.ObservedGeneration < ds.Generation {
+		conditions = append(conditions, fmt.Sprintf("plugin daemonset %q update is not observed yet", ds.Name))
+	}
+	if ds.Status.NumberReady < ds.Status.DesiredNumberScheduled {
+		conditions = append(conditions, fmt.Sprintf("%d of %d plugin pods are ready", ds.Status.NumberReady, ds.Status.DesiredNumberScheduled))
+	}
+	if ds.Status.UpdatedNumberScheduled < ds.Status.DesiredNumberScheduled {
+		conditions = append(conditions, fmt.Sprintf("%d of %d plugin pods are updated", ds.Status.UpdatedNumberScheduled, ds.Status.DesiredNumberScheduled))
+	}
+	return conditions
+}
+
+func deploymentConditions(deployment *appsv1.Deployment) []string {
+	conditions := []string{}
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		conditions = append(conditions, fmt.Sprintf("provisioner deployment %q update is not observed yet", deployment.Name))
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	if deployment.Status.AvailableReplicas < replicas {
+		conditions = append(conditions, fmt.Sprintf("%d of %d provisioner replicas are available", deployment.Status.AvailableReplicas, replicas))
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Status == corev1.ConditionFalse {
+			conditions = append(conditions, fmt.Sprintf("provisioner deployment %q is not %s: %s", deployment.Name, condition.Type, condition.Message))
+		}
+	}
+	return conditions
+}
+
+// updateCSIDriverConditions reports the health of the csi drivers in the conditions of all the
+// CephClusters, the conditions of the disabled drivers, or of all the drivers if they are not
+// managed by rook, are removed. Returns whether all the enabled drivers are ready.
+func (r *ReconcileCSI) updateCSIDriverConditions(managed bool) bool {
+	health := map[string]DriverHealth{}
+	drivers := map[string]csiDriverResources{}
+	if managed {
+		health = GetCSIDriverHealth(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace)
+		drivers = enabledCSIDriverResources()
+	}
+
+	ready := true
+	conditions := map[cephv1.ConditionType]cephv1.Condition{}
+	for name, h := range health {
+		condition := cephv1.Condition{
+			Type:    drivers[name].conditionType,
+			Status:  corev1.ConditionTrue,
+			Reason:  cephv1.CSIPluginReadyReason,
+			Message: fmt.Sprintf("csi driver %q is ready", name),
+		}
+		if !h.Ready() {
+			ready = false
+			condition.Status = corev1.ConditionFalse
+			condition.Reason = cephv1.CSIPluginNotReadyReason
+			condition.Message = fmt.Sprintf("csi driver %q is not ready: %s", name, strings.Join(h.Conditions, "; "))
+		}
+		conditions[condition.Type] = condition
+	}
+
+	cephClusters := &cephv1.CephClusterList{}
+	err := r.client.List(r.opManagerContext, cephClusters, &client.ListOptions{})
+	if err != nil {
+		logger.Warningf("failed to list ceph clusters to update the csi driver conditions. %v", err)
+		return ready
+	}
+	for i := range cephClusters.Items {
+		cluster := &cephClusters.Items[i]
+		if !setCSIDriverConditions(&cluster.Status.Conditions, conditions) {
+			continue
+		}
+		err = reporting.UpdateStatus(r.client, cluster)
+		if err != nil {
+			// the conditions are informational only, they must not fail the reconcile
+			logger.Warningf("failed to update the csi driver conditions of ceph cluster %q. %v", cluster.Name, err)
+		}
+	}
+	return ready
+}
+
+// setCSIDriverConditions sets the csi driver conditions and removes the ones of the disabled
+// drivers. Returns whether the conditions changed, the heartbeat alone is not updated to avoid
+// updating the clusters on every reconcile.
+func setCSIDriverConditions(existing *[]cephv1.Condition, conditions map[cephv1.ConditionType]cephv1.Condition) bool {
+	changed := false
+	for _, conditionType := range []cephv1.ConditionType{cephv1.ConditionCSIRBDPluginReady, cephv1.ConditionCSICephFSPluginReady, cephv1.ConditionCSINFSPluginReady} {
+		current := cephv1.FindStatusCondition(*existing, conditionType)
+		condition, enabled := conditions[conditionType]
+		if !enabled {
+			if current != nil {
+				removed := []cephv1.Condition{}
+				for _, c := range *existing {
+					if c.Type != conditionType {
+						removed = append(removed, c)
+					}
+				}
+				*existing = removed
+				changed = true
+			}
+			continue
+		}
+		if current != nil && current.Status == condition.Status && current.Reason == condition.Reason && current.Message == condition.Message {
+			continue
+		}
+		cephv1.SetStatusCondition(existing, condition)
+		changed = true
+	}
+	return changed
+}
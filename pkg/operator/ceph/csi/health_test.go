@@ -0,0 +1,198 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"testing"
+
+	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	"github.com/rook/rook/pkg/client/clientset/versioned/scheme"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kfake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func healthyPlugin(name string) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "rook-ceph", Generation: 2},
+		Status:     appsv1.DaemonSetStatus{DesiredNumberScheduled: 3, NumberReady: 3, UpdatedNumberScheduled: 3, ObservedGeneration: 2},
+	}
+}
+
+func healthyProvisioner(name string) *appsv1.Deployment {
+	replicas := int32(2)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "rook-ceph", Generation: 1},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status: appsv1.DeploymentStatus{
+			AvailableReplicas:  2,
+			ObservedGeneration: 1,
+			Conditions:         []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func TestGetCSIDriverHealth(t *testing.T) {
+	origRBD, origCephFS, origNFS, origRBDName, origCephFSName := EnableRBD, EnableCephFS, EnableNFS, RBDDriverName, CephFSDriverName
+	defer func() {
+		EnableRBD, EnableCephFS, EnableNFS, RBDDriverName, CephFSDriverName = origRBD, origCephFS, origNFS, origRBDName, origCephFSName
+	}()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+	RBDDriverName, CephFSDriverName = "rook-ceph.rbd.csi.ceph.com", "rook-ceph.cephfs.csi.ceph.com"
+	ctx := context.TODO()
+
+	t.Run("healthy drivers", func(t *testing.T) {
+		clientset := kfake.NewSimpleClientset(
+			healthyPlugin(CsiRBDPlugin), healthyProvisioner(csiRBDProvisioner),
+			healthyPlugin(CsiCephFSPlugin), healthyProvisioner(csiCephFSProvisioner),
+		)
+		health := GetCSIDriverHealth(ctx, clientset, "rook-ceph")
+		assert.Len(t, health, 2)
+		rbd := health[RBDDriverName]
+		assert.True(t, rbd.Ready())
+		assert.Equal(t, int32(3), rbd.DesiredPods)
+		assert.Equal(t, int32(3), rbd.ReadyPods)
+		assert.Equal(t, int32(2), rbd.AvailableReplicas)
+		assert.Equal(t, int64(2), rbd.ObservedGeneration)
+		assert.True(t, health[CephFSDriverName].Ready())
+	})
+
+	t.Run("resources not found", func(t *testing.T) {
+		clientset := kfake.NewSimpleClientset(healthyPlugin(CsiRBDPlugin), healthyProvisioner(csiRBDProvisioner))
+		health := GetCSIDriverHealth(ctx, clientset, "rook-ceph")
+		assert.True(t, health[RBDDriverName].Ready())
+		cephfs := health[CephFSDriverName]
+		assert.False(t, cephfs.Ready())
+		assert.Equal(t, []string{
+			`plugin daemonset "csi-cephfsplugin" not found`,
+			`provisioner deployment "csi-cephfsplugin-provisioner" not found`,
+		}, cephfs.Conditions)
+	})
+
+	t.Run("rolling out", func(t *testing.T) {
+		plugin := healthyPlugin(CsiRBDPlugin)
+		plugin.Generation = 3
+		plugin.Status.NumberReady = 2
+		plugin.Status.UpdatedNumberScheduled = 1
+		provisioner := healthyProvisioner(csiRBDProvisioner)
+		provisioner.Status.AvailableReplicas = 1
+		provisioner.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionFalse, Message: "Deployment does not have minimum availability."}}
+		clientset := kfake.NewSimpleClientset(plugin, provisioner, healthyPlugin(CsiCephFSPlugin), healthyProvisioner(csiCephFSProvisioner))
+
+		rbd := GetCSIDriverHealth(ctx, clientset, "rook-ceph")[RBDDriverName]
+		assert.False(t, rbd.Ready())
+		assert.Equal(t, int32(2), rbd.ReadyPods)
+		assert.Equal(t, int32(1), rbd.AvailableReplicas)
+		assert.Equal(t, []string{
+			`plugin daemonset "csi-rbdplugin" update is not observed yet`,
+			"2 of 3 plugin pods are ready",
+			"1 of 3 plugin pods are updated",
+			"1 of 2 provisioner replicas are available",
+			`provisioner deployment "csi-rbdplugin-provisioner" is not Available: Deployment does not have minimum availability.`,
+		}, rbd.Conditions)
+	})
+
+	t.Run("disabled drivers", func(t *testing.T) {
+		EnableRBD, EnableCephFS = false, false
+		defer func() { EnableRBD, EnableCephFS = true, true }()
+		assert.Empty(t, GetCSIDriverHealth(ctx, kfake.NewSimpleClientset(), "rook-ceph"))
+	})
+}
+
+func TestUpdateCSIDriverConditions(t *testing.T) {
+	origRBD, origCephFS, origNFS, origRBDName := EnableRBD, EnableCephFS, EnableNFS, RBDDriverName
+	defer func() { EnableRBD, EnableCephFS, EnableNFS, RBDDriverName = origRBD, origCephFS, origNFS, origRBDName }()
+	EnableRBD, EnableCephFS, EnableNFS = true, false, false
+	RBDDriverName = "rook-ceph.rbd.csi.ceph.com"
+
+	cephCluster := &cephv1.CephCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "rook-ceph"},
+		Status: cephv1.ClusterStatus{Conditions: []cephv1.Condition{
+			{Type: cephv1.ConditionReady, Status: corev1.ConditionTrue, Reason: cephv1.ClusterCreatedReason},
+			// left over from a driver that is now disabled
+			{Type: cephv1.ConditionCSICephFSPluginReady, Status: corev1.ConditionTrue, Reason: cephv1.CSIPluginReadyReason},
+		}},
+	}
+	s := scheme.Scheme
+	s.AddKnownTypes(cephv1.SchemeGroupVersion, &cephv1.CephCluster{}, &cephv1.CephClusterList{})
+	cl := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(cephCluster).WithStatusSubresource(cephCluster).Build()
+	plugin := healthyPlugin(CsiRBDPlugin)
+	plugin.Status.NumberReady = 1
+	clientset := kfake.NewSimpleClientset(plugin, healthyProvisioner(csiRBDProvisioner))
+	r := &ReconcileCSI{
+		client:           cl,
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: "rook-ceph"},
+	}
+	getConditions := func() []cephv1.Condition {
+		cluster := &cephv1.CephCluster{}
+		err := cl.Get(context.TODO(), types.NamespacedName{Name: "my-cluster", Namespace: "rook-ceph"}, cluster)
+		assert.NoError(t, err)
+		return cluster.Status.Conditions
+	}
+
+	assert.False(t, r.updateCSIDriverConditions(true))
+	conditions := getConditions()
+	assert.Len(t, conditions, 2)
+	assert.Nil(t, cephv1.FindStatusCondition(conditions, cephv1.ConditionCSICephFSPluginReady))
+	rbd := cephv1.FindStatusCondition(conditions, cephv1.ConditionCSIRBDPluginReady)
+	assert.Equal(t, corev1.ConditionFalse, rbd.Status)
+	assert.Equal(t, cephv1.CSIPluginNotReadyReason, rbd.Reason)
+	assert.Equal(t, `csi driver "rook-ceph.rbd.csi.ceph.com" is not ready: 1 of 3 plugin pods are ready`, rbd.Message)
+
+	// the plugin pods become ready
+	plugin.Status.NumberReady = 3
+	_, err := clientset.AppsV1().DaemonSets("rook-ceph").Update(context.TODO(), plugin, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.True(t, r.updateCSIDriverConditions(true))
+	rbd = cephv1.FindStatusCondition(getConditions(), cephv1.ConditionCSIRBDPluginReady)
+	assert.Equal(t, corev1.ConditionTrue, rbd.Status)
+	assert.Equal(t, cephv1.CSIPluginReadyReason, rbd.Reason)
+
+	// the conditions are removed when the drivers are not managed by rook
+	assert.True(t, r.updateCSIDriverConditions(false))
+	conditions = getConditions()
+	assert.Len(t, conditions, 1)
+	assert.Equal(t, cephv1.ConditionReady, conditions[0].Type)
+}
+
+func TestSetCSIDriverConditions(t *testing.T) {
+	ready := cephv1.Condition{Type: cephv1.ConditionCSIRBDPluginReady, Status: corev1.ConditionTrue, Reason: cephv1.CSIPluginReadyReason, Message: "ready"}
+	conditions := []cephv1.Condition{}
+
+	assert.True(t, setCSIDriverConditions(&conditions, map[cephv1.ConditionType]cephv1.Condition{ready.Type: ready}))
+	assert.Len(t, conditions, 1)
+	// the same state does not update the cluster
+	assert.False(t, setCSIDriverConditions(&conditions, map[cephv1.ConditionType]cephv1.Condition{ready.Type: ready}))
+
+	notReady := ready
+	notReady.Status, notReady.Reason, notReady.Message = corev1.ConditionFalse, cephv1.CSIPluginNotReadyReason, "not ready"
+	assert.True(t, setCSIDriverConditions(&conditions, map[cephv1.ConditionType]cephv1.Condition{ready.Type: notReady}))
+	assert.Equal(t, corev1.ConditionFalse, conditions[0].Status)
+
+	assert.True(t, setCSIDriverConditions(&conditions, map[cephv1.ConditionType]cephv1.Condition{}))
+	assert.Empty(t, conditions)
+	assert.False(t, setCSIDriverConditions(&conditions, map[cephv1.ConditionType]cephv1.Condition{}))
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/rook/rook/pkg/operator/k8sutil/cmdreporter"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	kubeletDirPathEnv           = "ROOK_CSI_KUBELET_DIR_PATH"
+	detectKubeletDirPathJobName = "rook-ceph-csi-detect-kubelet-dir"
+	detectKubeletDirPathTimeout = 5 * time.Minute
+	// the detection is retried after a failure with an exponential backoff between these bounds
+	detectKubeletDirPathMinBackoff = 5 * time.Minute
+	detectKubeletDirPathMaxBackoff = 4 * time.Hour
+	hostMountsPath                 = "/proc/1/mounts"
+	kubeletPodsDirMountSeparator   = "/pods/"
+	// the plugin volume of the kubelet pods dir
+	kubeletPodsMountVolume = "pods-mount-dir"
+)
+
+var (
+	newCmdReporter = cmdreporter.New
+
+	// detectedKubeletDirPath caches the kubelet dir path detected on the nodes
+	detectedKubeletDirPath string
+	// detectKubeletDirPathBackoff is the delay before the detection is retried after the last
+	// failure, and detectKubeletDirPathRetry the time of the next attempt. The failures are cached
+	// so that a detection job that cannot run does not block every reconcile.
+	detectKubeletDirPathBackoff time.Duration
+	detectKubeletDirPathRetry   time.Time
+)
+
+// getKubeletDirPath returns the kubelet dir path configured by the user, or detects it from the
+// mounts of a node when not configured. The path of the deployed csi plugins is kept across operator
+// restarts without running the detection again, unless it is the default path. The default path is
+// returned if the detection fails.
+func (r *ReconcileCSI) getKubeletDirPath(ownerInfo *k8sutil.OwnerInfo) string {
+	if kubeletDirPath := k8sutil.GetValue(r.opConfig.Parameters, kubeletDirPathEnv, ""); kubeletDirPath != "" {
+		return kubeletDirPath
+	}
+	if detectedKubeletDirPath != "" {
+		return detectedKubeletDirPath
+	}
+	if deployed := r.deployedKubeletDirPath(); deployed != "" && deployed != DefaultKubeletDirPath {
+		logger.Infof("using kubelet dir path %q of the deployed csi plugins", deployed)
+		detectedKubeletDirPath = deployed
+		return deployed
+	}
+	if time.Now().Before(detectKubeletDirPathRetry) {
+		logger.Debugf("kubelet dir path detection failed, defaulting to %q until the next attempt at %s", DefaultKubeletDirPath, detectKubeletDirPathRetry.Format(time.RFC3339))
+		return DefaultKubeletDirPath
+	}
+
+	kubeletDirPath, err := detectKubeletDirPath(r.opManagerContext, r.context.Clientset, ownerInfo, r.opConfig.OperatorNamespace, r.opConfig.Image, r.opConfig.ServiceAccount)
+	if err != nil {
+		detectKubeletDirPathBackoff = min(max(2*detectKubeletDirPathBackoff, detectKubeletDirPathMinBackoff), detectKubeletDirPathMaxBackoff)
+		detectKubeletDirPathRetry = time.Now().Add(detectKubeletDirPathBackoff)
+		logger.Warningf("failed to detect the kubelet dir path, defaulting to %q and retrying in %s. set %s if the default is not correct. %v",
+			DefaultKubeletDirPath, detectKubeletDirPathBackoff, kubeletDirPathEnv, err)
+		return DefaultKubeletDirPath
+	}
+	logger.Infof("detected kubelet dir path %q", kubeletDirPath)
+	detectedKubeletDirPath = kubeletDirPath
+	detectKubeletDirPathBackoff = 0
+	return kubeletDirPath
+}
+
+// deployedKubeletDirPath returns the kubelet dir path of the deployed csi plugin daemonsets, or an
+// empty string if no plugin is deployed
+func (r *ReconcileCSI) deployedKubeletDirPath() string {
+	for _, name := range []string{CsiRBDPlugin, CsiCephFSPlugin, CsiNFSPlugin} {
+		ds, err := r.context.Clientset.AppsV1().DaemonSets(r.opConfig.OperatorNamespace).Get(r.opManagerContext, name, metav1.GetOptions{})
+		if err != nil {
+			if !kerrors.IsNotFound(err) {
+				logger.Debugf("failed to get csi plugin daemonset %q to find its kubelet dir path. %v", name, err)
+			}
+			continue
+		}
+		for _, volume := range ds.Spec.Template.Spec.Volumes {
+			if volume.Name == kubeletPodsMountVolume && volume.HostPath != nil {
+				return path.Dir(path.Clean(volume.HostPath.Path))
+			}
+		}
+	}
+	return ""
+}
+
+// detectKubeletDirPath runs a job on a schedulable node that reads the host mounts to find where
+// the kubelet keeps the pod volumes. The job runs with the service account of the operator, which
+// exists in the operator namespace and can write the job result. It needs the host pid namespace,
+// so the pod security of the operator namespace must allow privileged pods.
+func detectKubeletDirPath(ctx context.Context, clientset kubernetes.Interface, ownerInfo *k8sutil.OwnerInfo, namespace, rookImage, serviceAccount string) (string, error) {
+	reporter, err := newCmdReporter(
+		clientset,
+		ownerInfo,
+		detectKubeletDirPathJobName,
+		detectKubeletDirPathJobName,
+		namespace,
+		[]string{"cat"},
+		[]string{hostMountsPath},
+		rookImage,
+		rookImage,
+		corev1.PullIfNotPresent,
+		cephv1.ResourceSpec{},
+	)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to set up kubelet dir path detection job")
+	}
+
+	// the mounts of the host are only visible from the host pid namespace
+	job := reporter.Job()
+	job.Spec.Template.Spec.ServiceAccountName = serviceAccount
+	job.Spec.Template.Spec.HostPID = true
+
+	stdout, stderr, retcode, err := reporter.Run(ctx, detectKubeletDirPathTimeout)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to complete kubelet dir path detection job")
+	}
+	if retcode != 0 {
+		return "", errors.Errorf("kubelet dir path detection job returned failure with retcode %d. stdout: %s. stderr: %s", retcode, stdout, stderr)
+	}
+
+	return parseKubeletDirPath(stdout)
+}
+
+// parseKubeletDirPath returns the kubelet dir from the pod volume mounts found in the given
+// /proc/mounts content, e.g. /var/lib/kubelet from /var/lib/kubelet/pods/<uid>/volumes/...
+func parseKubeletDirPath(mounts string) (string, error) {
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mountPoint := fields[1]
+		i := strings.Index(mountPoint, kubeletPodsDirMountSeparator)
+		if i <= 0 || !strings.Contains(mountPoint[:i], "kubelet") {
+			continue
+		}
+		return path.Clean(mountPoint[:i]), nil
+	}
+	return "", errors.New("no kubelet pod volume mount found")
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/rook/rook/pkg/operator/k8sutil/cmdreporter"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batch "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	kfake "k8s.io/client-go/kubernetes/fake"
+)
+
+const rke2Mounts = `overlay / overlay rw,relatime 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+/dev/sda1 /var/lib/rancher/rke2/agent/kubelet ext4 rw,relatime 0 0
+tmpfs /var/lib/rancher/rke2/agent/kubelet/pods/0b4c6f6e-5d3a-4a0e-9a8f-0f2b0d9e7c1a/volumes/kubernetes.io~projected/kube-api-access-abcde tmpfs rw,relatime,size=16384k 0 0
+`
+
+type fakeCmdReporter struct {
+	job     *batch.Job
+	stdout  string
+	retcode int
+	err     error
+}
+
+func (f *fakeCmdReporter) Job() *batch.Job {
+	return f.job
+}
+
+func (f *fakeCmdReporter) Run(ctx context.Context, timeout time.Duration) (string, string, int, error) {
+	return f.stdout, "", f.retcode, f.err
+}
+
+func mockNewCmdReporter(reporter *fakeCmdReporter) func(clientset kubernetes.Interface, ownerInfo *k8sutil.OwnerInfo, appName, jobName, jobNamespace string, cmd, args []string, rookImage, runImage string, imagePullPolicy corev1.PullPolicy, resources cephv1.ResourceSpec) (cmdreporter.CmdReporterInterface, error) {
+	return func(clientset kubernetes.Interface, ownerInfo *k8sutil.OwnerInfo, appName, jobName, jobNamespace string, cmd, args []string, rookImage, runImage string, imagePullPolicy corev1.PullPolicy, resources cephv1.ResourceSpec) (cmdreporter.CmdReporterInterface, error) {
+		job, err := cmdreporter.MockCmdReporterJob(clientset, ownerInfo, appName, jobName, jobNamespace, cmd, args, rookImage, runImage, imagePullPolicy, resources)
+		reporter.job = job
+		return reporter, err
+	}
+}
+
+func TestParseKubeletDirPath(t *testing.T) {
+	dir, err := parseKubeletDirPath(rke2Mounts)
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/lib/rancher/rke2/agent/kubelet", dir)
+
+	dir, err = parseKubeletDirPath("tmpfs /var/lib/kubelet/pods/uid/volumes/kubernetes.io~secret/foo tmpfs rw 0 0\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/lib/kubelet", dir)
+
+	_, err = parseKubeletDirPath("overlay / overlay rw,relatime 0 0\ntmpfs /run/pods/foo tmpfs rw 0 0\n")
+	assert.Error(t, err)
+}
+
+func TestDetectKubeletDirPath(t *testing.T) {
+	oldNewCmdReporter, oldDetected, oldBackoff, oldRetry := newCmdReporter, detectedKubeletDirPath, detectKubeletDirPathBackoff, detectKubeletDirPathRetry
+	defer func() {
+		newCmdReporter, detectedKubeletDirPath, detectKubeletDirPathBackoff, detectKubeletDirPathRetry = oldNewCmdReporter, oldDetected, oldBackoff, oldRetry
+	}()
+
+	ownerInfo := k8sutil.NewOwnerInfoWithOwnerRef(&metav1.OwnerReference{}, "rook-ceph")
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: kfake.NewSimpleClientset()},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: "rook-ceph", Image: "rook/ceph:master", ServiceAccount: "rook-ceph-system"},
+	}
+
+	t.Run("detected from the job output and cached", func(t *testing.T) {
+		detectedKubeletDirPath, detectKubeletDirPathBackoff, detectKubeletDirPathRetry = "", 0, time.Time{}
+		reporter := &fakeCmdReporter{stdout: rke2Mounts}
+		newCmdReporter = mockNewCmdReporter(reporter)
+		assert.Equal(t, "/var/lib/rancher/rke2/agent/kubelet", r.getKubeletDirPath(ownerInfo))
+		assert.True(t, reporter.job.Spec.Template.Spec.HostPID)
+		assert.Equal(t, "rook-ceph-system", reporter.job.Spec.Template.Spec.ServiceAccountName)
+
+		reporter.stdout = ""
+		assert.Equal(t, "/var/lib/rancher/rke2/agent/kubelet", r.getKubeletDirPath(ownerInfo))
+	})
+
+	t.Run("failed job falls back to the default", func(t *testing.T) {
+		detectedKubeletDirPath = ""
+		newCmdReporter = mockNewCmdReporter(&fakeCmdReporter{retcode: 1})
+		assert.Equal(t, DefaultKubeletDirPath, r.getKubeletDirPath(ownerInfo))
+		assert.Empty(t, detectedKubeletDirPath)
+		assert.Equal(t, detectKubeletDirPathMinBackoff, detectKubeletDirPathBackoff)
+	})
+
+	t.Run("failure is retried after the backoff", func(t *testing.T) {
+		// the job is not run again before the retry time
+		calls := 0
+		newCmdReporter = func(clientset kubernetes.Interface, ownerInfo *k8sutil.OwnerInfo, appName, jobName, jobNamespace string, cmd, args []string, rookImage, runImage string, imagePullPolicy corev1.PullPolicy, resources cephv1.ResourceSpec) (cmdreporter.CmdReporterInterface, error) {
+			calls++
+			return mockNewCmdReporter(&fakeCmdReporter{retcode: 1})(clientset, ownerInfo, appName, jobName, jobNamespace, cmd, args, rookImage, runImage, imagePullPolicy, resources)
+		}
+		assert.Equal(t, DefaultKubeletDirPath, r.getKubeletDirPath(ownerInfo))
+		assert.Equal(t, 0, calls)
+
+		// the backoff doubles on each failure
+		detectKubeletDirPathRetry = time.Time{}
+		assert.Equal(t, DefaultKubeletDirPath, r.getKubeletDirPath(ownerInfo))
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, 2*detectKubeletDirPathMinBackoff, detectKubeletDirPathBackoff)
+
+		// and is reset once the detection succeeds
+		detectKubeletDirPathRetry = time.Time{}
+		newCmdReporter = mockNewCmdReporter(&fakeCmdReporter{stdout: rke2Mounts})
+		assert.Equal(t, "/var/lib/rancher/rke2/agent/kubelet", r.getKubeletDirPath(ownerInfo))
+		assert.Equal(t, time.Duration(0), detectKubeletDirPathBackoff)
+	})
+
+	t.Run("path of the deployed plugins is kept after a restart", func(t *testing.T) {
+		plugin := func(kubeletDirPath string) *appsv1.DaemonSet {
+			ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: CsiRBDPlugin, Namespace: "rook-ceph"}}
+			ds.Spec.Template.Spec.Volumes = []corev1.Volume{{
+				Name:         kubeletPodsMountVolume,
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: kubeletDirPath + "/pods"}},
+			}}
+			return ds
+		}
+		calls := 0
+		newCmdReporter = func(clientset kubernetes.Interface, ownerInfo *k8sutil.OwnerInfo, appName, jobName, jobNamespace string, cmd, args []string, rookImage, runImage string, imagePullPolicy corev1.PullPolicy, resources cephv1.ResourceSpec) (cmdreporter.CmdReporterInterface, error) {
+			calls++
+			return mockNewCmdReporter(&fakeCmdReporter{retcode: 1})(clientset, ownerInfo, appName, jobName, jobNamespace, cmd, args, rookImage, runImage, imagePullPolicy, resources)
+		}
+
+		// the detection is not run again for a path other than the default
+		detectedKubeletDirPath, detectKubeletDirPathBackoff, detectKubeletDirPathRetry = "", 0, time.Time{}
+		restarted := &ReconcileCSI{context: &clusterd.Context{Clientset: kfake.NewSimpleClientset(plugin("/var/lib/rancher/rke2/agent/kubelet"))}, opManagerContext: context.TODO(), opConfig: r.opConfig}
+		assert.Equal(t, "/var/lib/rancher/rke2/agent/kubelet", restarted.getKubeletDirPath(ownerInfo))
+		assert.Equal(t, 0, calls)
+
+		// the default path is detected again in case the previous detection failed
+		detectedKubeletDirPath = ""
+		restarted = &ReconcileCSI{context: &clusterd.Context{Clientset: kfake.NewSimpleClientset(plugin(DefaultKubeletDirPath))}, opManagerContext: context.TODO(), opConfig: r.opConfig}
+		assert.Equal(t, DefaultKubeletDirPath, restarted.getKubeletDirPath(ownerInfo))
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("configured path skips the detection", func(t *testing.T) {
+		detectedKubeletDirPath = ""
+		newCmdReporter = mockNewCmdReporter(&fakeCmdReporter{stdout: rke2Mounts})
+		r.opConfig.Parameters = map[string]string{kubeletDirPathEnv: "/opt/kubelet"}
+		assert.Equal(t, "/opt/kubelet", r.getKubeletDirPath(ownerInfo))
+		assert.Empty(t, detectedKubeletDirPath)
+	})
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/pkg/errors"
 	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
 	cephclient "github.com/rook/rook/pkg/daemon/ceph/client"
+	"github.com/rook/rook/pkg/operator/k8sutil"
 	v1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	k8scsiv1 "k8s.io/api/storage/v1"
@@ -190,6 +191,12 @@ func (r *ReconcileCSI) createOrUpdateNFSDriverResource(cluster cephv1.CephCluste
 		Spec: spec,
 	}
 
+	// the nfs mounts apply the group ownership with the File policy by default, like the rook
+	// managed nfs driver
+	NFSDriver.Spec.FsGroupPolicy = k8scsiv1.FSGroupPolicy(k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_FSGROUPPOLICY", string(k8scsiv1.FileFSGroupPolicy)))
+	nfsAttachRequired := CSIParam.NFSAttachRequired
+	NFSDriver.Spec.AttachRequired = &nfsAttachRequired
+
 	NFSDriver.Spec.ControllerPlugin.Resources = createDriverControllerPluginResources(r.opConfig.Parameters, nfsPluginResource)
 
 	NFSDriver.Spec.NodePlugin.Resources = createDriverNodePluginResouces(r.opConfig.Parameters, nfsProvisionerResource)
@@ -105,3 +105,42 @@ func TestReconcileCSI_createOrUpdateDriverResources(t *testing.T) {
 	err = cl.Get(context.TODO(), types.NamespacedName{Name: fmt.Sprintf("%s.nfs.csi.ceph.com", c.Namespace), Namespace: ns}, driver)
 	assert.NoError(t, err)
 }
+
+func TestNFSDriverResourceSettings(t *testing.T) {
+	origParam := CSIParam
+	defer func() { CSIParam = origParam }()
+
+	cluster := &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "testCluster", Namespace: "test"}}
+	s := scheme.Scheme
+	s.AddKnownTypes(cephv1.SchemeGroupVersion, &csiopv1a1.Driver{}, &cephv1.CephCluster{}, &v1.ConfigMap{})
+	c := clienttest.CreateTestClusterInfo(3)
+	c.Namespace = "test"
+
+	for _, policy := range []string{"", "File", "ReadWriteOnceWithFSType", "None"} {
+		for _, attachRequired := range []bool{true, false} {
+			r := &ReconcileCSI{
+				context:          &clusterd.Context{Clientset: testop.New(t, 1), RookClientset: rookclient.NewSimpleClientset()},
+				opManagerContext: context.TODO(),
+				opConfig:         opcontroller.OperatorConfig{OperatorNamespace: "test", Parameters: map[string]string{}},
+				client:           fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(cluster).Build(),
+			}
+			if policy != "" {
+				r.opConfig.Parameters["CSI_NFS_FSGROUPPOLICY"] = policy
+			}
+			CSIParam.NFSAttachRequired = attachRequired
+
+			err := r.createOrUpdateNFSDriverResource(*cluster, c)
+			assert.NoError(t, err)
+			driver := &csiopv1a1.Driver{}
+			err = r.client.Get(context.TODO(), types.NamespacedName{Name: "test.nfs.csi.ceph.com", Namespace: "test"}, driver)
+			assert.NoError(t, err)
+
+			expectedPolicy := policy
+			if policy == "" {
+				expectedPolicy = "File"
+			}
+			assert.Equal(t, expectedPolicy, string(driver.Spec.FsGroupPolicy), policy)
+			assert.Equal(t, attachRequired, *driver.Spec.AttachRequired, policy)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	policyv1 "k8s.io/api/policy/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+func provisionerPDBName(deployment string) string {
+	return deployment + "-pdb"
+}
+
+// createOrUpdateProvisionerPDB makes sure at most one pod of the provisioner deployment is
+// evicted at a time during voluntary disruptions such as node drains. Only policy/v1 is used since
+// all the supported kubernetes versions serve it.
+func createOrUpdateProvisionerPDB(ctx context.Context, clientset kubernetes.Interface, namespace, deployment string, ownerInfo *k8sutil.OwnerInfo) error {
+	maxUnavailable := intstr.FromInt(1)
+	pdb := &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      provisionerPDBName(deployment),
+			Namespace: namespace,
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": deployment},
+			},
+		},
+	}
+	err := ownerInfo.SetControllerReference(pdb)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set owner reference to pdb %q", pdb.Name)
+	}
+
+	existing, err := clientset.PolicyV1().PodDisruptionBudgets(namespace).Get(ctx, pdb.Name, metav1.GetOptions{})
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to get pdb %q", pdb.Name)
+		}
+		_, err = clientset.PolicyV1().PodDisruptionBudgets(namespace).Create(ctx, pdb, metav1.CreateOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "failed to create pdb %q", pdb.Name)
+		}
+		logger.Infof("created pdb %q", pdb.Name)
+		return nil
+	}
+
+	pdb.ResourceVersion = existing.ResourceVersion
+	_, err = clientset.PolicyV1().PodDisruptionBudgets(namespace).Update(ctx, pdb, metav1.UpdateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to update pdb %q", pdb.Name)
+	}
+	return nil
+}
+
+func deleteProvisionerPDB(ctx context.Context, clientset kubernetes.Interface, namespace, deployment string) error {
+	name := provisionerPDBName(deployment)
+	err := clientset.PolicyV1().PodDisruptionBudgets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete pdb %q", name)
+	}
+	return nil
+}
+
+// reconcileProvisionerPDB creates the pdb of the provisioner deployment if enabled and the deployment
+// runs more than one replica, or removes it. A pdb on a single replica would block node drains.
+func (r *ReconcileCSI) reconcileProvisionerPDB(deployment string, ownerInfo *k8sutil.OwnerInfo) error {
+	if CSIParam.EnableProvisionerPDB && CSIParam.ProvisionerReplicas > 1 {
+		return createOrUpdateProvisionerPDB(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, deployment, ownerInfo)
+	}
+	return deleteProvisionerPDB(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, deployment)
+}
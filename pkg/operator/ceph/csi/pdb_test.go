@@ -0,0 +1,95 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestProvisionerPDB(t *testing.T) {
+	ctx := context.TODO()
+	namespace := "rook-ceph"
+	clientset := fake.NewSimpleClientset()
+	ownerRef := &metav1.OwnerReference{Name: "rook-ceph-operator", Kind: "Deployment", APIVersion: "apps/v1", UID: "123"}
+	ownerInfo := k8sutil.NewOwnerInfoWithOwnerRef(ownerRef, namespace)
+
+	err := createOrUpdateProvisionerPDB(ctx, clientset, namespace, csiRBDProvisioner, ownerInfo)
+	assert.NoError(t, err)
+	pdb, err := clientset.PolicyV1().PodDisruptionBudgets(namespace).Get(ctx, "csi-rbdplugin-provisioner-pdb", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pdb.Spec.MaxUnavailable.IntValue())
+	assert.Nil(t, pdb.Spec.MinAvailable)
+	assert.Equal(t, map[string]string{"app": csiRBDProvisioner}, pdb.Spec.Selector.MatchLabels)
+	assert.Len(t, pdb.OwnerReferences, 1)
+
+	// updating an existing pdb succeeds
+	err = createOrUpdateProvisionerPDB(ctx, clientset, namespace, csiRBDProvisioner, ownerInfo)
+	assert.NoError(t, err)
+
+	err = deleteProvisionerPDB(ctx, clientset, namespace, csiRBDProvisioner)
+	assert.NoError(t, err)
+	_, err = clientset.PolicyV1().PodDisruptionBudgets(namespace).Get(ctx, "csi-rbdplugin-provisioner-pdb", metav1.GetOptions{})
+	assert.Error(t, err)
+
+	// deleting a missing pdb is not an error
+	err = deleteProvisionerPDB(ctx, clientset, namespace, csiRBDProvisioner)
+	assert.NoError(t, err)
+}
+
+func TestReconcileProvisionerPDB(t *testing.T) {
+	origParam := CSIParam
+	defer func() { CSIParam = origParam }()
+
+	namespace := "rook-ceph"
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: fake.NewSimpleClientset()},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+	}
+	ownerRef := &metav1.OwnerReference{Name: "rook-ceph-operator", Kind: "Deployment", APIVersion: "apps/v1", UID: "123"}
+	ownerInfo := k8sutil.NewOwnerInfoWithOwnerRef(ownerRef, namespace)
+	pdbExists := func() bool {
+		_, err := r.context.Clientset.PolicyV1().PodDisruptionBudgets(namespace).Get(context.TODO(), "csi-rbdplugin-provisioner-pdb", metav1.GetOptions{})
+		return err == nil
+	}
+
+	CSIParam.EnableProvisionerPDB = true
+	CSIParam.ProvisionerReplicas = 2
+	assert.NoError(t, r.reconcileProvisionerPDB(csiRBDProvisioner, ownerInfo))
+	assert.True(t, pdbExists())
+
+	// a single replica must not be protected, or node drains would hang
+	CSIParam.ProvisionerReplicas = 1
+	assert.NoError(t, r.reconcileProvisionerPDB(csiRBDProvisioner, ownerInfo))
+	assert.False(t, pdbExists())
+
+	CSIParam.ProvisionerReplicas = 2
+	assert.NoError(t, r.reconcileProvisionerPDB(csiRBDProvisioner, ownerInfo))
+	assert.True(t, pdbExists())
+
+	CSIParam.EnableProvisionerPDB = false
+	assert.NoError(t, r.reconcileProvisionerPDB(csiRBDProvisioner, ownerInfo))
+	assert.False(t, pdbExists())
+}
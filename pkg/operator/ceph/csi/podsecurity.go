@@ -0,0 +1,135 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+	opcontroller "github.com/rook/rook/pkg/operator/ceph/controller"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// restrictedPSASetting is the setting rendering the provisioner pods for the restricted
+// PodSecurity level
+const restrictedPSASetting = "CSI_ENABLE_RESTRICTED_PSA"
+
+// cephCSIContainers are the containers running the cephcsi image, the other containers of the
+// provisioner pods are sidecars which can run with a read-only root filesystem
+var cephCSIContainers = []string{"csi-rbdplugin", "csi-cephfsplugin", "csi-nfsplugin", "csi-addons"}
+
+// validateRestrictedPSA returns why the provisioner pods cannot be rendered for the restricted
+// PodSecurity level with the given parameters
+func validateRestrictedPSA(p Param) []error {
+	var errs []error
+
+	if p.CSILogRotation {
+		errs = append(errs, errors.Errorf("csi log rotation of the cephcluster log collector writes the logs to a host path and cannot be used with %s", restrictedPSASetting))
+	}
+	if opcontroller.EnforceHostNetwork() {
+		errs = append(errs, errors.Errorf("the host network is enforced for all the pods and cannot be used with %s", restrictedPSASetting))
+	}
+
+	// only the cephcsi releases at least as new as the default image are known to run the
+	// provisioner without root, older ones may require root in the provisioner path
+	minVersion, err := imageTagVersion(DefaultCSIPluginImage)
+	if err != nil {
+		return append(errs, errors.Wrap(err, "failed to parse the version of the default cephcsi image"))
+	}
+	images := map[string]bool{}
+	if EnableRBD {
+		images[p.RBDPluginImage] = true
+	}
+	if EnableCephFS {
+		images[p.CephFSPluginImage] = true
+	}
+	if EnableNFS {
+		images[p.NFSPluginImage] = true
+	}
+	for image := range images {
+		imageVersion, err := imageTagVersion(image)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to detect the cephcsi version required by %s", restrictedPSASetting))
+			continue
+		}
+		if !imageVersion.AtLeast(minVersion) {
+			errs = append(errs, errors.Errorf("cephcsi image %q requires root in the provisioner and cannot be used with %s, at least cephcsi %s is required", image, restrictedPSASetting, minVersion.String()))
+		}
+	}
+	return errs
+}
+
+// applyRestrictedPodSecurity makes the provisioner pod comply with the restricted PodSecurity
+// level. The host path volumes are not needed to provision volumes and are removed, and all the
+// containers run as the non-root ceph user without privileges.
+func applyRestrictedPodSecurity(podSpec *corev1.PodSpec) {
+	hostPathVolumes := []string{}
+	volumes := []corev1.Volume{}
+	for _, volume := range podSpec.Volumes {
+		if volume.HostPath != nil {
+			hostPathVolumes = append(hostPathVolumes, volume.Name)
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	podSpec.Volumes = volumes
+
+	runAsNonRoot := true
+	cephUserID := opcontroller.CephUserID
+	if podSpec.SecurityContext == nil {
+		podSpec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	podSpec.SecurityContext.RunAsNonRoot = &runAsNonRoot
+	podSpec.SecurityContext.RunAsUser = &cephUserID
+	podSpec.SecurityContext.RunAsGroup = &cephUserID
+	podSpec.SecurityContext.FSGroup = &cephUserID
+	// a localhost profile is allowed by the restricted level and kept
+	if podSpec.SecurityContext.SeccompProfile == nil || podSpec.SecurityContext.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+		podSpec.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	}
+
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		volumeMounts := []corev1.VolumeMount{}
+		for _, volumeMount := range container.VolumeMounts {
+			if !slices.Contains(hostPathVolumes, volumeMount.Name) {
+				volumeMounts = append(volumeMounts, volumeMount)
+			}
+		}
+		container.VolumeMounts = volumeMounts
+
+		privileged, allowPrivilegeEscalation := false, false
+		readOnlyRootFilesystem := !slices.Contains(cephCSIContainers, container.Name)
+		if container.SecurityContext == nil {
+			container.SecurityContext = &corev1.SecurityContext{}
+		}
+		container.SecurityContext.Privileged = &privileged
+		container.SecurityContext.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+		container.SecurityContext.RunAsNonRoot = &runAsNonRoot
+		if container.SecurityContext.RunAsUser != nil && *container.SecurityContext.RunAsUser == 0 {
+			container.SecurityContext.RunAsUser = nil
+		}
+		container.SecurityContext.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+		if readOnlyRootFilesystem {
+			container.SecurityContext.ReadOnlyRootFilesystem = &readOnlyRootFilesystem
+		}
+		// the container level profile overrides the pod one
+		if container.SecurityContext.SeccompProfile != nil && container.SecurityContext.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+			container.SecurityContext.SeccompProfile = nil
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	stderrors "errors"
+	"testing"
+
+	opcontroller "github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/stretchr/testify/assert"
+	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateRestrictedPSA(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+
+	p := Param{
+		RBDPluginImage:    DefaultCSIPluginImage,
+		CephFSPluginImage: DefaultCSIPluginImage,
+		// the nfs driver is disabled so its image is not checked
+		NFSPluginImage: "quay.io/cephcsi/cephcsi:v3.9.0",
+	}
+	assert.Empty(t, validateRestrictedPSA(p))
+
+	p.RBDPluginImage = "quay.io/cephcsi/cephcsi:v3.11.0"
+	p.CephFSPluginImage = "quay.io/cephcsi/cephcsi@sha256:0123456789abcdef"
+	p.CSILogRotation = true
+	errs := validateRestrictedPSA(p)
+	assert.Len(t, errs, 3)
+	assert.ErrorContains(t, errs[0], "log rotation")
+	assert.ErrorContains(t, stderrors.Join(errs...), `cephcsi image "quay.io/cephcsi/cephcsi:v3.11.0" requires root in the provisioner`)
+	assert.ErrorContains(t, stderrors.Join(errs...), "pinned by digest")
+
+	opcontroller.SetEnforceHostNetwork(map[string]string{"ROOK_ENFORCE_HOST_NETWORK": "true"})
+	defer opcontroller.SetEnforceHostNetwork(map[string]string{})
+	p = Param{RBDPluginImage: DefaultCSIPluginImage, CephFSPluginImage: DefaultCSIPluginImage}
+	errs = validateRestrictedPSA(p)
+	assert.Len(t, errs, 1)
+	assert.ErrorContains(t, errs[0], "host network")
+}
+
+func TestRestrictedPodSecurity(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	tp.EnableRestrictedPSA = true
+	result, err := renderCSIDrivers(tp, map[string]string{"CSI_PROVISIONER_SECCOMP_PROFILE": "Unconfined"})
+	assert.NoError(t, err)
+
+	for _, deployment := range []*apps.Deployment{result.RBDProvisioner, result.CephFSProvisioner, result.NFSProvisioner} {
+		podSpec := deployment.Spec.Template.Spec
+		assert.True(t, *podSpec.SecurityContext.RunAsNonRoot, deployment.Name)
+		assert.NotZero(t, *podSpec.SecurityContext.RunAsUser, deployment.Name)
+		assert.Equal(t, corev1.SeccompProfileTypeRuntimeDefault, podSpec.SecurityContext.SeccompProfile.Type, deployment.Name)
+		for _, volume := range podSpec.Volumes {
+			assert.Nil(t, volume.HostPath, volume.Name)
+		}
+		volumes := map[string]bool{}
+		for _, volume := range podSpec.Volumes {
+			volumes[volume.Name] = true
+		}
+		for _, container := range podSpec.Containers {
+			securityContext := container.SecurityContext
+			assert.False(t, *securityContext.Privileged, container.Name)
+			assert.False(t, *securityContext.AllowPrivilegeEscalation, container.Name)
+			assert.True(t, *securityContext.RunAsNonRoot, container.Name)
+			assert.Equal(t, []corev1.Capability{"ALL"}, securityContext.Capabilities.Drop, container.Name)
+			if container.Name == "csi-provisioner" || container.Name == "csi-attacher" {
+				assert.True(t, *securityContext.ReadOnlyRootFilesystem, container.Name)
+			}
+			for _, volumeMount := range container.VolumeMounts {
+				assert.True(t, volumes[volumeMount.Name], volumeMount.Name)
+			}
+		}
+	}
+
+	// the plugins keep running privileged for the mounts
+	for _, container := range result.RBDPlugin.Spec.Template.Spec.Containers {
+		if container.Name == "csi-rbdplugin" {
+			assert.True(t, *container.SecurityContext.Privileged)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package csi
 
 import (
 	"context"
+	"slices"
 
 	"github.com/google/go-cmp/cmp"
 	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
@@ -73,6 +74,12 @@ func predicateController(ctx context.Context, c client.Client, opNamespace strin
 		},
 
 		UpdateFunc: func(e event.UpdateEvent) bool {
+			// a deleted cephCluster waits for the csi cleanup, it is retried when the other
+			// finalizers of the cluster are removed
+			if cephCluster, ok := e.ObjectNew.(*cephv1.CephCluster); ok {
+				return !cephCluster.DeletionTimestamp.IsZero() && slices.Contains(cephCluster.Finalizers, csiCleanupFinalizer)
+			}
+
 			resourceQtyComparer := cmp.Comparer(func(x, y resource.Quantity) bool { return x.Cmp(y) == 0 })
 			if old, ok := e.ObjectOld.(*v1.ConfigMap); ok {
 				if new, ok := e.ObjectNew.(*v1.ConfigMap); ok {
@@ -82,6 +89,10 @@ func predicateController(ctx context.Context, c client.Client, opNamespace strin
 						if diff != "" {
 							return true
 						}
+						// pausing or resuming the csi reconcile only changes an annotation
+						if old.GetAnnotations()[csiReconcilePausedAnnotation] != new.GetAnnotations()[csiReconcilePausedAnnotation] {
+							return true
+						}
 					}
 				}
 			}
@@ -25,6 +25,7 @@ import (
 	"github.com/rook/rook/pkg/client/clientset/versioned/scheme"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/event"
@@ -96,6 +97,16 @@ func Test_predicateController(t *testing.T) {
 		assert.True(t, p.Update(u))
 	})
 
+	t.Run("update event is a CM and the csi reconcile is paused or resumed", func(t *testing.T) {
+		cm3 := cm2.DeepCopy()
+		cm3.Annotations = map[string]string{csiReconcilePausedAnnotation: "true"}
+		u = event.UpdateEvent{ObjectOld: &cm2, ObjectNew: cm3}
+		p = predicateController(context.TODO(), client, "rook-ceph")
+		assert.True(t, p.Update(u))
+		u = event.UpdateEvent{ObjectOld: cm3, ObjectNew: &cm2}
+		assert.True(t, p.Update(u))
+	})
+
 	t.Run("create event is a CephCluster and it's the first instance and a cm is present", func(t *testing.T) {
 		cm.Namespace = "rook-ceph"
 		err := client.Create(context.TODO(), &cm)
@@ -136,4 +147,21 @@ func Test_predicateController(t *testing.T) {
 		p = predicateController(context.TODO(), client, "rook-ceph")
 		assert.False(t, p.Create(c))
 	})
+
+	t.Run("update event is a CephCluster waiting for the csi cleanup", func(t *testing.T) {
+		p = predicateController(context.TODO(), client, "rook-ceph")
+		old := &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "ceph1", Finalizers: []string{"cephcluster.ceph.rook.io", csiCleanupFinalizer}}}
+		updated := old.DeepCopy()
+		u = event.UpdateEvent{ObjectOld: old, ObjectNew: updated}
+		assert.False(t, p.Update(u))
+
+		now := metav1.Now()
+		updated.DeletionTimestamp = &now
+		updated.Finalizers = []string{csiCleanupFinalizer}
+		assert.True(t, p.Update(u))
+
+		// the cleanup is done
+		updated.Finalizers = []string{"cephcluster.ceph.rook.io"}
+		assert.False(t, p.Update(u))
+	})
 }
@@ -0,0 +1,93 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+// kubeMinVerForSnapshot is the first kubernetes version serving the v1 volume snapshot API that
+// the snapshotter sidecars use
+var kubeMinVerForSnapshot = version.MustParseSemantic("1.20.0")
+
+// csiClusterRoles returns the cluster roles the service accounts of the enabled drivers are bound to
+func csiClusterRoles() []string {
+	clusterRoles := []string{}
+	if EnableRBD {
+		clusterRoles = append(clusterRoles, "rbd-csi-nodeplugin", "rbd-external-provisioner-runner")
+	}
+	if EnableCephFS {
+		clusterRoles = append(clusterRoles, "cephfs-csi-nodeplugin", "cephfs-external-provisioner-runner")
+	}
+	if EnableNFS {
+		clusterRoles = append(clusterRoles, "ceph-nfs-csi-nodeplugin", "ceph-nfs-external-provisioner-runner")
+	}
+	return clusterRoles
+}
+
+// PreflightChecks validates the prerequisites of the csi drivers before any of their resources is
+// created, so that a missing prerequisite does not leave the drivers partially deployed. All the
+// failed checks are returned so they can be fixed at once.
+func PreflightChecks(ctx context.Context, clientset kubernetes.Interface, namespace string, p Param) []error {
+	var errs []error
+
+	k8sVersion, err := k8sutil.GetK8SVersion(clientset)
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "failed to get the kubernetes version"))
+	} else if !k8sVersion.AtLeast(kubeMinVerForSnapshot) {
+		errs = append(errs, errors.Errorf("kubernetes version %q is older than the minimum version %q required by the csi drivers", k8sVersion.String(), kubeMinVerForSnapshot.String()))
+	}
+
+	for _, name := range csiClusterRoles() {
+		_, err := clientset.RbacV1().ClusterRoles().Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if kerrors.IsForbidden(err) {
+			// the operator rbac may not be updated yet, so the cluster roles cannot be checked
+			logger.Debugf("not allowed to check that the csi cluster role %q exists. %v", name, err)
+			continue
+		}
+		if kerrors.IsNotFound(err) {
+			errs = append(errs, errors.Errorf("csi cluster role %q not found", name))
+			continue
+		}
+		errs = append(errs, errors.Wrapf(err, "failed to get csi cluster role %q", name))
+	}
+
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Get(ctx, ConfigName, metav1.GetOptions{})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			errs = append(errs, errors.Errorf("csi config map %q not found", ConfigName))
+		} else {
+			errs = append(errs, errors.Wrapf(err, "failed to get csi config map %q", ConfigName))
+		}
+	}
+
+	if p.KubeletDirPath == "" {
+		errs = append(errs, errors.Errorf("kubelet dir path must not be empty, set %s", kubeletDirPathEnv))
+	}
+
+	return errs
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rook/rook/pkg/operator/test"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// createCSIClusterRoles creates the cluster roles of all the drivers checked by the preflight checks
+func createCSIClusterRoles(t *testing.T, clientset kubernetes.Interface) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	for _, name := range csiClusterRoles() {
+		_, err := clientset.RbacV1().ClusterRoles().Create(context.TODO(), &rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: name}}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+}
+
+func TestPreflightChecks(t *testing.T) {
+	ctx := context.TODO()
+	namespace := "rook-ceph"
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+	p := Param{KubeletDirPath: DefaultKubeletDirPath}
+
+	t.Run("all prerequisites met", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: ConfigName, Namespace: namespace}})
+		test.SetFakeKubernetesVersion(clientset, "v1.30.0")
+		createCSIClusterRoles(t, clientset)
+		assert.Empty(t, PreflightChecks(ctx, clientset, namespace, p))
+	})
+
+	t.Run("all failures are reported", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		test.SetFakeKubernetesVersion(clientset, "v1.19.0")
+		errs := PreflightChecks(ctx, clientset, namespace, Param{})
+		// the version, the four rbd and cephfs cluster roles, the config map and the kubelet dir
+		assert.Len(t, errs, 7)
+		assert.ErrorContains(t, errs[0], `"1.19.0"`)
+		assert.ErrorContains(t, errs[1], `"rbd-csi-nodeplugin" not found`)
+		assert.ErrorContains(t, errs[5], ConfigName)
+		assert.ErrorContains(t, errs[6], kubeletDirPathEnv)
+	})
+
+	t.Run("nfs cluster roles are checked when nfs is enabled", func(t *testing.T) {
+		EnableRBD, EnableCephFS, EnableNFS = false, false, true
+		clientset := fake.NewSimpleClientset(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: ConfigName, Namespace: namespace}})
+		test.SetFakeKubernetesVersion(clientset, "v1.30.0")
+		errs := PreflightChecks(ctx, clientset, namespace, p)
+		assert.Len(t, errs, 2)
+		assert.ErrorContains(t, errs[0], "ceph-nfs-csi-nodeplugin")
+	})
+}
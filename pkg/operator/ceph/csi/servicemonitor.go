@@ -0,0 +1,212 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"k8s.io/apimachinery/pkg/api/equality"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	csiMetricsPortName       = "csi-http-metrics"
+	rbdMetricsServiceName    = "csi-rbdplugin-metrics"
+	cephFSMetricsServiceName = "csi-cephfsplugin-metrics"
+	nfsMetricsServiceName    = "csi-nfsplugin-metrics"
+)
+
+var (
+	serviceMonitorGVR = schema.GroupVersionResource{Group: "monitoring.coreos.com", Version: "v1", Resource: "servicemonitors"}
+
+	// newDynamicClient is a variable so it can be mocked in the tests
+	newDynamicClient = func(config *rest.Config) (dynamic.Interface, error) {
+		return dynamic.NewForConfig(config)
+	}
+)
+
+// serviceMonitorCRDExists checks if the prometheus operator ServiceMonitor CRD is installed
+func serviceMonitorCRDExists(discoveryClient discovery.DiscoveryInterface) (bool, error) {
+	resources, err := discoveryClient.ServerResourcesForGroupVersion(serviceMonitorGVR.GroupVersion().String())
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to discover the %q resources", serviceMonitorGVR.GroupVersion())
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == serviceMonitorGVR.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// csiServiceMonitor returns a ServiceMonitor scraping the csi metrics service of the same name
+func csiServiceMonitor(name, namespace string) *monitoringv1.ServiceMonitor {
+	serviceMonitor := k8sutil.GetServiceMonitor(name, namespace, csiMetricsPortName)
+	serviceMonitor.TypeMeta = metav1.TypeMeta{APIVersion: serviceMonitorGVR.GroupVersion().String(), Kind: monitoringv1.ServiceMonitorsKind}
+	serviceMonitor.Spec.Selector.MatchLabels = map[string]string{
+		"app":      "csi-metrics",
+		"contains": name,
+	}
+	return serviceMonitor
+}
+
+// serviceMonitorUpToDate returns whether the existing ServiceMonitor has the desired spec and labels.
+// Labels added by others are kept.
+func serviceMonitorUpToDate(existing *unstructured.Unstructured, desired *monitoringv1.ServiceMonitor) (bool, error) {
+	current := &monitoringv1.ServiceMonitor{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(existing.Object, current)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to convert service monitor %q", existing.GetName())
+	}
+	for key, value := range desired.Labels {
+		if current.Labels[key] != value {
+			return false, nil
+		}
+	}
+	return equality.Semantic.DeepEqual(current.Spec, desired.Spec), nil
+}
+
+// createCSIServiceMonitors creates a ServiceMonitor for the metrics service of each enabled driver,
+// or updates it when it differs from the desired one
+func createCSIServiceMonitors(ctx context.Context, dynamicClient dynamic.Interface, namespace string, tp templateParam) error {
+	for _, svc := range []struct {
+		enabled bool
+		name    string
+	}{
+		{EnableRBD, rbdMetricsServiceName},
+		{EnableCephFS, cephFSMetricsServiceName},
+		{EnableNFS, nfsMetricsServiceName},
+	} {
+		if !svc.enabled {
+			continue
+		}
+		serviceMonitors := dynamicClient.Resource(serviceMonitorGVR).Namespace(namespace)
+		desired := csiServiceMonitor(svc.name, namespace)
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+		if err != nil {
+			return errors.Wrapf(err, "failed to convert csi service monitor %q", svc.name)
+		}
+		serviceMonitor := &unstructured.Unstructured{Object: content}
+
+		existing, err := serviceMonitors.Get(ctx, svc.name, metav1.GetOptions{})
+		if err != nil {
+			if !kerrors.IsNotFound(err) {
+				return errors.Wrapf(err, "failed to get csi service monitor %q", svc.name)
+			}
+			_, err = serviceMonitors.Create(ctx, serviceMonitor, metav1.CreateOptions{})
+			if err != nil {
+				return errors.Wrapf(err, "failed to create csi service monitor %q", svc.name)
+			}
+			logger.Infof("created csi service monitor %q", svc.name)
+			continue
+		}
+		upToDate, err := serviceMonitorUpToDate(existing, desired)
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			continue
+		}
+		serviceMonitor.SetResourceVersion(existing.GetResourceVersion())
+		_, err = serviceMonitors.Update(ctx, serviceMonitor, metav1.UpdateOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "failed to update csi service monitor %q", svc.name)
+		}
+		logger.Infof("updated csi service monitor %q", svc.name)
+	}
+	return nil
+}
+
+// deleteCSIServiceMonitor deletes the ServiceMonitor of a csi metrics service if it exists
+func deleteCSIServiceMonitor(ctx context.Context, dynamicClient dynamic.Interface, namespace, name string) error {
+	err := dynamicClient.Resource(serviceMonitorGVR).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete csi service monitor %q", name)
+	}
+	return nil
+}
+
+// reconcileCSIServiceMonitors creates the ServiceMonitors of the csi metrics services when the
+// prometheus monitoring is enabled, otherwise removes them
+func (r *ReconcileCSI) reconcileCSIServiceMonitors(tp templateParam) error {
+	exists, err := serviceMonitorCRDExists(r.context.Clientset.Discovery())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if tp.EnableCSIPrometheusMonitoring {
+			logger.Warning("csi prometheus monitoring is enabled but the ServiceMonitor CRD is not installed, skipping")
+		}
+		return nil
+	}
+
+	dynamicClient, err := r.getDynamicClient()
+	if err != nil {
+		return err
+	}
+	if tp.EnableCSIPrometheusMonitoring && tp.EnableLiveness {
+		return createCSIServiceMonitors(r.opManagerContext, dynamicClient, r.opConfig.OperatorNamespace, tp)
+	}
+	for _, name := range []string{rbdMetricsServiceName, cephFSMetricsServiceName, nfsMetricsServiceName} {
+		err = deleteCSIServiceMonitor(r.opManagerContext, dynamicClient, r.opConfig.OperatorNamespace, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeCSIServiceMonitor removes the ServiceMonitor of a csi metrics service if the ServiceMonitor
+// CRD is installed
+func (r *ReconcileCSI) removeCSIServiceMonitor(name string) error {
+	exists, err := serviceMonitorCRDExists(r.context.Clientset.Discovery())
+	if err != nil || !exists {
+		return err
+	}
+	dynamicClient, err := r.getDynamicClient()
+	if err != nil {
+		return err
+	}
+	return deleteCSIServiceMonitor(r.opManagerContext, dynamicClient, r.opConfig.OperatorNamespace, name)
+}
+
+// getDynamicClient returns the dynamic client of the ServiceMonitors, created on first use and then
+// shared by the following reconciles
+func (r *ReconcileCSI) getDynamicClient() (dynamic.Interface, error) {
+	if r.dynamicClient != nil {
+		return r.dynamicClient, nil
+	}
+	dynamicClient, err := newDynamicClient(r.context.KubeConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	r.dynamicClient = dynamicClient
+	return dynamicClient, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{serviceMonitorGVR: "ServiceMonitorList"}, objects...)
+}
+
+func toUnstructured(t *testing.T, obj interface{}) *unstructured.Unstructured {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	assert.NoError(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
+
+func TestCreateCSIServiceMonitors(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, false, false
+
+	ctx := context.TODO()
+	namespace := "rook-ceph"
+	stale := csiServiceMonitor(rbdMetricsServiceName, namespace)
+	stale.Spec.JobLabel = "stale"
+	dynamicClient := newFakeDynamicClient(toUnstructured(t, stale))
+
+	err := createCSIServiceMonitors(ctx, dynamicClient, namespace, templateParam{})
+	assert.NoError(t, err)
+
+	serviceMonitors := dynamicClient.Resource(serviceMonitorGVR).Namespace(namespace)
+	list, err := serviceMonitors.List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, list.Items, 1)
+	// the existing service monitor is updated
+	assert.Equal(t, toUnstructured(t, csiServiceMonitor(rbdMetricsServiceName, namespace)).Object["spec"], list.Items[0].Object["spec"])
+
+	// the service monitor is not updated again when it is up to date
+	updates := func() int {
+		count := 0
+		for _, action := range dynamicClient.Actions() {
+			if action.GetVerb() == "update" {
+				count++
+			}
+		}
+		return count
+	}
+	assert.Equal(t, 1, updates())
+	err = createCSIServiceMonitors(ctx, dynamicClient, namespace, templateParam{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, updates())
+
+	// labels added by others do not trigger an update, a changed label does
+	sm, err := serviceMonitors.Get(ctx, rbdMetricsServiceName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	sm.SetLabels(map[string]string{"team": "rook", "extra": "label"})
+	_, err = serviceMonitors.Update(ctx, sm, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, createCSIServiceMonitors(ctx, dynamicClient, namespace, templateParam{}))
+	assert.Equal(t, 2, updates())
+	sm.SetLabels(map[string]string{"team": "other"})
+	_, err = serviceMonitors.Update(ctx, sm, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, createCSIServiceMonitors(ctx, dynamicClient, namespace, templateParam{}))
+	assert.Equal(t, 4, updates())
+
+	EnableCephFS = true
+	err = createCSIServiceMonitors(ctx, dynamicClient, namespace, templateParam{})
+	assert.NoError(t, err)
+	sm, err = serviceMonitors.Get(ctx, cephFSMetricsServiceName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	labels, _, _ := unstructured.NestedStringMap(sm.Object, "spec", "selector", "matchLabels")
+	assert.Equal(t, map[string]string{"app": "csi-metrics", "contains": cephFSMetricsServiceName}, labels)
+
+	err = deleteCSIServiceMonitor(ctx, dynamicClient, namespace, cephFSMetricsServiceName)
+	assert.NoError(t, err)
+	_, err = serviceMonitors.Get(ctx, cephFSMetricsServiceName, metav1.GetOptions{})
+	assert.Error(t, err)
+	// deleting a missing service monitor is not an error
+	err = deleteCSIServiceMonitor(ctx, dynamicClient, namespace, cephFSMetricsServiceName)
+	assert.NoError(t, err)
+}
+
+func TestReconcileCSIServiceMonitors(t *testing.T) {
+	origRBD, origCephFS, origNFS, origNewDynamicClient := EnableRBD, EnableCephFS, EnableNFS, newDynamicClient
+	defer func() {
+		EnableRBD, EnableCephFS, EnableNFS, newDynamicClient = origRBD, origCephFS, origNFS, origNewDynamicClient
+	}()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+
+	dynamicClient := newFakeDynamicClient()
+	newDynamicClient = func(config *rest.Config) (dynamic.Interface, error) { return dynamicClient, nil }
+
+	clientset := fake.NewSimpleClientset()
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: "rook-ceph"},
+	}
+	tp := templateParam{Param: Param{EnableLiveness: true, EnableCSIPrometheusMonitoring: true}}
+	serviceMonitors := dynamicClient.Resource(serviceMonitorGVR).Namespace("rook-ceph")
+
+	t.Run("crd not installed", func(t *testing.T) {
+		err := r.reconcileCSIServiceMonitors(tp)
+		assert.NoError(t, err)
+		list, err := serviceMonitors.List(context.TODO(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, list.Items)
+	})
+
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{GroupVersion: "monitoring.coreos.com/v1", APIResources: []metav1.APIResource{{Name: "servicemonitors"}}},
+	}
+
+	t.Run("monitoring enabled", func(t *testing.T) {
+		err := r.reconcileCSIServiceMonitors(tp)
+		assert.NoError(t, err)
+		list, err := serviceMonitors.List(context.TODO(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, list.Items, 2)
+	})
+
+	t.Run("monitoring disabled", func(t *testing.T) {
+		tp.EnableCSIPrometheusMonitoring = false
+		err := r.reconcileCSIServiceMonitors(tp)
+		assert.NoError(t, err)
+		list, err := serviceMonitors.List(context.TODO(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, list.Items)
+	})
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	stderrors "errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	opcontroller "github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	snapshotWebhookName = "csi-snapshot-validation-webhook"
+	// snapshotWebhookTLSSecretName is the secret of the self-signed certificate generated by the
+	// operator when no secret is given with CSI_SNAPSHOT_WEBHOOK_TLS_SECRET
+	snapshotWebhookTLSSecretName = "csi-snapshot-validation-webhook-tls"
+	snapshotWebhookPath          = "/volumesnapshot"
+
+	snapshotWebhookCertValidity    = 365 * 24 * time.Hour
+	snapshotWebhookCertRenewBefore = 30 * 24 * time.Hour
+)
+
+var snapshotWebhookMinK8sVersion = version.MustParseSemantic("1.17.0")
+
+// snapshotWebhookConfigName is namespaced since the webhook configuration is cluster scoped and
+// several operators may run in the same kubernetes cluster
+func snapshotWebhookConfigName(namespace string) string {
+	return fmt.Sprintf("%s.%s", snapshotWebhookName, namespace)
+}
+
+// generateSnapshotWebhookCert returns a self-signed certificate and its key in PEM format for the
+// service of the snapshot validation webhook. The certificate is also the CA bundle of the webhook.
+func generateSnapshotWebhookCert(namespace string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate private key")
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate serial number")
+	}
+
+	serviceName := fmt.Sprintf("%s.%s.svc", snapshotWebhookName, namespace)
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: serviceName},
+		DNSNames:              []string{snapshotWebhookName, fmt.Sprintf("%s.%s", snapshotWebhookName, namespace), serviceName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(snapshotWebhookCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create certificate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to marshal private key")
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// snapshotWebhookCertNeedsRenewal returns true if the certificate cannot be parsed or expires soon
+func snapshotWebhookCertNeedsRenewal(certPEM []byte) bool {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(snapshotWebhookCertRenewBefore).After(cert.NotAfter)
+}
+
+// reconcileSnapshotWebhookTLS makes sure the TLS secret of the webhook exists and returns the CA
+// bundle the api server uses to verify the webhook. A secret given by the user is used as is and
+// must contain "tls.crt" and "tls.key", and optionally "ca.crt" if the certificate is not self-signed.
+func (r *ReconcileCSI) reconcileSnapshotWebhookTLS(secretName string, ownerInfo *k8sutil.OwnerInfo) ([]byte, error) {
+	namespace := r.opConfig.OperatorNamespace
+	if secretName != "" {
+		secret, err := r.context.Clientset.CoreV1().Secrets(namespace).Get(r.opManagerContext, secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get snapshot validation webhook tls secret %q", secretName)
+		}
+		if caBundle, ok := secret.Data["ca.crt"]; ok && len(caBundle) > 0 {
+			return caBundle, nil
+		}
+		if len(secret.Data[corev1.TLSCertKey]) == 0 {
+			return nil, errors.Errorf("snapshot validation webhook tls secret %q has no %q", secretName, corev1.TLSCertKey)
+		}
+		return secret.Data[corev1.TLSCertKey], nil
+	}
+
+	secret, err := r.context.Clientset.CoreV1().Secrets(namespace).Get(r.opManagerContext, snapshotWebhookTLSSecretName, metav1.GetOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "failed to get snapshot validation webhook tls secret %q", snapshotWebhookTLSSecretName)
+	}
+	if err == nil && !snapshotWebhookCertNeedsRenewal(secret.Data[corev1.TLSCertKey]) {
+		return secret.Data[corev1.TLSCertKey], nil
+	}
+
+	logger.Infof("generating self-signed certificate for the csi snapshot validation webhook")
+	certPEM, keyPEM, err := generateSnapshotWebhookCert(namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate snapshot validation webhook certificate")
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshotWebhookTLSSecretName,
+			Namespace: namespace,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       certPEM,
+			corev1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+	err = ownerInfo.SetControllerReference(secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to set owner reference to secret %q", secret.Name)
+	}
+	_, err = k8sutil.CreateOrUpdateSecret(r.opManagerContext, r.context.Clientset, secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to save snapshot validation webhook tls secret %q", secret.Name)
+	}
+	return certPEM, nil
+}
+
+func snapshotValidationWebhookConfig(namespace string, caBundle []byte) *admissionregistrationv1.ValidatingWebhookConfiguration {
+	path := snapshotWebhookPath
+	// only reject invalid snapshots when the webhook is up, as the upstream deployment recommends
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	timeoutSeconds := int32(2)
+	scope := admissionregistrationv1.AllScopes
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: snapshotWebhookConfigName(namespace),
+		},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{
+				Name: "validation-webhook.snapshot.storage.k8s.io",
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{
+						Name:      snapshotWebhookName,
+						Namespace: namespace,
+						Path:      &path,
+					},
+					CABundle: caBundle,
+				},
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{"snapshot.storage.k8s.io"},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"volumesnapshots", "volumesnapshotcontents", "volumesnapshotclasses"},
+							Scope:       &scope,
+						},
+					},
+				},
+				FailurePolicy:           &failurePolicy,
+				SideEffects:             &sideEffects,
+				TimeoutSeconds:          &timeoutSeconds,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+		},
+	}
+}
+
+func createOrUpdateValidatingWebhookConfig(ctx context.Context, clientset kubernetes.Interface, config *admissionregistrationv1.ValidatingWebhookConfiguration) error {
+	client := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	existing, err := client.Get(ctx, config.Name, metav1.GetOptions{})
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to get validating webhook configuration %q", config.Name)
+		}
+		_, err = client.Create(ctx, config, metav1.CreateOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "failed to create validating webhook configuration %q", config.Name)
+		}
+		logger.Infof("created validating webhook configuration %q", config.Name)
+		return nil
+	}
+
+	config.ResourceVersion = existing.ResourceVersion
+	_, err = client.Update(ctx, config, metav1.UpdateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to update validating webhook configuration %q", config.Name)
+	}
+	return nil
+}
+
+// reconcileSnapshotValidationWebhook deploys the snapshot validation webhook of the external
+// snapshotter, which rejects invalid VolumeSnapshot objects
+func (r *ReconcileCSI) reconcileSnapshotValidationWebhook(tp templateParam, ownerInfo *k8sutil.OwnerInfo) error {
+	k8sVersion, err := k8sutil.GetK8SVersion(r.context.Clientset)
+	if err != nil {
+		return errors.Wrap(err, "failed to get kubernetes version")
+	}
+	if !k8sVersion.AtLeast(snapshotWebhookMinK8sVersion) {
+		logger.Warningf("not deploying the csi snapshot validation webhook, kubernetes %s or newer is required, running %s", snapshotWebhookMinK8sVersion, k8sVersion)
+		return nil
+	}
+
+	caBundle, err := r.reconcileSnapshotWebhookTLS(tp.SnapshotValidationWebhookTLSSecret, ownerInfo)
+	if err != nil {
+		return err
+	}
+	if tp.SnapshotValidationWebhookTLSSecret == "" {
+		tp.SnapshotValidationWebhookTLSSecret = snapshotWebhookTLSSecretName
+	}
+
+	deployment, err := templateToDeployment(snapshotWebhookName, SnapshotWebhookDepTemplatePath, tp)
+	if err != nil {
+		return errors.Wrap(err, "failed to load snapshot validation webhook deployment template")
+	}
+	deployment.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+	applyImagePullSecrets(&deployment.Spec.Template.Spec, getImagePullSecrets(tp.Param))
+	err = ownerInfo.SetControllerReference(deployment)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set owner reference to snapshot validation webhook deployment %q", deployment.Name)
+	}
+	_, err = k8sutil.CreateOrUpdateDeployment(r.opManagerContext, r.context.Clientset, deployment)
+	if err != nil {
+		return errors.Wrapf(err, "failed to start snapshot validation webhook deployment %q", deployment.Name)
+	}
+
+	service, err := templateToService(snapshotWebhookName, SnapshotWebhookServiceTemplatePath, tp)
+	if err != nil {
+		return errors.Wrap(err, "failed to load snapshot validation webhook service template")
+	}
+	err = ownerInfo.SetControllerReference(service)
+	if err != nil {
+		return errors.Wrapf(err, "failed to set owner reference to snapshot validation webhook service %q", service.Name)
+	}
+	_, err = k8sutil.CreateOrUpdateService(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, service)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create snapshot validation webhook service %q", service.Name)
+	}
+
+	// the webhook configuration is cluster scoped and cannot be owned by the operator deployment,
+	// it is removed explicitly when the webhook is disabled
+	err = createOrUpdateValidatingWebhookConfig(r.opManagerContext, r.context.Clientset, snapshotValidationWebhookConfig(r.opConfig.OperatorNamespace, caBundle))
+	if err != nil {
+		return err
+	}
+	logger.Info("successfully started csi snapshot validation webhook")
+	return nil
+}
+
+// deleteSnapshotValidationWebhook removes all the resources of the snapshot validation webhook,
+// except a tls secret given by the user
+func (r *ReconcileCSI) deleteSnapshotValidationWebhook() error {
+	namespace := r.opConfig.OperatorNamespace
+	var errs []error
+
+	err := r.context.Clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Delete(r.opManagerContext, snapshotWebhookConfigName(namespace), metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		errs = append(errs, errors.Wrapf(err, "failed to delete validating webhook configuration %q", snapshotWebhookConfigName(namespace)))
+	}
+	err = k8sutil.DeleteDeployment(r.opManagerContext, r.context.Clientset, namespace, snapshotWebhookName)
+	if err != nil {
+		errs = append(errs, errors.Wrapf(err, "failed to delete the %q", snapshotWebhookName))
+	}
+	err = k8sutil.DeleteService(r.opManagerContext, r.context.Clientset, namespace, snapshotWebhookName)
+	if err != nil {
+		errs = append(errs, errors.Wrapf(err, "failed to delete the %q", snapshotWebhookName))
+	}
+	err = r.context.Clientset.CoreV1().Secrets(namespace).Delete(r.opManagerContext, snapshotWebhookTLSSecretName, metav1.DeleteOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		errs = append(errs, errors.Wrapf(err, "failed to delete secret %q", snapshotWebhookTLSSecretName))
+	}
+	return stderrors.Join(errs...)
+}
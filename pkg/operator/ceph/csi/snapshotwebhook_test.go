@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGenerateSnapshotWebhookCert(t *testing.T) {
+	certPEM, keyPEM, err := generateSnapshotWebhookCert("rook-ceph")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, keyPEM)
+	assert.False(t, snapshotWebhookCertNeedsRenewal(certPEM))
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	assert.Contains(t, cert.DNSNames, "csi-snapshot-validation-webhook.rook-ceph.svc")
+
+	assert.True(t, snapshotWebhookCertNeedsRenewal(nil))
+	assert.True(t, snapshotWebhookCertNeedsRenewal([]byte("not a certificate")))
+}
+
+func TestSnapshotValidationWebhook(t *testing.T) {
+	ctx := context.TODO()
+	namespace := "rook-ceph"
+	newReconciler := func(gitVersion string, objects ...corev1.Secret) *ReconcileCSI {
+		clientset := fake.NewSimpleClientset()
+		for i := range objects {
+			_, err := clientset.CoreV1().Secrets(namespace).Create(ctx, &objects[i], metav1.CreateOptions{})
+			assert.NoError(t, err)
+		}
+		clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: gitVersion}
+		return &ReconcileCSI{
+			context:          &clusterd.Context{Clientset: clientset},
+			opManagerContext: ctx,
+			opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+		}
+	}
+	ownerRef := &metav1.OwnerReference{Name: "rook-ceph-operator", Kind: "Deployment", APIVersion: "apps/v1", UID: "123"}
+	ownerInfo := k8sutil.NewOwnerInfoWithOwnerRef(ownerRef, namespace)
+	tp := templateParam{
+		Param: Param{
+			EnableSnapshotValidationWebhook: true,
+			SnapshotValidationWebhookImage:  "webhook-image",
+			ImagePullPolicy:                 "IfNotPresent",
+		},
+		Namespace: namespace,
+	}
+
+	t.Run("self-signed certificate", func(t *testing.T) {
+		r := newReconciler("v1.30.0")
+		err := r.reconcileSnapshotValidationWebhook(tp, ownerInfo)
+		assert.NoError(t, err)
+
+		secret, err := r.context.Clientset.CoreV1().Secrets(namespace).Get(ctx, snapshotWebhookTLSSecretName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		deployment, err := r.context.Clientset.AppsV1().Deployments(namespace).Get(ctx, snapshotWebhookName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "webhook-image", deployment.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, snapshotWebhookTLSSecretName, deployment.Spec.Template.Spec.Volumes[0].Secret.SecretName)
+		_, err = r.context.Clientset.CoreV1().Services(namespace).Get(ctx, snapshotWebhookName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		config, err := r.context.Clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, snapshotWebhookConfigName(namespace), metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data[corev1.TLSCertKey], config.Webhooks[0].ClientConfig.CABundle)
+
+		// the certificate is kept as long as it is valid
+		err = r.reconcileSnapshotValidationWebhook(tp, ownerInfo)
+		assert.NoError(t, err)
+		kept, err := r.context.Clientset.CoreV1().Secrets(namespace).Get(ctx, snapshotWebhookTLSSecretName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Data, kept.Data)
+
+		err = r.deleteSnapshotValidationWebhook()
+		assert.NoError(t, err)
+		_, err = r.context.Clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, snapshotWebhookConfigName(namespace), metav1.GetOptions{})
+		assert.Error(t, err)
+		_, err = r.context.Clientset.CoreV1().Secrets(namespace).Get(ctx, snapshotWebhookTLSSecretName, metav1.GetOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("user provided secret", func(t *testing.T) {
+		userSecret := corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-webhook-tls", Namespace: namespace},
+			Data:       map[string][]byte{"tls.crt": []byte("cert"), "tls.key": []byte("key"), "ca.crt": []byte("ca")},
+		}
+		r := newReconciler("v1.30.0", userSecret)
+		userTP := tp
+		userTP.SnapshotValidationWebhookTLSSecret = "my-webhook-tls"
+		err := r.reconcileSnapshotValidationWebhook(userTP, ownerInfo)
+		assert.NoError(t, err)
+
+		_, err = r.context.Clientset.CoreV1().Secrets(namespace).Get(ctx, snapshotWebhookTLSSecretName, metav1.GetOptions{})
+		assert.Error(t, err)
+		deployment, err := r.context.Clientset.AppsV1().Deployments(namespace).Get(ctx, snapshotWebhookName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "my-webhook-tls", deployment.Spec.Template.Spec.Volumes[0].Secret.SecretName)
+		config, err := r.context.Clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, snapshotWebhookConfigName(namespace), metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ca"), config.Webhooks[0].ClientConfig.CABundle)
+
+		// the user secret is not removed with the webhook
+		err = r.deleteSnapshotValidationWebhook()
+		assert.NoError(t, err)
+		_, err = r.context.Clientset.CoreV1().Secrets(namespace).Get(ctx, "my-webhook-tls", metav1.GetOptions{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("missing user provided secret", func(t *testing.T) {
+		r := newReconciler("v1.30.0")
+		userTP := tp
+		userTP.SnapshotValidationWebhookTLSSecret = "my-webhook-tls"
+		err := r.reconcileSnapshotValidationWebhook(userTP, ownerInfo)
+		assert.Error(t, err)
+	})
+
+	t.Run("kubernetes too old", func(t *testing.T) {
+		r := newReconciler("v1.16.0")
+		err := r.reconcileSnapshotValidationWebhook(tp, ownerInfo)
+		assert.NoError(t, err)
+		_, err = r.context.Clientset.AppsV1().Deployments(namespace).Get(ctx, snapshotWebhookName, metav1.GetOptions{})
+		assert.Error(t, err)
+	})
+}
@@ -18,14 +18,23 @@ package csi
 
 import (
 	"context"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"maps"
+	"os"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	opcontroller "github.com/rook/rook/pkg/operator/ceph/controller"
 	"github.com/rook/rook/pkg/operator/k8sutil"
+	rookversion "github.com/rook/rook/pkg/version"
 
 	"github.com/pkg/errors"
 	apps "k8s.io/api/apps/v1"
@@ -33,11 +42,16 @@ import (
 	k8scsi "k8s.io/api/storage/v1beta1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 )
 
 type Param struct {
 	CSIPluginImage                           string
+	RBDPluginImage                           string
+	CephFSPluginImage                        string
+	NFSPluginImage                           string
 	RegistrarImage                           string
 	ProvisionerImage                         string
 	AttacherImage                            string
@@ -51,12 +65,26 @@ type Param struct {
 	CephFSPluginUpdateStrategy               string
 	CephFSPluginUpdateStrategyMaxUnavailable string
 	NFSPluginUpdateStrategy                  string
+	NFSPluginUpdateStrategyMaxUnavailable    string
 	RBDPluginUpdateStrategy                  string
 	RBDPluginUpdateStrategyMaxUnavailable    string
+	RBDPluginServiceAccount                  string
+	RBDProvisionerServiceAccount             string
+	CephFSPluginServiceAccount               string
+	CephFSProvisionerServiceAccount          string
+	NFSPluginServiceAccount                  string
+	NFSProvisionerServiceAccount             string
 	PluginPriorityClassName                  string
+	RBDPluginPriorityClassName               string
+	CephFSPluginPriorityClassName            string
+	NFSPluginPriorityClassName               string
 	ProvisionerPriorityClassName             string
+	PluginRuntimeClassName                   string
+	ProvisionerRuntimeClassName              string
 	VolumeReplicationImage                   string
 	CSIAddonsImage                           string
+	SnapshotValidationWebhookImage           string
+	SnapshotValidationWebhookTLSSecret       string
 	ImagePullPolicy                          string
 	CSIClusterName                           string
 	CSIDomainLabels                          string
@@ -64,6 +92,10 @@ type Param struct {
 	CSIEnableMetadata                        bool
 	EnablePluginSelinuxHostMount             bool
 	EnableCSIHostNetwork                     bool
+	EnableRBDHostNetwork                     bool
+	EnableCephFSHostNetwork                  bool
+	EnableNFSHostNetwork                     bool
+	EnablePluginHostPID                      bool
 	EnableOMAPGenerator                      bool
 	EnableRBDSnapshotter                     bool
 	EnableCephFSSnapshotter                  bool
@@ -71,28 +103,64 @@ type Param struct {
 	EnableCSIAddonsSideCar                   bool
 	MountCustomCephConf                      bool
 	EnableCSIDriverSeLinuxMount              bool
+	EnableStorageCapacity                    bool
+	TokenProjectionAudience                  string
 	EnableCSIEncryption                      bool
 	EnableCSITopology                        bool
 	EnableLiveness                           bool
+	EnableCSIPrometheusMonitoring            bool
 	CephFSAttachRequired                     bool
 	RBDAttachRequired                        bool
 	NFSAttachRequired                        bool
+	RBDPodInfoOnMount                        bool
+	CephFSPodInfoOnMount                     bool
 	VolumeGroupSnapshotSupported             bool
 	EnableVolumeGroupSnapshot                bool
+	EnableSnapshotValidationWebhook          bool
 	LogLevel                                 uint8
 	SidecarLogLevel                          uint8
+	RBDLogLevel                              uint8
+	CephFSLogLevel                           uint8
+	NFSLogLevel                              uint8
 	CephFSLivenessMetricsPort                uint16
 	CSIAddonsPort                            uint16
 	RBDLivenessMetricsPort                   uint16
+	NFSLivenessMetricsPort                   uint16
+	EnableRestrictedPSA                      bool
+	ProvisionerWorkerThreads                 int
+	AttacherWorkerThreads                    int
+	DefaultEphemeralStorageRequest           string
 	KubeApiBurst                             uint16
 	KubeApiQPS                               float32
 	LeaderElectionLeaseDuration              time.Duration
 	LeaderElectionRenewDeadline              time.Duration
 	LeaderElectionRetryPeriod                time.Duration
+	DriverRolloutTimeout                     time.Duration
+	DriverDeletionTimeout                    time.Duration
 	ProvisionerReplicas                      int32
+	ProvisionerDeploymentStrategy            string
+	ProvisionerMaxUnavailable                string
+	ProvisionerMaxSurge                      string
+	ImagePullSecrets                         []string
+	PluginReadinessProbeInitialDelaySeconds  int32
+	PluginReadinessProbePeriodSeconds        int32
+	PluginReadinessProbeFailureThreshold     int32
+	PluginMinReadySeconds                    int32
+	PluginTerminationGracePeriodSeconds      *int64
+	ProvisionerTerminationGracePeriodSeconds *int64
+	CSIPluginImagePullSecret                 string
+	NFSPluginImagePullSecret                 string
+	SidecarImagePullSecret                   string
+	EnableProvisionerPDB                     bool
+	ProvisionerAntiAffinityTopologyKey       string
+	ProvisionerAntiAffinity                  string
+	PluginTolerateAllTaints                  bool
 	CSICephFSPodLabels                       map[string]string
 	CSINFSPodLabels                          map[string]string
 	CSIRBDPodLabels                          map[string]string
+	CSICephFSPodAnnotations                  map[string]string
+	CSINFSPodAnnotations                     map[string]string
+	CSIRBDPodAnnotations                     map[string]string
 	CSILogRotation                           bool
 	CsiComponentName                         string
 	CSILogRotationMaxSize                    string
@@ -100,10 +168,45 @@ type Param struct {
 	Privileged                               bool
 }
 
+// Hash returns a stable SHA-256 hex digest of the CSI parameters
+func (p Param) Hash() string {
+	b, err := json.Marshal(p)
+	if err != nil {
+		logger.Warningf("failed to serialize csi parameters. %v", err)
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// DeepCopy returns a copy of the CSI parameters that shares no maps, slices or pointers with p, so
+// that the copy can be changed while the global CSIParam is updated by another reconcile
+func (p *Param) DeepCopy() *Param {
+	out := *p
+	out.ImagePullSecrets = slices.Clone(p.ImagePullSecrets)
+	if p.PluginTerminationGracePeriodSeconds != nil {
+		gracePeriod := *p.PluginTerminationGracePeriodSeconds
+		out.PluginTerminationGracePeriodSeconds = &gracePeriod
+	}
+	if p.ProvisionerTerminationGracePeriodSeconds != nil {
+		gracePeriod := *p.ProvisionerTerminationGracePeriodSeconds
+		out.ProvisionerTerminationGracePeriodSeconds = &gracePeriod
+	}
+	out.CSICephFSPodLabels = maps.Clone(p.CSICephFSPodLabels)
+	out.CSINFSPodLabels = maps.Clone(p.CSINFSPodLabels)
+	out.CSIRBDPodLabels = maps.Clone(p.CSIRBDPodLabels)
+	out.CSICephFSPodAnnotations = maps.Clone(p.CSICephFSPodAnnotations)
+	out.CSINFSPodAnnotations = maps.Clone(p.CSINFSPodAnnotations)
+	out.CSIRBDPodAnnotations = maps.Clone(p.CSIRBDPodAnnotations)
+	return &out
+}
+
 type templateParam struct {
 	Param
 	// non-global template only parameters
 	Namespace string
+	// LogrotateImage is the image of the log collector sidecar, the plugin image of the driver
+	LogrotateImage string
 }
 
 var (
@@ -139,6 +242,9 @@ var (
 	DefaultResizerImage     = "registry.k8s.io/sig-storage/csi-resizer:v1.11.1"
 	DefaultCSIAddonsImage   = "quay.io/csiaddons/k8s-sidecar:v0.11.0"
 
+	// the snapshot validation webhook is not released with the external-snapshotter v8 anymore
+	DefaultSnapshotValidationWebhookImage = "registry.k8s.io/sig-storage/snapshot-validation-webhook:v7.0.2"
+
 	// image pull policy
 	DefaultCSIImagePullPolicy = string(corev1.PullIfNotPresent)
 
@@ -163,6 +269,14 @@ var (
 	NFSPluginTemplatePath string
 	//go:embed template/nfs/csi-nfsplugin-provisioner-dep.yaml
 	NFSProvisionerDepTemplatePath string
+	//go:embed template/nfs/csi-nfsplugin-svc.yaml
+	NFSPluginServiceTemplatePath string
+
+	// Local package template path for the snapshot validation webhook
+	//go:embed template/snapshot-webhook/csi-snapshot-validation-webhook-dep.yaml
+	SnapshotWebhookDepTemplatePath string
+	//go:embed template/snapshot-webhook/csi-snapshot-validation-webhook-svc.yaml
+	SnapshotWebhookServiceTemplatePath string
 
 	//go:embed template/csi-logrotate-sidecar.yaml
 	LogrotateTemplatePath string
@@ -173,29 +287,87 @@ var (
 )
 
 const (
-	// common tolerations and node affinity
+	// common tolerations, node affinity and node selector
 	provisionerTolerationsEnv  = "CSI_PROVISIONER_TOLERATIONS"
 	provisionerNodeAffinityEnv = "CSI_PROVISIONER_NODE_AFFINITY"
 	pluginTolerationsEnv       = "CSI_PLUGIN_TOLERATIONS"
 	pluginNodeAffinityEnv      = "CSI_PLUGIN_NODE_AFFINITY"
+	provisionerNodeSelectorEnv = "CSI_PROVISIONER_NODE_SELECTOR"
+	pluginNodeSelectorEnv      = "CSI_PLUGIN_NODE_SELECTOR"
+
+	// plugin and provisioner topology spread constraints
+	pluginTopologySpreadConstraintsEnv      = "CSI_PLUGIN_TOPOLOGY_SPREAD_CONSTRAINTS"
+	provisionerTopologySpreadConstraintsEnv = "CSI_PROVISIONER_TOPOLOGY_SPREAD_CONSTRAINTS"
+
+	// max unavailable plugins during a rolling update of the plugin daemonsets of all the drivers
+	pluginMaxUnavailableEnv = "CSI_PLUGIN_DAEMONSET_MAX_UNAVAILABLE"
+
+	// dns policy and dns config of the csi pods
+	podDNSPolicyEnv = "CSI_POD_DNS_POLICY"
+	podDNSConfigEnv = "CSI_POD_DNS_CONFIG"
 
-	// CephFS tolerations and node affinity
+	// host aliases of the csi pods
+	podHostAliasesEnv = "CSI_POD_HOST_ALIASES"
+
+	// extra environment variables of the cephcsi containers
+	pluginExtraEnvEnv      = "CSI_PLUGIN_EXTRA_ENV"
+	provisionerExtraEnvEnv = "CSI_PROVISIONER_EXTRA_ENV"
+
+	// extra volumes of the csi pods, mounted in the cephcsi container
+	pluginVolumesEnv           = "CSI_PLUGIN_VOLUMES"
+	pluginVolumeMountsEnv      = "CSI_PLUGIN_VOLUME_MOUNTS"
+	provisionerVolumesEnv      = "CSI_PROVISIONER_VOLUMES"
+	provisionerVolumeMountsEnv = "CSI_PROVISIONER_VOLUME_MOUNTS"
+
+	// security context merged onto the sidecars of the csi pods
+	pluginSecurityContextEnv      = "CSI_PLUGIN_SECURITY_CONTEXT"
+	provisionerSecurityContextEnv = "CSI_PROVISIONER_SECURITY_CONTEXT"
+
+	// seccomp profiles of the csi pods
+	pluginSeccompProfileEnv      = "CSI_PLUGIN_SECCOMP_PROFILE"
+	provisionerSeccompProfileEnv = "CSI_PROVISIONER_SECCOMP_PROFILE"
+
+	// the worker threads of the provisioner and attacher sidecars default to the upstream defaults
+	defaultProvisionerWorkerThreads = 100
+	defaultAttacherWorkerThreads    = 10
+	maxWorkerThreads                = 500
+
+	// ephemeral storage requested by the csi containers without an ephemeral storage resource
+	defaultEphemeralStorageRequestEnv = "CSI_DEFAULT_EPHEMERAL_STORAGE_REQUEST"
+
+	// pluginSocketPath is the path of the csi socket in the plugin containers
+	pluginSocketPath                               = "/csi/csi.sock"
+	defaultPluginReadinessProbeInitialDelaySeconds = int32(10)
+	defaultPluginReadinessProbePeriodSeconds       = int32(10)
+	defaultPluginReadinessProbeFailureThreshold    = int32(3)
+
+	// bounds of the termination grace period of the csi pods
+	minTerminationGracePeriodSeconds = int64(30)
+	maxTerminationGracePeriodSeconds = int64(600)
+
+	// CephFS tolerations, node affinity and node selector
 	cephFSProvisionerTolerationsEnv  = "CSI_CEPHFS_PROVISIONER_TOLERATIONS"
 	cephFSProvisionerNodeAffinityEnv = "CSI_CEPHFS_PROVISIONER_NODE_AFFINITY"
+	cephFSProvisionerNodeSelectorEnv = "CSI_CEPHFS_PROVISIONER_NODE_SELECTOR"
 	cephFSPluginTolerationsEnv       = "CSI_CEPHFS_PLUGIN_TOLERATIONS"
 	cephFSPluginNodeAffinityEnv      = "CSI_CEPHFS_PLUGIN_NODE_AFFINITY"
+	cephFSPluginNodeSelectorEnv      = "CSI_CEPHFS_PLUGIN_NODE_SELECTOR"
 
-	// NFS tolerations and node affinity
+	// NFS tolerations, node affinity and node selector
 	nfsProvisionerTolerationsEnv  = "CSI_NFS_PROVISIONER_TOLERATIONS"
 	nfsProvisionerNodeAffinityEnv = "CSI_NFS_PROVISIONER_NODE_AFFINITY"
+	nfsProvisionerNodeSelectorEnv = "CSI_NFS_PROVISIONER_NODE_SELECTOR"
 	nfsPluginTolerationsEnv       = "CSI_NFS_PLUGIN_TOLERATIONS"
 	nfsPluginNodeAffinityEnv      = "CSI_NFS_PLUGIN_NODE_AFFINITY"
+	nfsPluginNodeSelectorEnv      = "CSI_NFS_PLUGIN_NODE_SELECTOR"
 
-	// RBD tolerations and node affinity
+	// RBD tolerations, node affinity and node selector
 	rbdProvisionerTolerationsEnv  = "CSI_RBD_PROVISIONER_TOLERATIONS"
 	rbdProvisionerNodeAffinityEnv = "CSI_RBD_PROVISIONER_NODE_AFFINITY"
+	rbdProvisionerNodeSelectorEnv = "CSI_RBD_PROVISIONER_NODE_SELECTOR"
 	rbdPluginTolerationsEnv       = "CSI_RBD_PLUGIN_TOLERATIONS"
 	rbdPluginNodeAffinityEnv      = "CSI_RBD_PLUGIN_NODE_AFFINITY"
+	rbdPluginNodeSelectorEnv      = "CSI_RBD_PLUGIN_NODE_SELECTOR"
 
 	// compute resource for CSI pods
 	rbdProvisionerResource = "CSI_RBD_PROVISIONER_RESOURCE"
@@ -207,6 +379,17 @@ const (
 	nfsProvisionerResource = "CSI_NFS_PROVISIONER_RESOURCE"
 	nfsPluginResource      = "CSI_NFS_PLUGIN_RESOURCE"
 
+	// compute resource for single provisioner sidecars, overriding the provisioner resource list
+	rbdAttacherResource       = "CSI_RBD_ATTACHER_RESOURCE"
+	rbdSnapshotterResource    = "CSI_RBD_SNAPSHOTTER_RESOURCE"
+	rbdResizerResource        = "CSI_RBD_RESIZER_RESOURCE"
+	cephFSAttacherResource    = "CSI_CEPHFS_ATTACHER_RESOURCE"
+	cephFSSnapshotterResource = "CSI_CEPHFS_SNAPSHOTTER_RESOURCE"
+	cephFSResizerResource     = "CSI_CEPHFS_RESIZER_RESOURCE"
+	nfsAttacherResource       = "CSI_NFS_ATTACHER_RESOURCE"
+	nfsSnapshotterResource    = "CSI_NFS_SNAPSHOTTER_RESOURCE"
+	nfsResizerResource        = "CSI_NFS_RESIZER_RESOURCE"
+
 	cephFSPluginVolume      = "CSI_CEPHFS_PLUGIN_VOLUME"
 	cephFSPluginVolumeMount = "CSI_CEPHFS_PLUGIN_VOLUME_MOUNT"
 
@@ -219,31 +402,48 @@ const (
 	// kubelet directory path
 	DefaultKubeletDirPath = "/var/lib/kubelet"
 
-	// grpc metrics and liveness port for cephfs  and rbd
+	// grpc metrics and liveness port for cephfs, rbd and nfs
 	DefaultCephFSGRPCMerticsPort     uint16 = 9091
 	DefaultCephFSLivenessMerticsPort uint16 = 9081
 	DefaultRBDGRPCMerticsPort        uint16 = 9090
 	DefaultRBDLivenessMerticsPort    uint16 = 9080
+	DefaultNFSLivenessMerticsPort    uint16 = 9082
 	DefaultCSIAddonsPort             uint16 = 9070
 
 	// default log level for csi containers
-	defaultLogLevel        uint8 = 0
-	defaultSidecarLogLevel uint8 = 0
+	defaultLogLevel uint8 = 0
 
 	// default leader election flags
 	defaultLeaderElectionLeaseDuration = 137 * time.Second
 	defaultLeaderElectionRenewDeadline = 107 * time.Second
 	defaultLeaderElectionRetryPeriod   = 26 * time.Second
 
-	// GRPC timeout.
-	defaultGRPCTimeout = 150
-	grpcTimeout        = "CSI_GRPC_TIMEOUT_SECONDS"
+	// default time to wait for the provisioner deployments to roll out
+	defaultDriverRolloutTimeout = 5 * time.Minute
+
+	// default time to wait for the plugin daemonsets and their pods to be deleted
+	defaultDriverDeletionTimeout = 90 * time.Second
+
+	// GRPC timeout. Values below minGRPCTimeout are rejected, values below recommendedMinGRPCTimeout
+	// are applied with a warning since they may cause spurious timeouts of slow operations.
+	defaultGRPCTimeout        = 150
+	minGRPCTimeout            = 30
+	recommendedMinGRPCTimeout = 120
+	grpcTimeout               = "CSI_GRPC_TIMEOUT_SECONDS"
 	// default provisioner replicas
 	defaultProvisionerReplicas int32 = 2
 
+	// provisioner pod anti-affinity
+	requiredAntiAffinity  = "required"
+	preferredAntiAffinity = "preferred"
+
 	// update strategy
 	rollingUpdate = "RollingUpdate"
 	onDelete      = "OnDelete"
+	recreate      = "Recreate"
+
+	// default max unavailable provisioner pods of a rolling update
+	defaultProvisionerMaxUnavailable = "1"
 
 	// driver daemonset names
 	CsiRBDPlugin    = "csi-rbdplugin"
@@ -268,6 +468,13 @@ const (
 	nfsDriverSuffix       = "nfs.csi.ceph.com"
 	nodePlugin            = "node-plugin"
 	controllerPlugin      = "controller-plugin"
+
+	// annotation on the csi driver workloads holding the hash of the config they were applied with
+	csiParamHashAnnotation = "rook.io/csi-param-hash"
+	// annotation on the csi driver workloads holding their generation when they were applied
+	csiAppliedGenerationAnnotation = "rook.io/csi-applied-generation"
+	// multusNetworksAnnotation is the annotation holding the multus networks of a pod
+	multusNetworksAnnotation = "k8s.v1.cni.cncf.io/networks"
 )
 
 func CSIEnabled() bool {
@@ -279,36 +486,208 @@ func IsHolderEnabled() bool {
 }
 
 func validateCSIParam() error {
-	if len(CSIParam.CSIPluginImage) == 0 {
-		return errors.New("missing csi rbd plugin image")
+	var errs []error
+
+	requiredImages := []struct {
+		name  string
+		image string
+	}{
+		{"csi rbd plugin", CSIParam.CSIPluginImage},
+		{"csi registrar", CSIParam.RegistrarImage},
+		{"csi provisioner", CSIParam.ProvisionerImage},
+		{"csi attacher", CSIParam.AttacherImage},
+		{"csi snapshotter", CSIParam.SnapshotterImage},
+		{"csi resizer", CSIParam.ResizerImage},
 	}
-	if len(CSIParam.RegistrarImage) == 0 {
-		return errors.New("missing csi registrar image")
+	for _, required := range requiredImages {
+		if len(required.image) == 0 {
+			errs = append(errs, errors.Errorf("missing %s image", required.name))
+		}
 	}
-	if len(CSIParam.ProvisionerImage) == 0 {
-		return errors.New("missing csi provisioner image")
+	if CSIParam.EnableSnapshotValidationWebhook && len(CSIParam.SnapshotValidationWebhookImage) == 0 {
+		errs = append(errs, errors.New("missing csi snapshot validation webhook image"))
 	}
-	if len(CSIParam.AttacherImage) == 0 {
-		return errors.New("missing csi attacher image")
+	if CSIParam.EnableCSIAddonsSideCar && len(CSIParam.CSIAddonsImage) == 0 {
+		errs = append(errs, errors.New("missing csi-addons image, required when the csi-addons sidecar is enabled"))
+	}
+	// the images that are not set are reported above when they are required. The volume replication
+	// image is not required by any setting and is only checked when it is set.
+	for _, image := range []struct {
+		name  string
+		image string
+	}{
+		{"cephcsi", CSIParam.CSIPluginImage},
+		{"csi rbd plugin", CSIParam.RBDPluginImage},
+		{"csi cephfs plugin", CSIParam.CephFSPluginImage},
+		{"csi nfs plugin", CSIParam.NFSPluginImage},
+		{"csi registrar", CSIParam.RegistrarImage},
+		{"csi provisioner", CSIParam.ProvisionerImage},
+		{"csi attacher", CSIParam.AttacherImage},
+		{"csi snapshotter", CSIParam.SnapshotterImage},
+		{"csi resizer", CSIParam.ResizerImage},
+		{"csi volume replication", CSIParam.VolumeReplicationImage},
+		{"csi-addons", CSIParam.CSIAddonsImage},
+		{"csi snapshot validation webhook", CSIParam.SnapshotValidationWebhookImage},
+	} {
+		if image.image == "" {
+			continue
+		}
+		if err := validateImageRef(image.image); err != nil {
+			errs = append(errs, errors.Wrapf(err, "invalid %s image", image.name))
+		}
 	}
 
-	return nil
+	if CSIParam.EnableLiveness {
+		if CSIParam.RBDLivenessMetricsPort == 0 {
+			errs = append(errs, errors.New("invalid csi rbd liveness metrics port 0"))
+		}
+		if CSIParam.CephFSLivenessMetricsPort == 0 {
+			errs = append(errs, errors.New("invalid csi cephfs liveness metrics port 0"))
+		}
+		if EnableNFS && CSIParam.NFSLivenessMetricsPort == 0 {
+			errs = append(errs, errors.New("invalid csi nfs liveness metrics port 0"))
+		}
+	}
+	if CSIParam.EnableCSIAddonsSideCar && CSIParam.CSIAddonsPort == 0 {
+		errs = append(errs, errors.New("invalid csi-addons port 0"))
+	}
+
+	for _, pod := range []struct {
+		name        string
+		gracePeriod *int64
+	}{
+		{"plugin", CSIParam.PluginTerminationGracePeriodSeconds},
+		{"provisioner", CSIParam.ProvisionerTerminationGracePeriodSeconds},
+	} {
+		if pod.gracePeriod != nil && (*pod.gracePeriod < minTerminationGracePeriodSeconds || *pod.gracePeriod > maxTerminationGracePeriodSeconds) {
+			errs = append(errs, errors.Errorf("csi %s termination grace period %d must be between %d and %d seconds",
+				pod.name, *pod.gracePeriod, minTerminationGracePeriodSeconds, maxTerminationGracePeriodSeconds))
+		}
+	}
+
+	if CSIParam.EnableRestrictedPSA {
+		errs = append(errs, validateRestrictedPSA(CSIParam)...)
+	}
+
+	for _, serviceAccount := range []struct {
+		setting string
+		name    string
+	}{
+		{"CSI_RBD_PLUGIN_SERVICE_ACCOUNT", CSIParam.RBDPluginServiceAccount},
+		{"CSI_RBD_PROVISIONER_SERVICE_ACCOUNT", CSIParam.RBDProvisionerServiceAccount},
+		{"CSI_CEPHFS_PLUGIN_SERVICE_ACCOUNT", CSIParam.CephFSPluginServiceAccount},
+		{"CSI_CEPHFS_PROVISIONER_SERVICE_ACCOUNT", CSIParam.CephFSProvisionerServiceAccount},
+		{"CSI_NFS_PLUGIN_SERVICE_ACCOUNT", CSIParam.NFSPluginServiceAccount},
+		{"CSI_NFS_PROVISIONER_SERVICE_ACCOUNT", CSIParam.NFSProvisionerServiceAccount},
+	} {
+		if serviceAccount.name == "" {
+			continue
+		}
+		if msgs := validation.IsDNS1123Subdomain(serviceAccount.name); len(msgs) > 0 {
+			errs = append(errs, errors.Errorf("invalid service account name %q for %q: %s", serviceAccount.name, serviceAccount.setting, strings.Join(msgs, ", ")))
+		}
+	}
+
+	for _, sidecar := range []struct {
+		name          string
+		workerThreads int
+	}{
+		{"provisioner", CSIParam.ProvisionerWorkerThreads},
+		{"attacher", CSIParam.AttacherWorkerThreads},
+	} {
+		if sidecar.workerThreads < 1 || sidecar.workerThreads > maxWorkerThreads {
+			errs = append(errs, errors.Errorf("csi %s worker threads %d must be between 1 and %d", sidecar.name, sidecar.workerThreads, maxWorkerThreads))
+		}
+	}
+
+	for _, plugin := range []struct {
+		name           string
+		strategy       string
+		maxUnavailable string
+	}{
+		{"rbd", CSIParam.RBDPluginUpdateStrategy, CSIParam.RBDPluginUpdateStrategyMaxUnavailable},
+		{"cephfs", CSIParam.CephFSPluginUpdateStrategy, CSIParam.CephFSPluginUpdateStrategyMaxUnavailable},
+		{"nfs", CSIParam.NFSPluginUpdateStrategy, CSIParam.NFSPluginUpdateStrategyMaxUnavailable},
+	} {
+		if plugin.strategy != rollingUpdate {
+			continue
+		}
+		err := validateMaxUnavailable(plugin.maxUnavailable)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "invalid csi %s plugin update strategy max unavailable", plugin.name))
+		}
+	}
+
+	if CSIParam.ProvisionerDeploymentStrategy == rollingUpdate {
+		errs = append(errs, validateProvisionerRollingUpdate(CSIParam)...)
+	}
+
+	if _, err := getEphemeralStorageRequest(CSIParam); err != nil {
+		errs = append(errs, err)
+	}
+
+	if CSIParam.LeaderElectionLeaseDuration != 0 && CSIParam.LeaderElectionRenewDeadline >= CSIParam.LeaderElectionLeaseDuration {
+		errs = append(errs, errors.Errorf("csi leader election renew deadline %s must be less than the lease duration %s",
+			CSIParam.LeaderElectionRenewDeadline, CSIParam.LeaderElectionLeaseDuration))
+	}
+	if CSIParam.LeaderElectionRenewDeadline != 0 && CSIParam.LeaderElectionRetryPeriod >= CSIParam.LeaderElectionRenewDeadline {
+		errs = append(errs, errors.Errorf("csi leader election retry period %s must be less than the renew deadline %s",
+			CSIParam.LeaderElectionRetryPeriod, CSIParam.LeaderElectionRenewDeadline))
+	}
+
+	if !path.IsAbs(CSIParam.KubeletDirPath) {
+		errs = append(errs, errors.Errorf("kubelet dir path %q must be an absolute path", CSIParam.KubeletDirPath))
+	}
+
+	return stderrors.Join(errs...)
 }
 
-func (r *ReconcileCSI) startDrivers(ownerInfo *k8sutil.OwnerInfo) error {
-	var (
-		err                                                                             error
-		rbdPlugin, cephfsPlugin, nfsPlugin                                              *apps.DaemonSet
-		rbdProvisionerDeployment, cephfsProvisionerDeployment, nfsProvisionerDeployment *apps.Deployment
-		rbdService, cephfsService                                                       *corev1.Service
-		csiDriverobj                                                                    v1CsiDriver
-	)
+// StartDriversResult holds the csi driver resources rendered from the templates. The resources of
+// the disabled drivers are nil.
+type StartDriversResult struct {
+	RBDPlugin         *apps.DaemonSet
+	CephFSPlugin      *apps.DaemonSet
+	NFSPlugin         *apps.DaemonSet
+	RBDProvisioner    *apps.Deployment
+	CephFSProvisioner *apps.Deployment
+	NFSProvisioner    *apps.Deployment
+	RBDService        *corev1.Service
+	CephFSService     *corev1.Service
+	NFSService        *corev1.Service
+}
+
+// PreviewCSIResources renders the csi driver resources for the given parameters the same way the
+// operator does, without making any API call. The per-driver settings that are usually read from
+// the operator config are read from the environment.
+func PreviewCSIResources(tp templateParam) (*StartDriversResult, error) {
+	err := validateTemplateParam(tp)
+	if err != nil {
+		return nil, err
+	}
+	tp.DriverNamePrefix = fmt.Sprintf("%s.", tp.DriverNamePrefix)
+
+	return renderCSIDrivers(tp, map[string]string{})
+}
 
+// startDriversDryRun renders the csi driver resources from the operator settings without applying
+// them to the cluster
+func (r *ReconcileCSI) startDriversDryRun() (*StartDriversResult, error) {
 	tp := templateParam{
-		Param:     CSIParam,
+		Param:     *CSIParam.DeepCopy(),
 		Namespace: r.opConfig.OperatorNamespace,
 	}
+	err := validateTemplateParam(tp)
+	if err != nil {
+		return nil, err
+	}
+	tp.DriverNamePrefix = fmt.Sprintf("%s.", tp.DriverNamePrefix)
+	tp.Param.MountCustomCephConf = CustomCSICephConfigExists
+
+	return renderCSIDrivers(tp, r.opConfig.Parameters)
+}
 
+// validateTemplateParam checks the parameters that can be validated without the cluster
+func validateTemplateParam(tp templateParam) error {
 	if strings.HasSuffix(tp.DriverNamePrefix, ".") {
 		// As operator is adding a dot at the end of the prefix, we should not
 		// allow the user to add a dot at the end of the prefix. as it will
@@ -317,338 +696,670 @@ func (r *ReconcileCSI) startDrivers(ownerInfo *k8sutil.OwnerInfo) error {
 		return errors.Errorf("driver name prefix %q should not end with a dot", tp.DriverNamePrefix)
 	}
 
-	err = validateCSIDriverNamePrefix(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, tp.DriverNamePrefix)
+	return validateCSIPorts(tp)
+}
+
+// renderCSIDrivers renders the resources of the enabled drivers and applies the operator settings
+// to them. The driver name prefix of tp must already end with a dot.
+func renderCSIDrivers(tp templateParam, opConfig map[string]string) (*StartDriversResult, error) {
+	var err error
+	result := &StartDriversResult{}
+	imagePullSecrets := getImagePullSecrets(tp.Param)
+	ephemeralStorageRequest, err := getEphemeralStorageRequest(tp.Param)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Add a dot at the end of the prefix for having the driver name prefix
-	// with format <prefix>.<driver-name>
-	tp.DriverNamePrefix = fmt.Sprintf("%s.", tp.DriverNamePrefix)
-
-	CephFSDriverName = tp.DriverNamePrefix + cephFSDriverSuffix
-	RBDDriverName = tp.DriverNamePrefix + rbdDriverSuffix
-	NFSDriverName = tp.DriverNamePrefix + nfsDriverSuffix
-
-	tp.Param.MountCustomCephConf = CustomCSICephConfigExists
 
 	if EnableRBD {
 		tp.CsiComponentName = nodePlugin
-		tp.CsiLogRootPath = path.Join(csiRootPath, RBDDriverName)
-		rbdPlugin, err = templateToDaemonSet("rbdplugin", RBDPluginTemplatePath, tp)
+		tp.CsiLogRootPath = path.Join(csiRootPath, tp.DriverNamePrefix+rbdDriverSuffix)
+		tp.LogrotateImage = tp.RBDPluginImage
+		result.RBDPlugin, err = templateToDaemonSet("rbdplugin", RBDPluginTemplatePath, tp)
 		if err != nil {
-			return errors.Wrap(err, "failed to load rbdplugin template")
+			return nil, errors.Wrap(err, "failed to load rbdplugin template")
 		}
-		rbdPlugin.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.RBDPlugin.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.RBDPlugin.Spec.MinReadySeconds = tp.PluginMinReadySeconds
+		result.RBDPlugin.Spec.Template.Spec.TerminationGracePeriodSeconds = tp.PluginTerminationGracePeriodSeconds
+		applyImagePullSecrets(&result.RBDPlugin.Spec.Template.Spec, imagePullSecrets)
+		applyPluginReadinessProbe(&result.RBDPlugin.Spec.Template.Spec, "csi-rbdplugin", tp.Param)
 		if tp.CSILogRotation {
-			applyLogrotateSidecar(&rbdPlugin.Spec.Template, "csi-rbd-daemonset-log-collector", LogrotateTemplatePath, tp)
+			applyLogrotateSidecar(&result.RBDPlugin.Spec.Template, "csi-rbd-daemonset-log-collector", LogrotateTemplatePath, tp)
 		}
 
 		tp.CsiComponentName = controllerPlugin
-		rbdProvisionerDeployment, err = templateToDeployment("rbd-provisioner", RBDProvisionerDepTemplatePath, tp)
+		result.RBDProvisioner, err = templateToDeployment("rbd-provisioner", RBDProvisionerDepTemplatePath, tp)
 		if err != nil {
-			return errors.Wrap(err, "failed to load rbd provisioner deployment template")
+			return nil, errors.Wrap(err, "failed to load rbd provisioner deployment template")
 		}
 		if tp.CSILogRotation {
-			applyLogrotateSidecar(&rbdProvisionerDeployment.Spec.Template, "csi-rbd-deployment-log-collector", LogrotateTemplatePath, tp)
+			applyLogrotateSidecar(&result.RBDProvisioner.Spec.Template, "csi-rbd-deployment-log-collector", LogrotateTemplatePath, tp)
 		}
-		rbdProvisionerDeployment.Spec.Template.Spec.HostNetwork = opcontroller.EnforceHostNetwork()
-		rbdProvisionerDeployment.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.RBDProvisioner.Spec.Template.Spec.HostNetwork = opcontroller.EnforceHostNetwork()
+		result.RBDProvisioner.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.RBDProvisioner.Spec.Template.Spec.TerminationGracePeriodSeconds = tp.ProvisionerTerminationGracePeriodSeconds
+		applyImagePullSecrets(&result.RBDProvisioner.Spec.Template.Spec, imagePullSecrets)
 
 		// Create service if either liveness or GRPC metrics are enabled.
-		if CSIParam.EnableLiveness {
-			rbdService, err = templateToService("rbd-service", RBDPluginServiceTemplatePath, tp)
+		if tp.EnableLiveness {
+			result.RBDService, err = templateToService("rbd-service", RBDPluginServiceTemplatePath, tp)
 			if err != nil {
-				return errors.Wrap(err, "failed to load rbd plugin service template")
+				return nil, errors.Wrap(err, "failed to load rbd plugin service template")
 			}
-			rbdService.Namespace = r.opConfig.OperatorNamespace
+			result.RBDService.Namespace = tp.Namespace
 		}
 	}
 	if EnableCephFS {
 		tp.CsiComponentName = nodePlugin
-		tp.CsiLogRootPath = path.Join(csiRootPath, CephFSDriverName)
-		cephfsPlugin, err = templateToDaemonSet("cephfsplugin", CephFSPluginTemplatePath, tp)
+		tp.CsiLogRootPath = path.Join(csiRootPath, tp.DriverNamePrefix+cephFSDriverSuffix)
+		tp.LogrotateImage = tp.CephFSPluginImage
+		result.CephFSPlugin, err = templateToDaemonSet("cephfsplugin", CephFSPluginTemplatePath, tp)
 		if err != nil {
-			return errors.Wrap(err, "failed to load CephFS plugin template")
+			return nil, errors.Wrap(err, "failed to load CephFS plugin template")
 		}
-		cephfsPlugin.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.CephFSPlugin.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.CephFSPlugin.Spec.MinReadySeconds = tp.PluginMinReadySeconds
+		result.CephFSPlugin.Spec.Template.Spec.TerminationGracePeriodSeconds = tp.PluginTerminationGracePeriodSeconds
+		applyImagePullSecrets(&result.CephFSPlugin.Spec.Template.Spec, imagePullSecrets)
+		applyPluginReadinessProbe(&result.CephFSPlugin.Spec.Template.Spec, "csi-cephfsplugin", tp.Param)
 
 		if tp.CSILogRotation {
-			applyLogrotateSidecar(&cephfsPlugin.Spec.Template, "csi-cephfs-daemonset-log-collector", LogrotateTemplatePath, tp)
+			applyLogrotateSidecar(&result.CephFSPlugin.Spec.Template, "csi-cephfs-daemonset-log-collector", LogrotateTemplatePath, tp)
 		}
 
 		tp.CsiComponentName = controllerPlugin
-		cephfsProvisionerDeployment, err = templateToDeployment("cephfs-provisioner", CephFSProvisionerDepTemplatePath, tp)
+		result.CephFSProvisioner, err = templateToDeployment("cephfs-provisioner", CephFSProvisionerDepTemplatePath, tp)
 		if err != nil {
-			return errors.Wrap(err, "failed to load rbd provisioner deployment template")
+			return nil, errors.Wrap(err, "failed to load rbd provisioner deployment template")
 		}
 		if tp.CSILogRotation {
-			applyLogrotateSidecar(&cephfsProvisionerDeployment.Spec.Template, "csi-cephfs-deployment-log-collector", LogrotateTemplatePath, tp)
+			applyLogrotateSidecar(&result.CephFSProvisioner.Spec.Template, "csi-cephfs-deployment-log-collector", LogrotateTemplatePath, tp)
 		}
-		cephfsProvisionerDeployment.Spec.Template.Spec.HostNetwork = opcontroller.EnforceHostNetwork()
-		cephfsProvisionerDeployment.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.CephFSProvisioner.Spec.Template.Spec.HostNetwork = opcontroller.EnforceHostNetwork()
+		result.CephFSProvisioner.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.CephFSProvisioner.Spec.Template.Spec.TerminationGracePeriodSeconds = tp.ProvisionerTerminationGracePeriodSeconds
+		applyImagePullSecrets(&result.CephFSProvisioner.Spec.Template.Spec, imagePullSecrets)
 
 		// Create service if either liveness or GRPC metrics are enabled.
-		if CSIParam.EnableLiveness {
-			cephfsService, err = templateToService("cephfs-service", CephFSPluginServiceTemplatePath, tp)
+		if tp.EnableLiveness {
+			result.CephFSService, err = templateToService("cephfs-service", CephFSPluginServiceTemplatePath, tp)
 			if err != nil {
-				return errors.Wrap(err, "failed to load cephfs plugin service template")
+				return nil, errors.Wrap(err, "failed to load cephfs plugin service template")
 			}
-			cephfsService.Namespace = r.opConfig.OperatorNamespace
+			result.CephFSService.Namespace = tp.Namespace
 		}
 	}
 
 	if EnableNFS {
 		tp.CsiComponentName = nodePlugin
-		tp.CsiLogRootPath = path.Join(csiRootPath, NFSDriverName)
-		nfsPlugin, err = templateToDaemonSet("nfsplugin", NFSPluginTemplatePath, tp)
+		tp.CsiLogRootPath = path.Join(csiRootPath, tp.DriverNamePrefix+nfsDriverSuffix)
+		tp.LogrotateImage = tp.NFSPluginImage
+		result.NFSPlugin, err = templateToDaemonSet("nfsplugin", NFSPluginTemplatePath, tp)
 		if err != nil {
-			return errors.Wrap(err, "failed to load nfs plugin template")
+			return nil, errors.Wrap(err, "failed to load nfs plugin template")
 		}
-		nfsPlugin.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.NFSPlugin.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.NFSPlugin.Spec.MinReadySeconds = tp.PluginMinReadySeconds
+		result.NFSPlugin.Spec.Template.Spec.TerminationGracePeriodSeconds = tp.PluginTerminationGracePeriodSeconds
+		applyImagePullSecrets(&result.NFSPlugin.Spec.Template.Spec, imagePullSecrets)
+		applyPluginReadinessProbe(&result.NFSPlugin.Spec.Template.Spec, "csi-nfsplugin", tp.Param)
 		if tp.CSILogRotation {
-			applyLogrotateSidecar(&nfsPlugin.Spec.Template, "csi-nfs-daemonset-log-collector", LogrotateTemplatePath, tp)
+			applyLogrotateSidecar(&result.NFSPlugin.Spec.Template, "csi-nfs-daemonset-log-collector", LogrotateTemplatePath, tp)
 		}
 
 		tp.CsiComponentName = controllerPlugin
-		nfsProvisionerDeployment, err = templateToDeployment("nfs-provisioner", NFSProvisionerDepTemplatePath, tp)
+		result.NFSProvisioner, err = templateToDeployment("nfs-provisioner", NFSProvisionerDepTemplatePath, tp)
 		if err != nil {
-			return errors.Wrap(err, "failed to load nfs provisioner deployment template")
+			return nil, errors.Wrap(err, "failed to load nfs provisioner deployment template")
 		}
 		if tp.CSILogRotation {
-			applyLogrotateSidecar(&nfsProvisionerDeployment.Spec.Template, "csi-nfs-deployment-log-collector", LogrotateTemplatePath, tp)
+			applyLogrotateSidecar(&result.NFSProvisioner.Spec.Template, "csi-nfs-deployment-log-collector", LogrotateTemplatePath, tp)
+		}
+		result.NFSProvisioner.Spec.Template.Spec.HostNetwork = opcontroller.EnforceHostNetwork()
+		result.NFSProvisioner.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
+		result.NFSProvisioner.Spec.Template.Spec.TerminationGracePeriodSeconds = tp.ProvisionerTerminationGracePeriodSeconds
+		applyImagePullSecrets(&result.NFSProvisioner.Spec.Template.Spec, imagePullSecrets)
+
+		// Create service if either liveness or GRPC metrics are enabled.
+		if tp.EnableLiveness {
+			result.NFSService, err = templateToService("nfs-service", NFSPluginServiceTemplatePath, tp)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to load nfs plugin service template")
+			}
+			result.NFSService.Namespace = tp.Namespace
 		}
-		nfsProvisionerDeployment.Spec.Template.Spec.HostNetwork = opcontroller.EnforceHostNetwork()
-		nfsProvisionerDeployment.Spec.RevisionHistoryLimit = opcontroller.RevisionHistoryLimit()
 	}
 
 	// get common provisioner tolerations and node affinity
-	provisionerTolerations := getToleration(r.opConfig.Parameters, provisionerTolerationsEnv, []corev1.Toleration{})
-	provisionerNodeAffinity := getNodeAffinity(r.opConfig.Parameters, provisionerNodeAffinityEnv, &corev1.NodeAffinity{})
+	provisionerTolerations := getToleration(opConfig, provisionerTolerationsEnv, []corev1.Toleration{})
+	provisionerNodeAffinity := getNodeAffinity(opConfig, provisionerNodeAffinityEnv, &corev1.NodeAffinity{})
+	provisionerNodeSelector := getNodeSelector(opConfig, provisionerNodeSelectorEnv, nil)
+	provisionerTopologySpreadConstraints, err := getTopologySpreadConstraints(opConfig, provisionerTopologySpreadConstraintsEnv)
+	if err != nil {
+		return nil, err
+	}
+	provisionerSeccompProfile, err := getSeccompProfile(opConfig, provisionerSeccompProfileEnv)
+	if err != nil {
+		return nil, err
+	}
 
 	// get common plugin tolerations and node affinity
-	pluginTolerations := getToleration(r.opConfig.Parameters, pluginTolerationsEnv, []corev1.Toleration{})
-	pluginNodeAffinity := getNodeAffinity(r.opConfig.Parameters, pluginNodeAffinityEnv, &corev1.NodeAffinity{})
+	pluginTolerations := getToleration(opConfig, pluginTolerationsEnv, []corev1.Toleration{})
+	pluginNodeAffinity := getNodeAffinity(opConfig, pluginNodeAffinityEnv, &corev1.NodeAffinity{})
+	pluginNodeSelector := getNodeSelector(opConfig, pluginNodeSelectorEnv, nil)
+	pluginSeccompProfile, err := getSeccompProfile(opConfig, pluginSeccompProfileEnv)
+	if err != nil {
+		return nil, err
+	}
+	pluginTopologySpreadConstraints, err := getTopologySpreadConstraints(opConfig, pluginTopologySpreadConstraintsEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	// the dns settings apply to the plugins and the provisioners alike so they resolve names consistently
+	dnsPolicy, dnsConfig, err := getPodDNS(opConfig, podDNSPolicyEnv, podDNSConfigEnv)
+	if err != nil {
+		return nil, err
+	}
+	hostAliases, err := getHostAliases(opConfig, podHostAliasesEnv)
+	if err != nil {
+		return nil, err
+	}
+	pluginExtraEnv, err := getExtraEnv(opConfig, pluginExtraEnvEnv)
+	if err != nil {
+		return nil, err
+	}
+	provisionerExtraEnv, err := getExtraEnv(opConfig, provisionerExtraEnvEnv)
+	if err != nil {
+		return nil, err
+	}
+	pluginVolumes, pluginVolumeMounts, err := getExtraVolumes(opConfig, pluginVolumesEnv, pluginVolumeMountsEnv)
+	if err != nil {
+		return nil, err
+	}
+	provisionerVolumes, provisionerVolumeMounts, err := getExtraVolumes(opConfig, provisionerVolumesEnv, provisionerVolumeMountsEnv)
+	if err != nil {
+		return nil, err
+	}
+	if tp.EnableRestrictedPSA {
+		for _, volume := range provisionerVolumes {
+			if volume.HostPath != nil {
+				return nil, errors.Errorf("host path volume %q in %q cannot be used with %s", volume.Name, provisionerVolumesEnv, restrictedPSASetting)
+			}
+		}
+	}
+	pluginSecurityContext, err := getSecurityContext(opConfig, pluginSecurityContextEnv)
+	if err != nil {
+		return nil, err
+	}
+	provisionerSecurityContext, err := getSecurityContext(opConfig, provisionerSecurityContextEnv)
+	if err != nil {
+		return nil, err
+	}
 
-	if rbdPlugin != nil {
+	if result.RBDPlugin != nil {
 		// get RBD plugin tolerations and node affinity, defaults to common tolerations and node affinity if not specified
-		rbdPluginTolerations := getToleration(r.opConfig.Parameters, rbdPluginTolerationsEnv, pluginTolerations)
-		rbdPluginNodeAffinity := getNodeAffinity(r.opConfig.Parameters, rbdPluginNodeAffinityEnv, pluginNodeAffinity)
+		rbdPluginTolerations := getToleration(opConfig, rbdPluginTolerationsEnv, pluginTolerations)
+		if tp.PluginTolerateAllTaints {
+			rbdPluginTolerations = tolerateAllTaints()
+		}
+		rbdPluginNodeAffinity := getNodeAffinity(opConfig, rbdPluginNodeAffinityEnv, pluginNodeAffinity)
 		// apply RBD plugin tolerations and node affinity
-		applyToPodSpec(&rbdPlugin.Spec.Template.Spec, rbdPluginNodeAffinity, rbdPluginTolerations)
+		applyToPodSpec(&result.RBDPlugin.Spec.Template.Spec, rbdPluginNodeAffinity, rbdPluginTolerations)
+		result.RBDPlugin.Spec.Template.Spec.NodeSelector = getNodeSelector(opConfig, rbdPluginNodeSelectorEnv, pluginNodeSelector)
+		applySeccompProfile(&result.RBDPlugin.Spec.Template.Spec, pluginSeccompProfile)
+		applyTopologySpreadConstraints(&result.RBDPlugin.Spec.Template.Spec, "csi-rbdplugin", pluginTopologySpreadConstraints)
+		applyPodDNS(&result.RBDPlugin.Spec.Template.Spec, dnsPolicy, dnsConfig)
+		applyRuntimeClassName(&result.RBDPlugin.Spec.Template.Spec, tp.PluginRuntimeClassName)
+		applyPodLabels(&result.RBDPlugin.Spec.Template.ObjectMeta, tp.CSIRBDPodLabels)
+		applyPodAnnotations(&result.RBDPlugin.Spec.Template.ObjectMeta, tp.CSIRBDPodAnnotations)
+		result.RBDPlugin.Spec.Template.Spec.HostAliases = hostAliases
+		applyExtraEnvToContainer(&result.RBDPlugin.Spec.Template.Spec, "csi-rbdplugin", pluginExtraEnv)
+		err = applySidecarSecurityContext(&result.RBDPlugin.Spec.Template.Spec, pluginSecurityContext)
+		if err != nil {
+			return nil, err
+		}
 		// apply resource request and limit to rbdplugin containers
-		applyResourcesToContainers(r.opConfig.Parameters, rbdPluginResource, &rbdPlugin.Spec.Template.Spec)
+		applyResourcesToContainers(opConfig, rbdPluginResource, &result.RBDPlugin.Spec.Template.Spec)
+		applyDefaultEphemeralStorage(&result.RBDPlugin.Spec.Template.Spec, ephemeralStorageRequest)
 		// apply custom mounts to volumes
-		applyVolumeToPodSpec(r.opConfig.Parameters, rbdPluginVolume, &rbdPlugin.Spec.Template.Spec)
+		applyVolumeToPodSpec(opConfig, rbdPluginVolume, &result.RBDPlugin.Spec.Template.Spec)
 		// apply custom mounts to volume mounts
-		applyVolumeMountToContainer(r.opConfig.Parameters, rbdPluginVolumeMount, "csi-rbdplugin", &rbdPlugin.Spec.Template.Spec)
-		err = ownerInfo.SetControllerReference(rbdPlugin)
-		if err != nil {
-			return errors.Wrapf(err, "failed to set owner reference to rbd plugin daemonset %q", rbdPlugin.Name)
-		}
-		err = r.applyCephClusterNetworkConfig(r.opManagerContext, &rbdPlugin.Spec.Template.ObjectMeta)
-		if err != nil {
-			return errors.Wrapf(err, "failed to apply network config to rbd plugin daemonset %q", rbdPlugin.Name)
-		}
-		err = k8sutil.CreateDaemonSet(r.opManagerContext, r.opConfig.OperatorNamespace, r.context.Clientset, rbdPlugin)
+		applyVolumeMountToContainer(opConfig, rbdPluginVolumeMount, "csi-rbdplugin", &result.RBDPlugin.Spec.Template.Spec)
+		err = applyExtraVolumes(&result.RBDPlugin.Spec.Template.Spec, "csi-rbdplugin", pluginVolumes, pluginVolumeMounts)
 		if err != nil {
-			return errors.Wrapf(err, "failed to start rbdplugin daemonset %q", rbdPlugin.Name)
+			return nil, errors.Wrapf(err, "failed to apply the extra volumes of %q", pluginVolumesEnv)
 		}
-		k8sutil.AddRookVersionLabelToDaemonSet(rbdPlugin)
 	}
 
-	if rbdProvisionerDeployment != nil {
+	if result.RBDProvisioner != nil {
 		// get RBD provisioner tolerations and node affinity, defaults to common tolerations and node affinity if not specified
-		rbdProvisionerTolerations := getToleration(r.opConfig.Parameters, rbdProvisionerTolerationsEnv, provisionerTolerations)
-		rbdProvisionerNodeAffinity := getNodeAffinity(r.opConfig.Parameters, rbdProvisionerNodeAffinityEnv, provisionerNodeAffinity)
+		rbdProvisionerTolerations := getToleration(opConfig, rbdProvisionerTolerationsEnv, provisionerTolerations)
+		rbdProvisionerNodeAffinity := getNodeAffinity(opConfig, rbdProvisionerNodeAffinityEnv, provisionerNodeAffinity)
 		// apply RBD provisioner tolerations and node affinity
-		applyToPodSpec(&rbdProvisionerDeployment.Spec.Template.Spec, rbdProvisionerNodeAffinity, rbdProvisionerTolerations)
-		// apply resource request and limit to rbd provisioner containers
-		applyResourcesToContainers(r.opConfig.Parameters, rbdProvisionerResource, &rbdProvisionerDeployment.Spec.Template.Spec)
-		err = ownerInfo.SetControllerReference(rbdProvisionerDeployment)
-		if err != nil {
-			return errors.Wrapf(err, "failed to set owner reference to rbd provisioner deployment %q", rbdProvisionerDeployment.Name)
-		}
-		antiAffinity := GetPodAntiAffinity("app", csiRBDProvisioner)
-		rbdProvisionerDeployment.Spec.Template.Spec.Affinity.PodAntiAffinity = &antiAffinity
-		rbdProvisionerDeployment.Spec.Strategy = apps.DeploymentStrategy{
-			Type: apps.RecreateDeploymentStrategyType,
-		}
-
-		err = r.applyCephClusterNetworkConfig(r.opManagerContext, &rbdProvisionerDeployment.Spec.Template.ObjectMeta)
+		applyToPodSpec(&result.RBDProvisioner.Spec.Template.Spec, rbdProvisionerNodeAffinity, rbdProvisionerTolerations)
+		result.RBDProvisioner.Spec.Template.Spec.NodeSelector = getNodeSelector(opConfig, rbdProvisionerNodeSelectorEnv, provisionerNodeSelector)
+		applySeccompProfile(&result.RBDProvisioner.Spec.Template.Spec, provisionerSeccompProfile)
+		applyPodDNS(&result.RBDProvisioner.Spec.Template.Spec, dnsPolicy, dnsConfig)
+		applyRuntimeClassName(&result.RBDProvisioner.Spec.Template.Spec, tp.ProvisionerRuntimeClassName)
+		applyPodLabels(&result.RBDProvisioner.Spec.Template.ObjectMeta, tp.CSIRBDPodLabels)
+		applyPodAnnotations(&result.RBDProvisioner.Spec.Template.ObjectMeta, tp.CSIRBDPodAnnotations)
+		result.RBDProvisioner.Spec.Template.Spec.HostAliases = hostAliases
+		applyExtraEnvToContainer(&result.RBDProvisioner.Spec.Template.Spec, "csi-rbdplugin", provisionerExtraEnv)
+		err = applyExtraVolumes(&result.RBDProvisioner.Spec.Template.Spec, "csi-rbdplugin", provisionerVolumes, provisionerVolumeMounts)
 		if err != nil {
-			return errors.Wrapf(err, "failed to apply network config to rbd plugin provisioner deployment %q", rbdProvisionerDeployment.Name)
+			return nil, errors.Wrapf(err, "failed to apply the extra volumes of %q", provisionerVolumesEnv)
 		}
-		_, err = k8sutil.CreateOrUpdateDeployment(r.opManagerContext, r.context.Clientset, rbdProvisionerDeployment)
+		err = applySidecarSecurityContext(&result.RBDProvisioner.Spec.Template.Spec, provisionerSecurityContext)
 		if err != nil {
-			return errors.Wrapf(err, "failed to start rbd provisioner deployment %q", rbdProvisionerDeployment.Name)
+			return nil, err
 		}
-		k8sutil.AddRookVersionLabelToDeployment(rbdProvisionerDeployment)
-		logger.Info("successfully started CSI Ceph RBD driver")
-	}
-
-	if rbdService != nil {
-		rbdService.Namespace = r.opConfig.OperatorNamespace
-		err = ownerInfo.SetControllerReference(rbdService)
+		// apply resource request and limit to rbd provisioner containers
+		applyResourcesToContainers(opConfig, rbdProvisionerResource, &result.RBDProvisioner.Spec.Template.Spec)
+		err = applySidecarResources(opConfig, &result.RBDProvisioner.Spec.Template.Spec, rbdAttacherResource, rbdSnapshotterResource, rbdResizerResource)
 		if err != nil {
-			return errors.Wrapf(err, "failed to set owner reference to rbd service %q", rbdService)
+			return nil, err
 		}
-		_, err = k8sutil.CreateOrUpdateService(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, rbdService)
-		if err != nil {
-			return errors.Wrapf(err, "failed to create rbd service %q", rbdService.Name)
+		applyDefaultEphemeralStorage(&result.RBDProvisioner.Spec.Template.Spec, ephemeralStorageRequest)
+		applyProvisionerPodSpread(&result.RBDProvisioner.Spec.Template.Spec, csiRBDProvisioner, tp.ProvisionerAntiAffinityTopologyKey, tp.ProvisionerAntiAffinity, provisionerTopologySpreadConstraints)
+		result.RBDProvisioner.Spec.Strategy = getProvisionerDeploymentStrategy(tp.Param)
+		applyWorkerThreads(&result.RBDProvisioner.Spec.Template.Spec, tp.Param)
+		if tp.EnableRestrictedPSA {
+			applyRestrictedPodSecurity(&result.RBDProvisioner.Spec.Template.Spec)
 		}
 	}
 
-	if cephfsPlugin != nil {
+	if result.CephFSPlugin != nil {
 		// get CephFS plugin tolerations and node affinity, defaults to common tolerations and node affinity if not specified
-		cephFSPluginTolerations := getToleration(r.opConfig.Parameters, cephFSPluginTolerationsEnv, pluginTolerations)
-		cephFSPluginNodeAffinity := getNodeAffinity(r.opConfig.Parameters, cephFSPluginNodeAffinityEnv, pluginNodeAffinity)
+		cephFSPluginTolerations := getToleration(opConfig, cephFSPluginTolerationsEnv, pluginTolerations)
+		if tp.PluginTolerateAllTaints {
+			cephFSPluginTolerations = tolerateAllTaints()
+		}
+		cephFSPluginNodeAffinity := getNodeAffinity(opConfig, cephFSPluginNodeAffinityEnv, pluginNodeAffinity)
 		// apply CephFS plugin tolerations and node affinity
-		applyToPodSpec(&cephfsPlugin.Spec.Template.Spec, cephFSPluginNodeAffinity, cephFSPluginTolerations)
+		applyToPodSpec(&result.CephFSPlugin.Spec.Template.Spec, cephFSPluginNodeAffinity, cephFSPluginTolerations)
+		result.CephFSPlugin.Spec.Template.Spec.NodeSelector = getNodeSelector(opConfig, cephFSPluginNodeSelectorEnv, pluginNodeSelector)
+		applySeccompProfile(&result.CephFSPlugin.Spec.Template.Spec, pluginSeccompProfile)
+		applyTopologySpreadConstraints(&result.CephFSPlugin.Spec.Template.Spec, "csi-cephfsplugin", pluginTopologySpreadConstraints)
+		applyPodDNS(&result.CephFSPlugin.Spec.Template.Spec, dnsPolicy, dnsConfig)
+		applyRuntimeClassName(&result.CephFSPlugin.Spec.Template.Spec, tp.PluginRuntimeClassName)
+		applyPodLabels(&result.CephFSPlugin.Spec.Template.ObjectMeta, tp.CSICephFSPodLabels)
+		applyPodAnnotations(&result.CephFSPlugin.Spec.Template.ObjectMeta, tp.CSICephFSPodAnnotations)
+		result.CephFSPlugin.Spec.Template.Spec.HostAliases = hostAliases
+		applyExtraEnvToContainer(&result.CephFSPlugin.Spec.Template.Spec, "csi-cephfsplugin", pluginExtraEnv)
+		err = applySidecarSecurityContext(&result.CephFSPlugin.Spec.Template.Spec, pluginSecurityContext)
+		if err != nil {
+			return nil, err
+		}
 		// apply resource request and limit to cephfs plugin containers
-		applyResourcesToContainers(r.opConfig.Parameters, cephFSPluginResource, &cephfsPlugin.Spec.Template.Spec)
+		applyResourcesToContainers(opConfig, cephFSPluginResource, &result.CephFSPlugin.Spec.Template.Spec)
+		applyDefaultEphemeralStorage(&result.CephFSPlugin.Spec.Template.Spec, ephemeralStorageRequest)
 		// apply custom mounts to volumes
-		applyVolumeToPodSpec(r.opConfig.Parameters, cephFSPluginVolume, &cephfsPlugin.Spec.Template.Spec)
+		applyVolumeToPodSpec(opConfig, cephFSPluginVolume, &result.CephFSPlugin.Spec.Template.Spec)
 		// apply custom mounts to volume mounts
-		applyVolumeMountToContainer(r.opConfig.Parameters, cephFSPluginVolumeMount, "csi-cephfsplugin", &cephfsPlugin.Spec.Template.Spec)
-		err = ownerInfo.SetControllerReference(cephfsPlugin)
+		applyVolumeMountToContainer(opConfig, cephFSPluginVolumeMount, "csi-cephfsplugin", &result.CephFSPlugin.Spec.Template.Spec)
+		err = applyExtraVolumes(&result.CephFSPlugin.Spec.Template.Spec, "csi-cephfsplugin", pluginVolumes, pluginVolumeMounts)
 		if err != nil {
-			return errors.Wrapf(err, "failed to set owner reference to cephfs plugin daemonset %q", cephfsPlugin.Name)
+			return nil, errors.Wrapf(err, "failed to apply the extra volumes of %q", pluginVolumesEnv)
 		}
-		err = r.applyCephClusterNetworkConfig(r.opManagerContext, &cephfsPlugin.Spec.Template.ObjectMeta)
-		if err != nil {
-			return errors.Wrapf(err, "failed to apply network config to cephfs plugin daemonset %q", cephfsPlugin.Name)
-		}
-
-		err = k8sutil.CreateDaemonSet(r.opManagerContext, r.opConfig.OperatorNamespace, r.context.Clientset, cephfsPlugin)
-		if err != nil {
-			return errors.Wrapf(err, "failed to start cephfs plugin daemonset %q", cephfsPlugin.Name)
-		}
-		k8sutil.AddRookVersionLabelToDaemonSet(cephfsPlugin)
 	}
 
-	if cephfsProvisionerDeployment != nil {
+	if result.CephFSProvisioner != nil {
 		// get CephFS provisioner tolerations and node affinity, defaults to common tolerations and node affinity if not specified
-		cephFSProvisionerTolerations := getToleration(r.opConfig.Parameters, cephFSProvisionerTolerationsEnv, provisionerTolerations)
-		cephFSProvisionerNodeAffinity := getNodeAffinity(r.opConfig.Parameters, cephFSProvisionerNodeAffinityEnv, provisionerNodeAffinity)
+		cephFSProvisionerTolerations := getToleration(opConfig, cephFSProvisionerTolerationsEnv, provisionerTolerations)
+		cephFSProvisionerNodeAffinity := getNodeAffinity(opConfig, cephFSProvisionerNodeAffinityEnv, provisionerNodeAffinity)
 		// apply CephFS provisioner tolerations and node affinity
-		applyToPodSpec(&cephfsProvisionerDeployment.Spec.Template.Spec, cephFSProvisionerNodeAffinity, cephFSProvisionerTolerations)
+		applyToPodSpec(&result.CephFSProvisioner.Spec.Template.Spec, cephFSProvisionerNodeAffinity, cephFSProvisionerTolerations)
+		result.CephFSProvisioner.Spec.Template.Spec.NodeSelector = getNodeSelector(opConfig, cephFSProvisionerNodeSelectorEnv, provisionerNodeSelector)
+		applySeccompProfile(&result.CephFSProvisioner.Spec.Template.Spec, provisionerSeccompProfile)
+		applyPodDNS(&result.CephFSProvisioner.Spec.Template.Spec, dnsPolicy, dnsConfig)
+		applyRuntimeClassName(&result.CephFSProvisioner.Spec.Template.Spec, tp.ProvisionerRuntimeClassName)
+		applyPodLabels(&result.CephFSProvisioner.Spec.Template.ObjectMeta, tp.CSICephFSPodLabels)
+		applyPodAnnotations(&result.CephFSProvisioner.Spec.Template.ObjectMeta, tp.CSICephFSPodAnnotations)
+		result.CephFSProvisioner.Spec.Template.Spec.HostAliases = hostAliases
+		applyExtraEnvToContainer(&result.CephFSProvisioner.Spec.Template.Spec, "csi-cephfsplugin", provisionerExtraEnv)
+		err = applyExtraVolumes(&result.CephFSProvisioner.Spec.Template.Spec, "csi-cephfsplugin", provisionerVolumes, provisionerVolumeMounts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to apply the extra volumes of %q", provisionerVolumesEnv)
+		}
+		err = applySidecarSecurityContext(&result.CephFSProvisioner.Spec.Template.Spec, provisionerSecurityContext)
+		if err != nil {
+			return nil, err
+		}
 		// get resource details for cephfs provisioner
 		// apply resource request and limit to cephfs provisioner containers
-		applyResourcesToContainers(r.opConfig.Parameters, cephFSProvisionerResource, &cephfsProvisionerDeployment.Spec.Template.Spec)
-		err = ownerInfo.SetControllerReference(cephfsProvisionerDeployment)
+		applyResourcesToContainers(opConfig, cephFSProvisionerResource, &result.CephFSProvisioner.Spec.Template.Spec)
+		err = applySidecarResources(opConfig, &result.CephFSProvisioner.Spec.Template.Spec, cephFSAttacherResource, cephFSSnapshotterResource, cephFSResizerResource)
 		if err != nil {
-			return errors.Wrapf(err, "failed to set owner reference to cephfs provisioner deployment %q", cephfsProvisionerDeployment.Name)
+			return nil, err
 		}
-		antiAffinity := GetPodAntiAffinity("app", csiCephFSProvisioner)
-		cephfsProvisionerDeployment.Spec.Template.Spec.Affinity.PodAntiAffinity = &antiAffinity
-		cephfsProvisionerDeployment.Spec.Strategy = apps.DeploymentStrategy{
-			Type: apps.RecreateDeploymentStrategyType,
+		applyDefaultEphemeralStorage(&result.CephFSProvisioner.Spec.Template.Spec, ephemeralStorageRequest)
+		applyProvisionerPodSpread(&result.CephFSProvisioner.Spec.Template.Spec, csiCephFSProvisioner, tp.ProvisionerAntiAffinityTopologyKey, tp.ProvisionerAntiAffinity, provisionerTopologySpreadConstraints)
+		result.CephFSProvisioner.Spec.Strategy = getProvisionerDeploymentStrategy(tp.Param)
+		applyWorkerThreads(&result.CephFSProvisioner.Spec.Template.Spec, tp.Param)
+		if tp.EnableRestrictedPSA {
+			applyRestrictedPodSecurity(&result.CephFSProvisioner.Spec.Template.Spec)
 		}
+	}
 
-		err = r.applyCephClusterNetworkConfig(r.opManagerContext, &cephfsProvisionerDeployment.Spec.Template.ObjectMeta)
+	if result.NFSPlugin != nil {
+		// get NFS plugin tolerations and node affinity, defaults to common tolerations and node affinity if not specified
+		nfsPluginTolerations := getToleration(opConfig, nfsPluginTolerationsEnv, pluginTolerations)
+		if tp.PluginTolerateAllTaints {
+			nfsPluginTolerations = tolerateAllTaints()
+		}
+		nfsPluginNodeAffinity := getNodeAffinity(opConfig, nfsPluginNodeAffinityEnv, pluginNodeAffinity)
+		// apply NFS plugin tolerations and node affinity
+		applyToPodSpec(&result.NFSPlugin.Spec.Template.Spec, nfsPluginNodeAffinity, nfsPluginTolerations)
+		result.NFSPlugin.Spec.Template.Spec.NodeSelector = getNodeSelector(opConfig, nfsPluginNodeSelectorEnv, pluginNodeSelector)
+		applySeccompProfile(&result.NFSPlugin.Spec.Template.Spec, pluginSeccompProfile)
+		applyTopologySpreadConstraints(&result.NFSPlugin.Spec.Template.Spec, "csi-nfsplugin", pluginTopologySpreadConstraints)
+		applyPodDNS(&result.NFSPlugin.Spec.Template.Spec, dnsPolicy, dnsConfig)
+		applyRuntimeClassName(&result.NFSPlugin.Spec.Template.Spec, tp.PluginRuntimeClassName)
+		applyPodLabels(&result.NFSPlugin.Spec.Template.ObjectMeta, tp.CSINFSPodLabels)
+		applyPodAnnotations(&result.NFSPlugin.Spec.Template.ObjectMeta, tp.CSINFSPodAnnotations)
+		result.NFSPlugin.Spec.Template.Spec.HostAliases = hostAliases
+		applyExtraEnvToContainer(&result.NFSPlugin.Spec.Template.Spec, "csi-nfsplugin", pluginExtraEnv)
+		err = applySidecarSecurityContext(&result.NFSPlugin.Spec.Template.Spec, pluginSecurityContext)
 		if err != nil {
-			return errors.Wrapf(err, "failed to apply network config to cephfs plugin provisioner deployment %q", cephfsProvisionerDeployment.Name)
+			return nil, err
 		}
-
-		_, err = k8sutil.CreateOrUpdateDeployment(r.opManagerContext, r.context.Clientset, cephfsProvisionerDeployment)
+		// apply resource request and limit to nfs plugin containers
+		applyResourcesToContainers(opConfig, nfsPluginResource, &result.NFSPlugin.Spec.Template.Spec)
+		applyDefaultEphemeralStorage(&result.NFSPlugin.Spec.Template.Spec, ephemeralStorageRequest)
+		// apply custom mounts to volumes
+		applyVolumeToPodSpec(opConfig, nfsPluginVolume, &result.NFSPlugin.Spec.Template.Spec)
+		// apply custom mounts to volume mounts
+		applyVolumeMountToContainer(opConfig, nfsPluginVolumeMount, "csi-nfsplugin", &result.NFSPlugin.Spec.Template.Spec)
+		err = applyExtraVolumes(&result.NFSPlugin.Spec.Template.Spec, "csi-nfsplugin", pluginVolumes, pluginVolumeMounts)
 		if err != nil {
-			return errors.Wrapf(err, "failed to start cephfs provisioner deployment %q", cephfsProvisionerDeployment.Name)
+			return nil, errors.Wrapf(err, "failed to apply the extra volumes of %q", pluginVolumesEnv)
 		}
-		k8sutil.AddRookVersionLabelToDeployment(cephfsProvisionerDeployment)
-		logger.Info("successfully started CSI CephFS driver")
 	}
-	if cephfsService != nil {
-		err = ownerInfo.SetControllerReference(cephfsService)
+
+	if result.NFSProvisioner != nil {
+		// get NFS provisioner tolerations and node affinity, defaults to common tolerations and node affinity if not specified
+		nfsProvisionerTolerations := getToleration(opConfig, nfsProvisionerTolerationsEnv, provisionerTolerations)
+		nfsProvisionerNodeAffinity := getNodeAffinity(opConfig, nfsProvisionerNodeAffinityEnv, provisionerNodeAffinity)
+		// apply NFS provisioner tolerations and node affinity
+		applyToPodSpec(&result.NFSProvisioner.Spec.Template.Spec, nfsProvisionerNodeAffinity, nfsProvisionerTolerations)
+		result.NFSProvisioner.Spec.Template.Spec.NodeSelector = getNodeSelector(opConfig, nfsProvisionerNodeSelectorEnv, provisionerNodeSelector)
+		applySeccompProfile(&result.NFSProvisioner.Spec.Template.Spec, provisionerSeccompProfile)
+		applyPodDNS(&result.NFSProvisioner.Spec.Template.Spec, dnsPolicy, dnsConfig)
+		applyRuntimeClassName(&result.NFSProvisioner.Spec.Template.Spec, tp.ProvisionerRuntimeClassName)
+		applyPodLabels(&result.NFSProvisioner.Spec.Template.ObjectMeta, tp.CSINFSPodLabels)
+		applyPodAnnotations(&result.NFSProvisioner.Spec.Template.ObjectMeta, tp.CSINFSPodAnnotations)
+		result.NFSProvisioner.Spec.Template.Spec.HostAliases = hostAliases
+		applyExtraEnvToContainer(&result.NFSProvisioner.Spec.Template.Spec, "csi-nfsplugin", provisionerExtraEnv)
+		err = applyExtraVolumes(&result.NFSProvisioner.Spec.Template.Spec, "csi-nfsplugin", provisionerVolumes, provisionerVolumeMounts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to apply the extra volumes of %q", provisionerVolumesEnv)
+		}
+		err = applySidecarSecurityContext(&result.NFSProvisioner.Spec.Template.Spec, provisionerSecurityContext)
 		if err != nil {
-			return errors.Wrapf(err, "failed to set owner reference to cephfs service %q", cephfsService)
+			return nil, err
 		}
-		_, err = k8sutil.CreateOrUpdateService(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, cephfsService)
+		// get resource details for nfs provisioner
+		// apply resource request and limit to nfs provisioner containers
+		applyResourcesToContainers(opConfig, nfsProvisionerResource, &result.NFSProvisioner.Spec.Template.Spec)
+		err = applySidecarResources(opConfig, &result.NFSProvisioner.Spec.Template.Spec, nfsAttacherResource, nfsSnapshotterResource, nfsResizerResource)
 		if err != nil {
-			return errors.Wrapf(err, "failed to create cephfs service %q", cephfsService.Name)
+			return nil, err
+		}
+		applyDefaultEphemeralStorage(&result.NFSProvisioner.Spec.Template.Spec, ephemeralStorageRequest)
+		applyProvisionerPodSpread(&result.NFSProvisioner.Spec.Template.Spec, csiNFSProvisioner, tp.ProvisionerAntiAffinityTopologyKey, tp.ProvisionerAntiAffinity, provisionerTopologySpreadConstraints)
+		result.NFSProvisioner.Spec.Strategy = getProvisionerDeploymentStrategy(tp.Param)
+		applyWorkerThreads(&result.NFSProvisioner.Spec.Template.Spec, tp.Param)
+		if tp.EnableRestrictedPSA {
+			applyRestrictedPodSecurity(&result.NFSProvisioner.Spec.Template.Spec)
 		}
 	}
 
-	if nfsPlugin != nil {
-		// get NFS plugin tolerations and node affinity, defaults to common tolerations and node affinity if not specified
-		nfsPluginTolerations := getToleration(r.opConfig.Parameters, nfsPluginTolerationsEnv, pluginTolerations)
-		nfsPluginNodeAffinity := getNodeAffinity(r.opConfig.Parameters, nfsPluginNodeAffinityEnv, pluginNodeAffinity)
-		// apply NFS plugin tolerations and node affinity
-		applyToPodSpec(&nfsPlugin.Spec.Template.Spec, nfsPluginNodeAffinity, nfsPluginTolerations)
-		// apply resource request and limit to nfs plugin containers
-		applyResourcesToContainers(r.opConfig.Parameters, nfsPluginResource, &nfsPlugin.Spec.Template.Spec)
-		// apply custom mounts to volumes
-		applyVolumeToPodSpec(r.opConfig.Parameters, nfsPluginVolume, &nfsPlugin.Spec.Template.Spec)
-		// apply custom mounts to volume mounts
-		applyVolumeMountToContainer(r.opConfig.Parameters, nfsPluginVolumeMount, "csi-nfsplugin", &nfsPlugin.Spec.Template.Spec)
-		err = ownerInfo.SetControllerReference(nfsPlugin)
+	return result, nil
+}
+
+func (r *ReconcileCSI) startDrivers(ownerInfo *k8sutil.OwnerInfo) error {
+	var err error
+
+	// work on a copy so that a concurrent reconcile updating CSIParam does not change the
+	// parameters while the drivers are rendered
+	tp := templateParam{
+		Param:     *CSIParam.DeepCopy(),
+		Namespace: r.opConfig.OperatorNamespace,
+	}
+	tp.KubeletDirPath = r.getKubeletDirPath(ownerInfo)
+	tp.EnableStorageCapacity = csiDriverStorageCapacity(r.context.Clientset, tp.EnableStorageCapacity)
+
+	// check the prerequisites before any resource is created
+	if errs := PreflightChecks(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, tp.Param); len(errs) > 0 {
+		return errors.Wrap(stderrors.Join(errs...), "csi preflight checks failed")
+	}
+
+	err = validateTemplateParam(tp)
+	if err != nil {
+		return err
+	}
+
+	r.validateSidecarVersions(tp.Param)
+	r.checkPriorityClasses(tp.Param)
+	r.checkRuntimeClasses(tp.Param)
+
+	err = validateCSIDriverNamePrefix(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, tp.DriverNamePrefix)
+	if err != nil {
+		return err
+	}
+	// Add a dot at the end of the prefix for having the driver name prefix
+	// with format <prefix>.<driver-name>
+	tp.DriverNamePrefix = fmt.Sprintf("%s.", tp.DriverNamePrefix)
+
+	CephFSDriverName = tp.DriverNamePrefix + cephFSDriverSuffix
+	RBDDriverName = tp.DriverNamePrefix + rbdDriverSuffix
+	NFSDriverName = tp.DriverNamePrefix + nfsDriverSuffix
+
+	err = cleanupOrphanCSIDriverObjects(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, []string{RBDDriverName, CephFSDriverName, NFSDriverName})
+	if err != nil {
+		return errors.Wrap(err, "failed to clean up orphan CSIDriver objects")
+	}
+
+	tp.Param.MountCustomCephConf = CustomCSICephConfigExists
+
+	r.checkImagePullSecrets(getImagePullSecrets(tp.Param))
+
+	paramHash, err := r.csiDriversHash(tp)
+	if err != nil {
+		return errors.Wrap(err, "failed to compute csi parameters hash")
+	}
+	// the daemonsets and deployments are only written when the parameters changed or they were
+	// edited, the resources depending on them are reconciled on every pass
+	upToDate := r.csiDriversUpToDate(paramHash)
+	if upToDate {
+		logger.Debug("csi driver daemonsets and deployments are up to date")
+	}
+
+	rendered, err := renderCSIDrivers(tp, r.opConfig.Parameters)
+	if err != nil {
+		return err
+	}
+	if !upToDate {
+		r.checkResourceContainers(rendered)
+		err = r.applyCSIDriverWorkloads(rendered, paramHash, ownerInfo)
 		if err != nil {
-			return errors.Wrapf(err, "failed to set owner reference to nfs plugin daemonset %q", nfsPlugin.Name)
+			return err
+		}
+	}
+
+	for _, service := range []*corev1.Service{rendered.RBDService, rendered.CephFSService, rendered.NFSService} {
+		if service == nil {
+			continue
 		}
-		err = r.applyCephClusterNetworkConfig(r.opManagerContext, &nfsPlugin.Spec.Template.ObjectMeta)
+		service.Namespace = r.opConfig.OperatorNamespace
+		err = ownerInfo.SetControllerReference(service)
 		if err != nil {
-			return errors.Wrapf(err, "failed to apply network config to nfs plugin daemonset %q", nfsPlugin.Name)
+			return errors.Wrapf(err, "failed to set owner reference to service %q", service.Name)
 		}
-
-		err = k8sutil.CreateDaemonSet(r.opManagerContext, r.opConfig.OperatorNamespace, r.context.Clientset, nfsPlugin)
+		_, err = k8sutil.CreateOrUpdateService(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, service)
 		if err != nil {
-			return errors.Wrapf(err, "failed to start nfs plugin daemonset %q", nfsPlugin.Name)
+			return errors.Wrapf(err, "failed to create service %q", service.Name)
 		}
-		k8sutil.AddRookVersionLabelToDaemonSet(nfsPlugin)
 	}
 
-	if nfsProvisionerDeployment != nil {
-		// get NFS provisioner tolerations and node affinity, defaults to common tolerations and node affinity if not specified
-		nfsProvisionerTolerations := getToleration(r.opConfig.Parameters, nfsProvisionerTolerationsEnv, provisionerTolerations)
-		nfsProvisionerNodeAffinity := getNodeAffinity(r.opConfig.Parameters, nfsProvisionerNodeAffinityEnv, provisionerNodeAffinity)
-		// apply NFS provisioner tolerations and node affinity
-		applyToPodSpec(&nfsProvisionerDeployment.Spec.Template.Spec, nfsProvisionerNodeAffinity, nfsProvisionerTolerations)
-		// get resource details for nfs provisioner
-		// apply resource request and limit to nfs provisioner containers
-		applyResourcesToContainers(r.opConfig.Parameters, nfsProvisionerResource, &nfsProvisionerDeployment.Spec.Template.Spec)
-		err = ownerInfo.SetControllerReference(nfsProvisionerDeployment)
+	err = r.reconcileCSIServiceMonitors(tp)
+	if err != nil {
+		return errors.Wrap(err, "failed to reconcile csi service monitors")
+	}
+
+	if tp.EnableSnapshotValidationWebhook {
+		err = r.reconcileSnapshotValidationWebhook(tp, ownerInfo)
 		if err != nil {
-			return errors.Wrapf(err, "failed to set owner reference to nfs provisioner deployment %q", nfsProvisionerDeployment.Name)
+			return errors.Wrap(err, "failed to start csi snapshot validation webhook")
+		}
+	}
+
+	err = r.reconcileCSIDriverObjects(tp)
+	if err != nil {
+		return err
+	}
+
+	err = writeCSIDebugConfigMap(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, tp)
+	if err != nil {
+		// the active config is informational only, it must not fail the reconcile
+		logger.Warningf("failed to write the csi active config. %v", err)
+	}
+
+	for _, driver := range []struct {
+		enabled bool
+		name    string
+	}{{EnableRBD, RBDDriverName}, {EnableCephFS, CephFSDriverName}, {EnableNFS, NFSDriverName}} {
+		if driver.enabled {
+			r.recordCSIEvent(corev1.EventTypeNormal, csiDriverStartedReason, fmt.Sprintf("successfully started csi driver %q", driver.name))
+		}
+	}
+
+	return nil
+}
+
+// applyCSIDriverWorkloads creates or updates the plugin daemonsets and the provisioner deployments
+// of the enabled drivers, and records on them the parameters hash they were applied with
+func (r *ReconcileCSI) applyCSIDriverWorkloads(rendered *StartDriversResult, paramHash string, ownerInfo *k8sutil.OwnerInfo) error {
+	type appliedProvisioner struct {
+		driver string
+		name   string
+	}
+	var provisioners []appliedProvisioner
+	for _, driver := range []struct {
+		name        string
+		plugin      *apps.DaemonSet
+		provisioner *apps.Deployment
+	}{
+		{"Ceph RBD", rendered.RBDPlugin, rendered.RBDProvisioner},
+		{"CephFS", rendered.CephFSPlugin, rendered.CephFSProvisioner},
+		{"NFS", rendered.NFSPlugin, rendered.NFSProvisioner},
+	} {
+		if driver.plugin != nil {
+			plugin := driver.plugin
+			err := ownerInfo.SetControllerReference(plugin)
+			if err != nil {
+				return errors.Wrapf(err, "failed to set owner reference to plugin daemonset %q", plugin.Name)
+			}
+			err = r.applyCephClusterNetworkConfig(r.opManagerContext, &plugin.Spec.Template.ObjectMeta)
+			if err != nil {
+				return errors.Wrapf(err, "failed to apply network config to plugin daemonset %q", plugin.Name)
+			}
+			err = k8sutil.CreateDaemonSet(r.opManagerContext, r.opConfig.OperatorNamespace, r.context.Clientset, plugin)
+			if err != nil {
+				return errors.Wrapf(err, "failed to start plugin daemonset %q", plugin.Name)
+			}
+			err = r.setDaemonSetParamHash(plugin.Name, paramHash)
+			if err != nil {
+				return err
+			}
+			k8sutil.AddRookVersionLabelToDaemonSet(plugin)
 		}
-		antiAffinity := GetPodAntiAffinity("app", csiNFSProvisioner)
-		nfsProvisionerDeployment.Spec.Template.Spec.Affinity.PodAntiAffinity = &antiAffinity
-		nfsProvisionerDeployment.Spec.Strategy = apps.DeploymentStrategy{
-			Type: apps.RecreateDeploymentStrategyType,
+
+		if driver.provisioner != nil {
+			provisioner := driver.provisioner
+			err := ownerInfo.SetControllerReference(provisioner)
+			if err != nil {
+				return errors.Wrapf(err, "failed to set owner reference to provisioner deployment %q", provisioner.Name)
+			}
+			err = r.applyCephClusterNetworkConfig(r.opManagerContext, &provisioner.Spec.Template.ObjectMeta)
+			if err != nil {
+				return errors.Wrapf(err, "failed to apply network config to provisioner deployment %q", provisioner.Name)
+			}
+			_, err = k8sutil.CreateOrUpdateDeployment(r.opManagerContext, r.context.Clientset, provisioner)
+			if err != nil {
+				return errors.Wrapf(err, "failed to start provisioner deployment %q", provisioner.Name)
+			}
+			k8sutil.AddRookVersionLabelToDeployment(provisioner)
+			err = r.reconcileProvisionerPDB(provisioner.Name, ownerInfo)
+			if err != nil {
+				return errors.Wrapf(err, "failed to reconcile provisioner pdb of %q", provisioner.Name)
+			}
+			provisioners = append(provisioners, appliedProvisioner{driver: driver.name, name: provisioner.Name})
 		}
+	}
 
-		err = r.applyCephClusterNetworkConfig(r.opManagerContext, &nfsProvisionerDeployment.Spec.Template.ObjectMeta)
+	// the provisioners of all the drivers roll out together and are waited for with a shared
+	// deadline, so that a stuck provisioner does not hold back the other drivers. The hash is only
+	// recorded once the rollout succeeded, so that a failed rollout is retried on the next reconcile.
+	ctx := r.opManagerContext
+	if CSIParam.DriverRolloutTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CSIParam.DriverRolloutTimeout)
+		defer cancel()
+	}
+	var errs []error
+	for _, provisioner := range provisioners {
+		err := r.waitForProvisionerRollout(ctx, provisioner.name)
 		if err != nil {
-			return errors.Wrapf(err, "failed to apply network config to nfs provisioner deployment %q", nfsProvisionerDeployment.Name)
+			errs = append(errs, errors.Wrapf(err, "failed to roll out provisioner deployment %q", provisioner.name))
+			continue
 		}
-		_, err = k8sutil.CreateOrUpdateDeployment(r.opManagerContext, r.context.Clientset, nfsProvisionerDeployment)
+		err = r.setDeploymentParamHash(provisioner.name, paramHash)
 		if err != nil {
-			return errors.Wrapf(err, "failed to start nfs provisioner deployment %q", nfsProvisionerDeployment.Name)
+			errs = append(errs, err)
+			continue
 		}
-		k8sutil.AddRookVersionLabelToDeployment(nfsProvisionerDeployment)
-		logger.Info("successfully started CSI NFS driver")
+		logger.Infof("successfully started CSI %s driver", provisioner.driver)
 	}
+	return stderrors.Join(errs...)
+}
 
+// reconcileCSIDriverObjects creates the CSIDriver objects of the enabled drivers and repairs the
+// ones that drifted from the desired spec
+func (r *ReconcileCSI) reconcileCSIDriverObjects(tp templateParam) error {
+	var err error
+	csiDriverobj := v1CsiDriver{
+		recreated: func(message string) {
+			r.recordOperatorEvent(corev1.EventTypeWarning, csiDriverRecreatedReason, message)
+		},
+		notOwned: func(message string) {
+			r.recordOperatorEvent(corev1.EventTypeWarning, csiDriverNotOwnedReason, message)
+		},
+	}
+	seLinuxMount := csiDriverSELinuxMount(r.context.Clientset, tp.EnableCSIDriverSeLinuxMount)
 	if EnableRBD {
 		err = csiDriverobj.createCSIDriverInfo(
-			r.opManagerContext, r.context.Clientset,
+			r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace,
 			RBDDriverName, k8sutil.GetValue(r.opConfig.Parameters, "CSI_RBD_FSGROUPPOLICY", string(k8scsi.FileFSGroupPolicy)),
-			tp.Param.RBDAttachRequired, CSIParam.EnableCSIDriverSeLinuxMount)
+			tp.Param.RBDAttachRequired, tp.RBDPodInfoOnMount, seLinuxMount, tp.EnableStorageCapacity, tp.TokenProjectionAudience)
 		if err != nil {
 			return errors.Wrapf(err, "failed to create CSI driver object for %q", RBDDriverName)
 		}
 	}
 	if EnableCephFS {
 		err = csiDriverobj.createCSIDriverInfo(
-			r.opManagerContext, r.context.Clientset,
+			r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace,
 			CephFSDriverName, k8sutil.GetValue(r.opConfig.Parameters, "CSI_CEPHFS_FSGROUPPOLICY", string(k8scsi.FileFSGroupPolicy)),
-			tp.Param.CephFSAttachRequired, CSIParam.EnableCSIDriverSeLinuxMount)
+			tp.Param.CephFSAttachRequired, tp.CephFSPodInfoOnMount, seLinuxMount, tp.EnableStorageCapacity, tp.TokenProjectionAudience)
 		if err != nil {
 			return errors.Wrapf(err, "failed to create CSI driver object for %q", CephFSDriverName)
 		}
 	}
 	if EnableNFS {
-		err = csiDriverobj.createCSIDriverInfo(r.opManagerContext, r.context.Clientset,
+		err = csiDriverobj.createCSIDriverInfo(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace,
 			NFSDriverName, k8sutil.GetValue(r.opConfig.Parameters, "CSI_NFS_FSGROUPPOLICY", string(k8scsi.FileFSGroupPolicy)),
-			tp.Param.NFSAttachRequired, CSIParam.EnableCSIDriverSeLinuxMount)
+			tp.Param.NFSAttachRequired, false, seLinuxMount, tp.EnableStorageCapacity, tp.TokenProjectionAudience)
 		if err != nil {
 			return errors.Wrapf(err, "failed to create CSI driver object for %q", NFSDriverName)
 		}
@@ -657,44 +1368,92 @@ func (r *ReconcileCSI) startDrivers(ownerInfo *k8sutil.OwnerInfo) error {
 	return nil
 }
 
-func (r *ReconcileCSI) stopDrivers() error {
+// stopDrivers removes the resources of the disabled drivers, or of all the drivers when stopAll is
+// set, without changing which drivers are enabled
+func (r *ReconcileCSI) stopDrivers(stopAll bool) error {
 	RBDDriverName = fmt.Sprintf("%s.rbd.csi.ceph.com", r.opConfig.OperatorNamespace)
 	CephFSDriverName = fmt.Sprintf("%s.cephfs.csi.ceph.com", r.opConfig.OperatorNamespace)
 	NFSDriverName = fmt.Sprintf("%s.nfs.csi.ceph.com", r.opConfig.OperatorNamespace)
 
-	if !EnableRBD || EnableCSIOperator() {
+	// attempt to remove all the disabled drivers even if removing one of them fails, so that a
+	// single failure does not leave the resources of the other drivers behind
+	var errs []error
+
+	if stopAll || !EnableRBD || EnableCSIOperator() {
 		logger.Debugf("either EnableRBD if `false` or EnableCSIOperator is `true`, `EnableRBD is %t` and `EnableCSIOperator is %t", EnableRBD, EnableCSIOperator())
-		err := r.deleteCSIDriverResources(CsiRBDPlugin, csiRBDProvisioner, "csi-rbdplugin-metrics", RBDDriverName)
+		deployed := r.csiDaemonSetExists(CsiRBDPlugin)
+		err := r.deleteCSIDriverResources(CsiRBDPlugin, csiRBDProvisioner, rbdMetricsServiceName, RBDDriverName)
 		if err != nil {
-			return errors.Wrap(err, "failed to remove CSI Ceph RBD driver")
+			errs = append(errs, errors.Wrap(err, "failed to remove CSI Ceph RBD driver"))
+		} else {
+			logger.Info("successfully removed CSI Ceph RBD driver")
+			if deployed {
+				r.recordCSIEvent(corev1.EventTypeNormal, csiDriverStoppedReason, fmt.Sprintf("successfully stopped csi driver %q", RBDDriverName))
+			}
 		}
-		logger.Info("successfully removed CSI Ceph RBD driver")
 	}
 
-	if !EnableCephFS || EnableCSIOperator() {
+	if stopAll || !EnableCephFS || EnableCSIOperator() {
 		logger.Debugf("either EnableCephFS if `false` or EnableCSIOperator is `true`, `EnableCephFS is %t` and `EnableCSIOperator is %t", EnableRBD, EnableCSIOperator())
-		err := r.deleteCSIDriverResources(CsiCephFSPlugin, csiCephFSProvisioner, "csi-cephfsplugin-metrics", CephFSDriverName)
+		deployed := r.csiDaemonSetExists(CsiCephFSPlugin)
+		err := r.deleteCSIDriverResources(CsiCephFSPlugin, csiCephFSProvisioner, cephFSMetricsServiceName, CephFSDriverName)
 		if err != nil {
-			return errors.Wrap(err, "failed to remove CSI CephFS driver")
+			errs = append(errs, errors.Wrap(err, "failed to remove CSI CephFS driver"))
+		} else {
+			logger.Info("successfully removed CSI CephFS driver")
+			if deployed {
+				r.recordCSIEvent(corev1.EventTypeNormal, csiDriverStoppedReason, fmt.Sprintf("successfully stopped csi driver %q", CephFSDriverName))
+			}
 		}
-		logger.Info("successfully removed CSI CephFS driver")
 	}
 
-	if !EnableNFS || EnableCSIOperator() {
+	if stopAll || !EnableNFS || EnableCSIOperator() {
 		logger.Debugf("either EnableNFS if `false` or EnableCSIOperator is `true`, `EnableNFS is %t` and `EnableCSIOperator is %t", EnableRBD, EnableCSIOperator())
-		err := r.deleteCSIDriverResources(CsiNFSPlugin, csiNFSProvisioner, "csi-nfsplugin-metrics", NFSDriverName)
+		deployed := r.csiDaemonSetExists(CsiNFSPlugin)
+		err := r.deleteCSIDriverResources(CsiNFSPlugin, csiNFSProvisioner, nfsMetricsServiceName, NFSDriverName)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "failed to remove CSI NFS driver"))
+		} else {
+			logger.Info("successfully removed CSI NFS driver")
+			if deployed {
+				r.recordCSIEvent(corev1.EventTypeNormal, csiDriverStoppedReason, fmt.Sprintf("successfully stopped csi driver %q", NFSDriverName))
+			}
+		}
+	}
+
+	if stopAll || !CSIParam.EnableSnapshotValidationWebhook || EnableCSIOperator() {
+		err := r.deleteSnapshotValidationWebhook()
 		if err != nil {
-			return errors.Wrap(err, "failed to remove CSI NFS driver")
+			errs = append(errs, errors.Wrap(err, "failed to remove csi snapshot validation webhook"))
 		}
-		logger.Info("successfully removed CSI NFS driver")
 	}
 
-	return nil
+	if stopAll || (!EnableRBD && !EnableCephFS && !EnableNFS) || EnableCSIOperator() {
+		err := k8sutil.DeleteConfigMap(r.opManagerContext, r.context.Clientset, CsiActiveConfigMap, r.opConfig.OperatorNamespace, &k8sutil.DeleteOptions{})
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to delete csi active config configmap %q", CsiActiveConfigMap))
+		}
+	}
+
+	err := stderrors.Join(errs...)
+	r.saveCSIStatus(err)
+	return err
+}
+
+func (r *ReconcileCSI) csiDaemonSetExists(name string) bool {
+	_, err := r.context.Clientset.AppsV1().DaemonSets(r.opConfig.OperatorNamespace).Get(r.opManagerContext, name, metav1.GetOptions{})
+	return err == nil
 }
 
 func (r *ReconcileCSI) deleteCSIDriverResources(daemonset, deployment, service, driverName string) error {
-	csiDriverobj := v1CsiDriver{}
-	err := k8sutil.DeleteDaemonset(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, daemonset)
+	csiDriverobj := v1CsiDriver{
+		notOwned: func(message string) {
+			r.recordOperatorEvent(corev1.EventTypeWarning, csiDriverNotOwnedReason, message)
+		},
+	}
+	// wait for the plugin pods to be gone, a reinstalled driver would otherwise race with the
+	// terminating pods for the mounts on the nodes
+	err := deleteDaemonSetAndWait(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, daemonset, CSIParam.DriverDeletionTimeout)
 	if err != nil {
 		return errors.Wrapf(err, "failed to delete the %q", daemonset)
 	}
@@ -709,8 +1468,18 @@ func (r *ReconcileCSI) deleteCSIDriverResources(daemonset, deployment, service,
 		return errors.Wrapf(err, "failed to delete the %q", service)
 	}
 
+	err = r.removeCSIServiceMonitor(service)
+	if err != nil {
+		return err
+	}
+
+	err = deleteProvisionerPDB(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, deployment)
+	if err != nil {
+		return err
+	}
+
 	if !EnableCSIOperator() {
-		err = csiDriverobj.deleteCSIDriverInfo(r.opManagerContext, r.context.Clientset, driverName)
+		err = csiDriverobj.deleteCSIDriverInfo(r.opManagerContext, r.context.Clientset, r.opConfig.OperatorNamespace, driverName)
 		if err != nil {
 			return errors.Wrapf(err, "failed to delete %q Driver Info", driverName)
 		}
@@ -719,18 +1488,359 @@ func (r *ReconcileCSI) deleteCSIDriverResources(daemonset, deployment, service,
 	return nil
 }
 
+// csiDriversHash returns the digest of everything the csi driver resources are rendered from: the
+// csi parameters, the operator settings, the enabled drivers and the multus networks of the clusters
+func (r *ReconcileCSI) csiDriversHash(tp templateParam) (string, error) {
+	networkMeta := metav1.ObjectMeta{}
+	err := r.applyCephClusterNetworkConfig(r.opManagerContext, &networkMeta)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get the network config of the ceph clusters")
+	}
+
+	b, err := json.Marshal(struct {
+		RookVersion        string
+		ParamHash          string
+		Namespace          string
+		OperatorSettings   map[string]string
+		EnableRBD          bool
+		EnableCephFS       bool
+		EnableNFS          bool
+		CSIRootPath        string
+		NetworkAnnotations map[string]string
+	}{
+		RookVersion:        rookversion.Version,
+		ParamHash:          tp.Param.Hash(),
+		Namespace:          tp.Namespace,
+		OperatorSettings:   r.opConfig.Parameters,
+		EnableRBD:          EnableRBD,
+		EnableCephFS:       EnableCephFS,
+		EnableNFS:          EnableNFS,
+		CSIRootPath:        csiRootPath,
+		NetworkAnnotations: networkMeta.Annotations,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to serialize csi driver config")
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// csiParamHashPatch returns the merge patch recording the parameters hash and the generation a
+// daemonset or deployment was applied with. Changing the annotations does not bump the generation,
+// so a later generation means that the spec was edited outside of the operator.
+func csiParamHashPatch(hash string, generation int64) ([]byte, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				csiParamHashAnnotation:         hash,
+				csiAppliedGenerationAnnotation: strconv.FormatInt(generation, 10),
+			},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to serialize csi param hash patch")
+	}
+	return patch, nil
+}
+
+func (r *ReconcileCSI) setDaemonSetParamHash(name, hash string) error {
+	daemonsets := r.context.Clientset.AppsV1().DaemonSets(r.opConfig.OperatorNamespace)
+	ds, err := daemonsets.Get(r.opManagerContext, name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get daemonset %q", name)
+	}
+	patch, err := csiParamHashPatch(hash, ds.Generation)
+	if err != nil {
+		return err
+	}
+	_, err = daemonsets.Patch(r.opManagerContext, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to set csi param hash on daemonset %q", name)
+	}
+	return nil
+}
+
+func (r *ReconcileCSI) setDeploymentParamHash(name, hash string) error {
+	deployments := r.context.Clientset.AppsV1().Deployments(r.opConfig.OperatorNamespace)
+	dep, err := deployments.Get(r.opManagerContext, name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get deployment %q", name)
+	}
+	patch, err := csiParamHashPatch(hash, dep.Generation)
+	if err != nil {
+		return err
+	}
+	_, err = deployments.Patch(r.opManagerContext, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to set csi param hash on deployment %q", name)
+	}
+	return nil
+}
+
+// csiParamHashApplied returns true if the object was applied with the given hash and its spec was
+// not changed since
+func csiParamHashApplied(objectMeta metav1.ObjectMeta, hash string) bool {
+	return objectMeta.Annotations[csiParamHashAnnotation] == hash &&
+		objectMeta.Annotations[csiAppliedGenerationAnnotation] == strconv.FormatInt(objectMeta.Generation, 10)
+}
+
+// csiDriversUpToDate returns true if the resources of all the enabled drivers exist and were
+// applied with the given parameters hash, and the daemonsets and deployments were not edited since
+func (r *ReconcileCSI) csiDriversUpToDate(hash string) bool {
+	type driver struct {
+		enabled                              bool
+		daemonset, deployment, service, name string
+	}
+	drivers := []driver{
+		{EnableRBD, CsiRBDPlugin, csiRBDProvisioner, rbdMetricsServiceName, RBDDriverName},
+		{EnableCephFS, CsiCephFSPlugin, csiCephFSProvisioner, cephFSMetricsServiceName, CephFSDriverName},
+		{EnableNFS, CsiNFSPlugin, csiNFSProvisioner, nfsMetricsServiceName, NFSDriverName},
+	}
+
+	ctx := r.opManagerContext
+	namespace := r.opConfig.OperatorNamespace
+	for _, d := range drivers {
+		if !d.enabled {
+			continue
+		}
+		ds, err := r.context.Clientset.AppsV1().DaemonSets(namespace).Get(ctx, d.daemonset, metav1.GetOptions{})
+		if err != nil || !csiParamHashApplied(ds.ObjectMeta, hash) {
+			return false
+		}
+		dep, err := r.context.Clientset.AppsV1().Deployments(namespace).Get(ctx, d.deployment, metav1.GetOptions{})
+		if err != nil || !csiParamHashApplied(dep.ObjectMeta, hash) {
+			return false
+		}
+		if CSIParam.EnableLiveness && d.service != "" {
+			_, err = r.context.Clientset.CoreV1().Services(namespace).Get(ctx, d.service, metav1.GetOptions{})
+			if err != nil {
+				return false
+			}
+		}
+		if CSIParam.EnableProvisionerPDB && CSIParam.ProvisionerReplicas > 1 {
+			_, err = r.context.Clientset.PolicyV1().PodDisruptionBudgets(namespace).Get(ctx, provisionerPDBName(d.deployment), metav1.GetOptions{})
+			if err != nil {
+				return false
+			}
+		}
+		_, err = r.context.Clientset.StorageV1().CSIDrivers().Get(ctx, d.name, metav1.GetOptions{})
+		if err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// warnedSidecarIncompatibilities are the sidecar incompatibilities reported by the last check, so
+// that the same warnings are not recorded again on every reconcile
+var warnedSidecarIncompatibilities []string
+
+// validateSidecarVersions warns when a sidecar image requires a newer Kubernetes version than the
+// one running. The warnings are only reported again after the incompatibilities change.
+func (r *ReconcileCSI) validateSidecarVersions(p Param) {
+	k8sVersion, err := k8sutil.GetK8SVersion(r.context.Clientset)
+	if err != nil {
+		logger.Warningf("failed to get kubernetes version, skipping csi sidecar compatibility check. %v", err)
+		return
+	}
+	incompatible := checkSidecarCompatibility(p, k8sVersion)
+	if slices.Equal(incompatible, warnedSidecarIncompatibilities) {
+		for _, msg := range incompatible {
+			logger.Debug(msg)
+		}
+		return
+	}
+	warnedSidecarIncompatibilities = incompatible
+	for _, msg := range incompatible {
+		logger.Warning(msg)
+		r.recordCSIEvent(corev1.EventTypeWarning, csiSidecarIncompatibleReason, msg)
+	}
+}
+
+// missingImagePullSecrets are the image pull secrets found missing by the last check, so that the
+// same warnings are not recorded again on every reconcile
+var missingImagePullSecrets []string
+
+// checkImagePullSecrets warns if any of the image pull secrets does not exist in the operator
+// namespace. The drivers are still deployed since the nodes may have their own registry credentials.
+// The warnings are only reported again after the missing secrets change.
+func (r *ReconcileCSI) checkImagePullSecrets(secrets []corev1.LocalObjectReference) {
+	var missing []string
+	for _, secret := range secrets {
+		name := secret.Name
+		_, err := r.context.Clientset.CoreV1().Secrets(r.opConfig.OperatorNamespace).Get(r.opManagerContext, name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !kerrors.IsNotFound(err) {
+			logger.Warningf("failed to get csi image pull secret %q. %v", name, err)
+			continue
+		}
+		missing = append(missing, name)
+	}
+	if slices.Equal(missing, missingImagePullSecrets) {
+		return
+	}
+	missingImagePullSecrets = missing
+	for _, name := range missing {
+		message := fmt.Sprintf("csi image pull secret %q not found in namespace %q", name, r.opConfig.OperatorNamespace)
+		logger.Warning(message)
+		r.recordCSIEvent(corev1.EventTypeWarning, csiImagePullSecretNotFoundReason, message)
+	}
+}
+
+// checkPriorityClasses warns if any of the priority classes of the csi pods does not exist. The
+// drivers are still deployed so the pods are scheduled as soon as the class is created.
+func (r *ReconcileCSI) checkPriorityClasses(p Param) {
+	names := []string{}
+	for _, name := range []struct {
+		enabled bool
+		class   string
+	}{
+		{EnableRBD, p.RBDPluginPriorityClassName},
+		{EnableCephFS, p.CephFSPluginPriorityClassName},
+		{EnableNFS, p.NFSPluginPriorityClassName},
+		{true, p.PluginPriorityClassName},
+		{true, p.ProvisionerPriorityClassName},
+	} {
+		if name.enabled && name.class != "" && !slices.Contains(names, name.class) {
+			names = append(names, name.class)
+		}
+	}
+
+	for _, name := range names {
+		_, err := r.context.Clientset.SchedulingV1().PriorityClasses().Get(r.opManagerContext, name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if kerrors.IsForbidden(err) {
+			// the operator rbac may not be updated yet, so the priority classes cannot be checked
+			logger.Warningf("not allowed to check that the csi priority class %q exists, the operator rbac may need to be updated. %v", name, err)
+			continue
+		}
+		if !kerrors.IsNotFound(err) {
+			logger.Warningf("failed to get csi priority class %q. %v", name, err)
+			continue
+		}
+		logger.Errorf("csi priority class %q not found, the csi pods using it will not be scheduled until it is created", name)
+		r.recordOperatorEvent(corev1.EventTypeWarning, csiPriorityClassNotFoundReason, fmt.Sprintf("csi priority class %q not found", name))
+	}
+}
+
+// checkRuntimeClasses warns if a runtime class of the csi pods does not exist. The drivers are still
+// deployed since the runtime class may be created later.
+func (r *ReconcileCSI) checkRuntimeClasses(p Param) {
+	names := []string{}
+	for _, name := range []string{p.PluginRuntimeClassName, p.ProvisionerRuntimeClassName} {
+		if name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		_, err := r.context.Clientset.NodeV1().RuntimeClasses().Get(r.opManagerContext, name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !kerrors.IsNotFound(err) {
+			logger.Warningf("failed to get csi runtime class %q. %v", name, err)
+			continue
+		}
+		logger.Warningf("csi runtime class %q not found, the csi pods using it will not start until it is created", name)
+		r.recordOperatorEvent(corev1.EventTypeWarning, csiRuntimeClassNotFoundReason, fmt.Sprintf("csi runtime class %q not found", name))
+	}
+}
+
+// checkResourceContainers warns about the containers of the resource settings that are not in the
+// rendered csi pods, so that a misspelled container name does not silently leave it without resources
+func (r *ReconcileCSI) checkResourceContainers(rendered *StartDriversResult) {
+	type resourceSetting struct {
+		key     string
+		podSpec *corev1.PodSpec
+	}
+	settings := []resourceSetting{}
+	if rendered.RBDPlugin != nil {
+		settings = append(settings, resourceSetting{rbdPluginResource, &rendered.RBDPlugin.Spec.Template.Spec})
+	}
+	if rendered.RBDProvisioner != nil {
+		settings = append(settings, resourceSetting{rbdProvisionerResource, &rendered.RBDProvisioner.Spec.Template.Spec})
+	}
+	if rendered.CephFSPlugin != nil {
+		settings = append(settings, resourceSetting{cephFSPluginResource, &rendered.CephFSPlugin.Spec.Template.Spec})
+	}
+	if rendered.CephFSProvisioner != nil {
+		settings = append(settings, resourceSetting{cephFSProvisionerResource, &rendered.CephFSProvisioner.Spec.Template.Spec})
+	}
+	if rendered.NFSPlugin != nil {
+		settings = append(settings, resourceSetting{nfsPluginResource, &rendered.NFSPlugin.Spec.Template.Spec})
+	}
+	if rendered.NFSProvisioner != nil {
+		settings = append(settings, resourceSetting{nfsProvisionerResource, &rendered.NFSProvisioner.Spec.Template.Spec})
+	}
+
+	for _, setting := range settings {
+		unknown := unknownResourceContainers(r.opConfig.Parameters, setting.key, setting.podSpec)
+		if len(unknown) == 0 {
+			continue
+		}
+		message := fmt.Sprintf("ignoring the resources of unknown containers %v in %q", unknown, setting.key)
+		logger.Warning(message)
+		r.recordOperatorEvent(corev1.EventTypeWarning, csiUnknownContainerReason, message)
+	}
+}
+
+// recordOperatorEvent records an event on the operator deployment
+func (r *ReconcileCSI) recordOperatorEvent(eventType, reason, message string) {
+	ownerRef, err := k8sutil.GetDeploymentOwnerReference(r.opManagerContext, r.context.Clientset, os.Getenv(k8sutil.PodNameEnvVar), r.opConfig.OperatorNamespace)
+	if err != nil {
+		logger.Debugf("failed to find the operator deployment to record event %q. %v", reason, err)
+		return
+	}
+	operator := &apps.Deployment{ObjectMeta: metav1.ObjectMeta{Name: ownerRef.Name, Namespace: r.opConfig.OperatorNamespace, UID: ownerRef.UID}}
+	r.recorder.Event(operator, eventType, reason, message)
+}
+
+// waitForProvisionerRollout waits for the provisioner deployment to roll out until the context
+// deadline, unless waiting is disabled with a zero rollout timeout
+func (r *ReconcileCSI) waitForProvisionerRollout(ctx context.Context, name string) error {
+	if CSIParam.DriverRolloutTimeout == 0 {
+		return nil
+	}
+	logger.Debugf("waiting up to %s for provisioner deployment %q to roll out", CSIParam.DriverRolloutTimeout, name)
+	return waitForDeploymentRollout(ctx, r.context.Clientset, r.opConfig.OperatorNamespace, name, CSIParam.DriverRolloutTimeout)
+}
+
 func (r *ReconcileCSI) applyCephClusterNetworkConfig(ctx context.Context, objectMeta *metav1.ObjectMeta) error {
 	cephClusters, err := r.context.RookClientset.CephV1().CephClusters(objectMeta.Namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return errors.Wrap(err, "failed to find CephClusters")
 	}
+
+	// the csi pods can only be attached to the networks of a single cluster, so the multus
+	// networks of all the clusters must match rather than letting the last cluster win
+	var multusMeta *metav1.ObjectMeta
+	var multusCluster string
 	for i, cephCluster := range cephClusters.Items {
-		if cephCluster.Spec.Network.IsMultus() {
-			err = k8sutil.ApplyMultus(cephCluster.GetNamespace(), &cephClusters.Items[i].Spec.Network, objectMeta)
-			if err != nil {
-				return errors.Wrapf(err, "failed to apply multus configuration to CephCluster %q", cephCluster.Name)
-			}
+		if !cephCluster.Spec.Network.IsMultus() {
+			continue
+		}
+		clusterMeta := objectMeta.DeepCopy()
+		err = k8sutil.ApplyMultus(cephCluster.GetNamespace(), &cephClusters.Items[i].Spec.Network, clusterMeta)
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply multus configuration to CephCluster %q", cephCluster.Name)
 		}
+		if multusMeta == nil {
+			multusMeta, multusCluster = clusterMeta, cephCluster.Name
+			continue
+		}
+		if clusterMeta.Annotations[multusNetworksAnnotation] != multusMeta.Annotations[multusNetworksAnnotation] {
+			return errors.Errorf("conflicting multus networks on CephClusters %q (%q) and %q (%q), csi pods can only be attached to one set of networks",
+				multusCluster, multusMeta.Annotations[multusNetworksAnnotation], cephCluster.Name, clusterMeta.Annotations[multusNetworksAnnotation])
+		}
+	}
+	if multusMeta != nil {
+		*objectMeta = *multusMeta
 	}
 
 	return nil
@@ -19,13 +19,37 @@ package csi
 import (
 	"context"
 	_ "embed"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	cephv1 "github.com/rook/rook/pkg/apis/ceph.rook.io/v1"
+	rookclient "github.com/rook/rook/pkg/client/clientset/versioned/fake"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/rook/rook/pkg/operator/test"
 	"github.com/stretchr/testify/assert"
 	apps "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
 	kfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func Test_getCSIDriverNamePrefixFromDeployment(t *testing.T) {
@@ -115,3 +139,971 @@ func Test_getCSIDriverNamePrefixFromDeployment(t *testing.T) {
 		})
 	}
 }
+
+func Test_validateCSIParamPluginImages(t *testing.T) {
+	orig, origRBD, origCephFS, origNFS := CSIParam, EnableRBD, EnableCephFS, EnableNFS
+	defer func() { CSIParam, EnableRBD, EnableCephFS, EnableNFS = orig, origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+
+	CSIParam = Param{
+		CSIPluginImage:   "quay.io/cephcsi/cephcsi:v3.12.3",
+		NFSPluginImage:   "quay.io/cephcsi/cephcsi:v3.12.3",
+		RegistrarImage:   "image:v1",
+		ProvisionerImage: "image:v1",
+		AttacherImage:    "image:v1",
+		SnapshotterImage: "image:v1",
+		ResizerImage:     "image:v1",
+		KubeletDirPath:   DefaultKubeletDirPath,
+
+		ProvisionerWorkerThreads: defaultProvisionerWorkerThreads,
+		AttacherWorkerThreads:    defaultAttacherWorkerThreads,
+	}
+
+	t.Run("validation does not change the parameters", func(t *testing.T) {
+		assert.NoError(t, validateCSIParam())
+		assert.Empty(t, CSIParam.RBDPluginImage)
+		assert.Empty(t, CSIParam.CephFSPluginImage)
+	})
+
+	t.Run("per-driver images fall back to the common image", func(t *testing.T) {
+		common := "quay.io/cephcsi/cephcsi:v3.12.3"
+		assert.Equal(t, common, getPluginImage(map[string]string{}, "ROOK_CSI_RBD_PLUGIN_IMAGE", common))
+		assert.Equal(t, common, getPluginImage(map[string]string{"ROOK_CSI_RBD_PLUGIN_IMAGE": ""}, "ROOK_CSI_RBD_PLUGIN_IMAGE", common))
+		assert.Equal(t, "quay.io/cephcsi/cephcsi:v3.13.0", getPluginImage(map[string]string{"ROOK_CSI_RBD_PLUGIN_IMAGE": "quay.io/cephcsi/cephcsi:v3.13.0"}, "ROOK_CSI_RBD_PLUGIN_IMAGE", common))
+		assert.Equal(t, "localhost/cephcsi:v3.12.3", getPluginImage(map[string]string{"ROOK_CSI_RBD_PLUGIN_IMAGE": "localhost/cephcsi"}, "ROOK_CSI_RBD_PLUGIN_IMAGE", common))
+		assert.Equal(t, common, getPluginImage(map[string]string{"ROOK_CSI_NFS_PLUGIN_IMAGE": ""}, "ROOK_CSI_NFS_PLUGIN_IMAGE", common))
+	})
+
+	t.Run("per-driver images are used in the rendered templates", func(t *testing.T) {
+		CSIParam.RBDPluginImage = "quay.io/cephcsi/cephcsi:v3.13.0"
+		CSIParam.CephFSPluginImage = "quay.io/cephcsi/cephcsi:v3.12.3"
+		CSIParam.CSILogRotation = true
+		assert.NoError(t, validateCSIParam())
+
+		result, err := renderCSIDrivers(templateParam{Param: CSIParam, Namespace: "foo"}, map[string]string{})
+		assert.NoError(t, err)
+		rbdPods := []v1.PodSpec{result.RBDPlugin.Spec.Template.Spec, result.RBDProvisioner.Spec.Template.Spec}
+		cephfsPods := []v1.PodSpec{result.CephFSPlugin.Spec.Template.Spec, result.CephFSProvisioner.Spec.Template.Spec}
+		for _, pod := range rbdPods {
+			images := map[string]string{}
+			for _, c := range pod.Containers {
+				images[c.Name] = c.Image
+				assert.NotEqual(t, "quay.io/cephcsi/cephcsi:v3.12.3", c.Image, c.Name)
+			}
+			assert.Equal(t, "quay.io/cephcsi/cephcsi:v3.13.0", images["log-collector"])
+		}
+		for _, pod := range cephfsPods {
+			images := map[string]string{}
+			for _, c := range pod.Containers {
+				images[c.Name] = c.Image
+				assert.NotEqual(t, "quay.io/cephcsi/cephcsi:v3.13.0", c.Image, c.Name)
+			}
+			assert.Equal(t, "quay.io/cephcsi/cephcsi:v3.12.3", images["log-collector"])
+		}
+	})
+}
+
+func TestCheckImagePullSecrets(t *testing.T) {
+	origMissing := missingImagePullSecrets
+	defer func() { missingImagePullSecrets = origMissing }()
+	missingImagePullSecrets = nil
+
+	namespace := "rook-ceph"
+	cluster := &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: namespace}}
+	r, _, clientset := newFinalizerTestReconciler(t, cluster)
+	_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "exists", Namespace: namespace}}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	recorder := r.recorder.(*record.FakeRecorder)
+
+	r.checkImagePullSecrets([]v1.LocalObjectReference{{Name: "exists"}})
+	assert.Empty(t, recorder.Events)
+
+	r.checkImagePullSecrets([]v1.LocalObjectReference{{Name: "exists"}, {Name: "missing"}})
+	assert.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, "Warning "+csiImagePullSecretNotFoundReason)
+	assert.Contains(t, event, `"missing"`)
+
+	// the same missing secret is not reported again
+	r.checkImagePullSecrets([]v1.LocalObjectReference{{Name: "exists"}, {Name: "missing"}})
+	assert.Empty(t, recorder.Events)
+
+	// it is reported again once it was found and is missing again
+	r.checkImagePullSecrets([]v1.LocalObjectReference{{Name: "exists"}})
+	r.checkImagePullSecrets([]v1.LocalObjectReference{{Name: "exists"}, {Name: "missing"}})
+	assert.Len(t, recorder.Events, 1)
+}
+
+func TestCheckPriorityClasses(t *testing.T) {
+	origParam, origRBD, origCephFS, origNFS := CSIParam, EnableRBD, EnableCephFS, EnableNFS
+	defer func() { CSIParam, EnableRBD, EnableCephFS, EnableNFS = origParam, origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+
+	namespace := "rook-ceph"
+	t.Setenv(k8sutil.PodNameEnvVar, "rook-ceph-operator")
+	p := Param{
+		PluginPriorityClassName:       "system-node-critical",
+		RBDPluginPriorityClassName:    "system-node-critical",
+		CephFSPluginPriorityClassName: "system-node-critical",
+		NFSPluginPriorityClassName:    "nfs-not-checked",
+		ProvisionerPriorityClassName:  "csi-provisioner",
+	}
+	newReconciler := func(objects ...runtime.Object) (*ReconcileCSI, *record.FakeRecorder) {
+		objects = append(objects, test.FakeOperatorPod(namespace), test.FakeReplicaSet(namespace))
+		recorder := record.NewFakeRecorder(5)
+		return &ReconcileCSI{
+			context:          &clusterd.Context{Clientset: kfake.NewSimpleClientset(objects...)},
+			opManagerContext: context.TODO(),
+			opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+			recorder:         recorder,
+		}, recorder
+	}
+
+	t.Run("all classes exist", func(t *testing.T) {
+		r, recorder := newReconciler(
+			&schedulingv1.PriorityClass{ObjectMeta: metav1.ObjectMeta{Name: "system-node-critical"}},
+			&schedulingv1.PriorityClass{ObjectMeta: metav1.ObjectMeta{Name: "csi-provisioner"}},
+		)
+		r.checkPriorityClasses(p)
+		assert.Empty(t, recorder.Events)
+	})
+
+	t.Run("missing class", func(t *testing.T) {
+		r, recorder := newReconciler(&schedulingv1.PriorityClass{ObjectMeta: metav1.ObjectMeta{Name: "system-node-critical"}})
+		r.checkPriorityClasses(p)
+		assert.Len(t, recorder.Events, 1)
+		event := <-recorder.Events
+		assert.Contains(t, event, csiPriorityClassNotFoundReason)
+		assert.Contains(t, event, `"csi-provisioner"`)
+	})
+
+	t.Run("not allowed to get the classes", func(t *testing.T) {
+		r, recorder := newReconciler()
+		r.context.Clientset.(*kfake.Clientset).PrependReactor("get", "priorityclasses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, kerrors.NewForbidden(schedulingv1.Resource("priorityclasses"), action.(k8stesting.GetAction).GetName(), errors.New("rbac"))
+		})
+		r.checkPriorityClasses(p)
+		assert.Empty(t, recorder.Events)
+	})
+}
+
+func TestCheckRuntimeClasses(t *testing.T) {
+	namespace := "rook-ceph"
+	t.Setenv(k8sutil.PodNameEnvVar, "rook-ceph-operator")
+	p := Param{PluginRuntimeClassName: "runc", ProvisionerRuntimeClassName: "runc"}
+	newReconciler := func(objects ...runtime.Object) (*ReconcileCSI, *record.FakeRecorder) {
+		objects = append(objects, test.FakeOperatorPod(namespace), test.FakeReplicaSet(namespace))
+		recorder := record.NewFakeRecorder(5)
+		return &ReconcileCSI{
+			context:          &clusterd.Context{Clientset: kfake.NewSimpleClientset(objects...)},
+			opManagerContext: context.TODO(),
+			opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+			recorder:         recorder,
+		}, recorder
+	}
+
+	t.Run("runtime class exists", func(t *testing.T) {
+		r, recorder := newReconciler(&nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "runc"}, Handler: "runc"})
+		r.checkRuntimeClasses(p)
+		assert.Empty(t, recorder.Events)
+	})
+
+	t.Run("missing runtime class only warns once", func(t *testing.T) {
+		r, recorder := newReconciler()
+		r.checkRuntimeClasses(p)
+		assert.Len(t, recorder.Events, 1)
+		event := <-recorder.Events
+		assert.Contains(t, event, csiRuntimeClassNotFoundReason)
+		assert.Contains(t, event, `"runc"`)
+	})
+
+	t.Run("no runtime class", func(t *testing.T) {
+		r, recorder := newReconciler()
+		r.checkRuntimeClasses(Param{})
+		assert.Empty(t, recorder.Events)
+	})
+}
+
+func TestCheckResourceContainers(t *testing.T) {
+	namespace := "rook-ceph"
+	t.Setenv(k8sutil.PodNameEnvVar, "rook-ceph-operator")
+	podSpec := func(containers ...string) apps.DeploymentSpec {
+		spec := apps.DeploymentSpec{}
+		for _, container := range containers {
+			spec.Template.Spec.Containers = append(spec.Template.Spec.Containers, v1.Container{Name: container})
+		}
+		return spec
+	}
+	rendered := &StartDriversResult{
+		RBDProvisioner:    &apps.Deployment{Spec: podSpec("csi-provisioner", "csi-rbdplugin")},
+		CephFSProvisioner: &apps.Deployment{Spec: podSpec("csi-provisioner", "csi-cephfsplugin")},
+	}
+	newReconciler := func(parameters map[string]string) (*ReconcileCSI, *record.FakeRecorder) {
+		recorder := record.NewFakeRecorder(5)
+		return &ReconcileCSI{
+			context:          &clusterd.Context{Clientset: kfake.NewSimpleClientset(test.FakeOperatorPod(namespace), test.FakeReplicaSet(namespace))},
+			opManagerContext: context.TODO(),
+			opConfig:         controller.OperatorConfig{OperatorNamespace: namespace, Parameters: parameters},
+			recorder:         recorder,
+		}, recorder
+	}
+
+	t.Run("known containers", func(t *testing.T) {
+		r, recorder := newReconciler(map[string]string{
+			rbdProvisionerResource: "- name: csi-rbdplugin\n  resource:\n    limits:\n      memory: 1Gi\n",
+		})
+		r.checkResourceContainers(rendered)
+		assert.Empty(t, recorder.Events)
+	})
+
+	t.Run("unknown container", func(t *testing.T) {
+		r, recorder := newReconciler(map[string]string{
+			rbdProvisionerResource:    "- name: csi-rbdplugin\n  resource:\n    limits:\n      memory: 1Gi\n",
+			cephFSProvisionerResource: "- name: csi-cephfs-plugin\n  resource:\n    limits:\n      memory: 1Gi\n",
+			// the nfs driver is disabled and its setting is not checked
+			nfsProvisionerResource: "- name: foo\n  resource:\n    limits:\n      memory: 1Gi\n",
+		})
+		r.checkResourceContainers(rendered)
+		assert.Len(t, recorder.Events, 1)
+		event := <-recorder.Events
+		assert.Contains(t, event, csiUnknownContainerReason)
+		assert.Contains(t, event, "csi-cephfs-plugin")
+		assert.Contains(t, event, cephFSProvisionerResource)
+	})
+}
+
+func Test_validateCSIParamConditionalImages(t *testing.T) {
+	origParam, origNFS := CSIParam, EnableNFS
+	defer func() { CSIParam, EnableNFS = origParam, origNFS }()
+
+	CSIParam = Param{
+		CSIPluginImage:   "image:v1",
+		RegistrarImage:   "image:v1",
+		ProvisionerImage: "image:v1",
+		AttacherImage:    "image:v1",
+		SnapshotterImage: "image:v1",
+		ResizerImage:     "image:v1",
+		KubeletDirPath:   DefaultKubeletDirPath,
+		CSIAddonsPort:    DefaultCSIAddonsPort,
+
+		ProvisionerWorkerThreads: defaultProvisionerWorkerThreads,
+		AttacherWorkerThreads:    defaultAttacherWorkerThreads,
+	}
+
+	EnableNFS = false
+	assert.NoError(t, validateCSIParam())
+
+	// the nfs plugin image falls back to the cephcsi image
+	EnableNFS = true
+	assert.NoError(t, validateCSIParam())
+
+	CSIParam.EnableCSIAddonsSideCar = true
+	err := validateCSIParam()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "csi-addons image")
+	CSIParam.CSIAddonsImage = "image:v1"
+	assert.NoError(t, validateCSIParam())
+
+	CSIParam.VolumeReplicationImage = "quay.io/csiaddons/volumereplication-operator:v0.3.0"
+	assert.NoError(t, validateCSIParam())
+
+	// all the malformed images are reported
+	CSIParam.RegistrarImage = "registrar"
+	CSIParam.CSIAddonsImage = "quay.io/csiaddons/k8s-sidecar:"
+	CSIParam.VolumeReplicationImage = "quay.io/csiaddons/volumereplication-operator"
+	err = validateCSIParam()
+	assert.ErrorContains(t, err, `invalid csi registrar image: image "registrar" has no tag or digest`)
+	assert.ErrorContains(t, err, "invalid csi-addons image")
+	assert.ErrorContains(t, err, `invalid csi volume replication image: image "quay.io/csiaddons/volumereplication-operator" has no tag or digest`)
+}
+
+func Test_validateCSIParamLeaderElection(t *testing.T) {
+	origParam, origNFS := CSIParam, EnableNFS
+	defer func() { CSIParam, EnableNFS = origParam, origNFS }()
+	EnableNFS = false
+
+	tests := []struct {
+		name          string
+		lease         time.Duration
+		renew         time.Duration
+		retry         time.Duration
+		expectedError string
+	}{
+		{"defaults", defaultLeaderElectionLeaseDuration, defaultLeaderElectionRenewDeadline, defaultLeaderElectionRetryPeriod, ""},
+		{"tuned for slow etcd", 5 * time.Minute, 4 * time.Minute, time.Minute, ""},
+		{"renew deadline equals lease duration", time.Minute, time.Minute, 10 * time.Second, "renew deadline 1m0s must be less than the lease duration 1m0s"},
+		{"renew deadline above lease duration", time.Minute, 2 * time.Minute, 10 * time.Second, "renew deadline 2m0s must be less than the lease duration 1m0s"},
+		{"retry period equals renew deadline", time.Minute, 30 * time.Second, 30 * time.Second, "retry period 30s must be less than the renew deadline 30s"},
+		{"retry period above renew deadline", time.Minute, 30 * time.Second, 45 * time.Second, "retry period 45s must be less than the renew deadline 30s"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			CSIParam = Param{
+				CSIPluginImage:   "image:v1",
+				RegistrarImage:   "image:v1",
+				ProvisionerImage: "image:v1",
+				AttacherImage:    "image:v1",
+				SnapshotterImage: "image:v1",
+				ResizerImage:     "image:v1",
+				KubeletDirPath:   DefaultKubeletDirPath,
+
+				ProvisionerWorkerThreads: defaultProvisionerWorkerThreads,
+				AttacherWorkerThreads:    defaultAttacherWorkerThreads,
+
+				LeaderElectionLeaseDuration: tc.lease,
+				LeaderElectionRenewDeadline: tc.renew,
+				LeaderElectionRetryPeriod:   tc.retry,
+			}
+			err := validateCSIParam()
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tc.expectedError)
+		})
+	}
+}
+
+func Test_validateCSIParamAggregatesErrors(t *testing.T) {
+	origParam, origNFS := CSIParam, EnableNFS
+	defer func() { CSIParam, EnableNFS = origParam, origNFS }()
+
+	EnableNFS = true
+	pluginGracePeriod, provisionerGracePeriod := int64(10), int64(600)
+	CSIParam = Param{
+		EnableLiveness:                           true,
+		EnableCSIAddonsSideCar:                   true,
+		KubeletDirPath:                           "var/lib/kubelet",
+		LeaderElectionLeaseDuration:              60 * time.Second,
+		LeaderElectionRenewDeadline:              60 * time.Second,
+		LeaderElectionRetryPeriod:                90 * time.Second,
+		PluginTerminationGracePeriodSeconds:      &pluginGracePeriod,
+		ProvisionerTerminationGracePeriodSeconds: &provisionerGracePeriod,
+		RBDPluginUpdateStrategy:                  rollingUpdate,
+		RBDPluginUpdateStrategyMaxUnavailable:    "0",
+		CephFSPluginUpdateStrategy:               rollingUpdate,
+		CephFSPluginUpdateStrategyMaxUnavailable: "25%",
+		NFSPluginUpdateStrategy:                  onDelete,
+		NFSPluginUpdateStrategyMaxUnavailable:    "none",
+		RBDPluginServiceAccount:                  "Invalid_SA",
+		CephFSProvisionerServiceAccount:          "my-cephfs-provisioner",
+		ProvisionerWorkerThreads:                 501,
+		AttacherWorkerThreads:                    defaultAttacherWorkerThreads,
+	}
+	err := validateCSIParam()
+	assert.Error(t, err)
+	for _, expected := range []string{
+		"missing csi rbd plugin image",
+		"missing csi registrar image",
+		"missing csi provisioner image",
+		"missing csi attacher image",
+		"missing csi snapshotter image",
+		"missing csi resizer image",
+		"missing csi-addons image",
+		"invalid csi rbd liveness metrics port",
+		"invalid csi cephfs liveness metrics port",
+		"invalid csi-addons port",
+		`kubelet dir path "var/lib/kubelet" must be an absolute path`,
+		"csi leader election renew deadline 1m0s must be less than the lease duration 1m0s",
+		"csi leader election retry period 1m30s must be less than the renew deadline 1m0s",
+		"csi plugin termination grace period 10 must be between 30 and 600 seconds",
+		`invalid csi rbd plugin update strategy max unavailable: "0" must be at least 1`,
+		`invalid service account name "Invalid_SA" for "CSI_RBD_PLUGIN_SERVICE_ACCOUNT"`,
+		"csi provisioner worker threads 501 must be between 1 and 500",
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+	assert.NotContains(t, err.Error(), "csi provisioner termination grace period")
+	assert.NotContains(t, err.Error(), "my-cephfs-provisioner")
+	assert.NotContains(t, err.Error(), "nfs plugin image")
+	assert.NotContains(t, err.Error(), "csi attacher worker threads")
+	assert.NotContains(t, err.Error(), "csi cephfs plugin update strategy")
+	// the max unavailable is not used with the OnDelete strategy
+	assert.NotContains(t, err.Error(), "csi nfs plugin update strategy")
+}
+
+func Test_validateCSIParamErrorOrder(t *testing.T) {
+	origParam, origNFS := CSIParam, EnableNFS
+	defer func() { CSIParam, EnableNFS = origParam, origNFS }()
+
+	EnableNFS = false
+	pluginGracePeriod, provisionerGracePeriod := int64(10), int64(900)
+	CSIParam = Param{
+		KubeletDirPath:                           DefaultKubeletDirPath,
+		PluginTerminationGracePeriodSeconds:      &pluginGracePeriod,
+		ProvisionerTerminationGracePeriodSeconds: &provisionerGracePeriod,
+		ProvisionerWorkerThreads:                 0,
+		AttacherWorkerThreads:                    501,
+	}
+	err := validateCSIParam()
+	assert.Error(t, err)
+	msg := err.Error()
+	// the errors are reported in the same order on every reconcile
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, msg, validateCSIParam().Error())
+	}
+	assert.Less(t, strings.Index(msg, "csi plugin termination grace period"), strings.Index(msg, "csi provisioner termination grace period"))
+	assert.Less(t, strings.Index(msg, "csi provisioner worker threads"), strings.Index(msg, "csi attacher worker threads"))
+}
+
+func TestParamHash(t *testing.T) {
+	p := Param{
+		CSIPluginImage:  "quay.io/cephcsi/cephcsi:v3.12.3",
+		LogLevel:        3,
+		GRPCTimeout:     150 * time.Second,
+		CSIRBDPodLabels: map[string]string{"a": "b", "c": "d"},
+	}
+
+	t.Run("stable across identical inputs", func(t *testing.T) {
+		same := p
+		same.CSIRBDPodLabels = map[string]string{"c": "d", "a": "b"}
+		assert.NotEmpty(t, p.Hash())
+		assert.Equal(t, p.Hash(), p.Hash())
+		assert.Equal(t, p.Hash(), same.Hash())
+	})
+
+	t.Run("changes when any single field changes", func(t *testing.T) {
+		v := reflect.ValueOf(Param{})
+		for i := 0; i < v.NumField(); i++ {
+			changed := p
+			f := reflect.ValueOf(&changed).Elem().Field(i)
+			switch f.Kind() {
+			case reflect.String:
+				f.SetString(f.String() + "-changed")
+			case reflect.Bool:
+				f.SetBool(!f.Bool())
+			case reflect.Uint8, reflect.Uint16:
+				f.SetUint(f.Uint() + 1)
+			case reflect.Int, reflect.Int32, reflect.Int64:
+				f.SetInt(f.Int() + 1)
+			case reflect.Float32:
+				f.SetFloat(f.Float() + 1)
+			case reflect.Map:
+				f.Set(reflect.ValueOf(map[string]string{"changed": "true"}))
+			case reflect.Slice:
+				f.Set(reflect.ValueOf([]string{"changed"}))
+			case reflect.Ptr:
+				f.Set(reflect.New(f.Type().Elem()))
+			default:
+				t.Fatalf("unhandled kind %s for field %s", f.Kind(), v.Type().Field(i).Name)
+			}
+			assert.NotEqual(t, p.Hash(), changed.Hash(), v.Type().Field(i).Name)
+		}
+	})
+}
+
+func TestCSIDriversUpToDate(t *testing.T) {
+	origRBD, origCephFS, origNFS, origLiveness, origDriverName := EnableRBD, EnableCephFS, EnableNFS, CSIParam.EnableLiveness, RBDDriverName
+	defer func() {
+		EnableRBD, EnableCephFS, EnableNFS, CSIParam.EnableLiveness, RBDDriverName = origRBD, origCephFS, origNFS, origLiveness, origDriverName
+	}()
+	EnableRBD, EnableCephFS, EnableNFS, CSIParam.EnableLiveness = true, false, false, false
+
+	namespace := "rook-ceph"
+	RBDDriverName = "rook-ceph.rbd.csi.ceph.com"
+	meta := func(name, hash string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: namespace, Generation: 1, Annotations: map[string]string{
+			csiParamHashAnnotation:         hash,
+			csiAppliedGenerationAnnotation: "1",
+		}}
+	}
+	newReconciler := func(objects ...runtime.Object) *ReconcileCSI {
+		return &ReconcileCSI{
+			context:          &clusterd.Context{Clientset: kfake.NewSimpleClientset(objects...)},
+			opManagerContext: context.TODO(),
+			opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+		}
+	}
+	csiDriver := &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: RBDDriverName}}
+
+	t.Run("no resources", func(t *testing.T) {
+		assert.False(t, newReconciler().csiDriversUpToDate("hash"))
+	})
+
+	t.Run("resources applied with the same hash", func(t *testing.T) {
+		r := newReconciler(&apps.DaemonSet{ObjectMeta: meta(CsiRBDPlugin, "hash")}, &apps.Deployment{ObjectMeta: meta(csiRBDProvisioner, "hash")}, csiDriver)
+		assert.True(t, r.csiDriversUpToDate("hash"))
+		assert.False(t, r.csiDriversUpToDate("other"))
+	})
+
+	t.Run("one resource applied with an old hash", func(t *testing.T) {
+		r := newReconciler(&apps.DaemonSet{ObjectMeta: meta(CsiRBDPlugin, "hash")}, &apps.Deployment{ObjectMeta: meta(csiRBDProvisioner, "old")}, csiDriver)
+		assert.False(t, r.csiDriversUpToDate("hash"))
+	})
+
+	t.Run("daemonset edited after it was applied", func(t *testing.T) {
+		edited := meta(CsiRBDPlugin, "hash")
+		edited.Generation = 2
+		r := newReconciler(&apps.DaemonSet{ObjectMeta: edited}, &apps.Deployment{ObjectMeta: meta(csiRBDProvisioner, "hash")}, csiDriver)
+		assert.False(t, r.csiDriversUpToDate("hash"))
+	})
+
+	t.Run("csidriver is missing", func(t *testing.T) {
+		r := newReconciler(&apps.DaemonSet{ObjectMeta: meta(CsiRBDPlugin, "hash")}, &apps.Deployment{ObjectMeta: meta(csiRBDProvisioner, "hash")})
+		assert.False(t, r.csiDriversUpToDate("hash"))
+	})
+
+	t.Run("liveness service is missing", func(t *testing.T) {
+		CSIParam.EnableLiveness = true
+		r := newReconciler(&apps.DaemonSet{ObjectMeta: meta(CsiRBDPlugin, "hash")}, &apps.Deployment{ObjectMeta: meta(csiRBDProvisioner, "hash")}, csiDriver)
+		assert.False(t, r.csiDriversUpToDate("hash"))
+		CSIParam.EnableLiveness = false
+	})
+}
+
+func TestStopDriversContinuesOnError(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = false, false, false
+
+	clientset := kfake.NewSimpleClientset()
+	clientset.PrependReactor("delete", "daemonsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.DeleteAction).GetName() == CsiRBDPlugin {
+			return true, nil, errors.New("fake delete failure")
+		}
+		return false, nil, nil
+	})
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: "rook-ceph"},
+	}
+
+	err := r.stopDrivers(false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to remove CSI Ceph RBD driver")
+	assert.Contains(t, err.Error(), "fake delete failure")
+
+	deleted := []string{}
+	for _, action := range clientset.Actions() {
+		if action.Matches("delete", "daemonsets") {
+			deleted = append(deleted, action.(k8stesting.DeleteAction).GetName())
+		}
+	}
+	assert.Equal(t, []string{CsiRBDPlugin, CsiCephFSPlugin, CsiNFSPlugin}, deleted)
+}
+
+func TestRecordCSIEvents(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = false, false, false
+
+	namespace := "rook-ceph"
+	s := runtime.NewScheme()
+	assert.NoError(t, cephv1.AddToScheme(s))
+	cluster := &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: namespace}}
+	cl := fake.NewClientBuilder().WithScheme(s).WithRuntimeObjects(cluster).Build()
+	clientset := kfake.NewSimpleClientset(&apps.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: CsiRBDPlugin, Namespace: namespace}})
+	recorder := record.NewFakeRecorder(5)
+	r := &ReconcileCSI{
+		client:           cl,
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+		recorder:         recorder,
+	}
+
+	// only the driver that was deployed reports being stopped
+	assert.NoError(t, r.stopDrivers(false))
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Normal "+csiDriverStoppedReason)
+
+	r.recordCSIEvent(v1.EventTypeWarning, csiValidationFailedReason, "failed to validate csi parameters")
+	assert.Equal(t, "Warning "+csiValidationFailedReason+" failed to validate csi parameters", <-recorder.Events)
+}
+
+func TestApplyCephClusterNetworkConfig(t *testing.T) {
+	namespace := "rook-ceph"
+	multusCluster := func(name, publicNet string) *cephv1.CephCluster {
+		return &cephv1.CephCluster{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec: cephv1.ClusterSpec{
+				Network: cephv1.NetworkSpec{
+					Provider:  cephv1.NetworkProviderMultus,
+					Selectors: map[cephv1.CephNetworkType]string{"public": publicNet},
+				},
+			},
+		}
+	}
+	newReconciler := func(objects ...runtime.Object) *ReconcileCSI {
+		return &ReconcileCSI{
+			context:          &clusterd.Context{RookClientset: rookclient.NewSimpleClientset(objects...)},
+			opManagerContext: context.TODO(),
+		}
+	}
+
+	t.Run("single multus cluster", func(t *testing.T) {
+		r := newReconciler(multusCluster("a", "public-net"), &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: namespace}})
+		objectMeta := metav1.ObjectMeta{Namespace: namespace}
+		assert.NoError(t, r.applyCephClusterNetworkConfig(context.TODO(), &objectMeta))
+		assert.Contains(t, objectMeta.Annotations[multusNetworksAnnotation], "public-net")
+	})
+
+	t.Run("multus clusters on the same networks", func(t *testing.T) {
+		r := newReconciler(multusCluster("a", "public-net"), multusCluster("b", "public-net"))
+		objectMeta := metav1.ObjectMeta{Namespace: namespace}
+		assert.NoError(t, r.applyCephClusterNetworkConfig(context.TODO(), &objectMeta))
+		assert.Contains(t, objectMeta.Annotations[multusNetworksAnnotation], "public-net")
+	})
+
+	t.Run("multus clusters on conflicting networks", func(t *testing.T) {
+		r := newReconciler(multusCluster("a", "public-net"), multusCluster("b", "other-net"))
+		objectMeta := metav1.ObjectMeta{Namespace: namespace}
+		err := r.applyCephClusterNetworkConfig(context.TODO(), &objectMeta)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "conflicting multus networks")
+		assert.Empty(t, objectMeta.Annotations)
+	})
+}
+
+func TestStartDriversDryRun(t *testing.T) {
+	origParam, origRBD, origCephFS, origNFS := CSIParam, EnableRBD, EnableCephFS, EnableNFS
+	defer func() { CSIParam, EnableRBD, EnableCephFS, EnableNFS = origParam, origRBD, origCephFS, origNFS }()
+
+	gracePeriod := int64(120)
+	CSIParam = Param{
+		CSIPluginImage:                      "quay.io/cephcsi/cephcsi:v3.12.3",
+		RBDPluginImage:                      "quay.io/cephcsi/cephcsi:v3.13.0",
+		CephFSPluginImage:                   "quay.io/cephcsi/cephcsi:v3.12.3",
+		RegistrarImage:                      "image",
+		ProvisionerImage:                    "image",
+		AttacherImage:                       "image",
+		SnapshotterImage:                    "image",
+		ResizerImage:                        "image",
+		DriverNamePrefix:                    "test",
+		KubeletDirPath:                      "/var/lib/k8s",
+		ImagePullSecrets:                    []string{"my-secret"},
+		PluginTerminationGracePeriodSeconds: &gracePeriod,
+	}
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+
+	// no client is set, any API call would panic
+	r := &ReconcileCSI{
+		opConfig: controller.OperatorConfig{
+			OperatorNamespace: "rook-ceph",
+			Parameters: map[string]string{
+				"CSI_PLUGIN_TOLERATIONS":        "- key: foo\n  operator: Exists",
+				"CSI_PLUGIN_NODE_SELECTOR":      "storage=true",
+				"CSI_RBD_PLUGIN_NODE_SELECTOR":  "storage=rbd",
+				"CSI_PLUGIN_NODE_AFFINITY":      "role=storage-node",
+				"CSI_PROVISIONER_NODE_SELECTOR": "storage=true",
+			},
+		},
+	}
+	result, err := r.startDriversDryRun()
+	assert.NoError(t, err)
+	assert.Nil(t, result.NFSPlugin)
+	assert.Nil(t, result.NFSProvisioner)
+	assert.NotNil(t, result.RBDProvisioner)
+	assert.NotNil(t, result.CephFSProvisioner)
+
+	rbdPlugin := result.RBDPlugin
+	assert.Equal(t, "csi-rbdplugin", rbdPlugin.Name)
+	assert.Equal(t, "rook-ceph", rbdPlugin.Namespace)
+	assert.Equal(t, []v1.LocalObjectReference{{Name: "my-secret"}}, rbdPlugin.Spec.Template.Spec.ImagePullSecrets)
+	assert.Equal(t, []v1.Toleration{{Key: "foo", Operator: v1.TolerationOpExists}}, rbdPlugin.Spec.Template.Spec.Tolerations)
+	assert.Empty(t, rbdPlugin.OwnerReferences)
+	for _, c := range rbdPlugin.Spec.Template.Spec.Containers {
+		if c.Name == "csi-rbdplugin" {
+			assert.Equal(t, "quay.io/cephcsi/cephcsi:v3.13.0", c.Image)
+			assert.Contains(t, c.Args, "--drivername=test.rbd.csi.ceph.com")
+			assert.NotNil(t, c.ReadinessProbe)
+		}
+	}
+	assert.Equal(t, []v1.Toleration{{Key: "foo", Operator: v1.TolerationOpExists}}, result.CephFSPlugin.Spec.Template.Spec.Tolerations)
+
+	// the node selectors are applied alongside the node affinity
+	assert.Equal(t, map[string]string{"storage": "rbd"}, rbdPlugin.Spec.Template.Spec.NodeSelector)
+	assert.NotNil(t, rbdPlugin.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+	assert.Equal(t, map[string]string{"storage": "true"}, result.CephFSPlugin.Spec.Template.Spec.NodeSelector)
+	assert.Equal(t, map[string]string{"storage": "true"}, result.RBDProvisioner.Spec.Template.Spec.NodeSelector)
+
+	assert.Equal(t, int64(120), *rbdPlugin.Spec.Template.Spec.TerminationGracePeriodSeconds)
+	assert.Nil(t, result.RBDProvisioner.Spec.Template.Spec.TerminationGracePeriodSeconds)
+
+	t.Run("preview", func(t *testing.T) {
+		tp := templateParam{Param: CSIParam, Namespace: "rook-ceph"}
+		preview, err := PreviewCSIResources(tp)
+		assert.NoError(t, err)
+		assert.Equal(t, "csi-rbdplugin", preview.RBDPlugin.Name)
+		assert.Empty(t, preview.RBDPlugin.Spec.Template.Spec.Tolerations)
+
+		tp.DriverNamePrefix = "test."
+		_, err = PreviewCSIResources(tp)
+		assert.Error(t, err)
+	})
+}
+
+func TestNFSMetricsService(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = false, false, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "rook-ceph"}
+	tp.EnableLiveness = true
+	tp.NFSLivenessMetricsPort = DefaultNFSLivenessMerticsPort
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, result.RBDService)
+	assert.Nil(t, result.CephFSService)
+	service := result.NFSService
+	assert.Equal(t, nfsMetricsServiceName, service.Name)
+	assert.Equal(t, "rook-ceph", service.Namespace)
+	assert.Equal(t, intstr.FromInt(int(DefaultNFSLivenessMerticsPort)), service.Spec.Ports[0].TargetPort)
+	// the service selects both the plugin and the provisioner pods
+	for _, pod := range []v1.PodTemplateSpec{result.NFSPlugin.Spec.Template, result.NFSProvisioner.Spec.Template} {
+		assert.Equal(t, nfsMetricsServiceName, pod.Labels["contains"])
+		found := false
+		for _, c := range pod.Spec.Containers {
+			if c.Name == "liveness-prometheus" {
+				found = true
+				assert.Contains(t, c.Args, "--metricsport=9082")
+			}
+		}
+		assert.True(t, found)
+	}
+
+	tp.EnableLiveness = false
+	result, err = renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, result.NFSService)
+
+	// the service is deleted with the driver
+	EnableNFS = false
+	clientset := kfake.NewSimpleClientset(&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: nfsMetricsServiceName, Namespace: "rook-ceph"}})
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: "rook-ceph"},
+	}
+	assert.NoError(t, r.stopDrivers(false))
+	_, err = clientset.CoreV1().Services("rook-ceph").Get(context.TODO(), nfsMetricsServiceName, metav1.GetOptions{})
+	assert.True(t, kerrors.IsNotFound(err))
+}
+
+func TestParamDeepCopy(t *testing.T) {
+	gracePeriod := int64(60)
+	p := Param{
+		CSIPluginImage:                      "quay.io/cephcsi/cephcsi:v3.13.0",
+		ImagePullSecrets:                    []string{"my-secret"},
+		PluginTerminationGracePeriodSeconds: &gracePeriod,
+		CSIRBDPodLabels:                     map[string]string{"app": "rbd"},
+		CSICephFSPodAnnotations:             map[string]string{"foo": "bar"},
+	}
+
+	copied := p.DeepCopy()
+	assert.Equal(t, p, *copied)
+	assert.Equal(t, p.Hash(), copied.Hash())
+
+	copied.ImagePullSecrets[0] = "other-secret"
+	*copied.PluginTerminationGracePeriodSeconds = 120
+	copied.CSIRBDPodLabels["app"] = "changed"
+	copied.CSICephFSPodAnnotations["foo"] = "changed"
+	assert.Equal(t, []string{"my-secret"}, p.ImagePullSecrets)
+	assert.Equal(t, int64(60), *p.PluginTerminationGracePeriodSeconds)
+	assert.Equal(t, map[string]string{"app": "rbd"}, p.CSIRBDPodLabels)
+	assert.Equal(t, map[string]string{"foo": "bar"}, p.CSICephFSPodAnnotations)
+
+	// unset fields stay unset
+	copied = p.DeepCopy()
+	assert.Nil(t, copied.ProvisionerTerminationGracePeriodSeconds)
+	assert.Nil(t, copied.CSINFSPodLabels)
+}
+
+// run with -race to detect the parameters shared between the concurrent renderings
+func TestStartDriversDryRunConcurrently(t *testing.T) {
+	origParam, origRBD, origCephFS, origNFS := CSIParam, EnableRBD, EnableCephFS, EnableNFS
+	defer func() { CSIParam, EnableRBD, EnableCephFS, EnableNFS = origParam, origRBD, origCephFS, origNFS }()
+
+	CSIParam = Param{
+		CSIPluginImage:    "quay.io/cephcsi/cephcsi:v3.13.0",
+		RBDPluginImage:    "quay.io/cephcsi/cephcsi:v3.13.0",
+		CephFSPluginImage: "quay.io/cephcsi/cephcsi:v3.13.0",
+		RegistrarImage:    "image",
+		ProvisionerImage:  "image",
+		AttacherImage:     "image",
+		SnapshotterImage:  "image",
+		ResizerImage:      "image",
+		DriverNamePrefix:  "test",
+		KubeletDirPath:    "/var/lib/kubelet",
+		CSIRBDPodLabels:   map[string]string{"app": "rbd"},
+	}
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+
+	r := &ReconcileCSI{opConfig: controller.OperatorConfig{OperatorNamespace: "rook-ceph", Parameters: map[string]string{}}}
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// each reconcile changes its own copy of the parameters
+			p := CSIParam.DeepCopy()
+			p.CSIRBDPodLabels["reconcile"] = string(rune('a' + i))
+			_, errs[i] = r.startDriversDryRun()
+		}(i)
+	}
+	wg.Wait()
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.Equal(t, map[string]string{"app": "rbd"}, CSIParam.CSIRBDPodLabels)
+}
+
+func TestStartDriversUpToDate(t *testing.T) {
+	origParam, origRBD, origCephFS, origNFS, origNewDynamicClient := CSIParam, EnableRBD, EnableCephFS, EnableNFS, newDynamicClient
+	defer func() {
+		CSIParam, EnableRBD, EnableCephFS, EnableNFS, newDynamicClient = origParam, origRBD, origCephFS, origNFS, origNewDynamicClient
+	}()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, false
+	CSIParam = Param{
+		CSIPluginImage:                "image",
+		RegistrarImage:                "image",
+		ProvisionerImage:              "image",
+		AttacherImage:                 "image",
+		SnapshotterImage:              "image",
+		ResizerImage:                  "image",
+		DriverNamePrefix:              "rook-ceph",
+		EnableLiveness:                true,
+		EnableCSIPrometheusMonitoring: true,
+		RBDLivenessMetricsPort:        DefaultRBDLivenessMerticsPort,
+		CephFSLivenessMetricsPort:     DefaultCephFSLivenessMerticsPort,
+	}
+	dynamicClient := newFakeDynamicClient()
+	newDynamicClient = func(config *rest.Config) (dynamic.Interface, error) { return dynamicClient, nil }
+
+	ctx := context.TODO()
+	namespace := "rook-ceph"
+	clientset := test.New(t, 1)
+	test.SetFakeKubernetesVersion(clientset, "v1.28.0")
+	createCSIClusterRoles(t, clientset)
+	_, err := clientset.CoreV1().ConfigMaps(namespace).Create(ctx, &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: ConfigName, Namespace: namespace}}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{GroupVersion: "monitoring.coreos.com/v1", APIResources: []metav1.APIResource{{Name: "servicemonitors"}}},
+	}
+	s := runtime.NewScheme()
+	assert.NoError(t, cephv1.AddToScheme(s))
+	r := &ReconcileCSI{
+		client:           fake.NewClientBuilder().WithScheme(s).Build(),
+		context:          &clusterd.Context{Clientset: clientset, RookClientset: rookclient.NewSimpleClientset()},
+		opManagerContext: ctx,
+		recorder:         record.NewFakeRecorder(10),
+		opConfig: controller.OperatorConfig{
+			OperatorNamespace: namespace,
+			Parameters:        map[string]string{"ROOK_CSI_KUBELET_DIR_PATH": DefaultKubeletDirPath},
+		},
+	}
+	ownerInfo := k8sutil.NewOwnerInfoWithOwnerRef(&metav1.OwnerReference{}, namespace)
+	serviceMonitors := dynamicClient.Resource(serviceMonitorGVR).Namespace(namespace)
+
+	assert.NoError(t, r.startDrivers(ownerInfo))
+	list, err := serviceMonitors.List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, list.Items, 2)
+
+	// the deleted ServiceMonitor is recreated without writing the driver workloads again
+	assert.NoError(t, serviceMonitors.Delete(ctx, rbdMetricsServiceName, metav1.DeleteOptions{}))
+	clientset.ClearActions()
+	assert.NoError(t, r.startDrivers(ownerInfo))
+	list, err = serviceMonitors.List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, list.Items, 2)
+	for _, action := range clientset.Actions() {
+		for _, resource := range []string{"daemonsets", "deployments"} {
+			assert.False(t, action.Matches("update", resource), action)
+			assert.False(t, action.Matches("patch", resource), action)
+		}
+	}
+
+	// the workloads are applied again after a manual edit
+	ds, err := clientset.AppsV1().DaemonSets(namespace).Get(ctx, CsiRBDPlugin, metav1.GetOptions{})
+	assert.NoError(t, err)
+	ds.Generation++
+	_, err = clientset.AppsV1().DaemonSets(namespace).Update(ctx, ds, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	clientset.ClearActions()
+	assert.NoError(t, r.startDrivers(ownerInfo))
+	updated := false
+	for _, action := range clientset.Actions() {
+		updated = updated || action.Matches("update", "daemonsets")
+	}
+	assert.True(t, updated)
+}
+
+func TestApplyCSIDriverWorkloadsRolloutTimeout(t *testing.T) {
+	origParam, origInterval := CSIParam, rolloutPollInterval
+	defer func() { CSIParam, rolloutPollInterval = origParam, origInterval }()
+	rolloutPollInterval = 10 * time.Millisecond
+
+	ctx := context.TODO()
+	namespace := "rook-ceph"
+	clientset := kfake.NewSimpleClientset()
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: clientset, RookClientset: rookclient.NewSimpleClientset()},
+		opManagerContext: ctx,
+		opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+	}
+	ownerInfo := k8sutil.NewOwnerInfoWithOwnerRef(&metav1.OwnerReference{}, namespace)
+	provisioner := func() *apps.Deployment {
+		return &apps.Deployment{ObjectMeta: metav1.ObjectMeta{Name: csiRBDProvisioner, Namespace: namespace}}
+	}
+	paramHash := func() string {
+		dep, err := clientset.AppsV1().Deployments(namespace).Get(ctx, csiRBDProvisioner, metav1.GetOptions{})
+		assert.NoError(t, err)
+		return dep.Annotations[csiParamHashAnnotation]
+	}
+
+	// the fake deployment never becomes available, the hash is not recorded so that the next
+	// reconcile applies the deployment again
+	CSIParam.DriverRolloutTimeout = 50 * time.Millisecond
+	err := r.applyCSIDriverWorkloads(&StartDriversResult{RBDProvisioner: provisioner()}, "hash", ownerInfo)
+	assert.Error(t, err)
+	assert.Empty(t, paramHash())
+
+	// a stuck provisioner does not hold back the other drivers
+	cephFSProvisioner := &apps.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: csiCephFSProvisioner, Namespace: namespace},
+		Status:     apps.DeploymentStatus{UpdatedReplicas: 1, AvailableReplicas: 1},
+	}
+	cephFSPlugin := &apps.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: CsiCephFSPlugin, Namespace: namespace}}
+	err = r.applyCSIDriverWorkloads(&StartDriversResult{RBDProvisioner: provisioner(), CephFSPlugin: cephFSPlugin, CephFSProvisioner: cephFSProvisioner}, "hash", ownerInfo)
+	assert.ErrorContains(t, err, csiRBDProvisioner)
+	assert.NotContains(t, err.Error(), csiCephFSProvisioner)
+	assert.Empty(t, paramHash())
+	dep, err := clientset.AppsV1().Deployments(namespace).Get(ctx, csiCephFSProvisioner, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "hash", dep.Annotations[csiParamHashAnnotation])
+	ds, err := clientset.AppsV1().DaemonSets(namespace).Get(ctx, CsiCephFSPlugin, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "hash", ds.Annotations[csiParamHashAnnotation])
+
+	CSIParam.DriverRolloutTimeout = 0
+	err = r.applyCSIDriverWorkloads(&StartDriversResult{RBDProvisioner: provisioner()}, "hash", ownerInfo)
+	assert.NoError(t, err)
+	assert.Equal(t, "hash", paramHash())
+}
+
+func TestValidateSidecarVersions(t *testing.T) {
+	origWarned := warnedSidecarIncompatibilities
+	defer func() { warnedSidecarIncompatibilities = origWarned }()
+	warnedSidecarIncompatibilities = nil
+
+	cluster := &cephv1.CephCluster{ObjectMeta: metav1.ObjectMeta{Name: "my-cluster", Namespace: "rook-ceph"}}
+	r, _, clientset := newFinalizerTestReconciler(t, cluster)
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &k8sversion.Info{GitVersion: "v1.19.0"}
+	recorder := r.recorder.(*record.FakeRecorder)
+	p := Param{SnapshotterImage: "registry.k8s.io/sig-storage/csi-snapshotter:v7.0.2"}
+
+	r.validateSidecarVersions(p)
+	assert.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, csiSidecarIncompatibleReason)
+
+	// the same incompatibility is not reported again
+	r.validateSidecarVersions(p)
+	assert.Empty(t, recorder.Events)
+
+	// a new incompatibility is reported
+	p.ProvisionerImage = "registry.k8s.io/sig-storage/csi-provisioner:v5.0.1"
+	r.validateSidecarVersions(p)
+	assert.Len(t, recorder.Events, 2)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"maps"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// CsiStatusConfigMap is the name of the ConfigMap reporting the state of the csi drivers
+	CsiStatusConfigMap = "rook-ceph-csi-status"
+
+	csiReconcileSucceeded = "Succeeded"
+	csiReconcileFailed    = "Failed"
+
+	// csiStatusTransitionTimeKey is the time the csi status last changed
+	csiStatusTransitionTimeKey = "lastTransitionTime"
+)
+
+// csiStatusData returns the machine-readable state of the csi drivers deployed by the operator
+func csiStatusData(reconcileErr error) map[string]string {
+	// the drivers are not managed by rook when the csi operator is enabled
+	rbdEnabled := EnableRBD && !EnableCSIOperator()
+	cephfsEnabled := EnableCephFS && !EnableCSIOperator()
+	nfsEnabled := EnableNFS && !EnableCSIOperator()
+
+	data := map[string]string{
+		"rbdEnabled":          strconv.FormatBool(rbdEnabled),
+		"cephfsEnabled":       strconv.FormatBool(cephfsEnabled),
+		"nfsEnabled":          strconv.FormatBool(nfsEnabled),
+		"lastReconcileResult": csiReconcileSucceeded,
+	}
+	if reconcileErr != nil {
+		data["lastReconcileResult"] = csiReconcileFailed
+		data["lastReconcileError"] = reconcileErr.Error()
+	}
+
+	images := map[string]string{
+		"registrarImage":   CSIParam.RegistrarImage,
+		"provisionerImage": CSIParam.ProvisionerImage,
+		"attacherImage":    CSIParam.AttacherImage,
+		"snapshotterImage": CSIParam.SnapshotterImage,
+		"resizerImage":     CSIParam.ResizerImage,
+	}
+	if rbdEnabled {
+		data["rbdDriverName"] = RBDDriverName
+		images["rbdPluginImage"] = CSIParam.RBDPluginImage
+	}
+	if cephfsEnabled {
+		data["cephfsDriverName"] = CephFSDriverName
+		images["cephfsPluginImage"] = CSIParam.CephFSPluginImage
+	}
+	if nfsEnabled {
+		data["nfsDriverName"] = NFSDriverName
+		images["nfsPluginImage"] = CSIParam.NFSPluginImage
+	}
+	if CSIParam.EnableCSIAddonsSideCar {
+		images["csiAddonsImage"] = CSIParam.CSIAddonsImage
+	}
+	if rbdEnabled || cephfsEnabled || nfsEnabled {
+		for key, image := range images {
+			data[key] = image
+		}
+	}
+
+	return data
+}
+
+// saveCSIStatus writes the state of the csi drivers and the result of the last reconcile to the
+// csi status ConfigMap. The ConfigMap is only updated when the status changes, so that it is not
+// written on every reconcile.
+func (r *ReconcileCSI) saveCSIStatus(reconcileErr error) {
+	data := csiStatusData(reconcileErr)
+	existing, err := r.context.Clientset.CoreV1().ConfigMaps(r.opConfig.OperatorNamespace).Get(r.opManagerContext, CsiStatusConfigMap, metav1.GetOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		logger.Warningf("failed to get csi status configmap %q. %v", CsiStatusConfigMap, err)
+		return
+	}
+	if err == nil && csiStatusUnchanged(existing.Data, data) {
+		return
+	}
+	data[csiStatusTransitionTimeKey] = time.Now().UTC().Format(time.RFC3339)
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CsiStatusConfigMap,
+			Namespace: r.opConfig.OperatorNamespace,
+		},
+		Data: data,
+	}
+	// the status is removed with the operator deployment
+	ownerRef, err := k8sutil.GetDeploymentOwnerReference(r.opManagerContext, r.context.Clientset, os.Getenv(k8sutil.PodNameEnvVar), r.opConfig.OperatorNamespace)
+	if err != nil {
+		logger.Debugf("failed to find the operator deployment to own csi status configmap %q. %v", CsiStatusConfigMap, err)
+	} else {
+		blockOwnerDeletion := false
+		ownerRef.BlockOwnerDeletion = &blockOwnerDeletion
+		err = k8sutil.NewOwnerInfoWithOwnerRef(ownerRef, r.opConfig.OperatorNamespace).SetControllerReference(cm)
+		if err != nil {
+			logger.Warningf("failed to set owner reference to csi status configmap %q. %v", CsiStatusConfigMap, err)
+		}
+	}
+
+	_, err = k8sutil.CreateOrUpdateConfigMap(r.opManagerContext, r.context.Clientset, cm)
+	if err != nil {
+		// the status is informational only, it must not fail the reconcile
+		logger.Warningf("failed to save csi status configmap %q. %v", CsiStatusConfigMap, err)
+	}
+}
+
+// csiStatusUnchanged returns whether the saved csi status is the same as the new one, ignoring the
+// time of the last change
+func csiStatusUnchanged(saved, status map[string]string) bool {
+	saved = maps.Clone(saved)
+	delete(saved, csiStatusTransitionTimeKey)
+	return maps.Equal(saved, status)
+}
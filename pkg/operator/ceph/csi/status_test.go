@@ -0,0 +1,99 @@
+/*
+Copyright 2024 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/rook/rook/pkg/clusterd"
+	"github.com/rook/rook/pkg/operator/ceph/controller"
+	"github.com/rook/rook/pkg/operator/k8sutil"
+	"github.com/rook/rook/pkg/operator/test"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSaveCSIStatus(t *testing.T) {
+	origParam, origRBD, origCephFS, origNFS, origDriverName := CSIParam, EnableRBD, EnableCephFS, EnableNFS, RBDDriverName
+	defer func() {
+		CSIParam, EnableRBD, EnableCephFS, EnableNFS, RBDDriverName = origParam, origRBD, origCephFS, origNFS, origDriverName
+	}()
+
+	namespace := "rook-ceph"
+	t.Setenv(k8sutil.PodNameEnvVar, "rook-ceph-operator")
+	clientset := fake.NewSimpleClientset(test.FakeOperatorPod(namespace), test.FakeReplicaSet(namespace))
+	r := &ReconcileCSI{
+		context:          &clusterd.Context{Clientset: clientset},
+		opManagerContext: context.TODO(),
+		opConfig:         controller.OperatorConfig{OperatorNamespace: namespace},
+	}
+	getStatus := func() map[string]string {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), CsiStatusConfigMap, metav1.GetOptions{})
+		assert.NoError(t, err)
+		return cm.Data
+	}
+	countWrites := func() int {
+		writes := 0
+		for _, action := range clientset.Actions() {
+			if action.GetResource().Resource == "configmaps" && (action.GetVerb() == "create" || action.GetVerb() == "update") {
+				writes++
+			}
+		}
+		return writes
+	}
+
+	EnableRBD, EnableCephFS, EnableNFS = true, false, false
+	RBDDriverName = "rook-ceph.rbd.csi.ceph.com"
+	CSIParam.RBDPluginImage = "quay.io/cephcsi/cephcsi:v3.12.3"
+	CSIParam.ProvisionerImage = "registry.k8s.io/sig-storage/csi-provisioner:v5.0.1"
+	r.saveCSIStatus(nil)
+	status := getStatus()
+	assert.Equal(t, "true", status["rbdEnabled"])
+	assert.Equal(t, "false", status["cephfsEnabled"])
+	assert.Equal(t, "false", status["nfsEnabled"])
+	assert.Equal(t, "rook-ceph.rbd.csi.ceph.com", status["rbdDriverName"])
+	assert.NotContains(t, status, "cephfsDriverName")
+	assert.Equal(t, "quay.io/cephcsi/cephcsi:v3.12.3", status["rbdPluginImage"])
+	assert.Equal(t, "registry.k8s.io/sig-storage/csi-provisioner:v5.0.1", status["provisionerImage"])
+	assert.Equal(t, csiReconcileSucceeded, status["lastReconcileResult"])
+	assert.NotEmpty(t, status[csiStatusTransitionTimeKey])
+
+	// the operator deployment owns the status
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), CsiStatusConfigMap, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, cm.OwnerReferences, 1)
+	assert.Equal(t, "Deployment", cm.OwnerReferences[0].Kind)
+
+	// the status is not written again when it does not change
+	writes := countWrites()
+	r.saveCSIStatus(nil)
+	assert.Equal(t, writes, countWrites())
+
+	// the status is updated when the drivers are removed or the reconcile fails
+	EnableRBD = false
+	r.saveCSIStatus(errors.New("failed to remove CSI Ceph RBD driver"))
+	status = getStatus()
+	assert.Equal(t, "false", status["rbdEnabled"])
+	assert.NotContains(t, status, "rbdDriverName")
+	assert.NotContains(t, status, "provisionerImage")
+	assert.Equal(t, csiReconcileFailed, status["lastReconcileResult"])
+	assert.Equal(t, "failed to remove CSI Ceph RBD driver", status["lastReconcileError"])
+	assert.Equal(t, writes+1, countWrites())
+}
@@ -18,19 +18,38 @@ package csi
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 	k8sutil "github.com/rook/rook/pkg/operator/k8sutil"
 	apps "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
 )
 
+// rolloutPollInterval is how often the deployment status is checked while waiting for a rollout
+var rolloutPollInterval = 2 * time.Second
+
 func loadTemplate(name, templateData string, p templateParam) ([]byte, error) {
 	var writer bytes.Buffer
 	t := template.New(name)
@@ -110,6 +129,96 @@ func applyResourcesToContainers(opConfig map[string]string, key string, podspec
 	}
 }
 
+// unknownResourceContainers returns the containers named in the resource setting that are not in
+// the pod, the resources of those entries are not applied
+func unknownResourceContainers(opConfig map[string]string, key string, podspec *corev1.PodSpec) []string {
+	unknown := []string{}
+	for _, r := range getComputeResource(opConfig, key) {
+		if getContainer(podspec, r.Name) == nil && !slices.Contains(unknown, r.Name) {
+			unknown = append(unknown, r.Name)
+		}
+	}
+	return unknown
+}
+
+// applyResourcesToNamedContainer applies the resource requirements of the given setting to the
+// container with the given name. The container is left unchanged if the setting is not set.
+func applyResourcesToNamedContainer(params map[string]string, key string, spec *corev1.PodSpec, containerName string) error {
+	resourceRaw := k8sutil.GetValue(params, key, "")
+	if strings.TrimSpace(resourceRaw) == "" {
+		return nil
+	}
+	resource := corev1.ResourceRequirements{}
+	err := yaml.Unmarshal([]byte(resourceRaw), &resource)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse value for %q", key)
+	}
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == containerName {
+			spec.Containers[i].Resources = resource
+		}
+	}
+	return nil
+}
+
+// applySidecarResources applies the per-container resource settings of the attacher, snapshotter
+// and resizer sidecars of a provisioner
+func applySidecarResources(params map[string]string, spec *corev1.PodSpec, attacherKey, snapshotterKey, resizerKey string) error {
+	for _, sidecar := range []struct {
+		key           string
+		containerName string
+	}{
+		{attacherKey, "csi-attacher"},
+		{snapshotterKey, "csi-snapshotter"},
+		{resizerKey, "csi-resizer"},
+	} {
+		if err := applyResourcesToNamedContainer(params, sidecar.key, spec, sidecar.containerName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getEphemeralStorageRequest returns the ephemeral storage requested by default for the csi
+// containers. A zero quantity means that no request is added.
+func getEphemeralStorageRequest(p Param) (resource.Quantity, error) {
+	if strings.TrimSpace(p.DefaultEphemeralStorageRequest) == "" {
+		return resource.Quantity{}, nil
+	}
+	request, err := resource.ParseQuantity(strings.TrimSpace(p.DefaultEphemeralStorageRequest))
+	if err != nil {
+		return resource.Quantity{}, errors.Wrapf(err, "invalid value %q for %q", p.DefaultEphemeralStorageRequest, defaultEphemeralStorageRequestEnv)
+	}
+	if request.Sign() < 0 {
+		return resource.Quantity{}, errors.Errorf("invalid value %q for %q, the quantity must not be negative", p.DefaultEphemeralStorageRequest, defaultEphemeralStorageRequestEnv)
+	}
+	return request, nil
+}
+
+// applyDefaultEphemeralStorage requests the ephemeral storage for the containers which have no
+// ephemeral storage request or limit from the resource settings, so that the kubelet does not evict
+// the csi pods first on disk pressure. A limit is never added as the kubelet evicts the pods
+// exceeding it.
+func applyDefaultEphemeralStorage(podSpec *corev1.PodSpec, request resource.Quantity) {
+	if request.IsZero() {
+		return
+	}
+	for i := range podSpec.Containers {
+		resources := &podSpec.Containers[i].Resources
+		if _, ok := resources.Requests[corev1.ResourceEphemeralStorage]; ok {
+			continue
+		}
+		// the request defaults to the limit, which must not be exceeded by the request
+		if _, ok := resources.Limits[corev1.ResourceEphemeralStorage]; ok {
+			continue
+		}
+		if resources.Requests == nil {
+			resources.Requests = corev1.ResourceList{}
+		}
+		resources.Requests[corev1.ResourceEphemeralStorage] = request.DeepCopy()
+	}
+}
+
 func getComputeResource(opConfig map[string]string, key string) []k8sutil.ContainerResource {
 	// Add Resource list if any
 	resource := []k8sutil.ContainerResource{}
@@ -118,7 +227,9 @@ func getComputeResource(opConfig map[string]string, key string) []k8sutil.Contai
 	if resourceRaw := k8sutil.GetValue(opConfig, key, ""); resourceRaw != "" {
 		resource, err = k8sutil.YamlToContainerResourceArray(resourceRaw)
 		if err != nil {
+			// don't apply a partially parsed list, e.g. when an ephemeral-storage quantity is invalid
 			logger.Warningf("failed to parse %q. %v", resourceRaw, err)
+			return []k8sutil.ContainerResource{}
 		}
 	}
 	return resource
@@ -147,6 +258,11 @@ func getToleration(opConfig map[string]string, tolerationsName string, defaultTo
 	return tolerations
 }
 
+// tolerateAllTaints returns a wildcard toleration matching every taint
+func tolerateAllTaints() []corev1.Toleration {
+	return []corev1.Toleration{{Operator: corev1.TolerationOpExists}}
+}
+
 func getNodeAffinity(opConfig map[string]string, nodeAffinityName string, defaultNodeAffinity *corev1.NodeAffinity) *corev1.NodeAffinity {
 	// Add NodeAffinity if any, otherwise return defaultNodeAffinity
 	nodeAffinity := k8sutil.GetValue(opConfig, nodeAffinityName, "")
@@ -161,6 +277,26 @@ func getNodeAffinity(opConfig map[string]string, nodeAffinityName string, defaul
 	return v1NodeAffinity
 }
 
+// getNodeSelector parses a node selector in the "key1=value1,key2=value2" format, otherwise returns
+// defaultNodeSelector
+func getNodeSelector(opConfig map[string]string, nodeSelectorName string, defaultNodeSelector map[string]string) map[string]string {
+	nodeSelectorRaw := strings.TrimSpace(k8sutil.GetValue(opConfig, nodeSelectorName, ""))
+	if nodeSelectorRaw == "" {
+		return defaultNodeSelector
+	}
+	nodeSelector := map[string]string{}
+	for _, pair := range strings.Split(nodeSelectorRaw, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			logger.Warningf("failed to parse %q for %q, expected key=value pairs separated by commas", nodeSelectorRaw, nodeSelectorName)
+			return defaultNodeSelector
+		}
+		nodeSelector[key] = strings.TrimSpace(value)
+	}
+	return nodeSelector
+}
+
 func applyToPodSpec(pod *corev1.PodSpec, n *corev1.NodeAffinity, t []corev1.Toleration) {
 	pod.Tolerations = t
 	pod.Affinity = &corev1.Affinity{
@@ -183,21 +319,665 @@ func getPortFromConfig(data map[string]string, env string, defaultPort uint16) (
 	return uint16(p), nil
 }
 
-// Get PodAntiAffinity from a key and value pair
-func GetPodAntiAffinity(key, value string) corev1.PodAntiAffinity {
+// getProvisionerDeploymentStrategy returns the update strategy of the provisioner deployments
+func getProvisionerDeploymentStrategy(p Param) apps.DeploymentStrategy {
+	if p.ProvisionerDeploymentStrategy != rollingUpdate {
+		return apps.DeploymentStrategy{
+			Type: apps.RecreateDeploymentStrategyType,
+		}
+	}
+
+	strategy := apps.DeploymentStrategy{
+		Type:          apps.RollingUpdateDeploymentStrategyType,
+		RollingUpdate: &apps.RollingUpdateDeployment{},
+	}
+	maxUnavailable := intstr.Parse(provisionerMaxUnavailable(p))
+	strategy.RollingUpdate.MaxUnavailable = &maxUnavailable
+	if p.ProvisionerMaxSurge != "" {
+		maxSurge := intstr.Parse(strings.TrimSpace(p.ProvisionerMaxSurge))
+		strategy.RollingUpdate.MaxSurge = &maxSurge
+	}
+
+	return strategy
+}
+
+// provisionerMaxUnavailable returns the max unavailable provisioner pods of a rolling update. It
+// defaults to 1 since the kubernetes default of 25% rounds down to 0 with 2 replicas, and the surge
+// pod cannot be scheduled next to the other replicas on 2 nodes because of the pod anti-affinity.
+func provisionerMaxUnavailable(p Param) string {
+	if strings.TrimSpace(p.ProvisionerMaxUnavailable) == "" {
+		return defaultProvisionerMaxUnavailable
+	}
+	return strings.TrimSpace(p.ProvisionerMaxUnavailable)
+}
+
+// validateProvisionerRollingUpdate checks the max unavailable and max surge provisioner pods of a
+// rolling update, each either a non-negative number of pods or a percentage of the pods
+func validateProvisionerRollingUpdate(p Param) []error {
+	var errs []error
+	maxUnavailable, err := parseRollingUpdateValue(provisionerMaxUnavailable(p))
+	if err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid csi provisioner max unavailable"))
+	} else if maxUnavailable.Type == intstr.String && maxUnavailable.StrVal != "" && percentValue(maxUnavailable) > 100 {
+		errs = append(errs, errors.Errorf("invalid csi provisioner max unavailable %q, must not be more than 100%%", maxUnavailable.StrVal))
+	}
+	maxSurge := intstr.FromString("25%")
+	if p.ProvisionerMaxSurge != "" {
+		maxSurge, err = parseRollingUpdateValue(p.ProvisionerMaxSurge)
+		if err != nil {
+			errs = append(errs, errors.Wrap(err, "invalid csi provisioner max surge"))
+		}
+	}
+	if len(errs) == 0 && intOrPercentIsZero(maxUnavailable) && intOrPercentIsZero(maxSurge) {
+		errs = append(errs, errors.New("csi provisioner max unavailable and max surge must not both be 0"))
+	}
+	return errs
+}
+
+// parseRollingUpdateValue parses a non-negative number or percentage of pods
+func parseRollingUpdateValue(value string) (intstr.IntOrString, error) {
+	v := intstr.Parse(strings.TrimSpace(value))
+	if v.Type == intstr.Int {
+		if v.IntVal < 0 {
+			return v, errors.Errorf("%q must not be negative", value)
+		}
+		return v, nil
+	}
+	percent, found := strings.CutSuffix(v.StrVal, "%")
+	if !found {
+		return v, errors.Errorf("%q is neither a number nor a percentage", value)
+	}
+	p, err := strconv.Atoi(percent)
+	if err != nil || p < 0 {
+		return v, errors.Errorf("%q must be a non-negative percentage", value)
+	}
+	return v, nil
+}
+
+// percentValue returns the number of a valid percentage
+func percentValue(v intstr.IntOrString) int {
+	p, _ := strconv.Atoi(strings.TrimSuffix(v.StrVal, "%"))
+	return p
+}
+
+func intOrPercentIsZero(v intstr.IntOrString) bool {
+	if v.Type == intstr.Int {
+		return v.IntVal == 0
+	}
+	return percentValue(v) == 0
+}
+
+// validateMaxUnavailable checks the max unavailable pods of a daemonset rolling update, either a
+// positive number of pods or a percentage of the pods between 1% and 100%
+func validateMaxUnavailable(value string) error {
+	maxUnavailable := intstr.Parse(strings.TrimSpace(value))
+	if maxUnavailable.Type == intstr.Int {
+		if maxUnavailable.IntVal < 1 {
+			return errors.Errorf("%q must be at least 1", value)
+		}
+		return nil
+	}
+	percent, found := strings.CutSuffix(maxUnavailable.StrVal, "%")
+	if !found {
+		return errors.Errorf("%q is neither a number nor a percentage", value)
+	}
+	p, err := strconv.Atoi(percent)
+	if err != nil || p < 1 || p > 100 {
+		return errors.Errorf("%q must be a percentage between 1%% and 100%%", value)
+	}
+	return nil
+}
+
+// wellKnownRookPorts are the host ports used by other Rook daemons that the csi drivers must not reuse
+var wellKnownRookPorts = map[uint16]string{
+	3300: "ceph mon msgr2",
+	6789: "ceph mon msgr1",
+	9283: "ceph mgr metrics",
+	9926: "ceph exporter metrics",
+}
+
+// validateCSIPorts makes sure that none of the ports used by the CSI drivers collide with each
+// other or with the well-known Rook ports. Ports can only collide when the plugins run on the
+// host network, so the ports of the drivers on the pod network are not checked.
+func validateCSIPorts(tp templateParam) error {
+	allPorts := []struct {
+		name        string
+		port        uint16
+		hostNetwork bool
+	}{
+		{"CSI_RBD_LIVENESS_METRICS_PORT", tp.RBDLivenessMetricsPort, tp.EnableRBDHostNetwork},
+		{"CSI_CEPHFS_LIVENESS_METRICS_PORT", tp.CephFSLivenessMetricsPort, tp.EnableCephFSHostNetwork},
+		{"CSI_NFS_LIVENESS_METRICS_PORT", tp.NFSLivenessMetricsPort, tp.EnableNFSHostNetwork},
+		// the csi-addons sidecar runs in the rbd plugin pods
+		{"CSIADDONS_PORT", tp.CSIAddonsPort, tp.EnableRBDHostNetwork},
+	}
+
+	ports := allPorts[:0]
+	portNames := map[uint16][]string{}
+	for _, p := range allPorts {
+		if !p.hostNetwork {
+			continue
+		}
+		ports = append(ports, p)
+		portNames[p.port] = append(portNames[p.port], p.name)
+	}
+
+	collisions := []string{}
+	for _, p := range ports {
+		names := portNames[p.port]
+		if len(names) > 1 && names[0] == p.name {
+			collisions = append(collisions, fmt.Sprintf("port %d is used by %s", p.port, strings.Join(names, ", ")))
+		}
+		if daemon, ok := wellKnownRookPorts[p.port]; ok {
+			collisions = append(collisions, fmt.Sprintf("port %d of %s is reserved for the %s", p.port, p.name, daemon))
+		}
+	}
+	if len(collisions) > 0 {
+		return errors.Errorf("csi port conflict detected: %s", strings.Join(collisions, "; "))
+	}
+
+	return nil
+}
+
+// parseImagePullSecrets returns the secret names from a comma-separated list
+func parseImagePullSecrets(raw string) []string {
+	secrets := []string{}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			secrets = append(secrets, name)
+		}
+	}
+	return secrets
+}
+
+// getImagePullSecrets returns the deduplicated list of the common and per-image pull secrets
+func getImagePullSecrets(p Param) []corev1.LocalObjectReference {
+	names := append([]string{}, p.ImagePullSecrets...)
+	names = append(names, p.CSIPluginImagePullSecret, p.NFSPluginImagePullSecret, p.SidecarImagePullSecret)
+
+	secrets := []corev1.LocalObjectReference{}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		secrets = appendImagePullSecret(secrets, corev1.LocalObjectReference{Name: name})
+	}
+	return secrets
+}
+
+func appendImagePullSecret(secrets []corev1.LocalObjectReference, secret corev1.LocalObjectReference) []corev1.LocalObjectReference {
+	for _, s := range secrets {
+		if s.Name == secret.Name {
+			return secrets
+		}
+	}
+	return append(secrets, secret)
+}
+
+// applyImagePullSecrets adds the image pull secrets to the pod spec, skipping the ones already present
+func applyImagePullSecrets(podSpec *corev1.PodSpec, secrets []corev1.LocalObjectReference) {
+	for _, secret := range secrets {
+		podSpec.ImagePullSecrets = appendImagePullSecret(podSpec.ImagePullSecrets, secret)
+	}
+}
+
+// getLogLevelFromConfig returns the log level for the given setting name, or the default log level
+// if the setting is not set or cannot be parsed.
+func getLogLevelFromConfig(data map[string]string, env string, defaultLogLevel uint8) uint8 {
+	logLevel := k8sutil.GetValue(data, env, "")
+	if logLevel == "" {
+		return defaultLogLevel
+	}
+	l, err := strconv.ParseUint(logLevel, 10, 8)
+	if err != nil {
+		logger.Errorf("failed to parse %s. Defaulting to %d. %v", env, defaultLogLevel, err)
+		return defaultLogLevel
+	}
+	return uint8(l)
+}
+
+// getGRPCTimeout returns the GRPC timeout of the csi sidecars. Values too low to be usable are
+// rejected, while low values are trusted with a warning.
+func getGRPCTimeout(data map[string]string) (time.Duration, error) {
+	timeout := k8sutil.GetValue(data, grpcTimeout, strconv.Itoa(defaultGRPCTimeout))
+	timeoutSeconds, err := strconv.Atoi(timeout)
+	if err != nil {
+		logger.Errorf("failed to parse %q. Defaulting to %d. %v", grpcTimeout, defaultGRPCTimeout, err)
+		timeoutSeconds = defaultGRPCTimeout
+	}
+	if timeoutSeconds < minGRPCTimeout {
+		return 0, errors.Errorf("%s is %q but it must be >= %d", grpcTimeout, timeout, minGRPCTimeout)
+	}
+	if timeoutSeconds < recommendedMinGRPCTimeout {
+		logger.Warningf("%s is %q, values below %d may cause csi operations to time out", grpcTimeout, timeout, recommendedMinGRPCTimeout)
+	}
+	return time.Duration(timeoutSeconds) * time.Second, nil
+}
+
+// getPositiveInt32FromConfig returns the setting as a positive int32 or the default if unset or invalid
+func getPositiveInt32FromConfig(data map[string]string, env string, defaultValue int32) int32 {
+	value := k8sutil.GetValue(data, env, "")
+	if value == "" {
+		return defaultValue
+	}
+	v, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || v <= 0 {
+		logger.Errorf("failed to parse %s %q as a positive integer. Defaulting to %d. %v", env, value, defaultValue, err)
+		return defaultValue
+	}
+	return int32(v)
+}
+
+// getOptionalInt64FromConfig returns nil if the setting is not set
+func getOptionalInt64FromConfig(data map[string]string, env string) (*int64, error) {
+	value := strings.TrimSpace(k8sutil.GetValue(data, env, ""))
+	if value == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse value for %q", env)
+	}
+	return &v, nil
+}
+
+// applyWorkerThreads sets the number of worker threads of the provisioner and attacher sidecars
+func applyWorkerThreads(podSpec *corev1.PodSpec, p Param) {
+	for containerName, workerThreads := range map[string]int{
+		"csi-provisioner": p.ProvisionerWorkerThreads,
+		"csi-attacher":    p.AttacherWorkerThreads,
+	} {
+		if workerThreads <= 0 {
+			continue
+		}
+		for i := range podSpec.Containers {
+			if podSpec.Containers[i].Name == containerName {
+				podSpec.Containers[i].Args = append(podSpec.Containers[i].Args, fmt.Sprintf("--worker-threads=%d", workerThreads))
+			}
+		}
+	}
+}
+
+// applyPluginReadinessProbe adds a readiness probe checking for the csi socket to the plugin container
+func applyPluginReadinessProbe(podSpec *corev1.PodSpec, containerName string, p Param) {
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name != containerName {
+			continue
+		}
+		podSpec.Containers[i].ReadinessProbe = &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"test", "-S", pluginSocketPath},
+				},
+			},
+			InitialDelaySeconds: p.PluginReadinessProbeInitialDelaySeconds,
+			PeriodSeconds:       p.PluginReadinessProbePeriodSeconds,
+			FailureThreshold:    p.PluginReadinessProbeFailureThreshold,
+		}
+	}
+}
+
+// parseTopologySpreadConstraints parses a YAML (or JSON) list of topology spread constraints
+func parseTopologySpreadConstraints(raw string) ([]corev1.TopologySpreadConstraint, error) {
+	constraints := []corev1.TopologySpreadConstraint{}
+	err := yaml.Unmarshal([]byte(raw), &constraints)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse topology spread constraints")
+	}
+	return constraints, nil
+}
+
+// getTopologySpreadConstraints returns the topology spread constraints if any, otherwise nil. Invalid
+// constraints are an error rather than silently falling back to the pod anti-affinity.
+func getTopologySpreadConstraints(opConfig map[string]string, constraintsName string) ([]corev1.TopologySpreadConstraint, error) {
+	constraintsRaw := k8sutil.GetValue(opConfig, constraintsName, "")
+	if strings.TrimSpace(constraintsRaw) == "" {
+		return nil, nil
+	}
+	constraints, err := parseTopologySpreadConstraints(constraintsRaw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid value for %q", constraintsName)
+	}
+	return constraints, nil
+}
+
+// getPodDNS parses the dns policy and the dns config of the csi pods. The dns config is a yaml or
+// json PodDNSConfig, which is required with the "None" dns policy.
+func getPodDNS(opConfig map[string]string, policyName, configName string) (corev1.DNSPolicy, *corev1.PodDNSConfig, error) {
+	policy := corev1.DNSPolicy(strings.TrimSpace(k8sutil.GetValue(opConfig, policyName, "")))
+	switch policy {
+	case "", corev1.DNSClusterFirstWithHostNet, corev1.DNSClusterFirst, corev1.DNSDefault, corev1.DNSNone:
+	default:
+		return "", nil, errors.Errorf("invalid value %q for %q, expected %q, %q, %q or %q", policy, policyName,
+			corev1.DNSClusterFirstWithHostNet, corev1.DNSClusterFirst, corev1.DNSDefault, corev1.DNSNone)
+	}
+
+	var dnsConfig *corev1.PodDNSConfig
+	configRaw := k8sutil.GetValue(opConfig, configName, "")
+	if strings.TrimSpace(configRaw) != "" {
+		dnsConfig = &corev1.PodDNSConfig{}
+		err := yaml.Unmarshal([]byte(configRaw), dnsConfig)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "invalid value for %q", configName)
+		}
+	}
+	if policy == corev1.DNSNone && (dnsConfig == nil || len(dnsConfig.Nameservers) == 0) {
+		return "", nil, errors.Errorf("%q must have at least one nameserver with the %q dns policy", configName, corev1.DNSNone)
+	}
+	return policy, dnsConfig, nil
+}
+
+// getHostAliases parses the yaml or json list of host aliases added to the /etc/hosts of the csi pods.
+// An entry with an invalid ip or hostname is an error naming the entry.
+func getHostAliases(opConfig map[string]string, hostAliasesName string) ([]corev1.HostAlias, error) {
+	hostAliasesRaw := k8sutil.GetValue(opConfig, hostAliasesName, "")
+	if strings.TrimSpace(hostAliasesRaw) == "" {
+		return nil, nil
+	}
+	var hostAliases []corev1.HostAlias
+	err := yaml.Unmarshal([]byte(hostAliasesRaw), &hostAliases)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid value for %q", hostAliasesName)
+	}
+	for _, hostAlias := range hostAliases {
+		if net.ParseIP(hostAlias.IP) == nil {
+			return nil, errors.Errorf("invalid ip %q of host alias %v in %q", hostAlias.IP, hostAlias.Hostnames, hostAliasesName)
+		}
+		if len(hostAlias.Hostnames) == 0 {
+			return nil, errors.Errorf("host alias %q in %q has no hostnames", hostAlias.IP, hostAliasesName)
+		}
+		for _, hostname := range hostAlias.Hostnames {
+			if msgs := validation.IsDNS1123Subdomain(hostname); len(msgs) > 0 {
+				return nil, errors.Errorf("invalid hostname %q of host alias %q in %q: %s", hostname, hostAlias.IP, hostAliasesName, strings.Join(msgs, ", "))
+			}
+		}
+	}
+	return hostAliases, nil
+}
+
+// rookManagedEnvVars are the environment variables of the cephcsi containers set by Rook, which
+// cannot be overridden with extra environment variables
+var rookManagedEnvVars = []string{
+	"ADDRESS",
+	"CSI_ENDPOINT",
+	"CSIADDONS_ENDPOINT",
+	"DRIVER_NAMESPACE",
+	"KUBE_NODE_NAME",
+	"NODE_ID",
+	"POD_IP",
+	"POD_NAME",
+	"POD_NAMESPACE",
+	"POD_UID",
+}
+
+// getExtraEnv returns the extra environment variables of the cephcsi containers from a YAML list
+func getExtraEnv(opConfig map[string]string, extraEnvName string) ([]corev1.EnvVar, error) {
+	extraEnvRaw := k8sutil.GetValue(opConfig, extraEnvName, "")
+	if strings.TrimSpace(extraEnvRaw) == "" {
+		return nil, nil
+	}
+	var extraEnv []corev1.EnvVar
+	err := yaml.Unmarshal([]byte(extraEnvRaw), &extraEnv)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid value for %q", extraEnvName)
+	}
+	names := map[string]bool{}
+	for _, env := range extraEnv {
+		if env.Name == "" {
+			return nil, errors.Errorf("environment variable without a name in %q", extraEnvName)
+		}
+		if slices.Contains(rookManagedEnvVars, env.Name) {
+			return nil, errors.Errorf("environment variable %q in %q is managed by rook and cannot be set", env.Name, extraEnvName)
+		}
+		if names[env.Name] {
+			return nil, errors.Errorf("duplicate environment variable %q in %q", env.Name, extraEnvName)
+		}
+		names[env.Name] = true
+	}
+	return extraEnv, nil
+}
+
+// applyExtraEnvToContainer appends the extra environment variables to the named container
+func applyExtraEnvToContainer(podSpec *corev1.PodSpec, containerName string, extraEnv []corev1.EnvVar) {
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == containerName {
+			podSpec.Containers[i].Env = append(podSpec.Containers[i].Env, extraEnv...)
+			return
+		}
+	}
+}
+
+// securityContextSidecars are the sidecar containers of the csi pods the configured security context
+// is merged onto. The cephcsi containers always run privileged and are not part of them.
+var securityContextSidecars = []string{
+	"driver-registrar",
+	"csi-provisioner",
+	"csi-attacher",
+	"csi-snapshotter",
+	"csi-resizer",
+	"liveness-prometheus",
+}
+
+// getSecurityContext returns the security context to merge onto the csi sidecars from a YAML
+// securityContext
+func getSecurityContext(opConfig map[string]string, securityContextName string) (*corev1.SecurityContext, error) {
+	securityContextRaw := k8sutil.GetValue(opConfig, securityContextName, "")
+	if strings.TrimSpace(securityContextRaw) == "" {
+		return nil, nil
+	}
+	securityContext := &corev1.SecurityContext{}
+	err := yaml.Unmarshal([]byte(securityContextRaw), securityContext)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid value for %q", securityContextName)
+	}
+	if securityContext.Privileged != nil && *securityContext.Privileged {
+		return nil, errors.Errorf("privileged containers cannot be configured with %q", securityContextName)
+	}
+	return securityContext, nil
+}
+
+// applySidecarSecurityContext merges the security context onto the sidecars of the pod. The fields
+// set in the security context override the ones of the sidecars, and the sidecars that must run
+// privileged to access the csi socket are left untouched.
+func applySidecarSecurityContext(podSpec *corev1.PodSpec, securityContext *corev1.SecurityContext) error {
+	if securityContext == nil {
+		return nil
+	}
+	// only the fields set in the security context are serialized, so unmarshaling it onto the
+	// security context of a container merges them
+	raw, err := json.Marshal(securityContext)
+	if err != nil {
+		return errors.Wrap(err, "failed to serialize the csi security context")
+	}
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if !slices.Contains(securityContextSidecars, container.Name) {
+			continue
+		}
+		if container.SecurityContext != nil && container.SecurityContext.Privileged != nil && *container.SecurityContext.Privileged {
+			logger.Debugf("not applying the csi security context to the privileged container %q", container.Name)
+			continue
+		}
+		if container.SecurityContext == nil {
+			container.SecurityContext = &corev1.SecurityContext{}
+		}
+		err = json.Unmarshal(raw, container.SecurityContext)
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply the csi security context to container %q", container.Name)
+		}
+	}
+	return nil
+}
+
+// applyPodDNS overrides the dns policy of the pod if set, and sets the dns config
+func applyPodDNS(podSpec *corev1.PodSpec, policy corev1.DNSPolicy, dnsConfig *corev1.PodDNSConfig) {
+	if policy != "" {
+		podSpec.DNSPolicy = policy
+	}
+	if dnsConfig != nil {
+		podSpec.DNSConfig = dnsConfig.DeepCopy()
+	}
+}
+
+// getPodLabels returns the labels of the csi pods of a driver. The labels of the legacy setting in
+// the key1=value1,key2=value2 format are overridden by the labels of the json setting.
+func getPodLabels(opConfig map[string]string, legacyName, name string) (map[string]string, error) {
+	labels := k8sutil.ParseStringToLabels(k8sutil.GetValue(opConfig, legacyName, ""))
+	labelsRaw := k8sutil.GetValue(opConfig, name, "")
+	if strings.TrimSpace(labelsRaw) != "" {
+		jsonLabels := map[string]string{}
+		err := json.Unmarshal([]byte(labelsRaw), &jsonLabels)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for %q", name)
+		}
+		maps.Copy(labels, jsonLabels)
+	}
+	for key, value := range labels {
+		if msgs := validation.IsQualifiedName(key); len(msgs) > 0 {
+			return nil, errors.Errorf("invalid csi pod label key %q: %s", key, strings.Join(msgs, ", "))
+		}
+		if msgs := validation.IsValidLabelValue(value); len(msgs) > 0 {
+			return nil, errors.Errorf("invalid value %q of csi pod label %q: %s", value, key, strings.Join(msgs, ", "))
+		}
+	}
+	return labels, nil
+}
+
+// applyPodLabels adds the user labels to the pod template. The labels set by Rook are kept as the
+// selectors of the daemonsets and deployments and the services rely on them.
+func applyPodLabels(podMeta *metav1.ObjectMeta, labels map[string]string) {
+	for key, value := range labels {
+		if _, ok := podMeta.Labels[key]; ok {
+			logger.Warningf("ignoring csi pod label %q already set by rook", key)
+			continue
+		}
+		if podMeta.Labels == nil {
+			podMeta.Labels = map[string]string{}
+		}
+		podMeta.Labels[key] = value
+	}
+}
+
+// applyPodAnnotations adds the user annotations to the pod template. The annotations set by Rook take
+// precedence: the multus networks are managed from the CephCluster network settings, and existing
+// annotations of the template are not overridden.
+func applyPodAnnotations(podMeta *metav1.ObjectMeta, annotations map[string]string) {
+	for key, value := range annotations {
+		if key == multusNetworksAnnotation {
+			logger.Warningf("ignoring csi pod annotation %q, the multus networks are set from the CephCluster network", key)
+			continue
+		}
+		if _, ok := podMeta.Annotations[key]; ok {
+			logger.Warningf("ignoring csi pod annotation %q already set by rook", key)
+			continue
+		}
+		if podMeta.Annotations == nil {
+			podMeta.Annotations = map[string]string{}
+		}
+		podMeta.Annotations[key] = value
+	}
+}
+
+func applyRuntimeClassName(podSpec *corev1.PodSpec, runtimeClassName string) {
+	if runtimeClassName == "" {
+		return
+	}
+	podSpec.RuntimeClassName = &runtimeClassName
+}
+
+// getSeccompProfile parses the seccomp profile setting, which is one of RuntimeDefault, Unconfined or
+// Localhost/<path> with the path relative to the kubelet seccomp profile root
+func getSeccompProfile(opConfig map[string]string, profileName string) (*corev1.SeccompProfile, error) {
+	profileRaw := strings.TrimSpace(k8sutil.GetValue(opConfig, profileName, ""))
+	if profileRaw == "" {
+		return nil, nil
+	}
+	switch profileRaw {
+	case string(corev1.SeccompProfileTypeRuntimeDefault):
+		return &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}, nil
+	case string(corev1.SeccompProfileTypeUnconfined):
+		return &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}, nil
+	}
+	profileType, localhostProfile, found := strings.Cut(profileRaw, "/")
+	if !found || profileType != string(corev1.SeccompProfileTypeLocalhost) || strings.TrimSpace(localhostProfile) == "" {
+		return nil, errors.Errorf("invalid value %q for %q, expected %q, %q or %q", profileRaw, profileName,
+			corev1.SeccompProfileTypeRuntimeDefault, corev1.SeccompProfileTypeUnconfined, "Localhost/<path>")
+	}
+	return &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &localhostProfile}, nil
+}
+
+func applySeccompProfile(podSpec *corev1.PodSpec, profile *corev1.SeccompProfile) {
+	if profile == nil {
+		return
+	}
+	if podSpec.SecurityContext == nil {
+		podSpec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	podSpec.SecurityContext.SeccompProfile = profile
+}
+
+// applyProvisionerPodSpread spreads the provisioner pods with the topology spread constraints if
+// any, otherwise with the required or preferred pod anti-affinity on the app label across the
+// anti-affinity topology key
+func applyProvisionerPodSpread(podSpec *corev1.PodSpec, app, antiAffinityTopologyKey, antiAffinityType string, constraints []corev1.TopologySpreadConstraint) {
+	if len(constraints) == 0 {
+		antiAffinity := GetPodAntiAffinity("app", app, antiAffinityTopologyKey)
+		if antiAffinityType == preferredAntiAffinity {
+			antiAffinity = GetPreferredPodAntiAffinity("app", app, antiAffinityTopologyKey)
+		}
+		podSpec.Affinity.PodAntiAffinity = &antiAffinity
+		return
+	}
+
+	podSpec.Affinity.PodAntiAffinity = nil
+	applyTopologySpreadConstraints(podSpec, app, constraints)
+}
+
+// applyTopologySpreadConstraints sets the topology spread constraints of the pod if any. The
+// constraints without a label selector select the pods of the app.
+func applyTopologySpreadConstraints(podSpec *corev1.PodSpec, app string, constraints []corev1.TopologySpreadConstraint) {
+	if len(constraints) == 0 {
+		return
+	}
+	podSpec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{}
+	for _, c := range constraints {
+		if c.LabelSelector == nil {
+			c.LabelSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": app}}
+		}
+		podSpec.TopologySpreadConstraints = append(podSpec.TopologySpreadConstraints, c)
+	}
+}
+
+// Get PodAntiAffinity from a label key and value pair, spreading the pods across the topology key
+func GetPodAntiAffinity(labelKey, labelValue, topologyKey string) corev1.PodAntiAffinity {
 	return corev1.PodAntiAffinity{
 		RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{
 			{
 				LabelSelector: &metav1.LabelSelector{
 					MatchExpressions: []metav1.LabelSelectorRequirement{
 						{
-							Key:      key,
+							Key:      labelKey,
 							Operator: metav1.LabelSelectorOpIn,
-							Values:   []string{value},
+							Values:   []string{labelValue},
 						},
 					},
 				},
-				TopologyKey: corev1.LabelHostname,
+				TopologyKey: topologyKey,
+			},
+		},
+	}
+}
+
+// GetPreferredPodAntiAffinity returns a soft PodAntiAffinity from a label key and value pair,
+// preferring to spread the pods across the topology key
+func GetPreferredPodAntiAffinity(labelKey, labelValue, topologyKey string) corev1.PodAntiAffinity {
+	required := GetPodAntiAffinity(labelKey, labelValue, topologyKey)
+	return corev1.PodAntiAffinity{
+		PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+			{
+				Weight:          100,
+				PodAffinityTerm: required.RequiredDuringSchedulingIgnoredDuringExecution[0],
 			},
 		},
 	}
@@ -230,6 +1010,77 @@ func applyVolumeToPodSpec(opConfig map[string]string, configName string, podspec
 	}
 }
 
+// getExtraVolumes returns the extra volumes of the csi pods and their mounts in the cephcsi
+// container from YAML lists
+func getExtraVolumes(opConfig map[string]string, volumesName, volumeMountsName string) ([]corev1.Volume, []corev1.VolumeMount, error) {
+	volumes, err := k8sutil.YamlToVolumes(strings.TrimSpace(k8sutil.GetValue(opConfig, volumesName, "")))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid value for %q", volumesName)
+	}
+	volumeMounts, err := k8sutil.YamlToVolumeMounts(strings.TrimSpace(k8sutil.GetValue(opConfig, volumeMountsName, "")))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid value for %q", volumeMountsName)
+	}
+
+	names := map[string]bool{}
+	for _, volume := range volumes {
+		if volume.Name == "" {
+			return nil, nil, errors.Errorf("volume without a name in %q", volumesName)
+		}
+		if names[volume.Name] {
+			return nil, nil, errors.Errorf("duplicate volume %q in %q", volume.Name, volumesName)
+		}
+		names[volume.Name] = true
+	}
+	for _, volumeMount := range volumeMounts {
+		if !names[volumeMount.Name] {
+			return nil, nil, errors.Errorf("volume mount %q in %q does not refer to a volume of %q", volumeMount.Name, volumeMountsName, volumesName)
+		}
+		if volumeMount.MountPath == "" {
+			return nil, nil, errors.Errorf("volume mount %q in %q has no mount path", volumeMount.Name, volumeMountsName)
+		}
+	}
+	return volumes, volumeMounts, nil
+}
+
+// applyExtraVolumes appends the extra volumes to the pod and their mounts to the named container.
+// Unlike the per-driver plugin volumes, the extra volumes cannot override the ones of the template.
+func applyExtraVolumes(podSpec *corev1.PodSpec, containerName string, volumes []corev1.Volume, volumeMounts []corev1.VolumeMount) error {
+	for _, volume := range volumes {
+		for _, existing := range podSpec.Volumes {
+			if volume.Name == existing.Name {
+				return errors.Errorf("extra volume %q collides with a volume of the csi pod template", volume.Name)
+			}
+		}
+	}
+	if len(volumeMounts) > 0 {
+		container := getContainer(podSpec, containerName)
+		if container == nil {
+			return errors.Errorf("container %q not found to mount the extra volumes", containerName)
+		}
+		for _, volumeMount := range volumeMounts {
+			for _, existing := range container.VolumeMounts {
+				if volumeMount.MountPath == existing.MountPath {
+					return errors.Errorf("extra volume mount %q collides with the mount path %q of container %q", volumeMount.Name, existing.MountPath, containerName)
+				}
+			}
+		}
+		container.VolumeMounts = append(container.VolumeMounts, volumeMounts...)
+	}
+	podSpec.Volumes = append(podSpec.Volumes, volumes...)
+	return nil
+}
+
+// getContainer returns the named container of the pod, or nil if there is none
+func getContainer(podSpec *corev1.PodSpec, containerName string) *corev1.Container {
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == containerName {
+			return &podSpec.Containers[i]
+		}
+	}
+	return nil
+}
+
 func applyVolumeMountToContainer(opConfig map[string]string, configName, containerName string, podspec *corev1.PodSpec) {
 	volumeMountsRaw := k8sutil.GetValue(opConfig, configName, "")
 	if volumeMountsRaw == "" {
@@ -276,3 +1127,214 @@ func getImage(data map[string]string, settingName, defaultImage string) string {
 
 	return image
 }
+
+// getPluginImage returns the plugin image of a driver, or the common cephcsi image when the driver
+// image is not set or empty
+func getPluginImage(data map[string]string, settingName, cephCSIImage string) string {
+	if k8sutil.GetValue(data, settingName, "") == "" {
+		return cephCSIImage
+	}
+	return getImage(data, settingName, cephCSIImage)
+}
+
+// sidecarRequirement is the minimum Kubernetes version required by a sidecar image, depending on its
+// major version
+type sidecarRequirement struct {
+	name  string
+	image func(p Param) string
+	// the minimum Kubernetes versions by sidecar major version, in increasing order
+	minK8s []sidecarMinK8s
+}
+
+// sidecarMinK8s is the minimum Kubernetes version required starting from a sidecar major version
+type sidecarMinK8s struct {
+	sidecarMajor uint
+	minK8s       *version.Version
+}
+
+var sidecarRequirements = []sidecarRequirement{
+	// csi-snapshotter v4+ only serves the snapshot.storage.k8s.io/v1 API
+	{name: "csi-snapshotter", image: func(p Param) string { return p.SnapshotterImage }, minK8s: []sidecarMinK8s{
+		{sidecarMajor: 4, minK8s: version.MustParseGeneric("1.20.0")},
+		{sidecarMajor: 7, minK8s: version.MustParseGeneric("1.25.0")},
+	}},
+	{name: "csi-provisioner", image: func(p Param) string { return p.ProvisionerImage }, minK8s: []sidecarMinK8s{
+		{sidecarMajor: 3, minK8s: version.MustParseGeneric("1.20.0")},
+	}},
+	{name: "csi-attacher", image: func(p Param) string { return p.AttacherImage }, minK8s: []sidecarMinK8s{
+		{sidecarMajor: 3, minK8s: version.MustParseGeneric("1.17.0")},
+	}},
+	{name: "csi-resizer", image: func(p Param) string { return p.ResizerImage }, minK8s: []sidecarMinK8s{
+		{sidecarMajor: 1, minK8s: version.MustParseGeneric("1.16.0")},
+	}},
+}
+
+var (
+	// the grammar of the image references, following the distribution reference format
+	imageNameComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	imageRegistryRegexp      = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+	imageTagRegexp           = regexp.MustCompile(`^\w[\w.-]{0,127}$`)
+	imageDigestRegexp        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[0-9a-fA-F]{32,}$`)
+)
+
+// validateImageRef checks that the image is a valid image reference with a tag or a digest, so that
+// a malformed image is reported by the operator instead of failing the csi pods to pull it. The
+// registry is optional and defaults to docker hub as for any other pod.
+func validateImageRef(image string) error {
+	if image == "" {
+		return errors.New("image must not be empty")
+	}
+
+	name, digest, hasDigest := strings.Cut(image, "@")
+	if hasDigest && !imageDigestRegexp.MatchString(digest) {
+		return errors.Errorf("image %q has an invalid digest %q", image, digest)
+	}
+	hasTag := false
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		tag := name[i+1:]
+		if !imageTagRegexp.MatchString(tag) {
+			return errors.Errorf("image %q has an invalid tag %q", image, tag)
+		}
+		name, hasTag = name[:i], true
+	}
+	if !hasTag && !hasDigest {
+		return errors.Errorf("image %q has no tag or digest", image)
+	}
+
+	components := strings.Split(name, "/")
+	// the first component is a registry if it has a dot or a port, or is localhost
+	if len(components) > 1 && (strings.ContainsAny(components[0], ".:") || components[0] == "localhost") {
+		if !imageRegistryRegexp.MatchString(components[0]) {
+			return errors.Errorf("image %q has an invalid registry %q", image, components[0])
+		}
+		components = components[1:]
+	}
+	for _, component := range components {
+		if !imageNameComponentRegexp.MatchString(component) {
+			return errors.Errorf("image %q has an invalid name %q", image, name)
+		}
+	}
+	return nil
+}
+
+// imageTagVersion returns the semantic version of the image tag. Digest-pinned images and
+// non-semver tags return an error.
+func imageTagVersion(image string) (*version.Version, error) {
+	if strings.Contains(image, "@") {
+		return nil, errors.Errorf("image %q is pinned by digest", image)
+	}
+	i := strings.LastIndex(image, ":")
+	if i == -1 || strings.Contains(image[i:], "/") {
+		return nil, errors.Errorf("image %q has no tag", image)
+	}
+	return version.ParseSemantic(image[i+1:])
+}
+
+// checkSidecarCompatibility returns a message for each sidecar image that requires a newer
+// Kubernetes version than the one running
+func checkSidecarCompatibility(p Param, k8sVersion *version.Version) []string {
+	var incompatible []string
+	for _, req := range sidecarRequirements {
+		image := req.image(p)
+		sidecarVersion, err := imageTagVersion(image)
+		if err != nil {
+			logger.Debugf("skipping kubernetes compatibility check of %s. %v", req.name, err)
+			continue
+		}
+		// the highest requirement of the sidecar version applies
+		var minK8s *version.Version
+		for _, m := range req.minK8s {
+			if sidecarVersion.Major() >= m.sidecarMajor {
+				minK8s = m.minK8s
+			}
+		}
+		if minK8s != nil && !k8sVersion.AtLeast(minK8s) {
+			incompatible = append(incompatible, fmt.Sprintf("%s image %q requires kubernetes %s or newer, running %s", req.name, image, minK8s, k8sVersion))
+		}
+	}
+	return incompatible
+}
+
+// waitForDeploymentRollout waits until the latest generation of the deployment has been observed and
+// all its replicas are updated and available, or the timeout expires
+func waitForDeploymentRollout(ctx context.Context, clientset kubernetes.Interface, namespace, name string, timeout time.Duration) error {
+	var lastStatus apps.DeploymentStatus
+	err := wait.PollUntilContextTimeout(ctx, rolloutPollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		d, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			logger.Debugf("failed to get deployment %q to check its rollout. %v", name, err)
+			return false, nil
+		}
+		lastStatus = d.Status
+		for _, c := range d.Status.Conditions {
+			if c.Type == apps.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+				return false, errors.Errorf("deployment %q exceeded its progress deadline. %s", name, c.Message)
+			}
+		}
+		if d.Status.ObservedGeneration < d.Generation {
+			return false, nil
+		}
+		replicas := int32(1)
+		if d.Spec.Replicas != nil {
+			replicas = *d.Spec.Replicas
+		}
+		return d.Status.UpdatedReplicas >= replicas && d.Status.AvailableReplicas >= replicas, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "deployment %q did not roll out within %s (updated %d, available %d)", name, timeout, lastStatus.UpdatedReplicas, lastStatus.AvailableReplicas)
+	}
+	return nil
+}
+
+// deleteDaemonSetAndWait deletes the daemonset in the foreground, so that the daemonset is only
+// removed after all its pods are gone, and waits up to the timeout for the removal. A zero timeout
+// does not wait.
+func deleteDaemonSetAndWait(ctx context.Context, clientset kubernetes.Interface, namespace, name string, timeout time.Duration) error {
+	propagation := metav1.DeletePropagationForeground
+	err := clientset.AppsV1().DaemonSets(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to delete daemonset %q", name)
+	}
+	logger.Infof("removed daemonset %q", name)
+	if timeout == 0 {
+		return nil
+	}
+	return waitForDaemonSetDeletion(ctx, clientset, namespace, name, timeout)
+}
+
+// waitForDaemonSetDeletion waits until the daemonset does not exist anymore or the timeout expires
+func waitForDaemonSetDeletion(ctx context.Context, clientset kubernetes.Interface, namespace, name string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	w, err := clientset.AppsV1().DaemonSets(namespace).Watch(ctx, metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()})
+	if err != nil {
+		return errors.Wrapf(err, "failed to watch daemonset %q", name)
+	}
+	defer w.Stop()
+
+	// the daemonset may already be gone before the watch started
+	_, err = clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+
+	logger.Infof("waiting up to %s for daemonset %q and its pods to be deleted", timeout, name)
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return errors.Errorf("watch of daemonset %q closed before it was deleted", name)
+			}
+			if event.Type == watch.Deleted {
+				logger.Infof("confirmed daemonset %q does not exist", name)
+				return nil
+			}
+		case <-ctx.Done():
+			return errors.Errorf("gave up waiting %s for daemonset %q and its pods to be deleted", timeout, name)
+		}
+	}
+}
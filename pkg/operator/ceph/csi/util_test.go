@@ -17,12 +17,22 @@ limitations under the License.
 package csi
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v2"
+	apps "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestDaemonSetTemplate(t *testing.T) {
@@ -76,6 +86,1010 @@ func TestGetPortFromConfig(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestGetProvisionerDeploymentStrategy(t *testing.T) {
+	t.Run("defaults to recreate", func(t *testing.T) {
+		s := getProvisionerDeploymentStrategy(Param{})
+		assert.Equal(t, apps.RecreateDeploymentStrategyType, s.Type)
+		assert.Nil(t, s.RollingUpdate)
+	})
+
+	t.Run("recreate", func(t *testing.T) {
+		s := getProvisionerDeploymentStrategy(Param{ProvisionerDeploymentStrategy: recreate, ProvisionerMaxSurge: "1"})
+		assert.Equal(t, apps.RecreateDeploymentStrategyType, s.Type)
+		assert.Nil(t, s.RollingUpdate)
+	})
+
+	t.Run("rolling update with the defaults", func(t *testing.T) {
+		s := getProvisionerDeploymentStrategy(Param{ProvisionerDeploymentStrategy: rollingUpdate})
+		assert.Equal(t, apps.RollingUpdateDeploymentStrategyType, s.Type)
+		assert.NotNil(t, s.RollingUpdate)
+		// one pod is replaced at a time so the update does not wait for a surge pod that cannot be scheduled
+		assert.Equal(t, intstr.FromInt(1), *s.RollingUpdate.MaxUnavailable)
+		assert.Nil(t, s.RollingUpdate.MaxSurge)
+	})
+
+	t.Run("rolling update with max unavailable and max surge", func(t *testing.T) {
+		s := getProvisionerDeploymentStrategy(Param{ProvisionerDeploymentStrategy: rollingUpdate, ProvisionerMaxUnavailable: "1", ProvisionerMaxSurge: "50%"})
+		assert.Equal(t, apps.RollingUpdateDeploymentStrategyType, s.Type)
+		assert.Equal(t, intstr.FromInt(1), *s.RollingUpdate.MaxUnavailable)
+		assert.Equal(t, intstr.FromString("50%"), *s.RollingUpdate.MaxSurge)
+	})
+}
+
+func TestValidateProvisionerRollingUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		maxUnavailable string
+		maxSurge       string
+		valid          bool
+	}{
+		{"defaults", "", "", true},
+		{"numbers", "2", "1", true},
+		{"percentages", "50%", "200%", true},
+		{"no unavailable pods", "0", "1", true},
+		{"no surge pods", "1", "0%", true},
+		{"no unavailable and no surge pods", "0%", "0", false},
+		{"negative max unavailable", "-1", "", false},
+		{"negative max surge", "", "-1", false},
+		{"max unavailable over 100%", "150%", "", false},
+		{"negative percentage", "-10%", "", false},
+		{"not a number", "one", "", false},
+		{"not a percentage", "", "1.5%", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := validateProvisionerRollingUpdate(Param{ProvisionerDeploymentStrategy: rollingUpdate, ProvisionerMaxUnavailable: tc.maxUnavailable, ProvisionerMaxSurge: tc.maxSurge})
+			if tc.valid {
+				assert.Empty(t, errs)
+			} else {
+				assert.Len(t, errs, 1)
+			}
+		})
+	}
+}
+
+func TestValidateCSIPorts(t *testing.T) {
+	tp := templateParam{}
+	tp.EnableRBDHostNetwork = true
+	tp.EnableCephFSHostNetwork = true
+	tp.EnableNFSHostNetwork = true
+	tp.RBDLivenessMetricsPort = DefaultRBDLivenessMerticsPort
+	tp.CephFSLivenessMetricsPort = DefaultCephFSLivenessMerticsPort
+	tp.NFSLivenessMetricsPort = DefaultNFSLivenessMerticsPort
+	tp.CSIAddonsPort = DefaultCSIAddonsPort
+
+	t.Run("no collisions", func(t *testing.T) {
+		assert.NoError(t, validateCSIPorts(tp))
+	})
+
+	t.Run("rbd and cephfs liveness ports collide", func(t *testing.T) {
+		p := tp
+		p.CephFSLivenessMetricsPort = p.RBDLivenessMetricsPort
+		err := validateCSIPorts(p)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "port 9080 is used by CSI_RBD_LIVENESS_METRICS_PORT, CSI_CEPHFS_LIVENESS_METRICS_PORT")
+	})
+
+	t.Run("nfs liveness port collides", func(t *testing.T) {
+		p := tp
+		p.NFSLivenessMetricsPort = p.CephFSLivenessMetricsPort
+		err := validateCSIPorts(p)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "port 9081 is used by CSI_CEPHFS_LIVENESS_METRICS_PORT, CSI_NFS_LIVENESS_METRICS_PORT")
+	})
+
+	t.Run("csi-addons port collides with a liveness port", func(t *testing.T) {
+		p := tp
+		p.CSIAddonsPort = p.CephFSLivenessMetricsPort
+		err := validateCSIPorts(p)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "port 9081 is used by CSI_CEPHFS_LIVENESS_METRICS_PORT, CSIADDONS_PORT")
+	})
+
+	t.Run("all ports collide", func(t *testing.T) {
+		p := tp
+		p.CephFSLivenessMetricsPort = 9000
+		p.RBDLivenessMetricsPort = 9000
+		p.CSIAddonsPort = 9000
+		err := validateCSIPorts(p)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "port 9000 is used by CSI_RBD_LIVENESS_METRICS_PORT, CSI_CEPHFS_LIVENESS_METRICS_PORT, CSIADDONS_PORT")
+	})
+
+	t.Run("port collides with a well-known rook port", func(t *testing.T) {
+		p := tp
+		p.RBDLivenessMetricsPort = 9283
+		err := validateCSIPorts(p)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "port 9283 of CSI_RBD_LIVENESS_METRICS_PORT is reserved for the ceph mgr metrics")
+	})
+
+	t.Run("ports may be reused on the pod network", func(t *testing.T) {
+		p := tp
+		p.EnableRBDHostNetwork = false
+		p.EnableCephFSHostNetwork = false
+		p.CephFSLivenessMetricsPort = p.RBDLivenessMetricsPort
+		p.CSIAddonsPort = 6789
+		assert.NoError(t, validateCSIPorts(p))
+	})
+
+	t.Run("only the drivers on the host network are checked", func(t *testing.T) {
+		p := tp
+		p.EnableCephFSHostNetwork = false
+		p.CephFSLivenessMetricsPort = p.RBDLivenessMetricsPort
+		assert.NoError(t, validateCSIPorts(p))
+
+		p.CSIAddonsPort = p.RBDLivenessMetricsPort
+		err := validateCSIPorts(p)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "port 9080 is used by CSI_RBD_LIVENESS_METRICS_PORT, CSIADDONS_PORT")
+	})
+}
+
+func TestImagePullSecrets(t *testing.T) {
+	assert.Equal(t, []string{}, parseImagePullSecrets(""))
+	assert.Equal(t, []string{"foo"}, parseImagePullSecrets("foo"))
+	assert.Equal(t, []string{"foo", "bar"}, parseImagePullSecrets(" foo, ,bar,"))
+
+	podSpec := &corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "foo"}}}
+	applyImagePullSecrets(podSpec, []corev1.LocalObjectReference{{Name: "foo"}, {Name: "bar"}})
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "foo"}, {Name: "bar"}}, podSpec.ImagePullSecrets)
+
+	t.Run("per-image secrets are aggregated and deduplicated", func(t *testing.T) {
+		assert.Equal(t, []corev1.LocalObjectReference{}, getImagePullSecrets(Param{}))
+
+		p := Param{
+			ImagePullSecrets:         []string{"common", "plugin"},
+			CSIPluginImagePullSecret: "plugin",
+			NFSPluginImagePullSecret: "nfs",
+			SidecarImagePullSecret:   "sidecar",
+		}
+		secrets := getImagePullSecrets(p)
+		assert.Equal(t, []corev1.LocalObjectReference{{Name: "common"}, {Name: "plugin"}, {Name: "nfs"}, {Name: "sidecar"}}, secrets)
+
+		tp := templateParam{Param: CSIParam, Namespace: "foo"}
+		for _, tmpl := range []string{RBDPluginTemplatePath, CephFSPluginTemplatePath, NFSPluginTemplatePath} {
+			ds, err := templateToDaemonSet("test-ds", tmpl, tp)
+			assert.NoError(t, err)
+			applyImagePullSecrets(&ds.Spec.Template.Spec, secrets)
+			assert.Equal(t, secrets, ds.Spec.Template.Spec.ImagePullSecrets)
+		}
+		for _, tmpl := range []string{RBDProvisionerDepTemplatePath, CephFSProvisionerDepTemplatePath, NFSProvisionerDepTemplatePath} {
+			dep, err := templateToDeployment("test-dep", tmpl, tp)
+			assert.NoError(t, err)
+			applyImagePullSecrets(&dep.Spec.Template.Spec, secrets)
+			assert.Equal(t, secrets, dep.Spec.Template.Spec.ImagePullSecrets)
+		}
+	})
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	ds, err := templateToDaemonSet("test-ds", RBDPluginTemplatePath, tp)
+	assert.NoError(t, err)
+	applyImagePullSecrets(&ds.Spec.Template.Spec, nil)
+	assert.Empty(t, ds.Spec.Template.Spec.ImagePullSecrets)
+}
+
+func TestGetLogLevelFromConfig(t *testing.T) {
+	var globalLogLevel uint8 = 3
+
+	tests := []struct {
+		name string
+		data map[string]string
+		want map[string]uint8
+	}{
+		{
+			name: "no per-driver log levels",
+			data: map[string]string{},
+			want: map[string]uint8{"CSI_RBD_LOG_LEVEL": 3, "CSI_CEPHFS_LOG_LEVEL": 3, "CSI_NFS_LOG_LEVEL": 3},
+		},
+		{
+			name: "only rbd log level",
+			data: map[string]string{"CSI_RBD_LOG_LEVEL": "5"},
+			want: map[string]uint8{"CSI_RBD_LOG_LEVEL": 5, "CSI_CEPHFS_LOG_LEVEL": 3, "CSI_NFS_LOG_LEVEL": 3},
+		},
+		{
+			name: "only cephfs log level",
+			data: map[string]string{"CSI_CEPHFS_LOG_LEVEL": "5"},
+			want: map[string]uint8{"CSI_RBD_LOG_LEVEL": 3, "CSI_CEPHFS_LOG_LEVEL": 5, "CSI_NFS_LOG_LEVEL": 3},
+		},
+		{
+			name: "only nfs log level",
+			data: map[string]string{"CSI_NFS_LOG_LEVEL": "0"},
+			want: map[string]uint8{"CSI_RBD_LOG_LEVEL": 3, "CSI_CEPHFS_LOG_LEVEL": 3, "CSI_NFS_LOG_LEVEL": 0},
+		},
+		{
+			name: "all per-driver log levels",
+			data: map[string]string{"CSI_RBD_LOG_LEVEL": "1", "CSI_CEPHFS_LOG_LEVEL": "4", "CSI_NFS_LOG_LEVEL": "5"},
+			want: map[string]uint8{"CSI_RBD_LOG_LEVEL": 1, "CSI_CEPHFS_LOG_LEVEL": 4, "CSI_NFS_LOG_LEVEL": 5},
+		},
+		{
+			name: "invalid per-driver log levels",
+			data: map[string]string{"CSI_RBD_LOG_LEVEL": "abc", "CSI_CEPHFS_LOG_LEVEL": "256", "CSI_NFS_LOG_LEVEL": "-1"},
+			want: map[string]uint8{"CSI_RBD_LOG_LEVEL": 3, "CSI_CEPHFS_LOG_LEVEL": 3, "CSI_NFS_LOG_LEVEL": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for env, want := range tt.want {
+				assert.Equal(t, want, getLogLevelFromConfig(tt.data, env, globalLogLevel), env)
+			}
+		})
+	}
+}
+
+func TestGetNodeSelector(t *testing.T) {
+	defaultSelector := map[string]string{"storage": "true"}
+	for _, tc := range []struct {
+		value    string
+		expected map[string]string
+	}{
+		{"", defaultSelector},
+		{"role=rbd", map[string]string{"role": "rbd"}},
+		{" role = rbd , zone=a,empty=", map[string]string{"role": "rbd", "zone": "a", "empty": ""}},
+		{"role", defaultSelector},
+		{"role=rbd,=a", defaultSelector},
+	} {
+		nodeSelector := getNodeSelector(map[string]string{"CSI_PLUGIN_NODE_SELECTOR": tc.value}, "CSI_PLUGIN_NODE_SELECTOR", defaultSelector)
+		assert.Equal(t, tc.expected, nodeSelector, tc.value)
+	}
+}
+
+func TestValidateImageRef(t *testing.T) {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, image := range []string{
+		"quay.io/cephcsi/cephcsi:v3.13.0",
+		"registry.k8s.io/sig-storage/csi-provisioner:v5.1.0",
+		"localhost:5000/cephcsi/cephcsi:canary",
+		"localhost/cephcsi:v3.13.0",
+		// the registry defaults to docker hub
+		"cephcsi/cephcsi:v3.13.0",
+		"cephcsi:latest",
+		"quay.io/cephcsi/cephcsi@" + digest,
+		"quay.io/cephcsi/cephcsi:v3.13.0@" + digest,
+		"localhost:5000/cephcsi@" + digest,
+	} {
+		assert.NoError(t, validateImageRef(image), image)
+	}
+
+	for image, expected := range map[string]string{
+		"":                                      "must not be empty",
+		"quay.io/cephcsi/cephcsi":               "no tag or digest",
+		"localhost:5000/cephcsi":                "no tag or digest",
+		"quay.io/cephcsi/cephcsi:":              "invalid tag",
+		"quay.io/cephcsi/cephcsi:v3.13.0 ":      "invalid tag",
+		"quay.io/cephcsi/cephcsi@sha256:abc":    "invalid digest",
+		"quay.io/cephcsi/cephcsi@" + digest[7:]: "invalid digest",
+		"quay.io/CephCSI/cephcsi:v3.13.0":       "invalid name",
+		"quay.io//cephcsi:v3.13.0":              "invalid name",
+		":v3.13.0":                              "invalid name",
+		"-quay.io/cephcsi:v3.13.0":              "invalid registry",
+	} {
+		err := validateImageRef(image)
+		assert.ErrorContains(t, err, expected, image)
+	}
+}
+
+func TestValidateMaxUnavailable(t *testing.T) {
+	for _, value := range []string{"1", "10", "1%", "25%", "100%"} {
+		assert.NoError(t, validateMaxUnavailable(value), value)
+	}
+	for _, value := range []string{"", "0", "-1", "0%", "101%", "a%", "abc"} {
+		assert.Error(t, validateMaxUnavailable(value), value)
+	}
+}
+
+func TestGetPodDNS(t *testing.T) {
+	policy, dnsConfig, err := getPodDNS(map[string]string{}, podDNSPolicyEnv, podDNSConfigEnv)
+	assert.NoError(t, err)
+	assert.Empty(t, policy)
+	assert.Nil(t, dnsConfig)
+
+	for _, tc := range []struct {
+		name      string
+		opConfig  map[string]string
+		expectErr bool
+	}{
+		{"unknown policy", map[string]string{podDNSPolicyEnv: "ClusterLast"}, true},
+		{"invalid config", map[string]string{podDNSConfigEnv: "nameservers: 10.0.0.53"}, true},
+		{"none policy without nameservers", map[string]string{podDNSPolicyEnv: "None"}, true},
+		{"none policy with nameservers", map[string]string{podDNSPolicyEnv: "None", podDNSConfigEnv: `{"nameservers": ["10.0.0.53"]}`}, false},
+		{"config only", map[string]string{podDNSConfigEnv: "searches: [corp.example.com]"}, false},
+	} {
+		_, _, err := getPodDNS(tc.opConfig, podDNSPolicyEnv, podDNSConfigEnv)
+		assert.Equal(t, tc.expectErr, err != nil, tc.name)
+	}
+}
+
+func TestApplyPodAnnotations(t *testing.T) {
+	podMeta := &metav1.ObjectMeta{Annotations: map[string]string{"rook": "value"}}
+	applyPodAnnotations(podMeta, map[string]string{
+		"sidecar.istio.io/inject": "false",
+		"rook":                    "user",
+		multusNetworksAnnotation:  "user-network",
+		"prometheus.io/scrape":    "true",
+	})
+	assert.Equal(t, map[string]string{
+		"rook":                    "value",
+		"sidecar.istio.io/inject": "false",
+		"prometheus.io/scrape":    "true",
+	}, podMeta.Annotations)
+
+	// the annotations are applied per driver to the plugins and the provisioners
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	tp.CSIRBDPodAnnotations = map[string]string{"driver": "rbd"}
+	tp.CSICephFSPodAnnotations = map[string]string{"driver": "cephfs"}
+	tp.CSINFSPodAnnotations = nil
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "rbd", result.RBDPlugin.Spec.Template.Annotations["driver"])
+	assert.Equal(t, "rbd", result.RBDProvisioner.Spec.Template.Annotations["driver"])
+	assert.Equal(t, "cephfs", result.CephFSPlugin.Spec.Template.Annotations["driver"])
+	assert.Equal(t, "cephfs", result.CephFSProvisioner.Spec.Template.Annotations["driver"])
+	assert.Empty(t, result.NFSPlugin.Spec.Template.Annotations)
+	assert.Empty(t, result.NFSProvisioner.Spec.Template.Annotations)
+}
+
+func TestGetPodLabels(t *testing.T) {
+	labels, err := getPodLabels(map[string]string{}, "ROOK_CSI_RBD_POD_LABELS", "CSI_RBD_POD_LABELS")
+	assert.NoError(t, err)
+	assert.Empty(t, labels)
+
+	// the json labels override the legacy labels
+	labels, err = getPodLabels(map[string]string{
+		"ROOK_CSI_RBD_POD_LABELS": "team=storage,tier=legacy",
+		"CSI_RBD_POD_LABELS":      `{"tier": "gold", "example.com/owner": "infra"}`,
+	}, "ROOK_CSI_RBD_POD_LABELS", "CSI_RBD_POD_LABELS")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "storage", "tier": "gold", "example.com/owner": "infra"}, labels)
+
+	for name, opConfig := range map[string]map[string]string{
+		"malformed json":     {"CSI_RBD_POD_LABELS": `{"tier": gold}`},
+		"not a map":          {"CSI_RBD_POD_LABELS": `["tier"]`},
+		"invalid key":        {"CSI_RBD_POD_LABELS": `{"tier gold": "x"}`},
+		"invalid value":      {"CSI_RBD_POD_LABELS": `{"tier": "gold/silver"}`},
+		"invalid legacy key": {"ROOK_CSI_RBD_POD_LABELS": "team=storage, tier=gold"},
+	} {
+		_, err := getPodLabels(opConfig, "ROOK_CSI_RBD_POD_LABELS", "CSI_RBD_POD_LABELS")
+		assert.Error(t, err, name)
+	}
+}
+
+func TestApplyPodLabels(t *testing.T) {
+	podMeta := &metav1.ObjectMeta{Labels: map[string]string{"app": "csi-rbdplugin"}}
+	applyPodLabels(podMeta, map[string]string{"app": "user", "team": "storage"})
+	assert.Equal(t, map[string]string{"app": "csi-rbdplugin", "team": "storage"}, podMeta.Labels)
+
+	// the labels are applied per driver to the plugins and the provisioners, the template labels are kept
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	tp.CSIRBDPodLabels = map[string]string{"driver": "rbd", "app": "user", "contains": "user"}
+	tp.CSICephFSPodLabels = map[string]string{"driver": "cephfs"}
+	tp.CSINFSPodLabels = map[string]string{"driver": "nfs"}
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "csi-rbdplugin", "contains": "csi-rbdplugin-metrics", "driver": "rbd"}, result.RBDPlugin.Spec.Template.Labels)
+	assert.Equal(t, "rbd", result.RBDProvisioner.Spec.Template.Labels["driver"])
+	assert.Equal(t, "csi-rbdplugin-provisioner", result.RBDProvisioner.Spec.Template.Labels["app"])
+	assert.Equal(t, "cephfs", result.CephFSPlugin.Spec.Template.Labels["driver"])
+	assert.Equal(t, "cephfs", result.CephFSProvisioner.Spec.Template.Labels["driver"])
+	assert.Equal(t, "nfs", result.NFSPlugin.Spec.Template.Labels["driver"])
+	assert.Equal(t, "nfs", result.NFSProvisioner.Spec.Template.Labels["driver"])
+	assert.Equal(t, "csi-nfsplugin", result.NFSPlugin.Spec.Template.Labels["app"])
+	// the selectors still match the pods
+	assert.Equal(t, "csi-rbdplugin", result.RBDPlugin.Spec.Selector.MatchLabels["app"])
+}
+
+func TestGetExtraVolumes(t *testing.T) {
+	volumesKey, volumeMountsKey := "CSI_PROVISIONER_VOLUMES", "CSI_PROVISIONER_VOLUME_MOUNTS"
+
+	volumes, volumeMounts, err := getExtraVolumes(map[string]string{}, volumesKey, volumeMountsKey)
+	assert.NoError(t, err)
+	assert.Empty(t, volumes)
+	assert.Empty(t, volumeMounts)
+
+	for name, opConfig := range map[string]map[string]string{
+		"invalid volumes":         {volumesKey: "not a list"},
+		"volume without a name":   {volumesKey: "- emptyDir: {}"},
+		"duplicate volumes":       {volumesKey: "- name: ca\n  emptyDir: {}\n- name: ca\n  emptyDir: {}"},
+		"mount of unknown volume": {volumesKey: "- name: ca\n  emptyDir: {}", volumeMountsKey: "- name: other\n  mountPath: /etc/other"},
+		"mount without a path":    {volumesKey: "- name: ca\n  emptyDir: {}", volumeMountsKey: "- name: ca"},
+	} {
+		_, _, err = getExtraVolumes(opConfig, volumesKey, volumeMountsKey)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestExtraVolumes(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	opConfig := map[string]string{
+		"CSI_PLUGIN_VOLUMES": `
+- name: vendor-modules
+  hostPath:
+    path: /opt/vendor/modules
+`,
+		"CSI_PLUGIN_VOLUME_MOUNTS": `
+- name: vendor-modules
+  mountPath: /opt/vendor/modules
+  readOnly: true
+`,
+		"CSI_PROVISIONER_VOLUMES": `
+- name: corporate-ca
+  configMap:
+    name: corporate-ca-bundle
+- name: kms-client-cert
+  secret:
+    secretName: kms-client-cert
+`,
+		"CSI_PROVISIONER_VOLUME_MOUNTS": `
+- name: corporate-ca
+  mountPath: /etc/pki/corporate
+- name: kms-client-cert
+  mountPath: /etc/kms/tls
+`,
+	}
+	result, err := renderCSIDrivers(tp, opConfig)
+	assert.NoError(t, err)
+
+	findVolume := func(podSpec corev1.PodSpec, name string) *corev1.Volume {
+		for i := range podSpec.Volumes {
+			if podSpec.Volumes[i].Name == name {
+				return &podSpec.Volumes[i]
+			}
+		}
+		return nil
+	}
+	mountPaths := func(podSpec corev1.PodSpec, containerName string) map[string]string {
+		paths := map[string]string{}
+		for _, volumeMount := range getContainer(&podSpec, containerName).VolumeMounts {
+			paths[volumeMount.Name] = volumeMount.MountPath
+		}
+		return paths
+	}
+
+	for _, ds := range []*apps.DaemonSet{result.RBDPlugin, result.CephFSPlugin, result.NFSPlugin} {
+		podSpec := ds.Spec.Template.Spec
+		volume := findVolume(podSpec, "vendor-modules")
+		assert.NotNil(t, volume, ds.Name)
+		assert.Equal(t, "/opt/vendor/modules", volume.HostPath.Path, ds.Name)
+		assert.Nil(t, findVolume(podSpec, "corporate-ca"), ds.Name)
+	}
+	assert.Equal(t, "/opt/vendor/modules", mountPaths(result.RBDPlugin.Spec.Template.Spec, "csi-rbdplugin")["vendor-modules"])
+	assert.NotContains(t, mountPaths(result.RBDPlugin.Spec.Template.Spec, "driver-registrar"), "vendor-modules")
+
+	for _, deployment := range []*apps.Deployment{result.RBDProvisioner, result.CephFSProvisioner, result.NFSProvisioner} {
+		podSpec := deployment.Spec.Template.Spec
+		assert.Equal(t, "corporate-ca-bundle", findVolume(podSpec, "corporate-ca").ConfigMap.Name, deployment.Name)
+		assert.Equal(t, "kms-client-cert", findVolume(podSpec, "kms-client-cert").Secret.SecretName, deployment.Name)
+		assert.Nil(t, findVolume(podSpec, "vendor-modules"), deployment.Name)
+	}
+	assert.Equal(t, "/etc/pki/corporate", mountPaths(result.CephFSProvisioner.Spec.Template.Spec, "csi-cephfsplugin")["corporate-ca"])
+	assert.Equal(t, "/etc/kms/tls", mountPaths(result.NFSProvisioner.Spec.Template.Spec, "csi-nfsplugin")["kms-client-cert"])
+
+	t.Run("volumes of the template cannot be overridden", func(t *testing.T) {
+		for _, name := range []string{"host-dev", "ceph-csi-config"} {
+			_, err := renderCSIDrivers(tp, map[string]string{"CSI_PLUGIN_VOLUMES": "- name: " + name + "\n  emptyDir: {}"})
+			assert.ErrorContains(t, err, "collides with a volume of the csi pod template", name)
+		}
+		_, err := renderCSIDrivers(tp, map[string]string{
+			"CSI_PROVISIONER_VOLUMES":       "- name: other-config\n  emptyDir: {}",
+			"CSI_PROVISIONER_VOLUME_MOUNTS": "- name: other-config\n  mountPath: /etc/ceph-csi-config/",
+		})
+		assert.ErrorContains(t, err, "collides with the mount path")
+	})
+
+	t.Run("host paths cannot be added to restricted provisioners", func(t *testing.T) {
+		restricted := tp
+		restricted.EnableRestrictedPSA = true
+		_, err := renderCSIDrivers(restricted, map[string]string{"CSI_PROVISIONER_VOLUMES": "- name: host\n  hostPath:\n    path: /opt"})
+		assert.Error(t, err)
+	})
+}
+
+func TestGetSecurityContext(t *testing.T) {
+	key := "CSI_PROVISIONER_SECURITY_CONTEXT"
+
+	securityContext, err := getSecurityContext(map[string]string{}, key)
+	assert.NoError(t, err)
+	assert.Nil(t, securityContext)
+
+	securityContext, err = getSecurityContext(map[string]string{key: `
+runAsNonRoot: true
+seccompProfile:
+  type: RuntimeDefault
+`}, key)
+	assert.NoError(t, err)
+	assert.True(t, *securityContext.RunAsNonRoot)
+	assert.Equal(t, corev1.SeccompProfileTypeRuntimeDefault, securityContext.SeccompProfile.Type)
+
+	_, err = getSecurityContext(map[string]string{key: "privileged: true"}, key)
+	assert.Error(t, err)
+	_, err = getSecurityContext(map[string]string{key: "runAsNonRoot: maybe"}, key)
+	assert.Error(t, err)
+}
+
+func TestSidecarSecurityContext(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	unchanged := result.RBDProvisioner.Spec.Template.Spec.DeepCopy()
+
+	opConfig := map[string]string{
+		"CSI_PLUGIN_SECURITY_CONTEXT":      "seccompProfile:\n  type: RuntimeDefault",
+		"CSI_PROVISIONER_SECURITY_CONTEXT": "runAsNonRoot: true\nseccompProfile:\n  type: RuntimeDefault",
+	}
+	result, err = renderCSIDrivers(tp, opConfig)
+	assert.NoError(t, err)
+
+	for _, deployment := range []*apps.Deployment{result.RBDProvisioner, result.CephFSProvisioner, result.NFSProvisioner} {
+		for _, container := range deployment.Spec.Template.Spec.Containers {
+			switch container.Name {
+			case "csi-provisioner", "csi-attacher", "csi-snapshotter", "csi-resizer":
+				assert.True(t, *container.SecurityContext.RunAsNonRoot, container.Name)
+				assert.Equal(t, corev1.SeccompProfileTypeRuntimeDefault, container.SecurityContext.SeccompProfile.Type, container.Name)
+			case "csi-rbdplugin", "csi-cephfsplugin", "csi-nfsplugin":
+				// the cephcsi containers are left untouched
+				if container.SecurityContext != nil {
+					assert.Nil(t, container.SecurityContext.RunAsNonRoot, container.Name)
+				}
+			}
+		}
+	}
+	// the privileged sidecars of the plugins keep their security context
+	for _, container := range result.RBDPlugin.Spec.Template.Spec.Containers {
+		if container.SecurityContext != nil && container.SecurityContext.Privileged != nil && *container.SecurityContext.Privileged {
+			assert.Nil(t, container.SecurityContext.SeccompProfile, container.Name)
+		}
+	}
+
+	// the fields not set in the security context are kept
+	for i, container := range result.RBDProvisioner.Spec.Template.Spec.Containers {
+		if container.Name != "csi-provisioner" || unchanged.Containers[i].SecurityContext == nil {
+			continue
+		}
+		assert.Equal(t, unchanged.Containers[i].SecurityContext.Capabilities, container.SecurityContext.Capabilities)
+	}
+}
+
+func TestWorkerThreads(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	containerArgs := func(podSpec corev1.PodSpec, containerName string) []string {
+		for _, container := range podSpec.Containers {
+			if container.Name == containerName {
+				return container.Args
+			}
+		}
+		return nil
+	}
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	tp.ProvisionerWorkerThreads = 200
+	tp.AttacherWorkerThreads = 20
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	for _, deployment := range []*apps.Deployment{result.RBDProvisioner, result.CephFSProvisioner, result.NFSProvisioner} {
+		assert.Contains(t, containerArgs(deployment.Spec.Template.Spec, "csi-provisioner"), "--worker-threads=200", deployment.Name)
+		assert.Contains(t, containerArgs(deployment.Spec.Template.Spec, "csi-attacher"), "--worker-threads=20", deployment.Name)
+		assert.NotContains(t, containerArgs(deployment.Spec.Template.Spec, "csi-resizer"), "--worker-threads=200", deployment.Name)
+	}
+	// the plugins do not run the provisioner and attacher sidecars
+	for _, container := range result.RBDPlugin.Spec.Template.Spec.Containers {
+		assert.NotContains(t, container.Args, "--worker-threads=200", container.Name)
+	}
+}
+
+func TestAttacherFollowsAttachRequired(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	tp.RBDAttachRequired, tp.CephFSAttachRequired, tp.NFSAttachRequired = true, false, true
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	assert.NotNil(t, getContainer(&result.RBDProvisioner.Spec.Template.Spec, "csi-attacher"))
+	assert.Nil(t, getContainer(&result.CephFSProvisioner.Spec.Template.Spec, "csi-attacher"))
+	assert.NotNil(t, getContainer(&result.NFSProvisioner.Spec.Template.Spec, "csi-attacher"))
+}
+
+func TestServiceAccountNames(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	// the default service accounts of the rook rbac manifests
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "rook-csi-rbd-plugin-sa", result.RBDPlugin.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "rook-csi-rbd-provisioner-sa", result.RBDProvisioner.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "rook-csi-cephfs-plugin-sa", result.CephFSPlugin.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "rook-csi-cephfs-provisioner-sa", result.CephFSProvisioner.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "rook-csi-nfs-plugin-sa", result.NFSPlugin.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "rook-csi-nfs-provisioner-sa", result.NFSProvisioner.Spec.Template.Spec.ServiceAccountName)
+
+	tp.RBDPluginServiceAccount = "rbd-plugin"
+	tp.RBDProvisionerServiceAccount = "rbd-provisioner"
+	tp.CephFSPluginServiceAccount = "cephfs-plugin"
+	tp.CephFSProvisionerServiceAccount = "cephfs-provisioner"
+	tp.NFSPluginServiceAccount = "nfs-plugin"
+	tp.NFSProvisionerServiceAccount = "nfs-provisioner"
+	result, err = renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "rbd-plugin", result.RBDPlugin.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "rbd-provisioner", result.RBDProvisioner.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "cephfs-plugin", result.CephFSPlugin.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "cephfs-provisioner", result.CephFSProvisioner.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "nfs-plugin", result.NFSPlugin.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "nfs-provisioner", result.NFSProvisioner.Spec.Template.Spec.ServiceAccountName)
+}
+
+func TestRuntimeClassName(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	tp.PluginRuntimeClassName = ""
+	tp.ProvisionerRuntimeClassName = ""
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, result.RBDPlugin.Spec.Template.Spec.RuntimeClassName)
+	assert.Nil(t, result.RBDProvisioner.Spec.Template.Spec.RuntimeClassName)
+
+	tp.PluginRuntimeClassName = "runc"
+	tp.ProvisionerRuntimeClassName = "gvisor"
+	result, err = renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	for _, ds := range []*apps.DaemonSet{result.RBDPlugin, result.CephFSPlugin, result.NFSPlugin} {
+		assert.Equal(t, "runc", *ds.Spec.Template.Spec.RuntimeClassName, ds.Name)
+	}
+	for _, deployment := range []*apps.Deployment{result.RBDProvisioner, result.CephFSProvisioner, result.NFSProvisioner} {
+		assert.Equal(t, "gvisor", *deployment.Spec.Template.Spec.RuntimeClassName, deployment.Name)
+	}
+}
+
+func TestGetExtraEnv(t *testing.T) {
+	key := "CSI_PLUGIN_EXTRA_ENV"
+
+	extraEnv, err := getExtraEnv(map[string]string{}, key)
+	assert.NoError(t, err)
+	assert.Nil(t, extraEnv)
+
+	extraEnv, err = getExtraEnv(map[string]string{key: `
+- name: GODEBUG
+  value: madvdontneed=1
+- name: OTEL_ENDPOINT
+  valueFrom:
+    configMapKeyRef:
+      name: telemetry
+      key: endpoint
+`}, key)
+	assert.NoError(t, err)
+	assert.Len(t, extraEnv, 2)
+	assert.Equal(t, corev1.EnvVar{Name: "GODEBUG", Value: "madvdontneed=1"}, extraEnv[0])
+	assert.Equal(t, "telemetry", extraEnv[1].ValueFrom.ConfigMapKeyRef.Name)
+
+	for _, invalid := range []string{
+		"not a list",
+		"- value: foo",
+		"- name: POD_IP\n  value: 10.0.0.1",
+		"- name: NODE_ID\n  value: node",
+		"- name: FOO\n  value: a\n- name: FOO\n  value: b",
+	} {
+		_, err = getExtraEnv(map[string]string{key: invalid}, key)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestExtraEnv(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	opConfig := map[string]string{
+		"CSI_PLUGIN_EXTRA_ENV":      "- name: GODEBUG\n  value: madvdontneed=1",
+		"CSI_PROVISIONER_EXTRA_ENV": "- name: TELEMETRY_ENDPOINT\n  value: http://collector:4317",
+	}
+	result, err := renderCSIDrivers(tp, opConfig)
+	assert.NoError(t, err)
+
+	envNames := func(podSpec corev1.PodSpec, containerName string) []string {
+		names := []string{}
+		for _, container := range podSpec.Containers {
+			for _, env := range container.Env {
+				if container.Name == containerName {
+					names = append(names, env.Name)
+				} else {
+					assert.NotContains(t, []string{"GODEBUG", "TELEMETRY_ENDPOINT"}, env.Name, container.Name)
+				}
+			}
+		}
+		return names
+	}
+	assert.Contains(t, envNames(result.RBDPlugin.Spec.Template.Spec, "csi-rbdplugin"), "GODEBUG")
+	assert.Contains(t, envNames(result.CephFSPlugin.Spec.Template.Spec, "csi-cephfsplugin"), "GODEBUG")
+	assert.Contains(t, envNames(result.NFSPlugin.Spec.Template.Spec, "csi-nfsplugin"), "GODEBUG")
+	assert.Contains(t, envNames(result.RBDProvisioner.Spec.Template.Spec, "csi-rbdplugin"), "TELEMETRY_ENDPOINT")
+	assert.Contains(t, envNames(result.CephFSProvisioner.Spec.Template.Spec, "csi-cephfsplugin"), "TELEMETRY_ENDPOINT")
+	assert.Contains(t, envNames(result.NFSProvisioner.Spec.Template.Spec, "csi-nfsplugin"), "TELEMETRY_ENDPOINT")
+	assert.NotContains(t, envNames(result.RBDProvisioner.Spec.Template.Spec, "csi-rbdplugin"), "GODEBUG")
+
+	opConfig["CSI_PLUGIN_EXTRA_ENV"] = "- name: POD_IP\n  value: 10.0.0.1"
+	_, err = renderCSIDrivers(tp, opConfig)
+	assert.Error(t, err)
+}
+
+func TestGetHostAliases(t *testing.T) {
+	hostAliases, err := getHostAliases(map[string]string{}, podHostAliasesEnv)
+	assert.NoError(t, err)
+	assert.Nil(t, hostAliases)
+
+	hostAliases, err = getHostAliases(map[string]string{podHostAliasesEnv: `
+- ip: 10.0.0.10
+  hostnames:
+    - mon-a.ceph.example.com
+    - mon-a
+- ip: fd00::11
+  hostnames: [mon-b.ceph.example.com]
+`}, podHostAliasesEnv)
+	assert.NoError(t, err)
+	assert.Equal(t, []corev1.HostAlias{
+		{IP: "10.0.0.10", Hostnames: []string{"mon-a.ceph.example.com", "mon-a"}},
+		{IP: "fd00::11", Hostnames: []string{"mon-b.ceph.example.com"}},
+	}, hostAliases)
+
+	for value, expected := range map[string]string{
+		"ip: 10.0.0.10":                                     "invalid value",
+		"- ip: 10.0.0.300\n  hostnames: [mon-a]":            `invalid ip "10.0.0.300"`,
+		"- ip: 10.0.0.10":                                   `host alias "10.0.0.10"`,
+		"- ip: 10.0.0.10\n  hostnames: [mon_a.example.com]": `invalid hostname "mon_a.example.com"`,
+	} {
+		_, err := getHostAliases(map[string]string{podHostAliasesEnv: value}, podHostAliasesEnv)
+		assert.Error(t, err, value)
+		if err != nil {
+			assert.Contains(t, err.Error(), expected)
+		}
+	}
+
+	// the host aliases are added to all the csi pods
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	result, err := renderCSIDrivers(tp, map[string]string{podHostAliasesEnv: "- ip: 10.0.0.10\n  hostnames: [mon-a]"})
+	assert.NoError(t, err)
+	expected := []corev1.HostAlias{{IP: "10.0.0.10", Hostnames: []string{"mon-a"}}}
+	for _, podSpec := range []corev1.PodSpec{
+		result.RBDPlugin.Spec.Template.Spec, result.CephFSPlugin.Spec.Template.Spec, result.NFSPlugin.Spec.Template.Spec,
+		result.RBDProvisioner.Spec.Template.Spec, result.CephFSProvisioner.Spec.Template.Spec, result.NFSProvisioner.Spec.Template.Spec,
+	} {
+		assert.Equal(t, expected, podSpec.HostAliases)
+	}
+
+	_, err = renderCSIDrivers(tp, map[string]string{podHostAliasesEnv: "- ip: mon-a"})
+	assert.Error(t, err)
+}
+
+func TestRenderPodDNS(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	result, err := renderCSIDrivers(tp, map[string]string{})
+	assert.NoError(t, err)
+	// the template defaults are kept if not set
+	assert.Equal(t, corev1.DNSClusterFirstWithHostNet, result.RBDPlugin.Spec.Template.Spec.DNSPolicy)
+	assert.Nil(t, result.RBDPlugin.Spec.Template.Spec.DNSConfig)
+
+	opConfig := map[string]string{
+		podDNSPolicyEnv: "None",
+		podDNSConfigEnv: `
+nameservers:
+  - 10.0.0.53
+searches:
+  - corp.example.com
+options:
+  - name: ndots
+    value: "2"
+`,
+	}
+	result, err = renderCSIDrivers(tp, opConfig)
+	assert.NoError(t, err)
+	podSpecs := []corev1.PodSpec{
+		result.RBDPlugin.Spec.Template.Spec, result.CephFSPlugin.Spec.Template.Spec, result.NFSPlugin.Spec.Template.Spec,
+		result.RBDProvisioner.Spec.Template.Spec, result.CephFSProvisioner.Spec.Template.Spec, result.NFSProvisioner.Spec.Template.Spec,
+	}
+	for _, podSpec := range podSpecs {
+		assert.Equal(t, corev1.DNSNone, podSpec.DNSPolicy)
+		assert.Equal(t, []string{"10.0.0.53"}, podSpec.DNSConfig.Nameservers)
+		assert.Equal(t, []string{"corp.example.com"}, podSpec.DNSConfig.Searches)
+		assert.Equal(t, "ndots", podSpec.DNSConfig.Options[0].Name)
+	}
+
+	opConfig[podDNSConfigEnv] = "nameservers: [10.0.0.53"
+	_, err = renderCSIDrivers(tp, opConfig)
+	assert.Error(t, err)
+}
+
+func TestGetSeccompProfile(t *testing.T) {
+	localhostProfile := "profiles/csi.json"
+	for _, tc := range []struct {
+		value    string
+		expected *corev1.SeccompProfile
+	}{
+		{"", nil},
+		{"RuntimeDefault", &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}},
+		{"Unconfined", &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}},
+		{"Localhost/profiles/csi.json", &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &localhostProfile}},
+	} {
+		profile, err := getSeccompProfile(map[string]string{"CSI_PLUGIN_SECCOMP_PROFILE": tc.value}, "CSI_PLUGIN_SECCOMP_PROFILE")
+		assert.NoError(t, err, tc.value)
+		assert.Equal(t, tc.expected, profile, tc.value)
+	}
+
+	for _, value := range []string{"runtimedefault", "Localhost", "Localhost/", "Other/profile.json"} {
+		_, err := getSeccompProfile(map[string]string{"CSI_PLUGIN_SECCOMP_PROFILE": value}, "CSI_PLUGIN_SECCOMP_PROFILE")
+		assert.Error(t, err, value)
+	}
+
+	podSpec := &corev1.PodSpec{}
+	applySeccompProfile(podSpec, nil)
+	assert.Nil(t, podSpec.SecurityContext)
+	applySeccompProfile(podSpec, &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault})
+	assert.Equal(t, corev1.SeccompProfileTypeRuntimeDefault, podSpec.SecurityContext.SeccompProfile.Type)
+}
+
+func TestGetPodAntiAffinity(t *testing.T) {
+	antiAffinity := GetPodAntiAffinity("app", csiRBDProvisioner, corev1.LabelHostname)
+	assert.Len(t, antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, 1)
+	term := antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0]
+	assert.Equal(t, corev1.LabelHostname, term.TopologyKey)
+	assert.Equal(t, "app", term.LabelSelector.MatchExpressions[0].Key)
+	assert.Equal(t, []string{csiRBDProvisioner}, term.LabelSelector.MatchExpressions[0].Values)
+
+	podSpec := &corev1.PodSpec{Affinity: &corev1.Affinity{}}
+	applyProvisionerPodSpread(podSpec, csiRBDProvisioner, corev1.LabelTopologyZone, requiredAntiAffinity, nil)
+	assert.Equal(t, corev1.LabelTopologyZone, podSpec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0].TopologyKey)
+	assert.Empty(t, podSpec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+}
+
+func TestPreferredProvisionerAntiAffinity(t *testing.T) {
+	antiAffinity := GetPreferredPodAntiAffinity("app", csiCephFSProvisioner, corev1.LabelHostname)
+	assert.Empty(t, antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+	assert.Len(t, antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, 1)
+	weighted := antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0]
+	assert.Equal(t, int32(100), weighted.Weight)
+	assert.Equal(t, corev1.LabelHostname, weighted.PodAffinityTerm.TopologyKey)
+	assert.Equal(t, []string{csiCephFSProvisioner}, weighted.PodAffinityTerm.LabelSelector.MatchExpressions[0].Values)
+
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+	tp.ProvisionerAntiAffinityTopologyKey = corev1.LabelHostname
+	for _, mode := range []string{requiredAntiAffinity, preferredAntiAffinity} {
+		tp.ProvisionerAntiAffinity = mode
+		result, err := renderCSIDrivers(tp, map[string]string{})
+		assert.NoError(t, err)
+		for _, deployment := range []*apps.Deployment{result.RBDProvisioner, result.CephFSProvisioner, result.NFSProvisioner} {
+			antiAffinity := deployment.Spec.Template.Spec.Affinity.PodAntiAffinity
+			if mode == preferredAntiAffinity {
+				assert.Empty(t, antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, deployment.Name)
+				assert.Equal(t, int32(100), antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].Weight, deployment.Name)
+			} else {
+				assert.Len(t, antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, 1, deployment.Name)
+				assert.Empty(t, antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, deployment.Name)
+			}
+		}
+	}
+}
+
+func TestPluginTopologySpreadConstraints(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+
+	t.Run("absent key", func(t *testing.T) {
+		result, err := renderCSIDrivers(tp, map[string]string{})
+		assert.NoError(t, err)
+		for _, ds := range []*apps.DaemonSet{result.RBDPlugin, result.CephFSPlugin, result.NFSPlugin} {
+			assert.Empty(t, ds.Spec.Template.Spec.TopologySpreadConstraints, ds.Name)
+		}
+	})
+
+	t.Run("valid json", func(t *testing.T) {
+		raw := `[{"maxSkew": 1, "topologyKey": "topology.kubernetes.io/zone", "whenUnsatisfiable": "ScheduleAnyway"}]`
+		result, err := renderCSIDrivers(tp, map[string]string{pluginTopologySpreadConstraintsEnv: raw})
+		assert.NoError(t, err)
+		for app, ds := range map[string]*apps.DaemonSet{"csi-rbdplugin": result.RBDPlugin, "csi-cephfsplugin": result.CephFSPlugin, "csi-nfsplugin": result.NFSPlugin} {
+			constraints := ds.Spec.Template.Spec.TopologySpreadConstraints
+			assert.Len(t, constraints, 1, app)
+			assert.Equal(t, "topology.kubernetes.io/zone", constraints[0].TopologyKey, app)
+			assert.Equal(t, map[string]string{"app": app}, constraints[0].LabelSelector.MatchLabels)
+		}
+		// the provisioners are not affected
+		assert.Empty(t, result.RBDProvisioner.Spec.Template.Spec.TopologySpreadConstraints)
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		_, err := renderCSIDrivers(tp, map[string]string{pluginTopologySpreadConstraintsEnv: `[{"maxSkew": "one"}]`})
+		assert.ErrorContains(t, err, pluginTopologySpreadConstraintsEnv)
+	})
+}
+
+func TestProvisionerTopologySpreadConstraints(t *testing.T) {
+	t.Run("fallback to pod anti-affinity", func(t *testing.T) {
+		constraints, err := getTopologySpreadConstraints(map[string]string{}, provisionerTopologySpreadConstraintsEnv)
+		assert.NoError(t, err)
+		assert.Nil(t, constraints)
+
+		podSpec := &corev1.PodSpec{Affinity: &corev1.Affinity{}}
+		applyProvisionerPodSpread(podSpec, csiRBDProvisioner, corev1.LabelHostname, requiredAntiAffinity, constraints)
+		antiAffinity := GetPodAntiAffinity("app", csiRBDProvisioner, corev1.LabelHostname)
+		assert.Equal(t, &antiAffinity, podSpec.Affinity.PodAntiAffinity)
+		assert.Empty(t, podSpec.TopologySpreadConstraints)
+	})
+
+	t.Run("invalid constraints are rejected", func(t *testing.T) {
+		_, err := parseTopologySpreadConstraints("maxSkew: 1")
+		assert.Error(t, err)
+		constraints, err := getTopologySpreadConstraints(map[string]string{provisionerTopologySpreadConstraintsEnv: "maxSkew: 1"}, provisionerTopologySpreadConstraintsEnv)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), provisionerTopologySpreadConstraintsEnv)
+		assert.Nil(t, constraints)
+	})
+
+	t.Run("yaml constraints", func(t *testing.T) {
+		raw := `- maxSkew: 1
+  topologyKey: topology.kubernetes.io/zone
+  whenUnsatisfiable: ScheduleAnyway
+- maxSkew: 2
+  topologyKey: kubernetes.io/hostname
+  whenUnsatisfiable: DoNotSchedule
+`
+		constraints, err := getTopologySpreadConstraints(map[string]string{provisionerTopologySpreadConstraintsEnv: raw}, provisionerTopologySpreadConstraintsEnv)
+		assert.NoError(t, err)
+		assert.Len(t, constraints, 2)
+		assert.Equal(t, corev1.ScheduleAnyway, constraints[0].WhenUnsatisfiable)
+		assert.Equal(t, int32(2), constraints[1].MaxSkew)
+	})
+
+	t.Run("zone spread constraints", func(t *testing.T) {
+		raw := `[{"maxSkew": 1, "topologyKey": "topology.kubernetes.io/zone", "whenUnsatisfiable": "DoNotSchedule"}]`
+		constraints, err := parseTopologySpreadConstraints(raw)
+		assert.NoError(t, err)
+		assert.Len(t, constraints, 1)
+		assert.Equal(t, int32(1), constraints[0].MaxSkew)
+		assert.Equal(t, "topology.kubernetes.io/zone", constraints[0].TopologyKey)
+
+		podSpec := &corev1.PodSpec{Affinity: &corev1.Affinity{}}
+		applyProvisionerPodSpread(podSpec, csiRBDProvisioner, corev1.LabelHostname, requiredAntiAffinity, constraints)
+		assert.Nil(t, podSpec.Affinity.PodAntiAffinity)
+		assert.Len(t, podSpec.TopologySpreadConstraints, 1)
+		assert.Equal(t, corev1.DoNotSchedule, podSpec.TopologySpreadConstraints[0].WhenUnsatisfiable)
+		assert.Equal(t, map[string]string{"app": csiRBDProvisioner}, podSpec.TopologySpreadConstraints[0].LabelSelector.MatchLabels)
+	})
+}
+
 func TestApplyingResourcesToRBDPlugin(t *testing.T) {
 	tp := templateParam{}
 	rbdPlugin, err := templateToDaemonSet("rbdplugin", RBDPluginTemplatePath, tp)
@@ -111,6 +1125,176 @@ func TestApplyingResourcesToRBDPlugin(t *testing.T) {
 	assert.Equal(t, rbdPlugin.Spec.Template.Spec.Containers[0].Resources.Limits.Cpu().String(), "200m")
 }
 
+func TestApplyingEphemeralStorageResources(t *testing.T) {
+	tp := templateParam{}
+	newPodSpec := func() *corev1.PodSpec {
+		rbdPlugin, err := templateToDaemonSet("rbdplugin", RBDPluginTemplatePath, tp)
+		assert.NoError(t, err)
+		return &rbdPlugin.Spec.Template.Spec
+	}
+	resourceYaml := func(resource map[string]interface{}) string {
+		raw, err := yaml.Marshal([]map[string]interface{}{{"name": "driver-registrar", "resource": resource}})
+		assert.NoError(t, err)
+		return string(raw)
+	}
+
+	t.Run("ephemeral storage is set", func(t *testing.T) {
+		podSpec := newPodSpec()
+		params := map[string]string{rbdPluginResource: resourceYaml(map[string]interface{}{
+			"limits":   map[string]interface{}{"memory": "256Mi", "ephemeral-storage": "2Gi"},
+			"requests": map[string]interface{}{"memory": "128Mi", "ephemeral-storage": "1Gi"},
+		})}
+		applyResourcesToContainers(params, rbdPluginResource, podSpec)
+		assert.Equal(t, "1Gi", podSpec.Containers[0].Resources.Requests.StorageEphemeral().String())
+		assert.Equal(t, "2Gi", podSpec.Containers[0].Resources.Limits.StorageEphemeral().String())
+		assert.Equal(t, "128Mi", podSpec.Containers[0].Resources.Requests.Memory().String())
+	})
+
+	t.Run("ephemeral storage is omitted", func(t *testing.T) {
+		podSpec := newPodSpec()
+		params := map[string]string{rbdPluginResource: resourceYaml(map[string]interface{}{
+			"limits": map[string]interface{}{"memory": "256Mi"},
+		})}
+		applyResourcesToContainers(params, rbdPluginResource, podSpec)
+		_, ok := podSpec.Containers[0].Resources.Limits[corev1.ResourceEphemeralStorage]
+		assert.False(t, ok)
+		assert.Equal(t, "256Mi", podSpec.Containers[0].Resources.Limits.Memory().String())
+	})
+
+	t.Run("invalid ephemeral storage", func(t *testing.T) {
+		podSpec := newPodSpec()
+		params := map[string]string{rbdPluginResource: resourceYaml(map[string]interface{}{
+			"limits": map[string]interface{}{"memory": "256Mi", "ephemeral-storage": "lots"},
+		})}
+		applyResourcesToContainers(params, rbdPluginResource, podSpec)
+		assert.Empty(t, podSpec.Containers[0].Resources.Limits)
+	})
+}
+
+func TestUnknownResourceContainers(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	result, err := renderCSIDrivers(templateParam{Param: CSIParam, Namespace: "foo"}, map[string]string{})
+	assert.NoError(t, err)
+	resourceYaml := func(containers ...string) string {
+		entries := []map[string]interface{}{}
+		for _, container := range containers {
+			entries = append(entries, map[string]interface{}{
+				"name":     container,
+				"resource": map[string]interface{}{"limits": map[string]interface{}{"memory": "256Mi"}},
+			})
+		}
+		raw, err := yaml.Marshal(entries)
+		assert.NoError(t, err)
+		return string(raw)
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		podSpec    *corev1.PodSpec
+		containers []string
+		expected   []string
+	}{
+		{"rbd plugin", rbdPluginResource, &result.RBDPlugin.Spec.Template.Spec, []string{"driver-registrar", "csi-rbdplugin"}, []string{}},
+		{"rbd plugin typo", rbdPluginResource, &result.RBDPlugin.Spec.Template.Spec, []string{"driver-registar", "csi-rbdplugin"}, []string{"driver-registar"}},
+		{"rbd provisioner", rbdProvisionerResource, &result.RBDProvisioner.Spec.Template.Spec, []string{"csi-provisioner", "csi-rbdplugin"}, []string{}},
+		{"rbd provisioner with cephfs container", rbdProvisionerResource, &result.RBDProvisioner.Spec.Template.Spec, []string{"csi-cephfsplugin", "csi-cephfsplugin"}, []string{"csi-cephfsplugin"}},
+		{"cephfs plugin", cephFSPluginResource, &result.CephFSPlugin.Spec.Template.Spec, []string{"driver-registrar", "csi-cephfsplugin"}, []string{}},
+		{"cephfs plugin with rbd container", cephFSPluginResource, &result.CephFSPlugin.Spec.Template.Spec, []string{"csi-rbdplugin"}, []string{"csi-rbdplugin"}},
+		{"cephfs provisioner", cephFSProvisionerResource, &result.CephFSProvisioner.Spec.Template.Spec, []string{"csi-provisioner", "csi-cephfsplugin"}, []string{}},
+		{"nfs plugin", nfsPluginResource, &result.NFSPlugin.Spec.Template.Spec, []string{"driver-registrar", "csi-nfsplugin"}, []string{}},
+		{"nfs provisioner", nfsProvisionerResource, &result.NFSProvisioner.Spec.Template.Spec, []string{"csi-provisioner", "csi-nfsplugin", "foo"}, []string{"foo"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opConfig := map[string]string{tc.key: resourceYaml(tc.containers...)}
+			assert.Equal(t, tc.expected, unknownResourceContainers(opConfig, tc.key, tc.podSpec))
+		})
+	}
+
+	t.Run("unset", func(t *testing.T) {
+		assert.Empty(t, unknownResourceContainers(map[string]string{}, rbdPluginResource, &result.RBDPlugin.Spec.Template.Spec))
+	})
+}
+
+func TestGetEphemeralStorageRequest(t *testing.T) {
+	for _, value := range []string{"", " ", "0"} {
+		request, err := getEphemeralStorageRequest(Param{DefaultEphemeralStorageRequest: value})
+		assert.NoError(t, err, value)
+		assert.True(t, request.IsZero(), value)
+	}
+
+	request, err := getEphemeralStorageRequest(Param{DefaultEphemeralStorageRequest: "512Mi"})
+	assert.NoError(t, err)
+	assert.Equal(t, "512Mi", request.String())
+
+	for _, value := range []string{"lots", "-1Gi"} {
+		_, err := getEphemeralStorageRequest(Param{DefaultEphemeralStorageRequest: value})
+		assert.ErrorContains(t, err, defaultEphemeralStorageRequestEnv, value)
+	}
+}
+
+func TestDefaultEphemeralStorage(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	tp := templateParam{Param: CSIParam, Namespace: "foo"}
+
+	t.Run("unset", func(t *testing.T) {
+		result, err := renderCSIDrivers(tp, map[string]string{})
+		assert.NoError(t, err)
+		for _, container := range result.RBDPlugin.Spec.Template.Spec.Containers {
+			_, ok := container.Resources.Requests[corev1.ResourceEphemeralStorage]
+			assert.False(t, ok, container.Name)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		tp.DefaultEphemeralStorageRequest = "1Gi"
+		resourceRaw, err := yaml.Marshal([]map[string]interface{}{
+			{"name": "csi-rbdplugin", "resource": map[string]interface{}{"requests": map[string]interface{}{"ephemeral-storage": "4Gi"}}},
+			{"name": "driver-registrar", "resource": map[string]interface{}{"limits": map[string]interface{}{"ephemeral-storage": "512Mi"}}},
+		})
+		assert.NoError(t, err)
+		result, err := renderCSIDrivers(tp, map[string]string{rbdPluginResource: string(resourceRaw)})
+		assert.NoError(t, err)
+
+		for _, container := range result.RBDPlugin.Spec.Template.Spec.Containers {
+			switch container.Name {
+			case "csi-rbdplugin":
+				// the request of the resource setting is kept
+				assert.Equal(t, "4Gi", container.Resources.Requests.StorageEphemeral().String())
+			case "driver-registrar":
+				// the request defaults to the limit of the resource setting
+				_, ok := container.Resources.Requests[corev1.ResourceEphemeralStorage]
+				assert.False(t, ok)
+			default:
+				assert.Equal(t, "1Gi", container.Resources.Requests.StorageEphemeral().String(), container.Name)
+			}
+			_, ok := container.Resources.Limits[corev1.ResourceEphemeralStorage]
+			assert.Equal(t, container.Name == "driver-registrar", ok, container.Name)
+		}
+		for _, deployment := range []*apps.Deployment{result.RBDProvisioner, result.CephFSProvisioner, result.NFSProvisioner} {
+			for _, container := range deployment.Spec.Template.Spec.Containers {
+				assert.Equal(t, "1Gi", container.Resources.Requests.StorageEphemeral().String(), container.Name)
+			}
+		}
+		for _, container := range result.NFSPlugin.Spec.Template.Spec.Containers {
+			assert.Equal(t, "1Gi", container.Resources.Requests.StorageEphemeral().String(), container.Name)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tp.DefaultEphemeralStorageRequest = "lots"
+		_, err := renderCSIDrivers(tp, map[string]string{})
+		assert.Error(t, err)
+	})
+}
+
 func Test_applyVolumeToPodSpec(t *testing.T) {
 	// when no volumes specified
 	config := make(map[string]string)
@@ -318,3 +1502,458 @@ func Test_getImage(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckSidecarCompatibility(t *testing.T) {
+	p := Param{
+		ProvisionerImage: DefaultProvisionerImage,
+		AttacherImage:    DefaultAttacherImage,
+		SnapshotterImage: DefaultSnapshotterImage,
+		ResizerImage:     DefaultResizerImage,
+	}
+
+	t.Run("default images on a recent kubernetes", func(t *testing.T) {
+		assert.Empty(t, checkSidecarCompatibility(p, version.MustParseGeneric("1.30.0")))
+	})
+
+	t.Run("snapshotter too new for kubernetes 1.19", func(t *testing.T) {
+		p := p
+		p.ProvisionerImage = "registry.k8s.io/sig-storage/csi-provisioner:v2.2.2"
+		p.SnapshotterImage = "registry.k8s.io/sig-storage/csi-snapshotter:v5.0.1"
+		msgs := checkSidecarCompatibility(p, version.MustParseGeneric("1.19.0"))
+		assert.Len(t, msgs, 1)
+		assert.Contains(t, msgs[0], "csi-snapshotter")
+		assert.Contains(t, msgs[0], "1.20.0")
+	})
+
+	t.Run("only the highest requirement of a sidecar is reported", func(t *testing.T) {
+		p := Param{SnapshotterImage: "registry.k8s.io/sig-storage/csi-snapshotter:v7.0.2"}
+		assert.Empty(t, checkSidecarCompatibility(p, version.MustParseGeneric("1.25.0")))
+		msgs := checkSidecarCompatibility(p, version.MustParseGeneric("1.22.0"))
+		assert.Len(t, msgs, 1)
+		assert.Contains(t, msgs[0], "1.25.0")
+		msgs = checkSidecarCompatibility(p, version.MustParseGeneric("1.19.0"))
+		assert.Len(t, msgs, 1)
+		assert.Contains(t, msgs[0], "1.25.0")
+	})
+
+	t.Run("digest-pinned and non-semver tags are skipped", func(t *testing.T) {
+		p := Param{
+			ProvisionerImage: "registry.k8s.io/sig-storage/csi-provisioner@sha256:0123456789abcdef",
+			SnapshotterImage: "registry.k8s.io/sig-storage/csi-snapshotter:latest",
+			AttacherImage:    "localhost:5000/csi-attacher",
+			ResizerImage:     "",
+		}
+		assert.Empty(t, checkSidecarCompatibility(p, version.MustParseGeneric("1.10.0")))
+	})
+}
+
+func TestPluginReadinessProbe(t *testing.T) {
+	t.Run("int settings", func(t *testing.T) {
+		assert.Equal(t, int32(10), getPositiveInt32FromConfig(map[string]string{}, "FOO", 10))
+		assert.Equal(t, int32(5), getPositiveInt32FromConfig(map[string]string{"FOO": "5"}, "FOO", 10))
+		assert.Equal(t, int32(10), getPositiveInt32FromConfig(map[string]string{"FOO": "0"}, "FOO", 10))
+		assert.Equal(t, int32(10), getPositiveInt32FromConfig(map[string]string{"FOO": "abc"}, "FOO", 10))
+	})
+
+	t.Run("probe is added to the plugin containers only", func(t *testing.T) {
+		p := CSIParam
+		p.PluginReadinessProbeInitialDelaySeconds = defaultPluginReadinessProbeInitialDelaySeconds
+		p.PluginReadinessProbePeriodSeconds = 15
+		p.PluginReadinessProbeFailureThreshold = defaultPluginReadinessProbeFailureThreshold
+		tp := templateParam{Param: p, Namespace: "foo"}
+		for name, tmpl := range map[string]string{
+			"csi-rbdplugin":    RBDPluginTemplatePath,
+			"csi-cephfsplugin": CephFSPluginTemplatePath,
+			"csi-nfsplugin":    NFSPluginTemplatePath,
+		} {
+			ds, err := templateToDaemonSet("test-ds", tmpl, tp)
+			assert.NoError(t, err)
+			applyPluginReadinessProbe(&ds.Spec.Template.Spec, name, tp.Param)
+			found := false
+			for _, c := range ds.Spec.Template.Spec.Containers {
+				if c.Name != name {
+					assert.Nil(t, c.ReadinessProbe, c.Name)
+					continue
+				}
+				found = true
+				assert.Equal(t, []string{"test", "-S", "/csi/csi.sock"}, c.ReadinessProbe.Exec.Command)
+				assert.Equal(t, int32(10), c.ReadinessProbe.InitialDelaySeconds)
+				assert.Equal(t, int32(15), c.ReadinessProbe.PeriodSeconds)
+				assert.Equal(t, int32(3), c.ReadinessProbe.FailureThreshold)
+			}
+			assert.True(t, found, name)
+		}
+	})
+}
+
+func TestSidecarLogLevel(t *testing.T) {
+	p := CSIParam
+	p.LogLevel = 5
+	p.RBDLogLevel = 5
+	p.CephFSLogLevel = 5
+	p.NFSLogLevel = 5
+	p.SidecarLogLevel = 1
+	tp := templateParam{Param: p, Namespace: "foo"}
+
+	sidecars := map[string]bool{"csi-provisioner": true, "csi-attacher": true, "csi-snapshotter": true, "csi-resizer": true, "driver-registrar": true}
+	assertLogLevels := func(containers []corev1.Container, cephcsi string) {
+		foundCephCSI := false
+		for _, c := range containers {
+			if sidecars[c.Name] {
+				assert.Contains(t, c.Args, "--v=1", c.Name)
+				assert.NotContains(t, c.Args, "--v=5", c.Name)
+			}
+			if c.Name == cephcsi {
+				foundCephCSI = true
+				assert.Contains(t, c.Args, "--v=5", c.Name)
+			}
+		}
+		assert.True(t, foundCephCSI, cephcsi)
+	}
+
+	for name, tmpl := range map[string]string{
+		"csi-rbdplugin":    RBDProvisionerDepTemplatePath,
+		"csi-cephfsplugin": CephFSProvisionerDepTemplatePath,
+		"csi-nfsplugin":    NFSProvisionerDepTemplatePath,
+	} {
+		dep, err := templateToDeployment("test-dep", tmpl, tp)
+		assert.NoError(t, err)
+		assertLogLevels(dep.Spec.Template.Spec.Containers, name)
+	}
+	for name, tmpl := range map[string]string{
+		"csi-rbdplugin":    RBDPluginTemplatePath,
+		"csi-cephfsplugin": CephFSPluginTemplatePath,
+		"csi-nfsplugin":    NFSPluginTemplatePath,
+	} {
+		ds, err := templateToDaemonSet("test-ds", tmpl, tp)
+		assert.NoError(t, err)
+		assertLogLevels(ds.Spec.Template.Spec.Containers, name)
+	}
+}
+
+func TestStorageCapacityProvisionerArgs(t *testing.T) {
+	findProvisioner := func(tmpl string, tp templateParam) corev1.Container {
+		deployment, err := templateToDeployment("test-dep", tmpl, tp)
+		assert.NoError(t, err)
+		for _, c := range deployment.Spec.Template.Spec.Containers {
+			if c.Name == "csi-provisioner" {
+				return c
+			}
+		}
+		t.Fatalf("csi-provisioner container not found in %s", tmpl)
+		return corev1.Container{}
+	}
+
+	for _, tmpl := range []string{RBDProvisionerDepTemplatePath, CephFSProvisionerDepTemplatePath, NFSProvisionerDepTemplatePath} {
+		tp := templateParam{Param: CSIParam, Namespace: "foo"}
+		tp.EnableStorageCapacity = false
+		c := findProvisioner(tmpl, tp)
+		assert.NotContains(t, c.Args, "--enable-capacity=true", tmpl)
+		assert.Len(t, c.Env, 1, tmpl)
+
+		tp.EnableStorageCapacity = true
+		c = findProvisioner(tmpl, tp)
+		assert.Contains(t, c.Args, "--enable-capacity=true", tmpl)
+		assert.Contains(t, c.Args, "--capacity-ownerref-level=2", tmpl)
+		// the provisioner finds its owner from the pod name and namespace
+		envs := map[string]string{}
+		for _, env := range c.Env {
+			if env.ValueFrom != nil {
+				envs[env.Name] = env.ValueFrom.FieldRef.FieldPath
+			}
+		}
+		assert.Equal(t, map[string]string{"NAMESPACE": "metadata.namespace", "POD_NAME": "metadata.name"}, envs, tmpl)
+	}
+}
+
+func TestGetGRPCTimeout(t *testing.T) {
+	timeout, err := getGRPCTimeout(map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, 150*time.Second, timeout)
+
+	timeout, err = getGRPCTimeout(map[string]string{grpcTimeout: "200"})
+	assert.NoError(t, err)
+	assert.Equal(t, 200*time.Second, timeout)
+
+	// low values are applied as-is
+	timeout, err = getGRPCTimeout(map[string]string{grpcTimeout: "60"})
+	assert.NoError(t, err)
+	assert.Equal(t, 60*time.Second, timeout)
+
+	timeout, err = getGRPCTimeout(map[string]string{grpcTimeout: "30"})
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, timeout)
+
+	_, err = getGRPCTimeout(map[string]string{grpcTimeout: "29"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must be >= 30")
+
+	timeout, err = getGRPCTimeout(map[string]string{grpcTimeout: "abc"})
+	assert.NoError(t, err)
+	assert.Equal(t, 150*time.Second, timeout)
+}
+
+func TestPerDriverHostNetwork(t *testing.T) {
+	p := CSIParam
+	p.EnableCSIHostNetwork = true
+	p.EnableRBDHostNetwork = true
+	p.EnableCephFSHostNetwork = false
+	p.EnableNFSHostNetwork = false
+	tp := templateParam{Param: p, Namespace: "foo"}
+
+	for tmpl, expected := range map[string]bool{
+		RBDPluginTemplatePath:    true,
+		CephFSPluginTemplatePath: false,
+		NFSPluginTemplatePath:    false,
+	} {
+		ds, err := templateToDaemonSet("test-ds", tmpl, tp)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, ds.Spec.Template.Spec.HostNetwork, tmpl)
+	}
+}
+
+func TestPerDriverPluginPriorityClassName(t *testing.T) {
+	p := CSIParam
+	p.PluginPriorityClassName = "system-node-critical"
+	p.RBDPluginPriorityClassName = "system-node-critical"
+	p.CephFSPluginPriorityClassName = "system-node-critical"
+	p.NFSPluginPriorityClassName = "nfs-low"
+	tp := templateParam{Param: p, Namespace: "foo"}
+
+	for tmpl, expected := range map[string]string{
+		RBDPluginTemplatePath:    "system-node-critical",
+		CephFSPluginTemplatePath: "system-node-critical",
+		NFSPluginTemplatePath:    "nfs-low",
+	} {
+		ds, err := templateToDaemonSet("test-ds", tmpl, tp)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, ds.Spec.Template.Spec.PriorityClassName, tmpl)
+	}
+}
+
+func TestWaitForDeploymentRollout(t *testing.T) {
+	oldInterval := rolloutPollInterval
+	rolloutPollInterval = 10 * time.Millisecond
+	defer func() { rolloutPollInterval = oldInterval }()
+
+	ctx := context.TODO()
+	replicas := int32(2)
+	newDeployment := func() *apps.Deployment {
+		return &apps.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "csi-rbdplugin-provisioner", Namespace: "rook-ceph", Generation: 2},
+			Spec:       apps.DeploymentSpec{Replicas: &replicas},
+			Status:     apps.DeploymentStatus{ObservedGeneration: 1, UpdatedReplicas: 1, AvailableReplicas: 1},
+		}
+	}
+
+	t.Run("rollout completes", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(newDeployment())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			d, err := clientset.AppsV1().Deployments("rook-ceph").Get(ctx, "csi-rbdplugin-provisioner", metav1.GetOptions{})
+			assert.NoError(t, err)
+			d.Status = apps.DeploymentStatus{ObservedGeneration: 2, UpdatedReplicas: 2, AvailableReplicas: 2}
+			_, err = clientset.AppsV1().Deployments("rook-ceph").UpdateStatus(ctx, d, metav1.UpdateOptions{})
+			assert.NoError(t, err)
+		}()
+		err := waitForDeploymentRollout(ctx, clientset, "rook-ceph", "csi-rbdplugin-provisioner", 5*time.Second)
+		assert.NoError(t, err)
+	})
+
+	t.Run("old generation is not a completed rollout", func(t *testing.T) {
+		d := newDeployment()
+		d.Status = apps.DeploymentStatus{ObservedGeneration: 1, UpdatedReplicas: 2, AvailableReplicas: 2}
+		clientset := fake.NewSimpleClientset(d)
+		err := waitForDeploymentRollout(ctx, clientset, "rook-ceph", "csi-rbdplugin-provisioner", 100*time.Millisecond)
+		assert.Error(t, err)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(newDeployment())
+		err := waitForDeploymentRollout(ctx, clientset, "rook-ceph", "csi-rbdplugin-provisioner", 100*time.Millisecond)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "updated 1, available 1")
+	})
+
+	t.Run("progress deadline exceeded", func(t *testing.T) {
+		d := newDeployment()
+		d.Status.Conditions = []apps.DeploymentCondition{{Type: apps.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"}}
+		clientset := fake.NewSimpleClientset(d)
+		err := waitForDeploymentRollout(ctx, clientset, "rook-ceph", "csi-rbdplugin-provisioner", 5*time.Second)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "progress deadline")
+	})
+}
+
+func TestPluginTolerateAllTaints(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	opConfig := map[string]string{
+		pluginTolerationsEnv:      "- key: node.rook.io/plugin\n  operator: Exists",
+		provisionerTolerationsEnv: "- key: node.rook.io/provisioner\n  operator: Exists",
+	}
+	explicitPluginTolerations := []corev1.Toleration{{Key: "node.rook.io/plugin", Operator: corev1.TolerationOpExists}}
+	provisionerTolerations := []corev1.Toleration{{Key: "node.rook.io/provisioner", Operator: corev1.TolerationOpExists}}
+
+	for _, tolerateAll := range []bool{false, true} {
+		tp := templateParam{Param: CSIParam, Namespace: "foo"}
+		tp.PluginTolerateAllTaints = tolerateAll
+		result, err := renderCSIDrivers(tp, opConfig)
+		assert.NoError(t, err)
+
+		expected := explicitPluginTolerations
+		if tolerateAll {
+			expected = []corev1.Toleration{{Operator: corev1.TolerationOpExists}}
+		}
+		for _, ds := range []*apps.DaemonSet{result.RBDPlugin, result.CephFSPlugin, result.NFSPlugin} {
+			assert.Equal(t, expected, ds.Spec.Template.Spec.Tolerations, ds.Name)
+		}
+		// the provisioners are not affected
+		for _, deployment := range []*apps.Deployment{result.RBDProvisioner, result.CephFSProvisioner, result.NFSProvisioner} {
+			assert.Equal(t, provisionerTolerations, deployment.Spec.Template.Spec.Tolerations, deployment.Name)
+		}
+	}
+}
+
+func TestPluginMinReadySeconds(t *testing.T) {
+	origRBD, origCephFS, origNFS := EnableRBD, EnableCephFS, EnableNFS
+	defer func() { EnableRBD, EnableCephFS, EnableNFS = origRBD, origCephFS, origNFS }()
+	EnableRBD, EnableCephFS, EnableNFS = true, true, true
+
+	for _, minReadySeconds := range []int32{0, 30} {
+		tp := templateParam{Param: CSIParam, Namespace: "foo"}
+		tp.PluginMinReadySeconds = minReadySeconds
+		result, err := renderCSIDrivers(tp, map[string]string{})
+		assert.NoError(t, err)
+		for _, ds := range []*apps.DaemonSet{result.RBDPlugin, result.CephFSPlugin, result.NFSPlugin} {
+			assert.Equal(t, minReadySeconds, ds.Spec.MinReadySeconds, ds.Name)
+		}
+	}
+
+	assert.Equal(t, int32(0), getPositiveInt32FromConfig(map[string]string{}, "CSI_PLUGIN_MIN_READY_SECONDS", 0))
+	assert.Equal(t, int32(10), getPositiveInt32FromConfig(map[string]string{"CSI_PLUGIN_MIN_READY_SECONDS": "10"}, "CSI_PLUGIN_MIN_READY_SECONDS", 0))
+}
+
+func TestPluginHostPID(t *testing.T) {
+	origRBD, origCephFS := EnableRBD, EnableCephFS
+	defer func() { EnableRBD, EnableCephFS = origRBD, origCephFS }()
+	EnableRBD, EnableCephFS = true, true
+
+	for _, hostPID := range []bool{false, true} {
+		tp := templateParam{Param: CSIParam, Namespace: "foo"}
+		tp.EnablePluginHostPID = hostPID
+		tp.EnableCephFSHostNetwork = false
+		result, err := renderCSIDrivers(tp, map[string]string{})
+		assert.NoError(t, err)
+		assert.Equal(t, hostPID, result.CephFSPlugin.Spec.Template.Spec.HostPID)
+		// the host pid namespace is independent of the host network
+		assert.False(t, result.CephFSPlugin.Spec.Template.Spec.HostNetwork)
+		// the rbd plugin always runs in the host pid namespace
+		assert.True(t, result.RBDPlugin.Spec.Template.Spec.HostPID)
+	}
+}
+
+func TestApplyResourcesToNamedContainer(t *testing.T) {
+	tp := templateParam{}
+	deployment, err := templateToDeployment("rbd-provisioner", RBDProvisionerDepTemplatePath, tp)
+	assert.NoError(t, err)
+	podSpec := &deployment.Spec.Template.Spec
+
+	params := map[string]string{
+		rbdProvisionerResource: `- name: csi-attacher
+  resource:
+    requests:
+      cpu: 100m
+- name: csi-resizer
+  resource:
+    requests:
+      cpu: 50m`,
+		rbdAttacherResource: `requests:
+  cpu: 500m
+  memory: 128Mi
+limits:
+  memory: 256Mi`,
+	}
+	applyResourcesToContainers(params, rbdProvisionerResource, podSpec)
+	err = applySidecarResources(params, podSpec, rbdAttacherResource, rbdSnapshotterResource, rbdResizerResource)
+	assert.NoError(t, err)
+
+	for _, c := range podSpec.Containers {
+		switch c.Name {
+		case "csi-attacher":
+			assert.Equal(t, "500m", c.Resources.Requests.Cpu().String())
+			assert.Equal(t, "128Mi", c.Resources.Requests.Memory().String())
+			assert.Equal(t, "256Mi", c.Resources.Limits.Memory().String())
+		case "csi-resizer":
+			// falls back to the provisioner resource list
+			assert.Equal(t, "50m", c.Resources.Requests.Cpu().String())
+		case "csi-snapshotter":
+			assert.Empty(t, c.Resources.Requests)
+		}
+	}
+
+	err = applyResourcesToNamedContainer(map[string]string{rbdResizerResource: "requests: [cpu]"}, rbdResizerResource, podSpec, "csi-resizer")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), rbdResizerResource)
+}
+
+func TestDeleteDaemonSetAndWait(t *testing.T) {
+	ctx := context.TODO()
+	namespace := "rook-ceph"
+	ds := &apps.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: CsiRBDPlugin, Namespace: namespace}}
+
+	// the daemonset stays until its pods are gone with the foreground deletion, which the fake
+	// clientset does not implement, so the deletion is only visible through the watcher
+	newClientset := func() (*fake.Clientset, *watch.FakeWatcher) {
+		clientset := fake.NewSimpleClientset(ds)
+		clientset.PrependReactor("delete", "daemonsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			propagation := action.(k8stesting.DeleteAction).GetDeleteOptions().PropagationPolicy
+			assert.Equal(t, metav1.DeletePropagationForeground, *propagation)
+			return true, nil, nil
+		})
+		watcher := watch.NewFake()
+		clientset.PrependWatchReactor("daemonsets", k8stesting.DefaultWatchReactor(watcher, nil))
+		return clientset, watcher
+	}
+
+	t.Run("daemonset deleted", func(t *testing.T) {
+		clientset, watcher := newClientset()
+		go func() {
+			pending := ds.DeepCopy()
+			now := metav1.Now()
+			pending.DeletionTimestamp = &now
+			watcher.Modify(pending)
+			watcher.Delete(pending)
+		}()
+		err := deleteDaemonSetAndWait(ctx, clientset, namespace, CsiRBDPlugin, time.Minute)
+		assert.NoError(t, err)
+	})
+
+	t.Run("pods not terminated in time", func(t *testing.T) {
+		clientset, watcher := newClientset()
+		go watcher.Modify(ds)
+		err := deleteDaemonSetAndWait(ctx, clientset, namespace, CsiRBDPlugin, 50*time.Millisecond)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "gave up waiting")
+	})
+
+	t.Run("watch closed", func(t *testing.T) {
+		clientset, watcher := newClientset()
+		go watcher.Stop()
+		err := deleteDaemonSetAndWait(ctx, clientset, namespace, CsiRBDPlugin, time.Minute)
+		assert.Error(t, err)
+	})
+
+	t.Run("no wait with zero timeout", func(t *testing.T) {
+		clientset, _ := newClientset()
+		err := deleteDaemonSetAndWait(ctx, clientset, namespace, CsiRBDPlugin, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("daemonset does not exist", func(t *testing.T) {
+		err := deleteDaemonSetAndWait(ctx, fake.NewSimpleClientset(), namespace, CsiRBDPlugin, time.Minute)
+		assert.NoError(t, err)
+	})
+}